@@ -0,0 +1,249 @@
+// Package main implements API keys that let services call the broker without a user.
+package main
+
+import (
+	"authentication-service/data"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// apiKeyHeader carries an API key from the broker.
+	apiKeyHeader = "X-API-Key"
+
+	apiKeyPrefix       = "mk_"
+	apiKeySecretBytes  = 32
+	apiKeyPrefixLength = len(apiKeyPrefix) + 8
+
+	// apiKeyTouchInterval limits how often a key's last-used time is written.
+	apiKeyTouchInterval = time.Minute
+)
+
+var errInvalidAPIKey = errors.New("invalid or revoked api key")
+
+// apiKeyIdentity is what the broker learns about a valid API key.
+type apiKeyIdentity struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// issuedAPIKey is returned when a key is created or rotated. Key is the only
+// time the plain key is ever shown.
+type issuedAPIKey struct {
+	*data.APIKey
+	Key string `json:"key"`
+}
+
+// generateAPIKey returns a new plain key, its display prefix and its hash.
+func generateAPIKey() (key, prefix, keyHash string, err error) {
+	secret, err := randomHex(apiKeySecretBytes)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	key = apiKeyPrefix + secret
+
+	return key, key[:apiKeyPrefixLength], hashAPIKey(key), nil
+}
+
+// hashAPIKey returns the value stored for an API key. Keys are 256 random
+// bits, so like reset tokens an unsalted SHA-256 is enough.
+func hashAPIKey(key string) string {
+	return hashResetToken(strings.TrimSpace(key))
+}
+
+// handleCreateAPIKey mints a key with a name and scopes.
+func (app *Config) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+	userID, err := claims.UserID()
+	if err != nil {
+		_ = app.writeErrorJSON(w, errInvalidToken, http.StatusUnauthorized)
+		return
+	}
+
+	var requestPayload struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+
+	err = app.decodeJSON(w, r, &requestPayload)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(requestPayload.Name)
+	errs := validationErrors{}
+	errs.checkAPIKeyName("name", name)
+	errs.checkScopes("scopes", requestPayload.Scopes)
+	if !errs.valid() {
+		_ = app.writeValidationErrorJSON(w, errs)
+		return
+	}
+
+	key, prefix, keyHash, err := generateAPIKey()
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	apiKey := data.APIKey{
+		Name:      name,
+		Prefix:    prefix,
+		KeyHash:   keyHash,
+		Scopes:    compactScopes(requestPayload.Scopes),
+		CreatedBy: userID,
+		CreatedAt: time.Now(),
+	}
+
+	apiKey.ID, err = app.Repository.InsertAPIKey(apiKey)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "API key created; store the key now, it is not shown again",
+		Data:    issuedAPIKey{APIKey: &apiKey, Key: key},
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, payload)
+}
+
+// handleListAPIKeys lists active keys without their secrets.
+func (app *Config) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.Repository.ListAPIKeys()
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "API keys",
+		Data:    keys,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// handleRotateAPIKey replaces a key's secret. The old key stops working at once.
+func (app *Config) handleRotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = app.writeErrorJSON(w, data.ErrAPIKeyNotFound, http.StatusNotFound)
+		return
+	}
+
+	key, prefix, keyHash, err := generateAPIKey()
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	err = app.Repository.RotateAPIKey(id, prefix, keyHash)
+	if err != nil {
+		app.writeAPIKeyError(w, err)
+		return
+	}
+
+	apiKey, err := app.Repository.GetAPIKeyByHash(keyHash)
+	if err != nil {
+		app.writeAPIKeyError(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "API key rotated; store the new key now, it is not shown again",
+		Data:    issuedAPIKey{APIKey: apiKey, Key: key},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// handleRevokeAPIKey revokes a key.
+func (app *Config) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = app.writeErrorJSON(w, data.ErrAPIKeyNotFound, http.StatusNotFound)
+		return
+	}
+
+	err = app.Repository.RevokeAPIKey(id)
+	if err != nil {
+		app.writeAPIKeyError(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "API key revoked",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// handleValidateAPIKey checks the key in the X-API-Key header and returns its
+// name and scopes. The broker calls it for every request that carries a key.
+func (app *Config) handleValidateAPIKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimSpace(r.Header.Get(apiKeyHeader))
+	if key == "" {
+		_ = app.writeErrorJSON(w, errors.New("missing api key"), http.StatusUnauthorized)
+		return
+	}
+
+	apiKey, err := app.Repository.GetAPIKeyByHash(hashAPIKey(key))
+	if errors.Is(err, data.ErrAPIKeyNotFound) {
+		_ = app.writeErrorJSON(w, errInvalidAPIKey, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	if now := time.Now(); apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= apiKeyTouchInterval {
+		if err := app.Repository.TouchAPIKey(apiKey.ID, now); err != nil {
+			log.Println("Error updating api key last used time:", err)
+		}
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "API key is valid",
+		Data: apiKeyIdentity{
+			ID:     apiKey.ID,
+			Name:   apiKey.Name,
+			Scopes: apiKey.Scopes,
+		},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *Config) writeAPIKeyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, data.ErrAPIKeyNotFound) {
+		_ = app.writeErrorJSON(w, err, http.StatusNotFound)
+		return
+	}
+
+	_ = app.writeErrorJSON(w, err)
+}
+
+// compactScopes sorts scopes and drops duplicates.
+func compactScopes(scopes []string) []string {
+	sorted := append([]string{}, scopes...)
+	slices.Sort(sorted)
+
+	return slices.Compact(sorted)
+}
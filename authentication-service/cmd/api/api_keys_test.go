@@ -0,0 +1,153 @@
+// Package main contains tests for minting, rotating and revoking API keys.
+package main
+
+import (
+	"authentication-service/data"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// createAPIKey mints a key through the API and returns the plain key and its ID.
+func createAPIKey(t *testing.T, app *Config, token string, scopes []string) (string, int) {
+	t.Helper()
+
+	rr := serveRequest(t, app, http.MethodPost, "/api-keys/", map[string]any{"name": "nightly batch", "scopes": scopes}, token)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d creating a key, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var response struct {
+		Data struct {
+			ID  int    `json:"id"`
+			Key string `json:"key"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+
+	return response.Data.Key, response.Data.ID
+}
+
+// validateAPIKey calls /api-keys/validate with key.
+func validateAPIKey(t *testing.T, app *Config, key string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/api-keys/validate", nil)
+	req.Header.Set(apiKeyHeader, key)
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestHandleCreateAPIKeyValidation(t *testing.T) {
+	app, _ := newRolesTestApp(t)
+
+	adminToken, _ := app.Tokens.IssuePair(data.User{ID: 1, Permissions: []string{data.PermissionAPIKeysManage}}, "")
+	userToken, _ := app.Tokens.IssuePair(data.User{ID: 2, Permissions: []string{data.PermissionLogsWrite}}, "")
+
+	tests := []struct {
+		name           string
+		token          string
+		body           map[string]any
+		expectedStatus int
+	}{
+		{name: "without permission", token: userToken.AccessToken, body: map[string]any{"name": "batch", "scopes": []string{data.ScopeLogWrite}}, expectedStatus: http.StatusForbidden},
+		{name: "without token", body: map[string]any{"name": "batch", "scopes": []string{data.ScopeLogWrite}}, expectedStatus: http.StatusUnauthorized},
+		{name: "missing name", token: adminToken.AccessToken, body: map[string]any{"scopes": []string{data.ScopeLogWrite}}, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "long name", token: adminToken.AccessToken, body: map[string]any{"name": strings.Repeat("a", maxAPIKeyNameLen+1), "scopes": []string{data.ScopeLogWrite}}, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "no scopes", token: adminToken.AccessToken, body: map[string]any{"name": "batch"}, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "unknown scope", token: adminToken.AccessToken, body: map[string]any{"name": "batch", "scopes": []string{"users:manage"}}, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "valid", token: adminToken.AccessToken, body: map[string]any{"name": "batch", "scopes": []string{data.ScopeMailSend, data.ScopeLogWrite}}, expectedStatus: http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serveRequest(t, app, http.MethodPost, "/api-keys/", tt.body, tt.token)
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+
+	adminID, _ := repo.Insert(data.User{Email: "admin@here.com", Password: "long-enough", Active: 1})
+	adminToken, _ := app.Tokens.IssuePair(data.User{ID: adminID, Permissions: []string{data.PermissionAPIKeysManage}}, "")
+
+	key, id := createAPIKey(t, app, adminToken.AccessToken, []string{data.ScopeLogWrite, data.ScopeLogWrite})
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		t.Fatalf("expected key to start with %q, got %q", apiKeyPrefix, key)
+	}
+
+	rr := validateAPIKey(t, app, key)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d validating, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var identity struct {
+		Data apiKeyIdentity `json:"data"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &identity)
+	if identity.Data.ID != id || !slices.Equal(identity.Data.Scopes, []string{data.ScopeLogWrite}) {
+		t.Fatalf("expected key %d with deduplicated scopes, got %+v", id, identity.Data)
+	}
+
+	rr = serveRequest(t, app, http.MethodGet, "/api-keys/", nil, adminToken.AccessToken)
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), key) {
+		t.Fatalf("expected the listing to omit the key, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = serveRequest(t, app, http.MethodPost, "/api-keys/"+strconv.Itoa(id)+"/rotate", nil, adminToken.AccessToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d rotating, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var rotated struct {
+		Data struct {
+			Key string `json:"key"`
+		} `json:"data"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &rotated)
+
+	tests := []struct {
+		name           string
+		key            string
+		expectedStatus int
+	}{
+		{name: "missing key", key: "", expectedStatus: http.StatusUnauthorized},
+		{name: "unknown key", key: apiKeyPrefix + "nope", expectedStatus: http.StatusUnauthorized},
+		{name: "rotated away key", key: key, expectedStatus: http.StatusUnauthorized},
+		{name: "rotated key", key: rotated.Data.Key, expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := validateAPIKey(t, app, tt.key)
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	rr = serveRequest(t, app, http.MethodDelete, "/api-keys/"+strconv.Itoa(id), nil, adminToken.AccessToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d revoking, got %d", http.StatusOK, rr.Code)
+	}
+	if rr := validateAPIKey(t, app, rotated.Data.Key); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a revoked key to be rejected, got %d", rr.Code)
+	}
+
+	if rr := serveRequest(t, app, http.MethodDelete, "/api-keys/"+strconv.Itoa(id), nil, adminToken.AccessToken); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected revoking twice to return %d, got %d", http.StatusNotFound, rr.Code)
+	}
+	if rr := serveRequest(t, app, http.MethodPost, "/api-keys/"+strconv.Itoa(id)+"/rotate", nil, adminToken.AccessToken); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected rotating a revoked key to return %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
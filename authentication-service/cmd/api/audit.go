@@ -0,0 +1,196 @@
+// Package main records authentication events in the audit trail.
+package main
+
+import (
+	"authentication-service/data"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// auditLogName names the structured entries shipped to logger-service.
+	auditLogName = "audit"
+
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 200
+
+	// defaultAuditQueueSize is used when AUDIT_QUEUE_SIZE is not set.
+	defaultAuditQueueSize = 256
+)
+
+// Reasons recorded for failures that have no matching API error code.
+const (
+	auditReasonInvalidToken   = "invalid_token"
+	auditReasonSessionRevoked = "session_revoked"
+	auditReasonIPLocked       = "ip_locked"
+)
+
+// maxAuditEmailLength is the size of the audit_events email column. Failed
+// logins are audited with whatever email was tried, however long.
+const maxAuditEmailLength = 255
+
+// auditPage is one page of a user's audit trail. NextBefore is passed back
+// as before to fetch the next page and is zero on the last one.
+type auditPage struct {
+	Events     []*data.AuditEvent `json:"events"`
+	NextBefore int                `json:"next_before,omitempty"`
+}
+
+// AuditShipper sends audit events to logger-service from a background
+// goroutine, so a slow or unavailable logger never delays a login. Events
+// that arrive while the queue is full are dropped from the log; the
+// repository still has them.
+type AuditShipper struct {
+	queue chan data.AuditEvent
+	send  func(entry string) error
+	done  sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewAuditShipper starts shipping up to size queued events with send.
+func NewAuditShipper(size int, send func(entry string) error) *AuditShipper {
+	if size < 1 {
+		size = 1
+	}
+
+	shipper := &AuditShipper{queue: make(chan data.AuditEvent, size), send: send}
+	shipper.done.Add(1)
+	go shipper.run()
+
+	return shipper
+}
+
+// Ship queues event without waiting, reporting whether there was room.
+// Nothing is queued once the shipper is closed.
+func (shipper *AuditShipper) Ship(event data.AuditEvent) bool {
+	shipper.mu.RLock()
+	defer shipper.mu.RUnlock()
+
+	if shipper.closed {
+		return false
+	}
+
+	select {
+	case shipper.queue <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops accepting events and waits for the queued ones to be sent.
+func (shipper *AuditShipper) Close() {
+	shipper.mu.Lock()
+	if !shipper.closed {
+		shipper.closed = true
+		close(shipper.queue)
+	}
+	shipper.mu.Unlock()
+
+	shipper.done.Wait()
+}
+
+func (shipper *AuditShipper) run() {
+	defer shipper.done.Done()
+
+	for event := range shipper.queue {
+		entry, err := json.Marshal(event)
+		if err != nil {
+			log.Println("Error encoding audit event:", err)
+			continue
+		}
+		if err := shipper.send(string(entry)); err != nil {
+			log.Println("Error logging audit event:", err)
+		}
+	}
+}
+
+// newAuditShipper ships audit events through logAuthenticationEvent.
+func (app *Config) newAuditShipper(size int) *AuditShipper {
+	return NewAuditShipper(size, func(entry string) error {
+		return app.logAuthenticationEvent(auditLogName, entry)
+	})
+}
+
+// audit stores event with the caller's IP and user agent, and queues it for
+// logger-service as a structured entry when the app has an AuditShipper.
+// Errors are only logged so that an unavailable database or logger never
+// blocks a login.
+func (app *Config) audit(r *http.Request, event data.AuditEvent) {
+	event.IP = app.clientIP(r)
+	event.UserAgent = truncateUserAgent(r.UserAgent())
+	event.Email = truncateUTF8(event.Email, maxAuditEmailLength)
+	event.CreatedAt = time.Now()
+
+	if err := app.Repository.InsertAuditEvent(event); err != nil {
+		log.Println("Error storing audit event:", err)
+	}
+
+	if app.AuditShipper != nil && !app.AuditShipper.Ship(event) {
+		log.Println("Audit queue is full or closed; not logging", event.Event, "event for", event.Email)
+	}
+}
+
+// auditUser records an event for a known user.
+func (app *Config) auditUser(r *http.Request, user *data.User, event, outcome, reason string) {
+	app.audit(r, data.AuditEvent{
+		UserID:  user.ID,
+		Email:   user.Email,
+		Event:   event,
+		Outcome: outcome,
+		Reason:  reason,
+	})
+}
+
+// handleListAuditEvents returns a user's audit trail, newest first. Users
+// can read their own; reading anyone else's needs audit:read.
+func (app *Config) handleListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = app.writeErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := claimsFromContext(r.Context())
+	callerID, err := claims.UserID()
+	if err != nil || (callerID != userID && !claims.HasPermission(data.PermissionAuditRead)) {
+		_ = app.writeErrorJSON(w, errForbidden, http.StatusForbidden)
+		return
+	}
+
+	errs := validationErrors{}
+	before := errs.checkQueryInt("before", r.URL.Query().Get("before"), 0, 0, 0)
+	limit := errs.checkQueryInt("limit", r.URL.Query().Get("limit"), defaultAuditPageSize, 1, maxAuditPageSize)
+	if !errs.valid() {
+		_ = app.writeValidationErrorJSON(w, errs)
+		return
+	}
+
+	events, err := app.Repository.ListAuditEvents(userID, before, limit)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	page := auditPage{Events: events}
+	if len(events) == limit {
+		page.NextBefore = events[len(events)-1].ID
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "Audit events",
+		Data:    page,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
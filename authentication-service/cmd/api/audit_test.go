@@ -0,0 +1,268 @@
+// Package main contains tests for the authentication audit trail.
+package main
+
+import (
+	"authentication-service/data"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func listAuditEvents(t *testing.T, app *Config, userID int, query, token string) auditPage {
+	t.Helper()
+
+	rr := serveRequest(t, app, http.MethodGet, fmt.Sprintf("/users/%d/audit%s", userID, query), nil, token)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d listing audit events, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var response struct {
+		Data auditPage `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+
+	return response.Data
+}
+
+func TestAuditTrail(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+
+	var mu sync.Mutex
+	var shipped []data.AuditEvent
+	app.HTTPClient = newTestHTTPClient(func(req *http.Request) *http.Response {
+		var entry struct {
+			Name string `json:"name"`
+			Data string `json:"data"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&entry)
+		if entry.Name == auditLogName {
+			var event data.AuditEvent
+			_ = json.Unmarshal([]byte(entry.Data), &event)
+			mu.Lock()
+			shipped = append(shipped, event)
+			mu.Unlock()
+		}
+
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"error":false}`)),
+			Header:     make(http.Header),
+		}
+	})
+	app.AuditShipper = app.newAuditShipper(defaultAuditQueueSize)
+
+	id, _ := repo.Insert(data.User{Email: "me@here.com", Password: "long-enough", Active: 1})
+	otherID, _ := repo.Insert(data.User{Email: "you@there.com", Password: "long-enough", Active: 1})
+
+	rr := serveRequest(t, app, http.MethodPost, "/authenticate", map[string]string{"email": "me@here.com", "password": "wrong-password"}, "")
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+	_ = serveRequest(t, app, http.MethodPost, "/authenticate", map[string]string{"email": "nobody@here.com", "password": "wrong-password"}, "")
+
+	pair := loginFrom(t, app, "audit-test/1.0")
+
+	rr = serveRequest(t, app, http.MethodPost, "/refresh", map[string]string{"refresh_token": pair.RefreshToken}, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d refreshing, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	_ = repo.InsertPasswordReset(data.PasswordReset{UserID: id, TokenHash: hashResetToken("reset-token"), ExpiresAt: time.Now().Add(time.Hour)})
+	rr = serveRequest(t, app, http.MethodPost, "/password-reset/confirm", map[string]string{"token": "reset-token", "password": "another-password"}, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d resetting, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	rr = serveRequest(t, app, http.MethodPost, "/authenticate", map[string]string{"email": "me@here.com", "password": "another-password"}, "")
+	token := decodeAuthResponse(t, rr).AccessToken
+
+	page := listAuditEvents(t, app, id, "", token)
+	expected := []struct{ event, outcome, reason string }{
+		{data.AuditEventLogin, data.AuditOutcomeSuccess, ""},
+		{data.AuditEventPasswordChange, data.AuditOutcomeSuccess, ""},
+		{data.AuditEventTokenRefresh, data.AuditOutcomeSuccess, ""},
+		{data.AuditEventLogin, data.AuditOutcomeSuccess, ""},
+		{data.AuditEventLogin, data.AuditOutcomeFailure, errorCodeInvalidCredentials},
+	}
+	if len(page.Events) != len(expected) || page.NextBefore != 0 {
+		t.Fatalf("expected %d events on one page, got %+v", len(expected), page)
+	}
+	for i, want := range expected {
+		got := page.Events[i]
+		if got.Event != want.event || got.Outcome != want.outcome || got.Reason != want.reason {
+			t.Errorf("event %d: expected %s %s %q, got %+v", i, want.event, want.outcome, want.reason, got)
+		}
+		if got.UserID != id || got.IP != "192.0.2.1" {
+			t.Errorf("event %d: expected user %d from 192.0.2.1, got %+v", i, id, got)
+		}
+	}
+	if page.Events[3].UserAgent != "audit-test/1.0" {
+		t.Errorf("expected the login's user agent, got %q", page.Events[3].UserAgent)
+	}
+
+	// nothing is audited after this, so the queue can be drained
+	app.AuditShipper.Close()
+	mu.Lock()
+	shippedCount := len(shipped)
+	mu.Unlock()
+	// the unknown email is shipped too, though it belongs to no user
+	if shippedCount != len(expected)+1 {
+		t.Errorf("expected every event to be shipped to logger-service, got %d", shippedCount)
+	}
+
+	first := listAuditEvents(t, app, id, "?limit=2", token)
+	if len(first.Events) != 2 || first.NextBefore != first.Events[1].ID {
+		t.Fatalf("expected a first page of two with a cursor, got %+v", first)
+	}
+	rest := listAuditEvents(t, app, id, fmt.Sprintf("?before=%d", first.NextBefore), token)
+	if len(rest.Events) != len(expected)-2 || rest.Events[0].Event != data.AuditEventTokenRefresh {
+		t.Fatalf("expected the remaining events after the cursor, got %+v", rest)
+	}
+
+	otherToken, _ := app.Tokens.IssuePair(data.User{ID: otherID}, "")
+	adminToken, _ := app.Tokens.IssuePair(data.User{ID: otherID, Permissions: []string{data.PermissionAuditRead}}, "")
+
+	tests := []struct {
+		name           string
+		query          string
+		token          string
+		expectedStatus int
+	}{
+		{name: "another user", token: otherToken.AccessToken, expectedStatus: http.StatusForbidden},
+		{name: "with audit:read", token: adminToken.AccessToken, expectedStatus: http.StatusOK},
+		{name: "unauthenticated", expectedStatus: http.StatusUnauthorized},
+		{name: "limit too large", query: "?limit=1000", token: token, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "bad cursor", query: "?before=x", token: token, expectedStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serveRequest(t, app, http.MethodGet, fmt.Sprintf("/users/%d/audit%s", id, tt.query), nil, tt.token)
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuditRecordsLockoutsAndSecondFactorFailures(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+	app.Limiter = NewLoginLimiter(2, 100, time.Minute, time.Minute)
+
+	id, _ := repo.Insert(data.User{Email: "me@here.com", Password: "long-enough", Active: 1})
+	_, _, _ = enrollTOTP(t, app, loginFrom(t, app, "test").AccessToken)
+
+	rr := serveRequest(t, app, http.MethodPost, "/authenticate", map[string]string{"email": "me@here.com", "password": "long-enough"}, "")
+	challenge := decodeChallenge(t, rr).ChallengeToken
+	for i := 0; i < 3; i++ {
+		_ = serveRequest(t, app, http.MethodPost, "/authenticate/second-factor", map[string]string{"challenge_token": challenge, "code": "000000"}, "")
+	}
+
+	events, _ := repo.ListAuditEvents(id, 0, 10)
+	expected := []struct{ event, reason string }{
+		{data.AuditEventSecondFactor, errorCodeAccountLocked},
+		{data.AuditEventLockout, errorCodeAccountLocked},
+		{data.AuditEventSecondFactor, errorCodeInvalidSecondFactor},
+		{data.AuditEventSecondFactor, errorCodeInvalidSecondFactor},
+		{data.AuditEventLogin, ""},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %+v", len(expected), events)
+	}
+	for i, want := range expected {
+		if events[i].Event != want.event || events[i].Reason != want.reason {
+			t.Errorf("event %d: expected %s %q, got %+v", i, want.event, want.reason, events[i])
+		}
+	}
+}
+
+func TestAuditRecordsRecoveryCodeUse(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+
+	id, _ := repo.Insert(data.User{Email: "me@here.com", Password: "long-enough", Active: 1})
+	_, _, recoveryCodes := enrollTOTP(t, app, loginFrom(t, app, "test").AccessToken)
+
+	rr := serveRequest(t, app, http.MethodPost, "/authenticate", map[string]string{"email": "me@here.com", "password": "long-enough"}, "")
+	challenge := decodeChallenge(t, rr).ChallengeToken
+	rr = serveRequest(t, app, http.MethodPost, "/authenticate/second-factor", map[string]string{"challenge_token": challenge, "recovery_code": recoveryCodes[0]}, "")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected the recovery code to be accepted, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	token, _ := app.Tokens.IssuePair(data.User{ID: id}, "")
+	page := listAuditEvents(t, app, id, "", token.AccessToken)
+	if len(page.Events) < 2 || page.Events[1].Event != data.AuditEventRecoveryCode || page.Events[1].Outcome != data.AuditOutcomeSuccess {
+		t.Fatalf("expected the recovery code use before the login, got %+v", page.Events)
+	}
+}
+
+func TestAuditDoesNotWaitForLogger(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+	id, _ := repo.Insert(data.User{Email: "me@here.com", Password: "long-enough", Active: 1})
+
+	release := make(chan struct{})
+	var sent atomic.Int32
+	app.AuditShipper = NewAuditShipper(1, func(entry string) error {
+		sent.Add(1)
+		<-release
+		return nil
+	})
+
+	// at most one event is being sent and one waits in the queue; the rest
+	// are dropped
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		rr := serveRequest(t, app, http.MethodPost, "/authenticate", map[string]string{"email": "me@here.com", "password": "wrong-password"}, "")
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected logins not to wait for logger-service, took %s", elapsed)
+	}
+
+	close(release)
+	app.AuditShipper.Close()
+	if sent.Load() > 2 {
+		t.Fatalf("expected the queue to bound what is sent, got %d", sent.Load())
+	}
+
+	// dropped events are still stored: five failures and the lockout
+	if events, _ := repo.ListAuditEvents(id, 0, 10); len(events) != 6 {
+		t.Fatalf("expected every event to be stored, got %d", len(events))
+	}
+}
+
+func TestAuditFitsLongEmailsInTheirColumns(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+	app.Limiter = NewLoginLimiter(1, 1, time.Minute, time.Minute)
+
+	email := strings.Repeat("a", 300) + "@example.com"
+	rr := serveRequest(t, app, http.MethodPost, "/authenticate", map[string]string{"email": email, "password": "wrong-password"}, "")
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	events, _ := repo.ListAuditEvents(0, 0, 10)
+	reasons := map[string]bool{}
+	for _, event := range events {
+		if len(event.Email) > maxAuditEmailLength || len(event.Reason) > 64 {
+			t.Fatalf("expected the event to fit its columns, got email of %d and reason %q", len(event.Email), event.Reason)
+		}
+		if event.Event == data.AuditEventLockout {
+			reasons[event.Reason] = true
+		}
+	}
+	if len(events) != 3 || !reasons[errorCodeAccountLocked] || !reasons[auditReasonIPLocked] {
+		t.Fatalf("expected the failure and both lockouts, got %+v", events)
+	}
+}
@@ -0,0 +1,429 @@
+// Package main implements the user administration subcommands of authctl.
+package main
+
+import (
+	"authentication-service/data"
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// authctlName is the name the binary answers to as an admin tool. Run as
+// authctl it only runs subcommands and never starts the server.
+const authctlName = "authctl"
+
+// authctlCommands are the subcommands authctl accepts.
+var authctlCommands = []string{"user", "migrate", "breached-passwords"}
+
+const authctlUsage = `usage: authctl <command>
+
+commands:
+  user                manage user accounts; run "authctl user" for details
+  migrate             apply or revert schema migrations: migrate [up | down [steps] | version]
+  breached-passwords  build a breached-password list: breached-passwords <passwords.txt> <list.bin>`
+
+const userUsage = `usage: authctl user <command> [flags] [arguments]
+
+commands:
+  create -email <email> [-first-name <name>] [-last-name <name>] [-roles <role,...>] [-verified] (-password <password> | -password-stdin)
+  list
+  set-password (-password <password> | -password-stdin) <email or id>
+  deactivate <email or id>
+
+every command also accepts -o table (the default) or -o json
+
+set-password does not lift a lockout from failed logins, which the running
+service keeps in memory; it ends after LOCKOUT_DURATION or a restart`
+
+// defaultUserListPageSize is how many users list reads at a time.
+const defaultUserListPageSize = 100
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// runUserCommand handles `authctl user ...` against the Postgres database,
+// with the same password hashing and policy settings as the service.
+func runUserCommand(conn *sql.DB, args []string) error {
+	app := Config{}
+	if err := app.setupRepository(repositoryDriverPostgres, conn); err != nil {
+		return err
+	}
+
+	cmd := &userCommand{
+		repo:   app.Repository,
+		policy: app.PasswordPolicy,
+		stdin:  os.Stdin,
+		stdout: os.Stdout,
+	}
+
+	return cmd.run(args)
+}
+
+// userCommand runs `authctl user ...` against a repository.
+type userCommand struct {
+	repo   data.Repository
+	policy *data.PasswordPolicy
+	stdin  io.Reader
+	stdout io.Writer
+
+	// pageSize is how many users list reads at a time; zero means
+	// defaultUserListPageSize.
+	pageSize int
+}
+
+// run dispatches args, the arguments after "user".
+func (cmd *userCommand) run(args []string) error {
+	if len(args) == 0 {
+		return errors.New(userUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		return cmd.create(args[1:])
+	case "list":
+		return cmd.list(args[1:])
+	case "set-password":
+		return cmd.setPassword(args[1:])
+	case "deactivate":
+		return cmd.deactivate(args[1:])
+	default:
+		return errors.New(userUsage)
+	}
+}
+
+func (cmd *userCommand) create(args []string) error {
+	flags, output := newUserFlagSet("create")
+	email := flags.String("email", "", "email address")
+	firstName := flags.String("first-name", "", "first name")
+	lastName := flags.String("last-name", "", "last name")
+	roles := flags.String("roles", "", "comma-separated roles to grant instead of the default one")
+	verified := flags.Bool("verified", false, "mark the email address as verified")
+	password := flags.String("password", "", "password")
+	passwordStdin := flags.Bool("password-stdin", false, "read the password from the first line of standard input")
+	if err := parseUserFlags(flags, args, 0); err != nil {
+		return err
+	}
+
+	secret, err := cmd.readPassword(*password, *passwordStdin)
+	if err != nil {
+		return err
+	}
+
+	errs := validationErrors{}
+	errs.checkEmail("email", *email)
+	errs.checkName("first-name", *firstName)
+	errs.checkName("last-name", *lastName)
+	if err := errs.checkPassword(cmd.policy, "password", secret, *email); err != nil {
+		return err
+	}
+	var grants []string
+	if *roles != "" {
+		grants = strings.Split(*roles, ",")
+		for _, role := range grants {
+			if _, ok := data.DefaultRolePermissions[role]; !ok {
+				errs.add("roles", "must only include known roles, such as "+data.RoleAdmin)
+			}
+		}
+	}
+	if !errs.valid() {
+		return errs.err()
+	}
+
+	id, err := cmd.repo.Insert(data.User{
+		Email:     *email,
+		FirstName: *firstName,
+		LastName:  *lastName,
+		Password:  secret,
+		Active:    1,
+	})
+	if err != nil {
+		return err
+	}
+	if grants != nil {
+		if err := cmd.repo.SetRoles(id, grants); err != nil {
+			return err
+		}
+	}
+	if *verified {
+		if err := cmd.repo.MarkEmailVerified(id, *email); err != nil {
+			return err
+		}
+	}
+
+	user, err := cmd.repo.GetOne(id)
+	if err != nil {
+		return err
+	}
+
+	return cmd.print(*output, []*data.User{user}, false)
+}
+
+func (cmd *userCommand) list(args []string) error {
+	flags, output := newUserFlagSet("list")
+	if err := parseUserFlags(flags, args, 0); err != nil {
+		return err
+	}
+
+	query := data.UserQuery{Limit: cmd.pageSize}
+	if query.Limit <= 0 {
+		query.Limit = defaultUserListPageSize
+	}
+
+	// users are read and printed a page at a time, so the list never holds
+	// every user in memory
+	writer := cmd.newUserWriter(*output, true)
+	for {
+		page, err := cmd.repo.ListUsers(query)
+		if err != nil {
+			return err
+		}
+		if err := writer.write(page.Users); err != nil {
+			return err
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+
+	return writer.close()
+}
+
+// setPassword replaces a password, as a reset would, ends the user's
+// sessions and records the change in the audit trail.
+func (cmd *userCommand) setPassword(args []string) error {
+	flags, output := newUserFlagSet("set-password")
+	password := flags.String("password", "", "new password")
+	passwordStdin := flags.Bool("password-stdin", false, "read the password from the first line of standard input")
+	if err := parseUserFlags(flags, args, 1); err != nil {
+		return err
+	}
+
+	secret, err := cmd.readPassword(*password, *passwordStdin)
+	if err != nil {
+		return err
+	}
+
+	user, err := cmd.lookup(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := cmd.repo.ResetPassword(secret, *user); err != nil {
+		return err
+	}
+	if err := cmd.repo.RevokeSessions(user.ID); err != nil {
+		return err
+	}
+	err = cmd.repo.InsertAuditEvent(data.AuditEvent{
+		UserID:    user.ID,
+		Email:     truncateUTF8(user.Email, maxAuditEmailLength),
+		Event:     data.AuditEventPasswordChange,
+		Outcome:   data.AuditOutcomeSuccess,
+		UserAgent: authctlName,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return cmd.print(*output, []*data.User{user}, false)
+}
+
+// deactivate stops a user logging in and ends their sessions.
+func (cmd *userCommand) deactivate(args []string) error {
+	flags, output := newUserFlagSet("deactivate")
+	if err := parseUserFlags(flags, args, 1); err != nil {
+		return err
+	}
+
+	user, err := cmd.lookup(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	user.Active = 0
+	if err := cmd.repo.Update(*user); err != nil {
+		return err
+	}
+	if err := cmd.repo.RevokeSessions(user.ID); err != nil {
+		return err
+	}
+
+	return cmd.print(*output, []*data.User{user}, false)
+}
+
+// lookup finds a user by ID if key is a number, and by email otherwise.
+func (cmd *userCommand) lookup(key string) (*data.User, error) {
+	var user *data.User
+	var err error
+	if id, convErr := strconv.Atoi(key); convErr == nil {
+		user, err = cmd.repo.GetOne(id)
+	} else {
+		user, err = cmd.repo.GetByEmail(key)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no user %s", key)
+	}
+
+	return user, err
+}
+
+// readPassword returns password, or the first line of stdin when fromStdin is
+// set, so that it need not appear in the shell history.
+func (cmd *userCommand) readPassword(password string, fromStdin bool) (string, error) {
+	if fromStdin {
+		if password != "" {
+			return "", errors.New("use either -password or -password-stdin, not both")
+		}
+
+		line, err := bufio.NewReader(cmd.stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		return "", errors.New("a password is required; use -password or -password-stdin")
+	}
+
+	return password, nil
+}
+
+// print writes users with their roles as a table, or as JSON: an array when
+// many is set and a single object otherwise.
+func (cmd *userCommand) print(output string, users []*data.User, many bool) error {
+	writer := cmd.newUserWriter(output, many)
+	if err := writer.write(users); err != nil {
+		return err
+	}
+
+	return writer.close()
+}
+
+// userWriter prints users for print and list, which writes them a page at a
+// time.
+type userWriter struct {
+	cmd     *userCommand
+	many    bool
+	table   *tabwriter.Writer
+	written int
+}
+
+func (cmd *userCommand) newUserWriter(output string, many bool) *userWriter {
+	writer := &userWriter{cmd: cmd, many: many}
+	if output != outputJSON {
+		writer.table = tabwriter.NewWriter(cmd.stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer.table, "ID\tEMAIL\tNAME\tACTIVE\tVERIFIED\tROLES")
+	}
+
+	return writer
+}
+
+// write prints users after loading their roles and permissions.
+func (writer *userWriter) write(users []*data.User) error {
+	for _, user := range users {
+		authorization, err := writer.cmd.repo.GetAuthorization(user.ID)
+		if err != nil {
+			return err
+		}
+		user.Roles = authorization.Roles
+		user.Permissions = authorization.Permissions
+
+		if writer.table != nil {
+			name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+			fmt.Fprintf(writer.table, "%d\t%s\t%s\t%s\t%s\t%s\n",
+				user.ID, user.Email, name, yesNo(user.Active == 1), yesNo(user.EmailVerified()), strings.Join(user.Roles, ","))
+			continue
+		}
+
+		if err := writer.writeJSON(user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeJSON prints user as an element of the array when many is set, with
+// the same layout json.Encoder gives the whole array.
+func (writer *userWriter) writeJSON(user *data.User) error {
+	if !writer.many {
+		enc := json.NewEncoder(writer.cmd.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(user)
+	}
+
+	encoded, err := json.MarshalIndent(user, "  ", "  ")
+	if err != nil {
+		return err
+	}
+
+	separator := ",\n  "
+	if writer.written == 0 {
+		separator = "[\n  "
+	}
+	writer.written++
+
+	_, err = fmt.Fprintf(writer.cmd.stdout, "%s%s", separator, encoded)
+	return err
+}
+
+// close flushes the table, or ends the JSON array.
+func (writer *userWriter) close() error {
+	switch {
+	case writer.table != nil:
+		return writer.table.Flush()
+	case !writer.many:
+		return nil
+	case writer.written == 0:
+		_, err := fmt.Fprintln(writer.cmd.stdout, "[]")
+		return err
+	default:
+		_, err := fmt.Fprintln(writer.cmd.stdout, "\n]")
+		return err
+	}
+}
+
+func newUserFlagSet(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet("user "+name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	output := flags.String("o", outputTable, "output format: table or json")
+
+	return flags, output
+}
+
+// parseUserFlags parses args and checks that exactly positional arguments
+// follow the flags.
+func parseUserFlags(flags *flag.FlagSet, args []string, positional int) error {
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w\n%s", err, userUsage)
+	}
+	if flags.NArg() != positional {
+		return errors.New(userUsage)
+	}
+	if output := flags.Lookup("o").Value.String(); !slices.Contains([]string{outputTable, outputJSON}, output) {
+		return fmt.Errorf("unknown output %q; use table or json", output)
+	}
+
+	return nil
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+
+	return "no"
+}
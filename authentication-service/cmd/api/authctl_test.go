@@ -0,0 +1,176 @@
+// Package main contains tests for the authctl user subcommands.
+package main
+
+import (
+	"authentication-service/data"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestUserCommand(t *testing.T, stdin string) (*userCommand, *data.MemoryRepository, *bytes.Buffer) {
+	t.Helper()
+
+	repo := data.NewMemoryRepository()
+	repo.Hasher = &data.PasswordHasher{Algorithm: data.HashAlgorithmBcrypt, BcryptCost: bcrypt.MinCost}
+	stdout := &bytes.Buffer{}
+
+	cmd := &userCommand{
+		repo:   repo,
+		policy: data.NewPasswordPolicy(),
+		stdin:  strings.NewReader(stdin),
+		stdout: stdout,
+	}
+
+	return cmd, repo, stdout
+}
+
+func TestUserCommandCreate(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          []string
+		stdin         string
+		expectedError string
+		expectedRoles []string
+		verified      bool
+	}{
+		{
+			name:          "first admin",
+			args:          []string{"create", "-email", "admin@here.com", "-roles", "admin", "-verified", "-password-stdin"},
+			stdin:         "long-enough\n",
+			expectedRoles: []string{data.RoleAdmin},
+			verified:      true,
+		},
+		{
+			name:          "default role",
+			args:          []string{"create", "-email", "user@here.com", "-first-name", "Ada", "-password", "long-enough"},
+			expectedRoles: []string{data.DefaultRole},
+		},
+		{name: "missing password", args: []string{"create", "-email", "user@here.com"}, expectedError: "a password is required"},
+		{name: "both passwords", args: []string{"create", "-email", "user@here.com", "-password", "long-enough", "-password-stdin"}, expectedError: "not both"},
+		{name: "invalid email", args: []string{"create", "-email", "nope", "-password", "long-enough"}, expectedError: "email must be a valid email address"},
+		{name: "weak password", args: []string{"create", "-email", "user@here.com", "-password", "password"}, expectedError: "password is too common"},
+		{name: "unknown role", args: []string{"create", "-email", "user@here.com", "-roles", "owner", "-password", "long-enough"}, expectedError: "roles must only include known roles"},
+		{name: "duplicate email", args: []string{"create", "-email", "taken@here.com", "-password", "long-enough"}, expectedError: data.ErrDuplicateEmail.Error()},
+		{name: "unknown flag", args: []string{"create", "-admin"}, expectedError: "flag provided but not defined"},
+		{name: "unknown output", args: []string{"create", "-o", "yaml", "-email", "user@here.com", "-password", "long-enough"}, expectedError: "unknown output"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, repo, _ := newTestUserCommand(t, tt.stdin)
+			_, _ = repo.Insert(data.User{Email: "taken@here.com", Password: "long-enough"})
+
+			err := cmd.run(tt.args)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Fatalf("expected an error containing %q, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			user, err := repo.GetByEmail(tt.args[2])
+			if err != nil {
+				t.Fatalf("expected the user to be created, got %v", err)
+			}
+			if matches, _ := repo.PasswordMatches("long-enough", *user); !matches {
+				t.Fatalf("expected the password to be set")
+			}
+			if user.EmailVerified() != tt.verified {
+				t.Fatalf("expected verified=%v, got %+v", tt.verified, user)
+			}
+			authorization, _ := repo.GetAuthorization(user.ID)
+			if strings.Join(authorization.Roles, ",") != strings.Join(tt.expectedRoles, ",") {
+				t.Fatalf("expected roles %v, got %v", tt.expectedRoles, authorization.Roles)
+			}
+		})
+	}
+}
+
+func TestUserCommandManagesAccounts(t *testing.T) {
+	cmd, repo, stdout := newTestUserCommand(t, "brand-new-secret\n")
+	id, _ := repo.Insert(data.User{Email: "me@here.com", FirstName: "Ada", LastName: "Lovelace", Password: "long-enough", Active: 1})
+	_, _ = repo.Insert(data.User{Email: "you@here.com", LastName: "Zed", Password: "long-enough", Active: 1})
+	_ = repo.CreateSession(data.Session{ID: "session", UserID: id, CreatedAt: time.Now(), LastSeenAt: time.Now()})
+	// list reads one user at a time
+	cmd.pageSize = 1
+
+	if err := cmd.run([]string{"list"}); err != nil {
+		t.Fatalf("expected list to succeed, got %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "ID") || !strings.Contains(lines[1], "Ada Lovelace") || !strings.Contains(lines[1], "user") {
+		t.Fatalf("expected a header and two users, got:\n%s", stdout.String())
+	}
+
+	stdout.Reset()
+	if err := cmd.run([]string{"list", "-o", "json"}); err != nil {
+		t.Fatalf("expected list to succeed, got %v", err)
+	}
+	var users []data.User
+	if err := json.Unmarshal(stdout.Bytes(), &users); err != nil || len(users) != 2 || users[1].Email != "you@here.com" {
+		t.Fatalf("expected a JSON array of users, got %s", stdout.String())
+	}
+
+	// pages are joined into the array json.Encoder would write
+	var expected bytes.Buffer
+	enc := json.NewEncoder(&expected)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(users)
+	if stdout.String() != expected.String() {
+		t.Fatalf("expected the paged list to match a single encoding, got:\n%s\nwant:\n%s", stdout.String(), expected.String())
+	}
+
+	if err := cmd.run([]string{"set-password", "-password-stdin", "me@here.com"}); err != nil {
+		t.Fatalf("expected set-password to succeed, got %v", err)
+	}
+	user, _ := repo.GetOne(id)
+	if matches, _ := repo.PasswordMatches("brand-new-secret", *user); !matches {
+		t.Fatalf("expected the new password to be set")
+	}
+	if sessions, _ := repo.ListSessions(id); len(sessions) != 0 {
+		t.Fatalf("expected a new password to end the user's sessions, got %d", len(sessions))
+	}
+	events, _ := repo.ListAuditEvents(id, 0, 10)
+	if len(events) != 1 || events[0].Event != data.AuditEventPasswordChange || events[0].UserAgent != authctlName {
+		t.Fatalf("expected the new password in the audit trail, got %+v", events)
+	}
+
+	stdout.Reset()
+	if err := cmd.run([]string{"deactivate", "-o", "json", "1"}); err != nil {
+		t.Fatalf("expected deactivate by id to succeed, got %v", err)
+	}
+	var deactivated data.User
+	_ = json.Unmarshal(stdout.Bytes(), &deactivated)
+	if user, _ := repo.GetOne(id); user.Active != 0 || deactivated.Active != 0 || deactivated.ID != id {
+		t.Fatalf("expected the user to be deactivated, got %+v", deactivated)
+	}
+
+	tests := []struct {
+		name          string
+		args          []string
+		expectedError string
+	}{
+		{name: "no command", args: nil, expectedError: "usage: authctl user"},
+		{name: "unknown command", args: []string{"delete"}, expectedError: "usage: authctl user"},
+		{name: "unknown user", args: []string{"deactivate", "nobody@here.com"}, expectedError: "no user nobody@here.com"},
+		{name: "missing user", args: []string{"deactivate"}, expectedError: "usage: authctl user"},
+		{name: "weak password", args: []string{"set-password", "-password", "short", "me@here.com"}, expectedError: "must be at least 8 characters long"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := cmd.run(tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Fatalf("expected an error containing %q, got %v", tt.expectedError, err)
+			}
+		})
+	}
+}
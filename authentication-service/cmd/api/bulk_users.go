@@ -0,0 +1,487 @@
+// Package main imports users from CSV or NDJSON and streams them back out.
+package main
+
+import (
+	"authentication-service/data"
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	importFormatCSV    = "csv"
+	importFormatNDJSON = "ndjson"
+
+	// importBatchSize is how many users each import transaction stores.
+	importBatchSize = 100
+	// maxImportBytes bounds an import request body.
+	maxImportBytes = 10 << 20
+	// exportFlushRows is how many users an export writes between flushes.
+	exportFlushRows = 100
+)
+
+var errImportFormat = errors.New("format must be csv or ndjson")
+
+// importRow is one user to import, read from the email, first_name,
+// last_name, password and active columns or fields. Others, such as the id
+// and timestamps of an export, are ignored. A blank password is replaced with
+// a random one, so the user sets their own through a password reset. Active
+// defaults to 1.
+type importRow struct {
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Password  string `json:"password"`
+	Active    *int   `json:"active"`
+}
+
+// importRowError lists the problems with one line of an import.
+type importRowError struct {
+	Line   int              `json:"line"`
+	Email  string           `json:"email,omitempty"`
+	Errors validationErrors `json:"errors"`
+}
+
+// importReport summarises an import. Valid rows passed validation; with a
+// dry run nothing is imported.
+type importReport struct {
+	DryRun   bool             `json:"dry_run"`
+	Total    int              `json:"total"`
+	Valid    int              `json:"valid"`
+	Imported int              `json:"imported"`
+	Failed   int              `json:"failed"`
+	Errors   []importRowError `json:"errors"`
+}
+
+// handleImportUsers creates users from a CSV file with a header row, or from
+// one JSON object per line. Every row is validated and problems are reported
+// per line; the valid rows are stored in transactions of importBatchSize.
+// With dry_run=true the rows are only validated.
+func (app *Config) handleImportUsers(w http.ResponseWriter, r *http.Request) {
+	errs := validationErrors{}
+	format := importFormat(r)
+	if format != importFormatCSV && format != importFormatNDJSON {
+		errs.add("format", errImportFormat.Error())
+	}
+	dryRun, err := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	if err != nil && r.URL.Query().Get("dry_run") != "" {
+		errs.add("dry_run", "must be true or false")
+	}
+	if !errs.valid() {
+		_ = app.writeValidationErrorJSON(w, errs)
+		return
+	}
+
+	importer := &userImporter{
+		app:    app,
+		dryRun: dryRun,
+		seen:   make(map[string]int),
+		report: importReport{DryRun: dryRun, Errors: []importRowError{}},
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+	if format == importFormatCSV {
+		err = readCSVImport(body, importer.add)
+	} else {
+		err = readNDJSONImport(body, importer.add)
+	}
+	if err == nil {
+		err = importer.flush()
+	}
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, errBadImport):
+		_ = app.writeErrorJSON(w, err, http.StatusBadRequest)
+		return
+	case errors.As(err, &tooLarge):
+		_ = app.writeErrorJSON(w, fmt.Errorf("import is larger than %d bytes; nothing after the last stored batch was imported", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		_ = app.writeErrorJSON(w, fmt.Errorf("import stopped after storing %d users: %w", importer.report.Imported, err))
+		return
+	}
+
+	report := importer.report
+	message := fmt.Sprintf("Imported %d of %d users", report.Imported, report.Total)
+	if dryRun {
+		message = fmt.Sprintf("Dry run: %d of %d users can be imported", report.Valid, report.Total)
+	}
+
+	payload := JsonResponse{
+		Error:   report.Failed > 0,
+		Message: message,
+		Data:    report,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// handleExportUsers streams every user as CSV or NDJSON without holding them
+// all in memory. Password hashes are never included.
+func (app *Config) handleExportUsers(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = importFormatNDJSON
+	}
+
+	var write func(*data.User) error
+	var finish func() error
+	switch format {
+	case importFormatCSV:
+		out := csv.NewWriter(w)
+		write = func(user *data.User) error {
+			return out.Write(exportRecord(user))
+		}
+		finish = func() error {
+			out.Flush()
+			return out.Error()
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+		w.WriteHeader(http.StatusOK)
+		if err := out.Write(exportColumns); err != nil {
+			return
+		}
+	case importFormatNDJSON:
+		enc := json.NewEncoder(w)
+		write = func(user *data.User) error {
+			return enc.Encode(user)
+		}
+		finish = func() error { return nil }
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="users.ndjson"`)
+		w.WriteHeader(http.StatusOK)
+	default:
+		_ = app.writeValidationErrorJSON(w, validationErrors{"format": errImportFormat.Error()})
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	rows := 0
+	err := app.Repository.EachUser(func(user *data.User) error {
+		if err := write(user); err != nil {
+			return err
+		}
+
+		rows++
+		if rows%exportFlushRows == 0 && flusher != nil {
+			if err := finish(); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+
+		return nil
+	})
+	if err == nil {
+		err = finish()
+	}
+	if err != nil {
+		// the status has been sent, so all that is left is to cut the export short
+		log.Println("Error exporting users:", err)
+	}
+}
+
+// exportColumns is the header of a CSV export.
+var exportColumns = []string{"id", "email", "first_name", "last_name", "active", "created_at", "updated_at", "email_verified_at"}
+
+func exportRecord(user *data.User) []string {
+	verifiedAt := ""
+	if user.EmailVerifiedAt != nil {
+		verifiedAt = user.EmailVerifiedAt.UTC().Format(time.RFC3339)
+	}
+
+	return []string{
+		strconv.Itoa(user.ID),
+		user.Email,
+		user.FirstName,
+		user.LastName,
+		strconv.Itoa(user.Active),
+		user.CreatedAt.UTC().Format(time.RFC3339),
+		user.UpdatedAt.UTC().Format(time.RFC3339),
+		verifiedAt,
+	}
+}
+
+// importFormat reads the format query parameter, falling back to the
+// request's Content-Type.
+func importFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return importFormatCSV
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return importFormatNDJSON
+	}
+
+	return ""
+}
+
+// readCSVImport calls add for each record after the header row. Records that
+// cannot be parsed are passed on with their error; only read errors stop it.
+func readCSVImport(r io.Reader, add func(line int, row importRow, err error) error) error {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return importReadError(err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["email"]; !ok {
+		return fmt.Errorf("%w: the header row must name an email column", errBadImport)
+	}
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			if err := add(parseErr.StartLine, importRow{}, parseErr.Err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := reader.FieldPos(0)
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		row := importRow{
+			Email:     field("email"),
+			FirstName: field("first_name"),
+			LastName:  field("last_name"),
+			Password:  field("password"),
+		}
+		if active := field("active"); active != "" {
+			row.Active = new(int)
+			if value, err := strconv.ParseBool(active); err != nil {
+				// left for add to reject along with the row's other problems
+				*row.Active = -1
+			} else if value {
+				*row.Active = 1
+			}
+		}
+
+		if err := add(line, row, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// readNDJSONImport calls add for each non-blank line. Lines that are not a
+// JSON object are passed on with their error; only read errors stop it.
+func readNDJSONImport(r io.Reader, add func(line int, row importRow, err error) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportBytes)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		var row importRow
+		err := json.Unmarshal(text, &row)
+		if err != nil {
+			err = errors.New("line must be a JSON object with email, first_name, last_name, password and active")
+		}
+		if err := add(line, row, err); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// errBadImport marks an import that could not be read at all.
+var errBadImport = errors.New("invalid import")
+
+func importReadError(err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return fmt.Errorf("%w: %v", errBadImport, err)
+	}
+
+	return err
+}
+
+// userImporter validates rows as they are read and stores them in batches.
+type userImporter struct {
+	app    *Config
+	dryRun bool
+	// seen maps each email in the import to the line it first appeared on.
+	seen   map[string]int
+	batch  []data.User
+	lines  []int
+	report importReport
+}
+
+// add validates one row and queues it for the next batch. A non-nil rowErr
+// means the row could not be parsed. An error stops the import.
+func (im *userImporter) add(line int, row importRow, rowErr error) error {
+	im.report.Total++
+	if rowErr != nil {
+		im.fail(line, "", validationErrors{"row": rowErr.Error()})
+		return nil
+	}
+	row.Email = strings.TrimSpace(row.Email)
+
+	errs := validationErrors{}
+	errs.checkEmail("email", row.Email)
+	errs.checkName("first_name", row.FirstName)
+	errs.checkName("last_name", row.LastName)
+	if row.Active != nil && *row.Active != 0 && *row.Active != 1 {
+		errs.add("active", "must be 0 or 1")
+	}
+	if row.Password != "" {
+		if err := errs.checkPassword(im.app.passwordPolicy(), "password", row.Password, row.Email); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := errs["email"]; !ok {
+		if first, ok := im.seen[row.Email]; ok {
+			errs.add("email", fmt.Sprintf("also appears on line %d", first))
+		} else {
+			im.seen[row.Email] = line
+			_, err := im.app.Repository.GetByEmail(row.Email)
+			switch {
+			case err == nil:
+				errs.add("email", data.ErrDuplicateEmail.Error())
+			case !errors.Is(err, sql.ErrNoRows):
+				return err
+			}
+		}
+	}
+
+	if !errs.valid() {
+		im.fail(line, row.Email, errs)
+		return nil
+	}
+	im.report.Valid++
+	if im.dryRun {
+		return nil
+	}
+
+	user := data.User{
+		Email:     row.Email,
+		FirstName: row.FirstName,
+		LastName:  row.LastName,
+		Password:  row.Password,
+		Active:    1,
+	}
+	if row.Active != nil {
+		user.Active = *row.Active
+	}
+	if user.Password == "" {
+		password, err := randomImportPassword()
+		if err != nil {
+			return err
+		}
+		user.Password = password
+	}
+
+	im.batch = append(im.batch, user)
+	im.lines = append(im.lines, line)
+	if len(im.batch) >= importBatchSize {
+		return im.flush()
+	}
+
+	return nil
+}
+
+// flush stores the queued batch. A user the repository rejects, say because
+// the email was registered since it was checked, is reported and the rest of
+// the batch is retried without it.
+func (im *userImporter) flush() error {
+	for len(im.batch) > 0 {
+		ids, err := im.app.Repository.InsertBatch(im.batch)
+
+		var rejected *data.BatchInsertError
+		if errors.As(err, &rejected) && rejected.Index < len(im.batch) {
+			if failure, ok := importFailure(rejected.Err); ok {
+				im.report.Valid--
+				im.fail(im.lines[rejected.Index], im.batch[rejected.Index].Email, failure)
+				im.batch = append(im.batch[:rejected.Index], im.batch[rejected.Index+1:]...)
+				im.lines = append(im.lines[:rejected.Index], im.lines[rejected.Index+1:]...)
+				continue
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		im.report.Imported += len(ids)
+		im.batch = im.batch[:0]
+		im.lines = im.lines[:0]
+	}
+
+	return nil
+}
+
+func (im *userImporter) fail(line int, email string, errs validationErrors) {
+	im.report.Failed++
+	im.report.Errors = append(im.report.Errors, importRowError{Line: line, Email: email, Errors: errs})
+}
+
+// importFailure describes the repository errors that only concern one row.
+func importFailure(err error) (validationErrors, bool) {
+	var policyErr *data.PasswordPolicyError
+	switch {
+	case errors.Is(err, data.ErrDuplicateEmail):
+		return validationErrors{"email": err.Error()}, true
+	case errors.As(err, &policyErr):
+		return validationErrors{"password": strings.Join(policyErr.Violations, "; ")}, true
+	}
+
+	return nil, false
+}
+
+// randomImportPassword returns a password nobody knows for an imported user
+// without one. It mixes all four character classes so that any policy accepts it.
+func randomImportPassword() (string, error) {
+	random, err := randomHex(24)
+	if err != nil {
+		return "", err
+	}
+
+	return random + "-Aa", nil
+}
@@ -0,0 +1,250 @@
+// Package main contains tests for bulk user import and export.
+package main
+
+import (
+	"authentication-service/data"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newBulkTestApp returns an app holding an admin, me@here.com, and their token.
+func newBulkTestApp(t *testing.T) (*Config, *data.MemoryRepository, string) {
+	t.Helper()
+
+	app, repo := newRolesTestApp(t)
+	id, _ := repo.Insert(data.User{Email: "me@here.com", LastName: "Admin", Password: "long-enough", Active: 1})
+	_ = repo.SetRoles(id, []string{data.RoleAdmin})
+
+	return app, repo, loginFrom(t, app, "test").AccessToken
+}
+
+func serveImport(t *testing.T, app *Config, query, contentType, body, token string) (*httptest.ResponseRecorder, importReport) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/users/import"+query, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, req)
+
+	var response struct {
+		Data importReport `json:"data"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &response)
+
+	return rr, response.Data
+}
+
+func TestImportUsers(t *testing.T) {
+	csvBody := strings.Join([]string{
+		"email,first_name,last_name,password,active",
+		"ada@here.com,Ada,Lovelace,Analytical-Engine,1",
+		"grace@here.com,Grace,Hopper,,false",
+		"not-an-email,Bad,Row,Analytical-Engine,",
+		"me@here.com,Taken,Already,Analytical-Engine,",
+		"ada@here.com,Ada,Again,Analytical-Engine,",
+		"weak@here.com,Weak,Password,password,",
+		`"unterminated,Broken,Quote,,`,
+	}, "\n")
+
+	ndjsonBody := strings.Join([]string{
+		`{"email":"ada@here.com","first_name":"Ada","password":"Analytical-Engine"}`,
+		``,
+		`{"email":"grace@here.com","active":0,"id":41,"created_at":"2020-01-01T00:00:00Z"}`,
+		`{"email":"me@here.com"}`,
+		`not json`,
+		`{"email":"status@here.com","active":2}`,
+	}, "\n")
+
+	tests := []struct {
+		name             string
+		query            string
+		contentType      string
+		body             string
+		expectedTotal    int
+		expectedImported int
+		expectedLines    []int
+	}{
+		{name: "csv", contentType: "text/csv", body: csvBody, expectedTotal: 7, expectedImported: 2, expectedLines: []int{4, 5, 6, 7, 8}},
+		{name: "csv dry run", query: "?dry_run=true", contentType: "text/csv", body: csvBody, expectedTotal: 7, expectedLines: []int{4, 5, 6, 7, 8}},
+		{name: "ndjson", query: "?format=ndjson", contentType: "text/plain", body: ndjsonBody, expectedTotal: 5, expectedImported: 2, expectedLines: []int{4, 5, 6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, repo, token := newBulkTestApp(t)
+
+			rr, report := serveImport(t, app, tt.query, tt.contentType, tt.body, token)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+			}
+			if report.Total != tt.expectedTotal || report.Imported != tt.expectedImported || report.Failed != len(tt.expectedLines) {
+				t.Fatalf("expected %d rows with %d imported, got %+v", tt.expectedTotal, tt.expectedImported, report)
+			}
+
+			lines := make([]int, len(report.Errors))
+			for i, rowErr := range report.Errors {
+				lines[i] = rowErr.Line
+			}
+			if fmt.Sprint(lines) != fmt.Sprint(tt.expectedLines) {
+				t.Fatalf("expected errors on lines %v, got %+v", tt.expectedLines, report.Errors)
+			}
+
+			users, _ := repo.GetAll()
+			if len(users) != 1+tt.expectedImported {
+				t.Fatalf("expected %d users after the import, got %d", 1+tt.expectedImported, len(users))
+			}
+			if tt.expectedImported == 0 {
+				return
+			}
+
+			// grace has no password and is inactive; ada can log in straight away
+			grace, err := repo.GetByEmail("grace@here.com")
+			if err != nil || grace.Active != 0 {
+				t.Fatalf("expected grace to be imported inactive, got %+v, %v", grace, err)
+			}
+			ada, _ := repo.GetByEmail("ada@here.com")
+			if matches, _ := repo.PasswordMatches("Analytical-Engine", *ada); !matches || ada.Active != 1 {
+				t.Fatalf("expected ada to be imported active with her password, got %+v", ada)
+			}
+		})
+	}
+}
+
+func TestImportUsersRejectsRequests(t *testing.T) {
+	app, repo, token := newBulkTestApp(t)
+	_, _ = repo.Insert(data.User{Email: "plain@here.com", Password: "long-enough", Active: 1})
+	login := serveRequest(t, app, http.MethodPost, "/authenticate", map[string]string{"email": "plain@here.com", "password": "long-enough"}, "")
+	userToken := decodeAuthResponse(t, login).AccessToken
+
+	tests := []struct {
+		name           string
+		query          string
+		contentType    string
+		body           string
+		token          string
+		expectedStatus int
+	}{
+		{name: "unknown format", contentType: "application/json", body: "{}", token: token, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "invalid dry run", query: "?dry_run=maybe", contentType: "text/csv", body: "email\n", token: token, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "csv without an email column", contentType: "text/csv", body: "name\nAda\n", token: token, expectedStatus: http.StatusBadRequest},
+		{name: "without users:manage", contentType: "text/csv", body: "email\n", token: userToken, expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, _ := serveImport(t, app, tt.query, tt.contentType, tt.body, tt.token)
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestImportUsersInBatches(t *testing.T) {
+	app, repo, token := newBulkTestApp(t)
+
+	var body strings.Builder
+	body.WriteString("email,last_name\n")
+	for i := range importBatchSize + 5 {
+		fmt.Fprintf(&body, "user%03d@here.com,User\n", i)
+	}
+
+	rr, report := serveImport(t, app, "", "text/csv", body.String(), token)
+	if rr.Code != http.StatusOK || report.Imported != importBatchSize+5 || report.Failed != 0 {
+		t.Fatalf("expected every user to be imported, got %d: %+v", rr.Code, report)
+	}
+
+	users, _ := repo.GetAll()
+	if len(users) != importBatchSize+6 {
+		t.Fatalf("expected %d users, got %d", importBatchSize+6, len(users))
+	}
+}
+
+func TestUserImporterRetriesRejectedBatch(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+	importer := &userImporter{app: app, seen: make(map[string]int)}
+
+	_ = importer.add(2, importRow{Email: "first@here.com"}, nil)
+	_ = importer.add(3, importRow{Email: "second@here.com"}, nil)
+	_ = importer.add(4, importRow{Email: "third@here.com"}, nil)
+
+	// second registers elsewhere after it was checked but before it is stored
+	_, _ = repo.Insert(data.User{Email: "second@here.com", Password: "long-enough"})
+
+	if err := importer.flush(); err != nil {
+		t.Fatalf("expected the batch to be retried, got %v", err)
+	}
+	if importer.report.Imported != 2 || importer.report.Valid != 2 || len(importer.report.Errors) != 1 || importer.report.Errors[0].Line != 3 {
+		t.Fatalf("expected line 3 to fail and the others to be stored, got %+v", importer.report)
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	app, repo, token := newBulkTestApp(t)
+	_, _ = repo.Insert(data.User{Email: "ada@here.com", FirstName: "Ada", LastName: "Lovelace", Password: "Analytical-Engine", Active: 1})
+
+	t.Run("ndjson", func(t *testing.T) {
+		rr := serveRequest(t, app, http.MethodGet, "/users/export", nil, token)
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("expected an NDJSON export, got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+		}
+		if strings.Contains(rr.Body.String(), "password") {
+			t.Fatalf("expected no password hashes in the export, got %s", rr.Body.String())
+		}
+
+		var emails []string
+		scanner := bufio.NewScanner(rr.Body)
+		for scanner.Scan() {
+			var user data.User
+			if err := json.Unmarshal(scanner.Bytes(), &user); err != nil {
+				t.Fatalf("expected one user per line, got %q", scanner.Text())
+			}
+			emails = append(emails, user.Email)
+		}
+		if fmt.Sprint(emails) != "[me@here.com ada@here.com]" {
+			t.Fatalf("expected users sorted by last name, got %v", emails)
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		rr := serveRequest(t, app, http.MethodGet, "/users/export?format=csv", nil, token)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		records, err := csv.NewReader(rr.Body).ReadAll()
+		if err != nil || len(records) != 3 {
+			t.Fatalf("expected a header and two users, got %v, %v", records, err)
+		}
+		if records[0][1] != "email" || records[2][1] != "ada@here.com" || records[2][2] != "Ada" {
+			t.Fatalf("unexpected CSV export %v", records)
+		}
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		rr := serveRequest(t, app, http.MethodGet, "/users/export?format=csv", nil, token)
+
+		target, targetRepo, targetToken := newBulkTestApp(t)
+		_, report := serveImport(t, target, "", "text/csv", rr.Body.String(), targetToken)
+		if report.Imported != 1 || report.Failed != 1 {
+			t.Fatalf("expected ada to be imported and the existing admin skipped, got %+v", report)
+		}
+		if ada, err := targetRepo.GetByEmail("ada@here.com"); err != nil || ada.LastName != "Lovelace" {
+			t.Fatalf("expected ada in the target, got %+v, %v", ada, err)
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		rr := serveRequest(t, app, http.MethodGet, "/users/export?format=xml", nil, token)
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected status %d, got %d", http.StatusUnprocessableEntity, rr.Code)
+		}
+	})
+}
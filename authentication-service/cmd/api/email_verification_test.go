@@ -0,0 +1,154 @@
+// Package main contains tests for email address verification.
+package main
+
+import (
+	"authentication-service/data"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// captureVerificationLinks records the token of every verification link
+// mailed by app.
+func captureVerificationLinks(t *testing.T, app *Config) *[]string {
+	t.Helper()
+
+	app.EmailVerificationURL = "http://front-end/verify"
+	tokens := &[]string{}
+	app.HTTPClient = newTestHTTPClient(func(req *http.Request) *http.Response {
+		var mail struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&mail)
+
+		if link := regexp.MustCompile(`http://front-end/verify\?token=\S+`).FindString(mail.Message); link != "" {
+			parsed, _ := url.Parse(link)
+			*tokens = append(*tokens, parsed.Query().Get("token"))
+		}
+
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"error":false}`)),
+			Header:     make(http.Header),
+		}
+	})
+
+	return tokens
+}
+
+func TestEmailVerificationRequired(t *testing.T) {
+	app, _ := newRolesTestApp(t)
+	app.EmailVerification = emailVerificationRequire
+	tokens := captureVerificationLinks(t, app)
+
+	credentials := map[string]string{"email": "new@here.com", "password": "long-enough"}
+	rr := serveRequest(t, app, http.MethodPost, "/users", credentials, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	if len(*tokens) != 1 {
+		t.Fatalf("expected one verification mail, got %d", len(*tokens))
+	}
+
+	rr = serveRequest(t, app, http.MethodPost, "/authenticate", credentials, "")
+	if rr.Code != http.StatusForbidden || decodeErrorCode(t, rr) != errorCodeEmailUnverified {
+		t.Fatalf("expected %s with status %d, got %d: %s", errorCodeEmailUnverified, http.StatusForbidden, rr.Code, rr.Body.String())
+	}
+
+	tests := []struct {
+		name           string
+		token          string
+		expectedStatus int
+	}{
+		{name: "tampered token", token: (*tokens)[0] + "x", expectedStatus: http.StatusBadRequest},
+		{name: "valid token", token: (*tokens)[0], expectedStatus: http.StatusOK},
+		{name: "already verified", token: (*tokens)[0], expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serveRequest(t, app, http.MethodPost, "/email-verification/confirm", map[string]string{"token": tt.token}, "")
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	rr = serveRequest(t, app, http.MethodPost, "/authenticate", credentials, "")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected verified user to log in, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestEmailVerificationRestricted(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+	app.EmailVerification = emailVerificationRestrict
+	tokens := captureVerificationLinks(t, app)
+
+	credentials := map[string]string{"email": "new@here.com", "password": "long-enough"}
+	_ = serveRequest(t, app, http.MethodPost, "/users", credentials, "")
+
+	rr := serveRequest(t, app, http.MethodPost, "/authenticate", credentials, "")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rr.Code, rr.Body.String())
+	}
+	pair := decodeAuthResponse(t, rr)
+	claims, _ := app.Tokens.Verify(pair.AccessToken, tokenTypeAccess)
+	if len(claims.Permissions) != 0 {
+		t.Fatalf("expected an unverified user to hold no permissions, got %v", claims.Permissions)
+	}
+
+	_ = serveRequest(t, app, http.MethodPost, "/email-verification/confirm", map[string]string{"token": (*tokens)[0]}, "")
+
+	rr = serveRequest(t, app, http.MethodPost, "/refresh", map[string]string{"refresh_token": pair.RefreshToken}, "")
+	claims, _ = app.Tokens.Verify(decodeAuthResponse(t, rr).AccessToken, tokenTypeAccess)
+	if !slices.Equal(claims.Permissions, data.DefaultRolePermissions[data.RoleUser]) {
+		t.Fatalf("expected default permissions once verified, got %v", claims.Permissions)
+	}
+
+	// changing the address needs a new verification, and old links stop working
+	user, _ := repo.GetByEmail("new@here.com")
+	rr = serveRequest(t, app, http.MethodPut, "/users/"+strconv.Itoa(user.ID), map[string]string{"email": "moved@here.com"}, pair.AccessToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d updating email, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	user, _ = repo.GetOne(user.ID)
+	if user.EmailVerified() {
+		t.Fatalf("expected a changed email to be unverified")
+	}
+
+	rr = serveRequest(t, app, http.MethodPost, "/email-verification/confirm", map[string]string{"token": (*tokens)[0]}, "")
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for a link to the old address, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestHandleResendEmailVerification(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+	tokens := captureVerificationLinks(t, app)
+
+	id, _ := repo.Insert(data.User{Email: "unverified@here.com", Password: "long-enough", Active: 1})
+	verifiedID, _ := repo.Insert(data.User{Email: "verified@here.com", Password: "long-enough", Active: 1})
+	_ = repo.MarkEmailVerified(verifiedID, "verified@here.com")
+
+	for _, email := range []string{"nobody@here.com", "verified@here.com", "unverified@here.com"} {
+		rr := serveRequest(t, app, http.MethodPost, "/email-verification", map[string]string{"email": email}, "")
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusAccepted, email, rr.Code)
+		}
+	}
+
+	if len(*tokens) != 1 {
+		t.Fatalf("expected a link only for the unverified account, got %d", len(*tokens))
+	}
+	claims, _ := app.Tokens.Verify((*tokens)[0], tokenTypeEmailVerification)
+	if userID, _ := claims.UserID(); userID != id {
+		t.Fatalf("expected a link for user %d, got %d", id, userID)
+	}
+}
@@ -0,0 +1,229 @@
+// Package main serves logins, token validation and user lookups over gRPC.
+package main
+
+import (
+	"authentication-service/auth"
+	"authentication-service/data"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const grpcPort = "50001"
+
+// errorInfoDomain identifies this service in gRPC error details.
+const errorInfoDomain = "authentication-service"
+
+// forwardedUserAgentKey carries the end user's user agent from broker-service.
+// gRPC reserves the user-agent key for the calling client's own.
+const forwardedUserAgentKey = "x-forwarded-user-agent"
+
+// AuthServer answers the same questions as /authenticate, /validate and
+// GET /users/{id}, with the same lockout, audit and session rules.
+type AuthServer struct {
+	auth.UnimplementedAuthServiceServer
+	app *Config
+}
+
+// Authenticate checks an email and password. Accounts with a second factor
+// get a challenge instead of tokens, answered at /authenticate/second-factor.
+func (s *AuthServer) Authenticate(ctx context.Context, req *auth.AuthenticateRequest) (*auth.AuthenticateResponse, error) {
+	r := requestFromGRPC(ctx)
+
+	user, err := s.app.checkCredentials(r, req.GetEmail(), req.GetPassword())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	secondFactor, err := s.app.requiresSecondFactor(user)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if secondFactor {
+		challenge, err := s.app.issueSecondFactorChallenge(user)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+
+		return &auth.AuthenticateResponse{
+			Challenge: &auth.SecondFactorChallenge{
+				ChallengeToken: challenge.ChallengeToken,
+				ExpiresIn:      challenge.ExpiresIn,
+				Methods:        challenge.Methods,
+			},
+		}, nil
+	}
+	s.app.Limiter.RecordSuccess(req.GetEmail())
+
+	tokens, err := s.app.issueLogin(r, user)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &auth.AuthenticateResponse{
+		User:         userMessage(user),
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		TokenType:    tokens.TokenType,
+		ExpiresIn:    tokens.ExpiresIn,
+	}, nil
+}
+
+// ValidateToken verifies an access token and its session.
+func (s *AuthServer) ValidateToken(ctx context.Context, req *auth.ValidateTokenRequest) (*auth.ValidateTokenResponse, error) {
+	identity, err := s.validateToken(req.GetAccessToken())
+	if err != nil {
+		return nil, err
+	}
+
+	return &auth.ValidateTokenResponse{
+		UserId:      int64(identity.UserID),
+		Email:       identity.Email,
+		ExpiresAt:   identity.ExpiresAt,
+		Roles:       identity.Roles,
+		Permissions: identity.Permissions,
+	}, nil
+}
+
+// GetUser returns the caller's own profile with their roles and permissions.
+func (s *AuthServer) GetUser(ctx context.Context, req *auth.GetUserRequest) (*auth.GetUserResponse, error) {
+	token, ok := bearerToken(requestFromGRPC(ctx))
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+
+	identity, err := s.validateToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if int64(identity.UserID) != req.GetId() {
+		return nil, status.Error(codes.PermissionDenied, errForbidden.Error())
+	}
+
+	user, err := s.app.Repository.GetOne(identity.UserID)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if err := s.app.loadAuthorization(user); err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &auth.GetUserResponse{User: userMessage(user)}, nil
+}
+
+func (s *AuthServer) validateToken(token string) (tokenIdentity, error) {
+	identity, httpStatus, err := s.app.validateAccessToken(token)
+	if httpStatus == http.StatusUnauthorized {
+		return identity, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if err != nil {
+		return identity, grpcError(err)
+	}
+
+	return identity, nil
+}
+
+// newGRPCServer returns a server with AuthServer and the standard health
+// service registered.
+func (app *Config) newGRPCServer() *grpc.Server {
+	grpcServer := grpc.NewServer()
+	auth.RegisterAuthServiceServer(grpcServer, &AuthServer{app: app})
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+
+	return grpcServer
+}
+
+// listenGRPC serves AuthServer until the listener fails.
+func (app *Config) listenGRPC() error {
+	lis, err := net.Listen("tcp", ":"+grpcPort)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("gRPC server started on port %s", grpcPort)
+
+	return app.newGRPCServer().Serve(lis)
+}
+
+// requestFromGRPC describes a call as the HTTP request that lockout, the
+// audit trail and sessions read the client from. Metadata keys become
+// headers, so X-Forwarded-For is honoured under the same TrustedProxies rule
+// as over HTTP.
+func requestFromGRPC(ctx context.Context) *http.Request {
+	r := (&http.Request{Header: make(http.Header)}).WithContext(ctx)
+
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if len(values) > 0 && !strings.HasPrefix(key, ":") {
+			r.Header.Set(key, values[0])
+		}
+	}
+	if userAgent := md.Get(forwardedUserAgentKey); len(userAgent) > 0 {
+		r.Header.Set("User-Agent", userAgent[0])
+	}
+
+	return r
+}
+
+// grpcError maps errors onto gRPC status codes. Refused logins carry their
+// API error code, and lockouts the seconds to wait, as ErrorInfo details.
+func grpcError(err error) error {
+	var refused *loginError
+	switch {
+	case errors.As(err, &refused):
+		code := codes.Unauthenticated
+		switch refused.Status {
+		case http.StatusForbidden:
+			code = codes.PermissionDenied
+		case http.StatusTooManyRequests:
+			code = codes.ResourceExhausted
+		}
+
+		info := &errdetails.ErrorInfo{Reason: refused.Code, Domain: errorInfoDomain}
+		if refused.RetryAfter > 0 {
+			info.Metadata = map[string]string{"retry_after": strconv.Itoa(int(math.Ceil(refused.RetryAfter.Seconds())))}
+		}
+
+		st, detailErr := status.New(code, refused.Err.Error()).WithDetails(info)
+		if detailErr != nil {
+			return status.Error(code, refused.Err.Error())
+		}
+		return st.Err()
+	case errors.Is(err, sql.ErrNoRows):
+		return status.Error(codes.NotFound, errUserNotFound.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func userMessage(user *data.User) *auth.User {
+	return &auth.User{
+		Id:            int64(user.ID),
+		Email:         user.Email,
+		FirstName:     user.FirstName,
+		LastName:      user.LastName,
+		Active:        user.Active == 1,
+		EmailVerified: user.EmailVerified(),
+		Roles:         user.Roles,
+		Permissions:   user.Permissions,
+	}
+}
@@ -0,0 +1,194 @@
+// Package main contains tests for the gRPC AuthService.
+package main
+
+import (
+	"authentication-service/auth"
+	"authentication-service/data"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func newTestAuthClient(t *testing.T, app *Config) auth.AuthServiceClient {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	server := app.newGRPCServer()
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial gRPC server: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return auth.NewAuthServiceClient(conn)
+}
+
+func errorReason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.GetReason()
+		}
+	}
+
+	return ""
+}
+
+func TestGRPCAuthService(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+	client := newTestAuthClient(t, app)
+	ctx := context.Background()
+
+	id, _ := repo.Insert(data.User{Email: "me@here.com", FirstName: "Me", Password: "long-enough", Active: 1})
+	otherID, _ := repo.Insert(data.User{Email: "you@there.com", Password: "long-enough", Active: 1})
+
+	loginCtx := metadata.AppendToOutgoingContext(ctx, forwardedUserAgentKey, "grpc-test/1.0")
+	login, err := client.Authenticate(loginCtx, &auth.AuthenticateRequest{Email: "me@here.com", Password: "long-enough"})
+	if err != nil {
+		t.Fatalf("failed to authenticate: %v", err)
+	}
+	if login.GetAccessToken() == "" || login.GetUser().GetId() != int64(id) || login.GetChallenge() != nil {
+		t.Fatalf("expected tokens for user %d, got %+v", id, login)
+	}
+
+	// the login is a session like any other, labelled with the end user's agent
+	sessions := listSessions(t, app, login.GetAccessToken())
+	if len(sessions) != 1 || sessions[0].UserAgent != "grpc-test/1.0" {
+		t.Fatalf("expected one session from grpc-test/1.0, got %+v", sessions)
+	}
+
+	identity, err := client.ValidateToken(ctx, &auth.ValidateTokenRequest{AccessToken: login.GetAccessToken()})
+	if err != nil {
+		t.Fatalf("failed to validate token: %v", err)
+	}
+	if identity.GetUserId() != int64(id) || len(identity.GetPermissions()) == 0 {
+		t.Fatalf("expected the caller's identity, got %+v", identity)
+	}
+
+	authorized := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+login.GetAccessToken())
+	profile, err := client.GetUser(authorized, &auth.GetUserRequest{Id: int64(id)})
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	if profile.GetUser().GetFirstName() != "Me" || len(profile.GetUser().GetRoles()) == 0 {
+		t.Fatalf("expected the profile with roles, got %+v", profile.GetUser())
+	}
+
+	tests := []struct {
+		name         string
+		call         func() error
+		expectedCode codes.Code
+	}{
+		{
+			name: "validate a garbage token",
+			call: func() error {
+				_, err := client.ValidateToken(ctx, &auth.ValidateTokenRequest{AccessToken: "not-a-token"})
+				return err
+			},
+			expectedCode: codes.Unauthenticated,
+		},
+		{
+			name: "get a user without a token",
+			call: func() error {
+				_, err := client.GetUser(ctx, &auth.GetUserRequest{Id: int64(id)})
+				return err
+			},
+			expectedCode: codes.Unauthenticated,
+		},
+		{
+			name: "get another user",
+			call: func() error {
+				_, err := client.GetUser(authorized, &auth.GetUserRequest{Id: int64(otherID)})
+				return err
+			},
+			expectedCode: codes.PermissionDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := status.Code(tt.call()); code != tt.expectedCode {
+				t.Fatalf("expected %s, got %s", tt.expectedCode, code)
+			}
+		})
+	}
+
+	// revoking the session stops the token at once
+	_ = repo.RevokeSessions(id)
+	_, err = client.ValidateToken(ctx, &auth.ValidateTokenRequest{AccessToken: login.GetAccessToken()})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected a revoked session to be rejected, got %v", err)
+	}
+}
+
+func TestGRPCAuthenticateRefusals(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+	app.Limiter = NewLoginLimiter(2, 100, time.Minute, time.Minute)
+	client := newTestAuthClient(t, app)
+	ctx := context.Background()
+
+	_, _ = repo.Insert(data.User{Email: "me@here.com", Password: "long-enough", Active: 1})
+	_, _ = repo.Insert(data.User{Email: "inactive@here.com", Password: "long-enough", Active: 0})
+
+	// cases run in order: two wrong passwords lock the account
+	tests := []struct {
+		name           string
+		email          string
+		password       string
+		expectedCode   codes.Code
+		expectedReason string
+	}{
+		{name: "wrong password", email: "me@here.com", password: "wrong-password", expectedCode: codes.Unauthenticated, expectedReason: errorCodeInvalidCredentials},
+		{name: "unknown email", email: "nobody@here.com", password: "long-enough", expectedCode: codes.Unauthenticated, expectedReason: errorCodeInvalidCredentials},
+		{name: "inactive account", email: "inactive@here.com", password: "long-enough", expectedCode: codes.PermissionDenied, expectedReason: errorCodeAccountInactive},
+		{name: "second wrong password", email: "me@here.com", password: "wrong-password", expectedCode: codes.Unauthenticated, expectedReason: errorCodeInvalidCredentials},
+		{name: "locked out", email: "me@here.com", password: "long-enough", expectedCode: codes.ResourceExhausted, expectedReason: errorCodeAccountLocked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.Authenticate(ctx, &auth.AuthenticateRequest{Email: tt.email, Password: tt.password})
+			if code := status.Code(err); code != tt.expectedCode {
+				t.Fatalf("expected %s, got %v", tt.expectedCode, err)
+			}
+			if reason := errorReason(err); reason != tt.expectedReason {
+				t.Fatalf("expected reason %q, got %q", tt.expectedReason, reason)
+			}
+		})
+	}
+}
+
+func TestGRPCAuthenticateWithSecondFactor(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+	client := newTestAuthClient(t, app)
+
+	_, _ = repo.Insert(data.User{Email: "me@here.com", Password: "long-enough", Active: 1})
+	_, _, _ = enrollTOTP(t, app, loginFrom(t, app, "test").AccessToken)
+
+	login, err := client.Authenticate(context.Background(), &auth.AuthenticateRequest{Email: "me@here.com", Password: "long-enough"})
+	if err != nil {
+		t.Fatalf("failed to authenticate: %v", err)
+	}
+	if login.GetAccessToken() != "" || login.GetChallenge().GetChallengeToken() == "" {
+		t.Fatalf("expected a challenge instead of tokens, got %+v", login)
+	}
+	if _, err := app.Tokens.Verify(login.GetChallenge().GetChallengeToken(), tokenTypeChallenge); err != nil {
+		t.Fatalf("expected a valid challenge token, got %v", err)
+	}
+}
@@ -2,14 +2,51 @@
 package main
 
 import (
+	"authentication-service/data"
 	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 )
 
+const (
+	errorCodeInvalidCredentials = "invalid_credentials"
+	errorCodeAccountInactive    = "account_inactive"
+	errorCodeAccountLocked      = "account_locked"
+)
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errAccountInactive    = errors.New("account is inactive")
+)
+
+// loginError is a refused login: the machine-readable Code and HTTP Status
+// to answer with and, for lockouts, how long until the caller may retry.
+type loginError struct {
+	Err        error
+	Code       string
+	Status     int
+	RetryAfter time.Duration
+}
+
+func (e *loginError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *loginError) Unwrap() error {
+	return e.Err
+}
+
+// authResponse is returned by successful authenticate and refresh calls.
+type authResponse struct {
+	User *data.User `json:"user"`
+	TokenPair
+}
+
 func (app *Config) handleAuthenticate(w http.ResponseWriter, r *http.Request) {
 	if app.Repository == nil {
 		_ = app.writeErrorJSON(w, errors.New("repository is not configured"))
@@ -30,37 +67,73 @@ func (app *Config) handleAuthenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// validate the user
-	user, err := app.Repository.GetByEmail(requestPayload.Email)
+	user, err := app.checkCredentials(r, requestPayload.Email, requestPayload.Password)
 	if err != nil {
-		err := app.writeErrorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
-		if err != nil {
-			return
-		}
+		app.writeLoginError(w, err)
+		return
+	}
+
+	secondFactor, err := app.requiresSecondFactor(user)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
 		return
 	}
+	if secondFactor {
+		// failures are only cleared once the second factor succeeds, so the
+		// password alone does not reset the budget for guessing codes
+		app.writeSecondFactorChallenge(w, user)
+		return
+	}
+	app.Limiter.RecordSuccess(requestPayload.Email)
+
+	app.completeLogin(w, r, user)
+}
+
+// checkCredentials verifies the email and password of a login from r's
+// client. Failures count towards lockout, and every refusal is audited and
+// returned as a *loginError.
+func (app *Config) checkCredentials(r *http.Request, email, password string) (*data.User, error) {
+	if retryAfter, locked := app.Limiter.Locked(email, app.clientIP(r)); locked {
+		app.audit(r, data.AuditEvent{Email: email, Event: data.AuditEventLogin, Outcome: data.AuditOutcomeFailure, Reason: errorCodeAccountLocked})
+		return nil, lockedOutError(retryAfter)
+	}
+
+	// validate the user
+	user, err := app.Repository.GetByEmail(email)
+	if err != nil {
+		return nil, app.recordFailedLogin(r, 0, email)
+	}
 
 	// validate password
-	valid, err := app.Repository.PasswordMatches(requestPayload.Password, *user)
+	valid, err := app.Repository.PasswordMatches(password, *user)
 	if err != nil || !valid {
-		err := app.writeErrorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
-		if err != nil {
-			return
-		}
-		return
+		return nil, app.recordFailedLogin(r, user.ID, email)
+	}
+	// only reveal the account state to callers who know the password
+	if user.Active == 0 {
+		app.auditUser(r, user, data.AuditEventLogin, data.AuditOutcomeFailure, errorCodeAccountInactive)
+		return nil, &loginError{Err: errAccountInactive, Code: errorCodeAccountInactive, Status: http.StatusForbidden}
+	}
+	if app.EmailVerification == emailVerificationRequire && !user.EmailVerified() {
+		app.auditUser(r, user, data.AuditEventLogin, data.AuditOutcomeFailure, errorCodeEmailUnverified)
+		return nil, &loginError{Err: errEmailUnverified, Code: errorCodeEmailUnverified, Status: http.StatusForbidden}
 	}
 
-	// log auth
-	err = app.logAuthenticationEvent("authentication", fmt.Sprintf("%s logged in", user.Email))
+	return user, nil
+}
+
+// completeLogin responds to a login that passed every check with tokens.
+func (app *Config) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	tokens, err := app.issueLogin(r, user)
 	if err != nil {
-		app.writeErrorJSON(w, err)
+		_ = app.writeErrorJSON(w, err)
 		return
 	}
 
 	payload := JsonResponse{
 		Error:   false,
 		Message: fmt.Sprintf("Logged in user %s", user.Email),
-		Data:    user,
+		Data:    authResponse{User: user, TokenPair: tokens},
 	}
 
 	if err = app.writeJSON(w, http.StatusAccepted, payload); err != nil {
@@ -68,6 +141,220 @@ func (app *Config) handleAuthenticate(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// issueLogin audits a login, starts a session and issues tokens carrying the
+// user's roles.
+func (app *Config) issueLogin(r *http.Request, user *data.User) (TokenPair, error) {
+	app.auditUser(r, user, data.AuditEventLogin, data.AuditOutcomeSuccess, "")
+
+	err := app.loadAuthorization(user)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	sessionID, err := app.startSession(r, user)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return app.Tokens.IssuePair(*user, sessionID)
+}
+
+func (app *Config) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	if app.Repository == nil {
+		_ = app.writeErrorJSON(w, errors.New("repository is not configured"))
+		return
+	}
+
+	var requestPayload struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.decodeJSON(w, r, &requestPayload)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	claims, err := app.Tokens.Verify(requestPayload.RefreshToken, tokenTypeRefresh)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := claims.UserID()
+	if err != nil {
+		_ = app.writeErrorJSON(w, errInvalidToken, http.StatusUnauthorized)
+		return
+	}
+	refreshFailure := data.AuditEvent{UserID: userID, Email: claims.Email, Event: data.AuditEventTokenRefresh, Outcome: data.AuditOutcomeFailure}
+
+	// every login starts a session, so a refresh token without one predates
+	// sessions and could never be revoked; it has to log in again
+	if claims.SessionID == "" {
+		refreshFailure.Reason = auditReasonInvalidToken
+		app.audit(r, refreshFailure)
+		_ = app.writeErrorJSON(w, errInvalidToken, http.StatusUnauthorized)
+		return
+	}
+	if err := app.checkSession(claims); err != nil {
+		refreshFailure.Reason = auditReasonSessionRevoked
+		app.audit(r, refreshFailure)
+		app.writeSessionError(w, err)
+		return
+	}
+
+	// the user may have been removed since the token was issued
+	user, err := app.Repository.GetOne(userID)
+	if err != nil {
+		refreshFailure.Reason = auditReasonInvalidToken
+		app.audit(r, refreshFailure)
+		_ = app.writeErrorJSON(w, errInvalidToken, http.StatusUnauthorized)
+		return
+	}
+	if user.Active == 0 {
+		app.auditUser(r, user, data.AuditEventTokenRefresh, data.AuditOutcomeFailure, errorCodeAccountInactive)
+		_ = app.writeErrorCodeJSON(w, errAccountInactive, errorCodeAccountInactive, http.StatusForbidden)
+		return
+	}
+	if !app.checkEmailVerification(w, user) {
+		app.auditUser(r, user, data.AuditEventTokenRefresh, data.AuditOutcomeFailure, errorCodeEmailUnverified)
+		return
+	}
+
+	err = app.loadAuthorization(user)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	tokens, err := app.Tokens.IssuePair(*user, claims.SessionID)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	app.auditUser(r, user, data.AuditEventTokenRefresh, data.AuditOutcomeSuccess, "")
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "Token refreshed",
+		Data:    authResponse{User: user, TokenPair: tokens},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// handleValidateToken lets other services verify a bearer access token.
+func (app *Config) handleValidateToken(w http.ResponseWriter, r *http.Request) {
+	token, ok := bearerToken(r)
+	if !ok {
+		_ = app.writeErrorJSON(w, errors.New("missing bearer token"), http.StatusUnauthorized)
+		return
+	}
+
+	identity, status, err := app.validateAccessToken(token)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, status)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "Token is valid",
+		Data:    identity,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// validateAccessToken verifies token and its session, returning the status
+// to answer with when it fails. A revoked session is rejected here, so
+// broker-service stops accepting its tokens immediately. OIDC access tokens
+// are refused, so relying parties cannot act through broker-service.
+func (app *Config) validateAccessToken(token string) (tokenIdentity, int, error) {
+	claims, err := app.Tokens.Verify(token, tokenTypeAccess)
+	if err != nil {
+		return tokenIdentity{}, http.StatusUnauthorized, err
+	}
+
+	userID, err := claims.UserID()
+	if err != nil {
+		return tokenIdentity{}, http.StatusUnauthorized, errInvalidToken
+	}
+
+	if err := app.checkSession(claims); err != nil {
+		if errors.Is(err, errSessionRevoked) {
+			return tokenIdentity{}, http.StatusUnauthorized, err
+		}
+		return tokenIdentity{}, http.StatusInternalServerError, err
+	}
+
+	return tokenIdentity{
+		UserID:      userID,
+		Email:       claims.Email,
+		ExpiresAt:   claims.ExpiresAt,
+		Roles:       claims.Roles,
+		Permissions: claims.Permissions,
+	}, http.StatusOK, nil
+}
+
+// recordFailedLogin counts a wrong email or password and returns the generic
+// invalid credentials error. userID is zero for unknown emails.
+func (app *Config) recordFailedLogin(r *http.Request, userID int, email string) error {
+	app.recordLoginFailure(r, data.AuditEvent{UserID: userID, Email: email, Event: data.AuditEventLogin, Reason: errorCodeInvalidCredentials})
+
+	return &loginError{Err: errInvalidCredentials, Code: errorCodeInvalidCredentials, Status: http.StatusUnauthorized}
+}
+
+// recordLoginFailure audits a failed attempt, counts it towards lockout and
+// audits any lockout it causes, with whether the account or the IP locked.
+func (app *Config) recordLoginFailure(r *http.Request, failure data.AuditEvent) {
+	failure.Outcome = data.AuditOutcomeFailure
+	app.audit(r, failure)
+
+	for _, key := range app.Limiter.RecordFailure(failure.Email, app.clientIP(r)) {
+		lockout := failure
+		lockout.Event = data.AuditEventLockout
+		lockout.Reason = lockoutReason(key)
+		app.audit(r, lockout)
+	}
+}
+
+// lockedOutError refuses a login while the account or client IP is locked.
+func lockedOutError(retryAfter time.Duration) *loginError {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+
+	return &loginError{
+		Err:        fmt.Errorf("too many failed login attempts, try again in %d seconds", seconds),
+		Code:       errorCodeAccountLocked,
+		Status:     http.StatusTooManyRequests,
+		RetryAfter: retryAfter,
+	}
+}
+
+// writeLoginError responds to a refused login with its code and status, or
+// with 500 for any other error.
+func (app *Config) writeLoginError(w http.ResponseWriter, err error) {
+	var refused *loginError
+	if !errors.As(err, &refused) {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	var headers []http.Header
+	if refused.RetryAfter > 0 {
+		headers = append(headers, http.Header{"Retry-After": {strconv.Itoa(int(math.Ceil(refused.RetryAfter.Seconds())))}})
+	}
+
+	payload := JsonResponse{
+		Error:   true,
+		Code:    refused.Code,
+		Message: refused.Err.Error(),
+	}
+
+	_ = app.writeJSON(w, refused.Status, payload, headers...)
+}
+
 func (app *Config) logAuthenticationEvent(name, data string) error {
 	entry := struct {
 		Name string `json:"name"`
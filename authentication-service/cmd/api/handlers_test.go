@@ -2,6 +2,7 @@
 package main
 
 import (
+	"authentication-service/data"
 	"bytes"
 	"encoding/json"
 	"io"
@@ -51,4 +52,125 @@ func TestHandleAuthenticate(t *testing.T) {
 	if rr.Code != http.StatusAccepted {
 		t.Errorf("expected http.StatusAccepted, got: %d", rr.Code)
 	}
+
+	tokens := decodeAuthResponse(t, rr)
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("expected access and refresh tokens in response")
+	}
+	if _, err := testApp.Tokens.Verify(tokens.AccessToken, tokenTypeAccess); err != nil {
+		t.Fatalf("expected issued access token to verify, got %v", err)
+	}
+}
+
+func TestHandleRefreshToken(t *testing.T) {
+	user := data.User{ID: 1, Email: "me@here.com"}
+	sessionID, err := testApp.startSession(httptest.NewRequest(http.MethodPost, "/authenticate", nil), &user)
+	if err != nil {
+		t.Fatalf("failed to start a session: %v", err)
+	}
+	pair, err := testApp.Tokens.IssuePair(user, sessionID)
+	if err != nil {
+		t.Fatalf("failed to issue tokens: %v", err)
+	}
+	withoutSession, _ := testApp.Tokens.IssuePair(user, "")
+
+	tests := []struct {
+		name           string
+		refreshToken   string
+		expectedStatus int
+	}{
+		{name: "valid refresh token", refreshToken: pair.RefreshToken, expectedStatus: http.StatusOK},
+		{name: "access token is rejected", refreshToken: pair.AccessToken, expectedStatus: http.StatusUnauthorized},
+		{name: "garbage token is rejected", refreshToken: "garbage", expectedStatus: http.StatusUnauthorized},
+		{name: "token without a session is rejected", refreshToken: withoutSession.RefreshToken, expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]string{"refresh_token": tt.refreshToken})
+
+			req, _ := http.NewRequest("POST", "/refresh", bytes.NewBuffer(body))
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(testApp.handleRefreshToken)
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+
+			if tt.expectedStatus == http.StatusOK {
+				tokens := decodeAuthResponse(t, rr)
+				if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+					t.Fatalf("expected a new token pair in response")
+				}
+			}
+		})
+	}
+}
+
+func TestHandleValidateToken(t *testing.T) {
+	pair, err := testApp.Tokens.IssuePair(data.User{ID: 5, Email: "me@here.com"}, "")
+	if err != nil {
+		t.Fatalf("failed to issue tokens: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		authorization  string
+		expectedStatus int
+	}{
+		{name: "valid access token", authorization: "Bearer " + pair.AccessToken, expectedStatus: http.StatusOK},
+		{name: "missing header", authorization: "", expectedStatus: http.StatusUnauthorized},
+		{name: "wrong scheme", authorization: "Basic " + pair.AccessToken, expectedStatus: http.StatusUnauthorized},
+		{name: "refresh token", authorization: "Bearer " + pair.RefreshToken, expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/validate", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(testApp.handleValidateToken)
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var response struct {
+				Data tokenIdentity `json:"data"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode JSON response: %v", err)
+			}
+			if response.Data.UserID != 5 {
+				t.Fatalf("expected user ID 5, got %d", response.Data.UserID)
+			}
+		})
+	}
+}
+
+func decodeAuthResponse(t *testing.T, rr *httptest.ResponseRecorder) TokenPair {
+	t.Helper()
+
+	var response struct {
+		Error bool         `json:"error"`
+		Data  authResponse `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+	if response.Error {
+		t.Fatalf("expected error=false, got true")
+	}
+
+	return response.Data.TokenPair
 }
@@ -10,6 +10,7 @@ import (
 
 type JsonResponse struct {
 	Error   bool   `json:"error"`
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message"`
 	Data    any    `json:"data,omitempty"`
 }
@@ -68,3 +69,14 @@ func (app *Config) writeErrorJSON(w http.ResponseWriter, err error, status ...in
 
 	return app.writeJSON(w, statusCode, payload)
 }
+
+// writeErrorCodeJSON writes an error with a machine-readable code so clients
+// can tell failure reasons apart without parsing the message.
+func (app *Config) writeErrorCodeJSON(w http.ResponseWriter, err error, code string, status int) error {
+	var payload JsonResponse
+	payload.Error = true
+	payload.Code = code
+	payload.Message = err.Error()
+
+	return app.writeJSON(w, status, payload)
+}
@@ -0,0 +1,254 @@
+// Package main throttles password guessing with per-account and per-IP lockouts.
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAccountLockoutThreshold = 5
+	defaultIPLockoutThreshold      = 20
+	defaultLockoutWindow           = 15 * time.Minute
+	defaultLockoutDuration         = 15 * time.Minute
+
+	// maxTrackedLoginKeys bounds memory before stale records are swept.
+	maxTrackedLoginKeys = 10000
+)
+
+type failedLogins struct {
+	count       int
+	windowStart time.Time
+	lockedUntil time.Time
+}
+
+// LoginLimiter counts failed logins per account and per client IP inside a
+// sliding window and locks a key out once its threshold is reached.
+type LoginLimiter struct {
+	AccountThreshold int
+	IPThreshold      int
+	Window           time.Duration
+	LockoutDuration  time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*failedLogins
+	now      func() time.Time
+}
+
+func NewLoginLimiter(accountThreshold, ipThreshold int, window, lockoutDuration time.Duration) *LoginLimiter {
+	return &LoginLimiter{
+		AccountThreshold: accountThreshold,
+		IPThreshold:      ipThreshold,
+		Window:           window,
+		LockoutDuration:  lockoutDuration,
+		failures:         make(map[string]*failedLogins),
+		now:              time.Now,
+	}
+}
+
+const (
+	accountLockoutKeyPrefix       = "account:"
+	ipLockoutKeyPrefix            = "ip:"
+	passwordResetLockoutKeyPrefix = "reset:"
+)
+
+func accountLockoutKey(email string) string {
+	return accountLockoutKeyPrefix + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipLockoutKey(ip string) string {
+	return ipLockoutKeyPrefix + ip
+}
+
+// lockoutReason is the audit reason recorded when key is locked out. The key
+// itself holds an email of any length, so it is not stored.
+func lockoutReason(key string) string {
+	if strings.HasPrefix(key, ipLockoutKeyPrefix) {
+		return auditReasonIPLocked
+	}
+
+	return errorCodeAccountLocked
+}
+
+// Locked reports whether either the account or the IP is locked out, and for
+// how much longer.
+func (l *LoginLimiter) Locked(email, ip string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var retryAfter time.Duration
+	for _, key := range []string{accountLockoutKey(email), ipLockoutKey(ip)} {
+		record, ok := l.failures[key]
+		if !ok {
+			continue
+		}
+		if remaining := record.lockedUntil.Sub(now); remaining > retryAfter {
+			retryAfter = remaining
+		}
+	}
+
+	return retryAfter, retryAfter > 0
+}
+
+// RecordFailure counts a failed login and returns the keys that became locked
+// out because of it.
+func (l *LoginLimiter) RecordFailure(email, ip string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if len(l.failures) > maxTrackedLoginKeys {
+		l.sweep(now)
+	}
+
+	var locked []string
+	if l.recordFailure(accountLockoutKey(email), l.AccountThreshold, now) {
+		locked = append(locked, accountLockoutKey(email))
+	}
+	if l.recordFailure(ipLockoutKey(ip), l.IPThreshold, now) {
+		locked = append(locked, ipLockoutKey(ip))
+	}
+
+	return locked
+}
+
+// AllowPasswordReset counts a password reset request from ip and reports
+// whether it may go ahead. Once an IP has made IPThreshold requests inside
+// the window it waits out LockoutDuration. These are counted apart from
+// failed logins, so asking for a reset never locks anyone out of logging in.
+func (l *LoginLimiter) AllowPasswordReset(ip string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if len(l.failures) > maxTrackedLoginKeys {
+		l.sweep(now)
+	}
+
+	key := passwordResetLockoutKeyPrefix + ip
+	if record, ok := l.failures[key]; ok && now.Before(record.lockedUntil) {
+		return record.lockedUntil.Sub(now), false
+	}
+	l.recordFailure(key, l.IPThreshold, now)
+
+	return 0, true
+}
+
+// RecordSuccess clears the failure count for an account. The IP counter is
+// kept so one valid login cannot reset guessing against other accounts.
+func (l *LoginLimiter) RecordSuccess(email string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.failures, accountLockoutKey(email))
+}
+
+func (l *LoginLimiter) recordFailure(key string, threshold int, now time.Time) bool {
+	if threshold <= 0 {
+		return false
+	}
+
+	record, ok := l.failures[key]
+	if !ok || now.Sub(record.windowStart) > l.Window {
+		record = &failedLogins{windowStart: now}
+		l.failures[key] = record
+	}
+
+	record.count++
+	if record.count < threshold || now.Before(record.lockedUntil) {
+		return false
+	}
+
+	record.lockedUntil = now.Add(l.LockoutDuration)
+	record.count = 0
+	record.windowStart = now
+
+	return true
+}
+
+func (l *LoginLimiter) sweep(now time.Time) {
+	for key, record := range l.failures {
+		if now.Sub(record.windowStart) > l.Window && !now.Before(record.lockedUntil) {
+			delete(l.failures, key)
+		}
+	}
+}
+
+// clientIP returns the address of the original caller. X-Forwarded-For is
+// only read when the request comes from a trusted proxy such as
+// broker-service, and then the caller is the rightmost hop that no trusted
+// proxy added, so a client cannot choose its own address by sending one.
+func (app *Config) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := host
+	if !app.trustedProxy(net.ParseIP(host)) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop.String()
+		if !app.trustedProxy(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func (app *Config) trustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range app.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseTrustedProxies reads a comma-separated list of CIDRs or single
+// addresses.
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
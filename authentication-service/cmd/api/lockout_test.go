@@ -0,0 +1,255 @@
+// Package main contains tests for login lockouts and inactive account handling.
+package main
+
+import (
+	"authentication-service/data"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// credentialsTestRepository accepts only "correct-password" and reports the
+// configured active flag, so handler tests can exercise failure paths.
+type credentialsTestRepository struct {
+	*data.PostgresTestRepository
+	active int
+}
+
+func (repo credentialsTestRepository) GetByEmail(email string) (*data.User, error) {
+	user, err := repo.PostgresTestRepository.GetByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	user.Active = repo.active
+
+	return user, nil
+}
+
+func (repo credentialsTestRepository) PasswordMatches(plainText string, user data.User) (bool, error) {
+	return plainText == "correct-password", nil
+}
+
+func TestLoginLimiterLocksAccountAfterThreshold(t *testing.T) {
+	limiter := NewLoginLimiter(3, 100, time.Minute, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if locked := limiter.RecordFailure("me@here.com", "10.0.0.1"); len(locked) != 0 {
+			t.Fatalf("expected no lockout after %d failures, got %v", i+1, locked)
+		}
+	}
+
+	locked := limiter.RecordFailure("ME@here.com", "10.0.0.2")
+	if len(locked) != 1 || locked[0] != accountLockoutKey("me@here.com") {
+		t.Fatalf("expected the account to be locked, got %v", locked)
+	}
+
+	if _, isLocked := limiter.Locked("me@here.com", "10.0.0.9"); !isLocked {
+		t.Fatalf("expected account to be locked from any IP")
+	}
+	if _, isLocked := limiter.Locked("other@here.com", "10.0.0.9"); isLocked {
+		t.Fatalf("expected other accounts to be unaffected")
+	}
+
+	limiter.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, isLocked := limiter.Locked("me@here.com", "10.0.0.9"); isLocked {
+		t.Fatalf("expected lockout to expire")
+	}
+}
+
+func TestLoginLimiterLocksIPAcrossAccounts(t *testing.T) {
+	limiter := NewLoginLimiter(100, 3, time.Minute, time.Minute)
+
+	var locked []string
+	for _, email := range []string{"a@here.com", "b@here.com", "c@here.com"} {
+		locked = limiter.RecordFailure(email, "10.0.0.1")
+	}
+
+	if len(locked) != 1 || locked[0] != ipLockoutKey("10.0.0.1") {
+		t.Fatalf("expected the IP to be locked, got %v", locked)
+	}
+	if _, isLocked := limiter.Locked("d@here.com", "10.0.0.1"); !isLocked {
+		t.Fatalf("expected new accounts to be locked from the same IP")
+	}
+}
+
+func TestLoginLimiterSuccessResetsAccountCount(t *testing.T) {
+	limiter := NewLoginLimiter(2, 100, time.Minute, time.Minute)
+
+	limiter.RecordFailure("me@here.com", "10.0.0.1")
+	limiter.RecordSuccess("me@here.com")
+
+	if locked := limiter.RecordFailure("me@here.com", "10.0.0.1"); len(locked) != 0 {
+		t.Fatalf("expected success to reset the account count, got %v", locked)
+	}
+}
+
+func TestLoginLimiterWindowExpiresFailures(t *testing.T) {
+	limiter := NewLoginLimiter(2, 100, time.Minute, time.Minute)
+
+	limiter.RecordFailure("me@here.com", "10.0.0.1")
+	limiter.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+	if locked := limiter.RecordFailure("me@here.com", "10.0.0.1"); len(locked) != 0 {
+		t.Fatalf("expected failures outside the window to be forgotten, got %v", locked)
+	}
+}
+
+func TestHandleAuthenticateLocksOutAfterRepeatedFailures(t *testing.T) {
+	var lockouts []data.AuditEvent
+	app := Config{
+		Repository: credentialsTestRepository{PostgresTestRepository: data.NewPostgresTestRepository(nil), active: 1},
+		Tokens:     NewTokenManager([]byte("test-secret"), 0, 0),
+		Limiter:    NewLoginLimiter(3, 100, time.Minute, time.Minute),
+		HTTPClient: newTestHTTPClient(func(req *http.Request) *http.Response {
+			var entry struct {
+				Name string `json:"name"`
+				Data string `json:"data"`
+			}
+			_ = json.NewDecoder(req.Body).Decode(&entry)
+
+			var event data.AuditEvent
+			_ = json.Unmarshal([]byte(entry.Data), &event)
+			if entry.Name == auditLogName && event.Event == data.AuditEventLockout {
+				lockouts = append(lockouts, event)
+			}
+
+			return &http.Response{
+				StatusCode: http.StatusAccepted,
+				Body:       io.NopCloser(bytes.NewBufferString(`{"error":false}`)),
+				Header:     make(http.Header),
+			}
+		}),
+	}
+
+	app.AuditShipper = app.newAuditShipper(defaultAuditQueueSize)
+
+	for i := 0; i < 3; i++ {
+		rr := authenticateWith(t, &app, "wrong-password")
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status %d on failure %d, got %d", http.StatusUnauthorized, i+1, rr.Code)
+		}
+	}
+
+	app.AuditShipper.Close()
+	if len(lockouts) != 1 || lockouts[0].Reason != errorCodeAccountLocked {
+		t.Fatalf("expected one account lockout audit event, got %+v", lockouts)
+	}
+
+	// even the correct password is refused while the account is locked
+	rr := authenticateWith(t, &app, "correct-password")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected a Retry-After header")
+	}
+
+	response := decodeErrorCode(t, rr)
+	if response != errorCodeAccountLocked {
+		t.Fatalf("expected code %q, got %q", errorCodeAccountLocked, response)
+	}
+}
+
+func TestHandleAuthenticateRejectsInactiveUser(t *testing.T) {
+	app := Config{
+		Repository: credentialsTestRepository{PostgresTestRepository: data.NewPostgresTestRepository(nil), active: 0},
+		Tokens:     NewTokenManager([]byte("test-secret"), 0, 0),
+		Limiter:    NewLoginLimiter(3, 100, time.Minute, time.Minute),
+		HTTPClient: newTestHTTPClient(func(req *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusAccepted,
+				Body:       io.NopCloser(bytes.NewBufferString(`{"error":false}`)),
+				Header:     make(http.Header),
+			}
+		}),
+	}
+
+	rr := authenticateWith(t, &app, "correct-password")
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, rr.Code)
+	}
+	if code := decodeErrorCode(t, rr); code != errorCodeAccountInactive {
+		t.Fatalf("expected code %q, got %q", errorCodeAccountInactive, code)
+	}
+
+	// a wrong password must not reveal that the account is inactive
+	rr = authenticateWith(t, &app, "wrong-password")
+	if code := decodeErrorCode(t, rr); code != errorCodeInvalidCredentials {
+		t.Fatalf("expected code %q, got %q", errorCodeInvalidCredentials, code)
+	}
+}
+
+func TestClientIPHonoursProxyHeadersOnlyFromTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.1, 192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := Config{TrustedProxies: proxies}
+
+	tests := []struct {
+		name      string
+		config    Config
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"no trusted proxies", Config{}, "10.0.0.1:5000", []string{"203.0.113.7"}, "10.0.0.1"},
+		{"caller is not a proxy", trusted, "198.51.100.4:5000", []string{"203.0.113.7"}, "198.51.100.4"},
+		{"forwarded by a proxy", trusted, "10.0.0.1:5000", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"spoofed hop before the client", trusted, "10.0.0.1:5000", []string{"1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{"chain of proxies", trusted, "10.0.0.1:5000", []string{"203.0.113.7", "192.168.1.2"}, "203.0.113.7"},
+		{"only proxies", trusted, "10.0.0.1:5000", []string{"192.168.1.2"}, "192.168.1.2"},
+		{"no header", trusted, "10.0.0.1:5000", nil, "10.0.0.1"},
+		{"malformed hop", trusted, "10.0.0.1:5000", []string{"203.0.113.7, junk"}, "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/authenticate", nil)
+			req.RemoteAddr = tt.remote
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+
+			if ip := tt.config.clientIP(req); ip != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, ip)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesRejectsInvalidEntries(t *testing.T) {
+	if _, err := parseTrustedProxies("10.0.0.1, not-an-ip"); err == nil {
+		t.Fatal("expected an error for an invalid entry")
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Fatal("expected an error for an invalid CIDR")
+	}
+}
+
+func authenticateWith(t *testing.T, app *Config, password string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]string{"email": "me@here.com", "password": password})
+	req := httptest.NewRequest(http.MethodPost, "/authenticate", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+
+	http.HandlerFunc(app.handleAuthenticate).ServeHTTP(rr, req)
+
+	return rr
+}
+
+func decodeErrorCode(t *testing.T, rr *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var response JsonResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+
+	return response.Code
+}
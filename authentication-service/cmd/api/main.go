@@ -3,11 +3,17 @@ package main
 
 import (
 	"authentication-service/data"
+	"crypto/rand"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"time"
 
 	_ "github.com/jackc/pgconn"
@@ -20,18 +26,96 @@ const httpPort = "80"
 const defaultPostgresDSN = "host=postgres port=5432 user=postgres password=password dbname=users sslmode=disable timezone=UTC connect_timeout=5"
 const defaultLoggerServiceURL = "http://logger-service/log"
 
+const (
+	repositoryDriverPostgres = "postgres"
+	repositoryDriverMemory   = "memory"
+)
+
 type Config struct {
 	Repository       data.Repository
 	HTTPClient       *http.Client
 	LoggerServiceURL string
+	MailServiceURL   string
+	PasswordResetURL string
+	PasswordResetTTL time.Duration
+	Tokens           *TokenManager
+	TOTPIssuer       string
+	PasswordPolicy   *data.PasswordPolicy
+
+	// EmailVerification is the allow, restrict or require policy for users
+	// who have not verified their address.
+	EmailVerification    string
+	EmailVerificationURL string
+	EmailVerificationTTL time.Duration
+
+	Limiter *LoginLimiter
+
+	// TrustedProxies are the networks whose X-Forwarded-For header names
+	// the client, such as broker-service's address.
+	TrustedProxies []*net.IPNet
+
+	// AuditShipper sends audit events to logger-service; without one they
+	// are only stored.
+	AuditShipper *AuditShipper
+
+	// OIDCIssuer is the public base URL of the OpenID Connect provider.
+	OIDCIssuer         string
+	OIDCClients        map[string]OIDCClient
+	SigningKeys        *SigningKeys
+	AuthorizationCodes *AuthorizationCodes
 }
 
 func main() {
+	var command string
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	// as authctl the binary is only an admin tool
+	if filepath.Base(os.Args[0]) == authctlName && !slices.Contains(authctlCommands, command) {
+		fmt.Fprintln(os.Stderr, authctlUsage)
+		os.Exit(2)
+	}
+
+	if command == "breached-passwords" {
+		if err := runBreachedPasswordsCommand(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+		return
+	}
+
+	repositoryDriver := getenv("REPOSITORY_DRIVER", repositoryDriverPostgres)
+	administering := command == "migrate" || command == "user"
+
+	var conn *sql.DB
+	if repositoryDriver == repositoryDriverPostgres || administering {
+		conn = connectToPostgres()
+		if conn == nil {
+			log.Panic("Can't connect to database")
+		}
+		defer conn.Close()
+	}
+
+	switch command {
+	case "migrate":
+		if err := runMigrateCommand(conn, os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+		return
+	case "user":
+		if err := runUserCommand(conn, os.Args[2:]); err != nil {
+			conn.Close()
+			log.Fatal(err)
+		}
+		return
+	}
+
 	log.Println("Starting authentication service")
 
-	conn := connectToPostgres()
-	if conn == nil {
-		log.Panic("Can't connect to database")
+	if conn != nil && getenv("MIGRATE_ON_START", "true") == "true" {
+		if err := migrateOnStart(conn); err != nil {
+			log.Panic(err)
+		}
 	}
 
 	app := Config{
@@ -39,9 +123,34 @@ func main() {
 			Timeout: 5 * time.Second,
 		},
 		LoggerServiceURL: getenv("LOGGER_SERVICE_URL", defaultLoggerServiceURL),
+		MailServiceURL:   getenv("MAIL_SERVICE_URL", defaultMailServiceURL),
+		PasswordResetURL: getenv("PASSWORD_RESET_URL", defaultPasswordResetURL),
+		PasswordResetTTL: getenvDuration("PASSWORD_RESET_TTL", defaultPasswordResetTTL),
+		Tokens:           tokenManagerFromEnv(),
+		TOTPIssuer:       getenv("TOTP_ISSUER", defaultTOTPIssuer),
+		Limiter:          loginLimiterFromEnv(),
+
+		EmailVerification:    emailVerificationFromEnv(),
+		EmailVerificationURL: getenv("EMAIL_VERIFICATION_URL", defaultEmailVerificationURL),
+		EmailVerificationTTL: getenvDuration("EMAIL_VERIFICATION_TTL", defaultEmailVerificationTTL),
+
+		TrustedProxies: trustedProxiesFromEnv(),
+
+		OIDCIssuer:         getenv("OIDC_ISSUER", defaultOIDCIssuer),
+		OIDCClients:        oidcClientsFromEnv(),
+		SigningKeys:        NewSigningKeys(getenvDuration("OIDC_KEY_ROTATION", defaultSigningKeyRotation)),
+		AuthorizationCodes: NewAuthorizationCodes(),
+	}
+	if err := app.setupRepository(repositoryDriver, conn); err != nil {
+		log.Panic(err)
 	}
-	app.setupRepository(conn)
-	defer conn.Close()
+	app.AuditShipper = app.newAuditShipper(getenvInt("AUDIT_QUEUE_SIZE", defaultAuditQueueSize))
+
+	go func() {
+		if err := app.listenGRPC(); err != nil {
+			log.Panic(err)
+		}
+	}()
 
 	server := &http.Server{
 		Addr:              fmt.Sprintf(":%s", httpPort),
@@ -102,6 +211,142 @@ func getenv(key, fallback string) string {
 	return value
 }
 
-func (app *Config) setupRepository(conn *sql.DB) {
-	app.Repository = data.NewPostgresRepository(conn)
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+
+	return value
+}
+
+func getenvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+func tokenManagerFromEnv() *TokenManager {
+	secret := []byte(os.Getenv("TOKEN_SECRET"))
+	if len(secret) == 0 {
+		log.Println("TOKEN_SECRET is not set; generating an ephemeral signing secret")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	return NewTokenManager(
+		secret,
+		getenvDuration("ACCESS_TOKEN_TTL", defaultAccessTokenTTL),
+		getenvDuration("REFRESH_TOKEN_TTL", defaultRefreshTokenTTL),
+	)
+}
+
+func loginLimiterFromEnv() *LoginLimiter {
+	return NewLoginLimiter(
+		getenvInt("LOCKOUT_ACCOUNT_THRESHOLD", defaultAccountLockoutThreshold),
+		getenvInt("LOCKOUT_IP_THRESHOLD", defaultIPLockoutThreshold),
+		getenvDuration("LOCKOUT_WINDOW", defaultLockoutWindow),
+		getenvDuration("LOCKOUT_DURATION", defaultLockoutDuration),
+	)
+}
+
+func trustedProxiesFromEnv() []*net.IPNet {
+	networks, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Panicf("invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	return networks
+}
+
+func emailVerificationFromEnv() string {
+	policy := getenv("EMAIL_VERIFICATION", emailVerificationAllow)
+	switch policy {
+	case emailVerificationAllow, emailVerificationRestrict, emailVerificationRequire:
+		return policy
+	default:
+		log.Panicf("unknown EMAIL_VERIFICATION %q; use allow, restrict or require", policy)
+		return ""
+	}
+}
+
+// oidcClientsFromEnv reads the OpenID Connect clients from OIDC_CLIENTS, a
+// JSON array of {"client_id", "name", "client_secret", "redirect_uris"}.
+func oidcClientsFromEnv() map[string]OIDCClient {
+	clients := map[string]OIDCClient{}
+
+	value := os.Getenv("OIDC_CLIENTS")
+	if value == "" {
+		return clients
+	}
+
+	var list []OIDCClient
+	if err := json.Unmarshal([]byte(value), &list); err != nil {
+		log.Panicf("invalid OIDC_CLIENTS: %v", err)
+	}
+	for _, client := range list {
+		if client.ID == "" || len(client.RedirectURIs) == 0 {
+			log.Panicf("invalid OIDC_CLIENTS: every client needs a client_id and redirect_uris")
+		}
+		clients[client.ID] = client
+	}
+
+	return clients
+}
+
+// passwordHasherFromEnv configures how new passwords are hashed. Existing
+// hashes made with other settings are upgraded when their owners log in.
+func passwordHasherFromEnv() (*data.PasswordHasher, error) {
+	hasher := data.NewPasswordHasher()
+	hasher.Algorithm = getenv("PASSWORD_HASH_ALGORITHM", hasher.Algorithm)
+	hasher.BcryptCost = getenvInt("BCRYPT_COST", hasher.BcryptCost)
+	hasher.Argon2id.Memory = uint32(getenvInt("ARGON2_MEMORY_KIB", int(hasher.Argon2id.Memory)))
+	hasher.Argon2id.Iterations = uint32(getenvInt("ARGON2_ITERATIONS", int(hasher.Argon2id.Iterations)))
+	hasher.Argon2id.Parallelism = uint8(getenvInt("ARGON2_PARALLELISM", int(hasher.Argon2id.Parallelism)))
+
+	// hashing once surfaces bad settings at startup instead of on first login
+	if _, err := hasher.Hash("startup-check"); err != nil {
+		return nil, fmt.Errorf("invalid password hashing settings: %w", err)
+	}
+
+	return hasher, nil
+}
+
+// setupRepository selects the storage backend named by REPOSITORY_DRIVER.
+func (app *Config) setupRepository(driver string, conn *sql.DB) error {
+	hasher, err := passwordHasherFromEnv()
+	if err != nil {
+		return err
+	}
+	policy, err := passwordPolicyFromEnv()
+	if err != nil {
+		return err
+	}
+	// a password the hasher cannot take is a validation error, not a 500
+	policy.MaxBytes = hasher.MaxPasswordBytes()
+	// handlers check the same policy first to report violations per field
+	app.PasswordPolicy = policy
+
+	switch driver {
+	case repositoryDriverPostgres:
+		repo := data.NewPostgresRepository(conn)
+		repo.Hasher = hasher
+		repo.Policy = policy
+		app.Repository = repo
+	case repositoryDriverMemory:
+		log.Println("Using the in-memory repository; data will be lost on restart")
+		repo := data.NewMemoryRepository()
+		repo.Hasher = hasher
+		repo.Policy = policy
+		app.Repository = repo
+	default:
+		return fmt.Errorf("unknown REPOSITORY_DRIVER %q", driver)
+	}
+
+	return nil
 }
@@ -0,0 +1,78 @@
+// Package main contains authentication-service HTTP middleware.
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+var errPermissionDenied = errors.New("permission denied")
+
+// requireAccessToken rejects requests without a valid bearer access token or
+// whose session was revoked, and stores the verified claims in the request
+// context. OIDC access tokens are refused.
+func (app *Config) requireAccessToken(next http.Handler) http.Handler {
+	return app.requireBearerToken(tokenTypeAccess)(next)
+}
+
+// requireOIDCAccessToken is requireAccessToken for the OIDC access tokens
+// issued to relying parties, which are good for nothing but userinfo.
+func (app *Config) requireOIDCAccessToken(next http.Handler) http.Handler {
+	return app.requireBearerToken(tokenTypeOIDCAccess)(next)
+}
+
+func (app *Config) requireBearerToken(tokenType string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := bearerToken(r)
+			if !ok {
+				_ = app.writeErrorJSON(w, errors.New("missing bearer token"), http.StatusUnauthorized)
+				return
+			}
+
+			claims, err := app.Tokens.Verify(token, tokenType)
+			if err != nil {
+				_ = app.writeErrorJSON(w, err, http.StatusUnauthorized)
+				return
+			}
+			if err := app.checkSession(claims); err != nil {
+				app.writeSessionError(w, err)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// requirePermission rejects callers whose access token does not grant
+// permission. It must run after requireAccessToken.
+func (app *Config) requirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := claimsFromContext(r.Context())
+			if !ok {
+				_ = app.writeErrorJSON(w, errors.New("missing bearer token"), http.StatusUnauthorized)
+				return
+			}
+			if !claims.HasPermission(permission) {
+				_ = app.writeErrorJSON(w, errPermissionDenied, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// claimsFromContext returns the claims stored by requireAccessToken.
+func claimsFromContext(ctx context.Context) (TokenClaims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(TokenClaims)
+	return claims, ok
+}
@@ -0,0 +1,120 @@
+// Package main runs schema migrations at startup and via the migrate subcommand.
+package main
+
+import (
+	"authentication-service/data"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+const migrationTimeout = 2 * time.Minute
+
+const migrateUsage = "usage: authApp migrate [up | down [steps] | version]"
+
+// migrateCommand is a parsed migrate subcommand.
+type migrateCommand struct {
+	Action string
+	Steps  int
+}
+
+func parseMigrateArgs(args []string) (migrateCommand, error) {
+	if len(args) == 0 {
+		return migrateCommand{Action: "up"}, nil
+	}
+
+	switch args[0] {
+	case "up", "version":
+		if len(args) > 1 {
+			return migrateCommand{}, errors.New(migrateUsage)
+		}
+		return migrateCommand{Action: args[0]}, nil
+	case "down":
+		command := migrateCommand{Action: "down", Steps: 1}
+		if len(args) > 2 {
+			return migrateCommand{}, errors.New(migrateUsage)
+		}
+		if len(args) == 2 {
+			steps, err := strconv.Atoi(args[1])
+			if err != nil || steps <= 0 {
+				return migrateCommand{}, errors.New(migrateUsage)
+			}
+			command.Steps = steps
+		}
+		return command, nil
+	default:
+		return migrateCommand{}, errors.New(migrateUsage)
+	}
+}
+
+// runMigrateCommand handles `authApp migrate ...`.
+func runMigrateCommand(conn *sql.DB, args []string) error {
+	command, err := parseMigrateArgs(args)
+	if err != nil {
+		return err
+	}
+
+	migrator, err := data.NewMigrator(conn)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+
+	switch command.Action {
+	case "down":
+		reverted, err := migrator.Down(ctx, command.Steps)
+		for _, migration := range reverted {
+			log.Printf("Reverted migration %d_%s", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(reverted) == 0 {
+			log.Println("No migrations to revert")
+		}
+	case "version":
+		version, err := migrator.Version(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println(version)
+	default:
+		return migrateUp(ctx, migrator)
+	}
+
+	return nil
+}
+
+// migrateOnStart brings the schema up to date before the service accepts traffic.
+func migrateOnStart(conn *sql.DB) error {
+	migrator, err := data.NewMigrator(conn)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+
+	return migrateUp(ctx, migrator)
+}
+
+func migrateUp(ctx context.Context, migrator *data.Migrator) error {
+	applied, err := migrator.Up(ctx)
+	for _, migration := range applied {
+		log.Printf("Applied migration %d_%s", migration.Version, migration.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		log.Println("Schema is up to date")
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+// Package main verifies argument parsing for the migrate subcommand.
+package main
+
+import "testing"
+
+func TestParseMigrateArgs(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          []string
+		expected      migrateCommand
+		expectedError bool
+	}{
+		{name: "defaults to up", args: nil, expected: migrateCommand{Action: "up"}},
+		{name: "up", args: []string{"up"}, expected: migrateCommand{Action: "up"}},
+		{name: "version", args: []string{"version"}, expected: migrateCommand{Action: "version"}},
+		{name: "down defaults to one step", args: []string{"down"}, expected: migrateCommand{Action: "down", Steps: 1}},
+		{name: "down with steps", args: []string{"down", "3"}, expected: migrateCommand{Action: "down", Steps: 3}},
+		{name: "down with invalid steps", args: []string{"down", "zero"}, expectedError: true},
+		{name: "down with negative steps", args: []string{"down", "-1"}, expectedError: true},
+		{name: "unknown action", args: []string{"sideways"}, expectedError: true},
+		{name: "extra arguments", args: []string{"up", "now"}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, err := parseMigrateArgs(tt.args)
+
+			if tt.expectedError {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", command)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if command != tt.expected {
+				t.Fatalf("expected %+v, got %+v", tt.expected, command)
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+// Package main implements a minimal OpenID Connect provider so internal apps
+// can use authentication-service to log users in.
+package main
+
+import (
+	"authentication-service/data"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOIDCIssuer    = "http://localhost:8081"
+	authorizationCodeTTL = time.Minute
+
+	oidcScopeOpenID  = "openid"
+	oidcScopeEmail   = "email"
+	oidcScopeProfile = "profile"
+
+	pkceMethodS256 = "S256"
+)
+
+var oidcScopes = []string{oidcScopeOpenID, oidcScopeEmail, oidcScopeProfile}
+
+// OAuth 2.0 error codes, RFC 6749 section 5.2.
+const (
+	oauthErrorInvalidRequest       = "invalid_request"
+	oauthErrorInvalidClient        = "invalid_client"
+	oauthErrorInvalidGrant         = "invalid_grant"
+	oauthErrorInvalidScope         = "invalid_scope"
+	oauthErrorUnsupportedGrantType = "unsupported_grant_type"
+	oauthErrorUnsupportedResponse  = "unsupported_response_type"
+	oauthErrorInsufficientScope    = "insufficient_scope"
+)
+
+// OIDCClient is an app allowed to use this service as its login provider.
+// Clients without a secret are public and rely on PKCE alone.
+type OIDCClient struct {
+	ID           string   `json:"client_id"`
+	Name         string   `json:"name"`
+	Secret       string   `json:"client_secret"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// oidcDiscovery is served at /.well-known/openid-configuration.
+type oidcDiscovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// oidcUserInfo holds the standard claims about a user that a client's
+// scopes allow it to see.
+type oidcUserInfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	GivenName     string `json:"given_name,omitempty"`
+	FamilyName    string `json:"family_name,omitempty"`
+}
+
+// idTokenClaims is the payload of an ID token.
+type idTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	AuthTime  int64  `json:"auth_time"`
+	Nonce     string `json:"nonce,omitempty"`
+	oidcUserInfo
+}
+
+// oidcTokenResponse is returned by the token endpoint.
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// authorizationCode is what a code issued by the authorize endpoint stands for.
+type authorizationCode struct {
+	ClientID      string
+	RedirectURI   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	UserID        int
+	SessionID     string
+	AuthTime      time.Time
+	ExpiresAt     time.Time
+}
+
+// AuthorizationCodes holds issued authorization codes until they are
+// exchanged or expire. Like LoginLimiter it is kept in memory, so codes do
+// not survive a restart and are not shared between replicas.
+type AuthorizationCodes struct {
+	mu    sync.Mutex
+	codes map[string]authorizationCode
+	now   func() time.Time
+}
+
+func NewAuthorizationCodes() *AuthorizationCodes {
+	return &AuthorizationCodes{
+		codes: make(map[string]authorizationCode),
+		now:   time.Now,
+	}
+}
+
+// Issue stores grant and returns the code that redeems it. Only a hash of
+// the code is kept.
+func (ac *AuthorizationCodes) Issue(grant authorizationCode) (string, error) {
+	code, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	now := ac.now()
+	for hash, stored := range ac.codes {
+		if !now.Before(stored.ExpiresAt) {
+			delete(ac.codes, hash)
+		}
+	}
+
+	grant.ExpiresAt = now.Add(authorizationCodeTTL)
+	ac.codes[hashResetToken(code)] = grant
+
+	return code, nil
+}
+
+// Consume redeems code once. Unknown, used and expired codes are refused.
+func (ac *AuthorizationCodes) Consume(code string) (authorizationCode, bool) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	hash := hashResetToken(code)
+	grant, ok := ac.codes[hash]
+	if !ok {
+		return authorizationCode{}, false
+	}
+	delete(ac.codes, hash)
+
+	if !ac.now().Before(grant.ExpiresAt) {
+		return authorizationCode{}, false
+	}
+
+	return grant, true
+}
+
+// handleOIDCDiscovery describes the provider to relying parties.
+func (app *Config) handleOIDCDiscovery(w http.ResponseWriter, r *http.Request) {
+	issuer := app.oidcIssuer()
+
+	_ = app.writeJSON(w, http.StatusOK, oidcDiscovery{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oauth/authorize",
+		TokenEndpoint:                     issuer + "/oauth/token",
+		UserInfoEndpoint:                  issuer + "/oauth/userinfo",
+		JWKSURI:                           issuer + "/.well-known/jwks.json",
+		ScopesSupported:                   oidcScopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		TokenEndpointAuthMethodsSupported: []string{"none", "client_secret_basic", "client_secret_post"},
+		CodeChallengeMethodsSupported:     []string{pkceMethodS256},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified", "name", "given_name", "family_name"},
+	})
+}
+
+// handleJWKS publishes the public keys ID tokens are signed with.
+func (app *Config) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	set, err := app.SigningKeys.JWKS()
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, set)
+}
+
+// handleOIDCToken exchanges an authorization code and its PKCE verifier for
+// an access token and an ID token.
+func (app *Config) handleOIDCToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		app.writeOAuthError(w, http.StatusBadRequest, oauthErrorInvalidRequest, "the request body could not be parsed")
+		return
+	}
+
+	client, ok := app.authenticateOIDCClient(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		app.writeOAuthError(w, http.StatusUnauthorized, oauthErrorInvalidClient, "client authentication failed")
+		return
+	}
+
+	if grantType := r.PostForm.Get("grant_type"); grantType != "authorization_code" {
+		app.writeOAuthError(w, http.StatusBadRequest, oauthErrorUnsupportedGrantType, "only authorization_code is supported")
+		return
+	}
+
+	grant, ok := app.AuthorizationCodes.Consume(r.PostForm.Get("code"))
+	if !ok || grant.ClientID != client.ID || grant.RedirectURI != r.PostForm.Get("redirect_uri") {
+		app.writeOAuthError(w, http.StatusBadRequest, oauthErrorInvalidGrant, "the authorization code is invalid or has expired")
+		return
+	}
+	if !verifyPKCE(grant.CodeChallenge, r.PostForm.Get("code_verifier")) {
+		app.writeOAuthError(w, http.StatusBadRequest, oauthErrorInvalidGrant, "code_verifier does not match the code challenge")
+		return
+	}
+
+	user, err := app.Repository.GetOne(grant.UserID)
+	if err != nil || user.Active == 0 {
+		app.writeOAuthError(w, http.StatusBadRequest, oauthErrorInvalidGrant, "the user can no longer log in")
+		return
+	}
+	if err := app.checkSession(TokenClaims{Subject: strconv.Itoa(user.ID), SessionID: grant.SessionID}); err != nil {
+		app.writeOAuthError(w, http.StatusBadRequest, oauthErrorInvalidGrant, "the login session has been revoked")
+		return
+	}
+
+	accessToken, err := app.Tokens.IssueOIDCAccess(*user, grant.SessionID, grant.Scope)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	now := time.Now()
+	idToken, err := app.SigningKeys.Sign(idTokenClaims{
+		Issuer:       app.oidcIssuer(),
+		Audience:     client.ID,
+		ExpiresAt:    now.Add(app.Tokens.AccessTTL).Unix(),
+		IssuedAt:     now.Unix(),
+		AuthTime:     grant.AuthTime.Unix(),
+		Nonce:        grant.Nonce,
+		oidcUserInfo: userInfoFor(user, grant.Scope),
+	})
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	headers := http.Header{}
+	headers.Set("Cache-Control", "no-store")
+	headers.Set("Pragma", "no-cache")
+
+	_ = app.writeJSON(w, http.StatusOK, oidcTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(app.Tokens.AccessTTL / time.Second),
+		IDToken:     idToken,
+		Scope:       grant.Scope,
+	}, headers)
+}
+
+// handleOIDCUserInfo returns the claims the caller's OIDC access token was
+// granted. It must run after requireOIDCAccessToken.
+func (app *Config) handleOIDCUserInfo(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+	if !hasScope(claims.Scope, oidcScopeOpenID) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		app.writeOAuthError(w, http.StatusForbidden, oauthErrorInsufficientScope, "the access token was not issued for openid")
+		return
+	}
+
+	// requireOIDCAccessToken has checked the session, which every OIDC
+	// access token is issued in, so one without a session is refused
+	userID, err := claims.UserID()
+	if err != nil || claims.SessionID == "" {
+		_ = app.writeErrorJSON(w, errInvalidToken, http.StatusUnauthorized)
+		return
+	}
+
+	// the account may have been deactivated since the token was issued
+	user, err := app.Repository.GetOne(userID)
+	if err != nil || user.Active == 0 {
+		_ = app.writeErrorJSON(w, errInvalidToken, http.StatusUnauthorized)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, userInfoFor(user, claims.Scope))
+}
+
+// authenticateOIDCClient identifies the client calling the token endpoint,
+// from HTTP basic auth or the request body. Confidential clients must also
+// present their secret.
+func (app *Config) authenticateOIDCClient(r *http.Request) (OIDCClient, bool) {
+	clientID, secret, basic := r.BasicAuth()
+	if !basic {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, ok := app.OIDCClients[clientID]
+	if !ok {
+		return OIDCClient{}, false
+	}
+	if client.Secret != "" && subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1 {
+		return OIDCClient{}, false
+	}
+
+	return client, true
+}
+
+// userInfoFor returns the claims about user that scope allows.
+func userInfoFor(user *data.User, scope string) oidcUserInfo {
+	info := oidcUserInfo{Subject: strconv.Itoa(user.ID)}
+
+	if hasScope(scope, oidcScopeEmail) {
+		verified := user.EmailVerified()
+		info.Email = user.Email
+		info.EmailVerified = &verified
+	}
+	if hasScope(scope, oidcScopeProfile) {
+		info.GivenName = user.FirstName
+		info.FamilyName = user.LastName
+		info.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+	}
+
+	return info
+}
+
+// verifyPKCE checks verifier against an S256 code challenge, RFC 7636.
+func verifyPKCE(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// hasScope reports whether the space-separated scope list includes scope.
+func hasScope(scopes, scope string) bool {
+	return slices.Contains(strings.Fields(scopes), scope)
+}
+
+// supportedScopes drops the scopes this provider does not know from a
+// space-separated list, so tokens only carry scopes it can honour.
+func supportedScopes(scopes string) string {
+	var supported []string
+	for _, scope := range strings.Fields(scopes) {
+		if slices.Contains(oidcScopes, scope) && !slices.Contains(supported, scope) {
+			supported = append(supported, scope)
+		}
+	}
+
+	return strings.Join(supported, " ")
+}
+
+// writeOAuthError responds with an RFC 6749 error body, which OAuth client
+// libraries expect instead of this service's usual JSON envelope.
+func (app *Config) writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	_ = app.writeJSON(w, status, struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{code, description})
+}
+
+func (app *Config) oidcIssuer() string {
+	if app.OIDCIssuer == "" {
+		return defaultOIDCIssuer
+	}
+
+	return strings.TrimSuffix(app.OIDCIssuer, "/")
+}
@@ -0,0 +1,330 @@
+// Package main implements the OpenID Connect authorize endpoint and its login page.
+package main
+
+import (
+	"authentication-service/data"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+//go:embed templates/authorize.page.gohtml
+var authorizeTemplateFS embed.FS
+
+var authorizeTemplate = template.Must(template.ParseFS(authorizeTemplateFS, "templates/authorize.page.gohtml"))
+
+// errUnknownOIDCClient is shown on the page, rather than sent back to the
+// client, when the client or redirect URI of a request cannot be trusted.
+var errUnknownOIDCClient = errors.New("unknown client_id or redirect_uri")
+
+// authorizeRequest holds the parameters of an authorization request. They
+// are carried through the login form as hidden fields.
+type authorizeRequest struct {
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// authorizeError is an OAuth error sent back to the client's redirect URI.
+type authorizeError struct {
+	Code        string
+	Description string
+}
+
+// authorizePage is the data rendered by the login page.
+type authorizePage struct {
+	ClientName     string
+	Fields         map[string]string
+	Email          string
+	ChallengeToken string
+	Error          string
+	ShowForm       bool
+}
+
+func authorizeRequestFrom(form url.Values) authorizeRequest {
+	return authorizeRequest{
+		ClientID:            form.Get("client_id"),
+		RedirectURI:         form.Get("redirect_uri"),
+		ResponseType:        form.Get("response_type"),
+		Scope:               form.Get("scope"),
+		State:               form.Get("state"),
+		Nonce:               form.Get("nonce"),
+		CodeChallenge:       form.Get("code_challenge"),
+		CodeChallengeMethod: form.Get("code_challenge_method"),
+	}
+}
+
+func (req authorizeRequest) fields() map[string]string {
+	return map[string]string{
+		"client_id":             req.ClientID,
+		"redirect_uri":          req.RedirectURI,
+		"response_type":         req.ResponseType,
+		"scope":                 req.Scope,
+		"state":                 req.State,
+		"nonce":                 req.Nonce,
+		"code_challenge":        req.CodeChallenge,
+		"code_challenge_method": req.CodeChallengeMethod,
+	}
+}
+
+// handleAuthorize starts an authorization-code login by showing the login page.
+func (app *Config) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	req := authorizeRequestFrom(r.URL.Query())
+
+	client, ok := app.checkAuthorizeRequest(w, r, req)
+	if !ok {
+		return
+	}
+
+	app.renderAuthorizePage(w, http.StatusOK, client, req, authorizePage{})
+}
+
+// handleAuthorizeLogin checks the credentials posted from the login page,
+// then the second factor if the account has one, and redirects back to the
+// client with an authorization code.
+func (app *Config) handleAuthorizeLogin(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		app.renderAuthorizeError(w, http.StatusBadRequest, err)
+		return
+	}
+	req := authorizeRequestFrom(r.PostForm)
+
+	client, ok := app.checkAuthorizeRequest(w, r, req)
+	if !ok {
+		return
+	}
+
+	if challengeToken := r.PostForm.Get("challenge_token"); challengeToken != "" {
+		app.authorizeSecondFactor(w, r, client, req, challengeToken)
+		return
+	}
+
+	email := strings.TrimSpace(r.PostForm.Get("email"))
+	page := authorizePage{Email: email}
+
+	user, err := app.checkCredentials(r, email, r.PostForm.Get("password"))
+	if err != nil {
+		var refused *loginError
+		if !errors.As(err, &refused) {
+			app.renderAuthorizeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		page.Error = loginErrorMessage(refused)
+		app.renderAuthorizePage(w, refused.Status, client, req, page)
+		return
+	}
+
+	secondFactor, err := app.requiresSecondFactor(user)
+	if err != nil {
+		app.renderAuthorizeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if secondFactor {
+		page.ChallengeToken, err = app.Tokens.IssueChallenge(*user)
+		if err != nil {
+			app.renderAuthorizeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		app.renderAuthorizePage(w, http.StatusOK, client, req, page)
+		return
+	}
+	app.Limiter.RecordSuccess(email)
+
+	app.authorizeUser(w, r, client, req, user)
+}
+
+// authorizeSecondFactor finishes a login whose password was accepted by
+// checking a TOTP or recovery code against the challenge token.
+func (app *Config) authorizeSecondFactor(w http.ResponseWriter, r *http.Request, client OIDCClient, req authorizeRequest, challengeToken string) {
+	claims, err := app.Tokens.Verify(challengeToken, tokenTypeChallenge)
+	if err != nil {
+		app.renderAuthorizePage(w, http.StatusUnauthorized, client, req, authorizePage{Error: "The login took too long. Please start again."})
+		return
+	}
+
+	page := authorizePage{Email: claims.Email, ChallengeToken: challengeToken}
+
+	userID, err := claims.UserID()
+	if err != nil {
+		app.renderAuthorizeError(w, http.StatusUnauthorized, errInvalidToken)
+		return
+	}
+
+	if retryAfter, locked := app.Limiter.Locked(claims.Email, app.clientIP(r)); locked {
+		app.audit(r, data.AuditEvent{UserID: userID, Email: claims.Email, Event: data.AuditEventSecondFactor, Outcome: data.AuditOutcomeFailure, Reason: errorCodeAccountLocked})
+		page.Error = lockedOutMessage(retryAfter)
+		app.renderAuthorizePage(w, http.StatusTooManyRequests, client, req, page)
+		return
+	}
+	user, err := app.Repository.GetOne(userID)
+	if err != nil || user.Active == 0 {
+		app.renderAuthorizePage(w, http.StatusForbidden, client, req, authorizePage{Error: "This account has been deactivated."})
+		return
+	}
+
+	code := strings.TrimSpace(r.PostForm.Get("code"))
+	if len(code) == totpDigits {
+		err = app.checkSecondFactor(r, user, code, "")
+	} else {
+		err = app.checkSecondFactor(r, user, "", code)
+	}
+	if errors.Is(err, errInvalidSecondFactor) {
+		app.recordLoginFailure(r, data.AuditEvent{UserID: user.ID, Email: claims.Email, Event: data.AuditEventSecondFactor, Reason: errorCodeInvalidSecondFactor})
+		page.Error = "That code is not valid. Please try again."
+		app.renderAuthorizePage(w, http.StatusUnauthorized, client, req, page)
+		return
+	}
+	if err != nil {
+		app.renderAuthorizeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	app.Limiter.RecordSuccess(claims.Email)
+
+	app.authorizeUser(w, r, client, req, user)
+}
+
+// authorizeUser starts a session for a logged-in user and redirects back to
+// the client with an authorization code for it.
+func (app *Config) authorizeUser(w http.ResponseWriter, r *http.Request, client OIDCClient, req authorizeRequest, user *data.User) {
+	app.auditUser(r, user, data.AuditEventLogin, data.AuditOutcomeSuccess, "")
+
+	sessionID, err := app.startSession(r, user)
+	if err != nil {
+		app.renderAuthorizeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	code, err := app.AuthorizationCodes.Issue(authorizationCode{
+		ClientID:      client.ID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         supportedScopes(req.Scope),
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		UserID:        user.ID,
+		SessionID:     sessionID,
+		AuthTime:      time.Now(),
+	})
+	if err != nil {
+		app.renderAuthorizeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	redirectToClient(w, r, req, url.Values{"code": {code}})
+}
+
+// checkAuthorizeRequest validates req. Requests from unknown clients or to
+// unregistered redirect URIs are refused on the page, since redirecting them
+// could leak to an attacker; other problems are sent back to the client. It
+// reports whether the request may continue.
+func (app *Config) checkAuthorizeRequest(w http.ResponseWriter, r *http.Request, req authorizeRequest) (OIDCClient, bool) {
+	client, ok := app.OIDCClients[req.ClientID]
+	if !ok || !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		app.renderAuthorizeError(w, http.StatusBadRequest, errUnknownOIDCClient)
+		return OIDCClient{}, false
+	}
+
+	var problem *authorizeError
+	switch {
+	case req.ResponseType != "code":
+		problem = &authorizeError{oauthErrorUnsupportedResponse, "only the code response type is supported"}
+	case !hasScope(req.Scope, oidcScopeOpenID):
+		problem = &authorizeError{oauthErrorInvalidScope, "scope must include openid"}
+	case req.CodeChallenge == "":
+		problem = &authorizeError{oauthErrorInvalidRequest, "code_challenge is required"}
+	case req.CodeChallengeMethod != pkceMethodS256:
+		problem = &authorizeError{oauthErrorInvalidRequest, "code_challenge_method must be S256"}
+	}
+	if problem != nil {
+		redirectToClient(w, r, req, url.Values{"error": {problem.Code}, "error_description": {problem.Description}})
+		return OIDCClient{}, false
+	}
+
+	return client, true
+}
+
+func (app *Config) renderAuthorizePage(w http.ResponseWriter, status int, client OIDCClient, req authorizeRequest, page authorizePage) {
+	page.ClientName = client.Name
+	if page.ClientName == "" {
+		page.ClientName = client.ID
+	}
+	page.Fields = req.fields()
+	page.ShowForm = true
+
+	app.writeAuthorizePage(w, status, page)
+}
+
+func (app *Config) renderAuthorizeError(w http.ResponseWriter, status int, err error) {
+	message := "Something went wrong. Please try again later."
+	if status < http.StatusInternalServerError {
+		message = "This login request is not valid: " + err.Error() + "."
+	} else {
+		log.Println("Error during authorization:", err)
+	}
+
+	app.writeAuthorizePage(w, status, authorizePage{Error: message})
+}
+
+func (app *Config) writeAuthorizePage(w http.ResponseWriter, status int, page authorizePage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// the page collects passwords, so it must not be framed by other sites
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(status)
+
+	if err := authorizeTemplate.Execute(w, page); err != nil {
+		log.Println("Error rendering authorize page:", err)
+	}
+}
+
+// redirectToClient sends the browser back to the client's redirect URI with
+// params and the request's state.
+func redirectToClient(w http.ResponseWriter, r *http.Request, req authorizeRequest, params url.Values) {
+	target, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		http.Error(w, errUnknownOIDCClient.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := target.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	target.RawQuery = query.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func lockedOutMessage(retryAfter time.Duration) string {
+	return fmt.Sprintf("Too many failed login attempts. Try again in %d seconds.", int(math.Ceil(retryAfter.Seconds())))
+}
+
+// loginErrorMessage is what the login page shows for a refused login.
+func loginErrorMessage(refused *loginError) string {
+	switch refused.Code {
+	case errorCodeAccountLocked:
+		return lockedOutMessage(refused.RetryAfter)
+	case errorCodeAccountInactive:
+		return "This account has been deactivated."
+	case errorCodeEmailUnverified:
+		return "Verify your email address before logging in."
+	default:
+		return "Invalid email or password."
+	}
+}
@@ -0,0 +1,585 @@
+// Package main contains tests for the OpenID Connect provider.
+package main
+
+import (
+	"authentication-service/data"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testOIDCRedirectURI = "https://notes.example/callback"
+	testOIDCSecret      = "notes-secret"
+	testCodeVerifier    = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk-verifier"
+)
+
+var challengeTokenPattern = regexp.MustCompile(`name="challenge_token" value="([^"]+)"`)
+
+// newOIDCTestApp returns an app with a confidential client "notes" and a
+// public client "spa", and a user me@here.com.
+func newOIDCTestApp(t *testing.T) (*Config, *data.MemoryRepository, int) {
+	t.Helper()
+
+	app, repo := newRolesTestApp(t)
+	app.OIDCIssuer = "https://auth.example/"
+	app.OIDCClients = map[string]OIDCClient{
+		"notes": {ID: "notes", Name: "Notes", Secret: testOIDCSecret, RedirectURIs: []string{testOIDCRedirectURI}},
+		"spa":   {ID: "spa", RedirectURIs: []string{"https://spa.example/"}},
+	}
+	app.SigningKeys = NewSigningKeys(time.Hour)
+	app.AuthorizationCodes = NewAuthorizationCodes()
+
+	id, _ := repo.Insert(data.User{Email: "me@here.com", FirstName: "Jo", LastName: "Bloggs", Password: "long-enough", Active: 1})
+
+	return app, repo, id
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func authorizeParams(clientID, redirectURI string) url.Values {
+	return url.Values{
+		"client_id":             {clientID},
+		"redirect_uri":          {redirectURI},
+		"response_type":         {"code"},
+		"scope":                 {"openid email profile"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {codeChallenge(testCodeVerifier)},
+		"code_challenge_method": {pkceMethodS256},
+	}
+}
+
+func serveForm(t *testing.T, app *Config, path string, form url.Values, setup func(req *http.Request)) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if setup != nil {
+		setup(req)
+	}
+	rr := httptest.NewRecorder()
+
+	app.routes().ServeHTTP(rr, req)
+
+	return rr
+}
+
+// redirectParams returns the query of a redirect back to the client.
+func redirectParams(t *testing.T, rr *httptest.ResponseRecorder, redirectURI string) url.Values {
+	t.Helper()
+
+	if rr.Code != http.StatusFound {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusFound, rr.Code, rr.Body.String())
+	}
+
+	location := rr.Header().Get("Location")
+	if !strings.HasPrefix(location, redirectURI+"?") {
+		t.Fatalf("expected a redirect to %s, got %q", redirectURI, location)
+	}
+	target, _ := url.Parse(location)
+
+	return target.Query()
+}
+
+// authorizeCode logs in through the authorize endpoint and returns the code.
+func authorizeCode(t *testing.T, app *Config, params url.Values) string {
+	t.Helper()
+
+	form := url.Values{"email": {"me@here.com"}, "password": {"long-enough"}}
+	for name, values := range params {
+		form[name] = values
+	}
+
+	query := redirectParams(t, serveForm(t, app, "/oauth/authorize", form, nil), params.Get("redirect_uri"))
+	if query.Get("state") != params.Get("state") {
+		t.Fatalf("expected state %q, got %q", params.Get("state"), query.Get("state"))
+	}
+
+	return query.Get("code")
+}
+
+func exchangeCode(t *testing.T, app *Config, code, verifier string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testOIDCRedirectURI},
+		"code_verifier": {verifier},
+	}
+
+	return serveForm(t, app, "/oauth/token", form, func(req *http.Request) {
+		req.SetBasicAuth("notes", testOIDCSecret)
+	})
+}
+
+func decodeOAuthError(t *testing.T, rr *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var response struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+
+	return response.Error
+}
+
+// getJSON fetches target from a test server and decodes the response into v.
+func getJSON(t *testing.T, client *http.Client, target, token string, v any) int {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", target, err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("failed to decode %s: %v", target, err)
+	}
+
+	return resp.StatusCode
+}
+
+// TestOIDCAuthorizationCodeFlow plays a relying party against a real server,
+// finding every endpoint through discovery.
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	app, _, id := newOIDCTestApp(t)
+	server := httptest.NewServer(app.routes())
+	defer server.Close()
+	app.OIDCIssuer = server.URL
+
+	client := server.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	var discovery oidcDiscovery
+	getJSON(t, client, server.URL+"/.well-known/openid-configuration", "", &discovery)
+	if discovery.Issuer != server.URL || discovery.TokenEndpoint != server.URL+"/oauth/token" {
+		t.Fatalf("unexpected discovery document: %+v", discovery)
+	}
+
+	params := authorizeParams("notes", testOIDCRedirectURI)
+	resp, err := client.Get(discovery.AuthorizationEndpoint + "?" + params.Encode())
+	if err != nil {
+		t.Fatalf("failed to load the login page: %v", err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "Log in to Notes") {
+		t.Fatalf("expected the login page, got %d: %s", resp.StatusCode, page)
+	}
+	if resp.Header.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("expected the login page to refuse framing")
+	}
+
+	form := url.Values{"email": {"me@here.com"}, "password": {"wrong-password"}}
+	for name, values := range params {
+		form[name] = values
+	}
+	resp, err = client.PostForm(discovery.AuthorizationEndpoint, form)
+	if err != nil {
+		t.Fatalf("failed to post the login form: %v", err)
+	}
+	page, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(string(page), "Invalid email or password") {
+		t.Fatalf("expected the login page with an error, got %d: %s", resp.StatusCode, page)
+	}
+
+	form.Set("password", "long-enough")
+	resp, err = client.PostForm(discovery.AuthorizationEndpoint, form)
+	if err != nil {
+		t.Fatalf("failed to post the login form: %v", err)
+	}
+	resp.Body.Close()
+	location, _ := resp.Location()
+	if resp.StatusCode != http.StatusFound || location == nil || location.Query().Get("state") != "xyz" {
+		t.Fatalf("expected a redirect with the state, got %d to %v", resp.StatusCode, location)
+	}
+	code := location.Query().Get("code")
+
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testOIDCRedirectURI},
+		"code_verifier": {testCodeVerifier},
+	}
+	req, _ := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(exchange.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("notes", testOIDCSecret)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("failed to exchange the code: %v", err)
+	}
+	var tokens oidcTokenResponse
+	_ = json.NewDecoder(resp.Body).Decode(&tokens)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("expected uncached tokens, got %d: %+v", resp.StatusCode, tokens)
+	}
+	if tokens.TokenType != "Bearer" || tokens.Scope != "openid email profile" {
+		t.Fatalf("unexpected token response: %+v", tokens)
+	}
+
+	var set jsonWebKeySet
+	getJSON(t, client, discovery.JWKSURI, "", &set)
+	var idToken idTokenClaims
+	if err := verifyJWT(set, tokens.IDToken, &idToken); err != nil {
+		t.Fatalf("expected the ID token to verify against the key set: %v", err)
+	}
+	if idToken.Issuer != server.URL || idToken.Audience != "notes" || idToken.Nonce != "n-0S6" {
+		t.Errorf("unexpected ID token claims: %+v", idToken)
+	}
+	if idToken.Subject != strconv.Itoa(id) || idToken.Email != "me@here.com" || idToken.Name != "Jo Bloggs" {
+		t.Errorf("unexpected ID token user claims: %+v", idToken.oidcUserInfo)
+	}
+
+	var info oidcUserInfo
+	status := getJSON(t, client, discovery.UserInfoEndpoint, tokens.AccessToken, &info)
+	if status != http.StatusOK || info.Subject != strconv.Itoa(id) || info.EmailVerified == nil || *info.EmailVerified {
+		t.Fatalf("unexpected userinfo %d: %+v", status, info)
+	}
+
+	// codes are single use
+	rr := exchangeCode(t, app, code, testCodeVerifier)
+	if rr.Code != http.StatusBadRequest || decodeOAuthError(t, rr) != oauthErrorInvalidGrant {
+		t.Fatalf("expected a reused code to be rejected, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// ordinary access tokens were not issued for openid
+	pair := loginFrom(t, app, "test")
+	rr = serveRequest(t, app, http.MethodGet, "/oauth/userinfo", nil, pair.AccessToken)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusUnauthorized, rr.Code, rr.Body.String())
+	}
+}
+
+func TestOIDCAccessTokenOnlyReachesUserInfo(t *testing.T) {
+	app, repo, id := newOIDCTestApp(t)
+	if err := repo.SetRoles(id, []string{data.RoleAdmin}); err != nil {
+		t.Fatalf("failed to make the user an admin: %v", err)
+	}
+
+	rr := exchangeCode(t, app, authorizeCode(t, app, authorizeParams("notes", testOIDCRedirectURI)), testCodeVerifier)
+	var tokens oidcTokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected tokens, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	claims, err := app.Tokens.Verify(tokens.AccessToken, tokenTypeOIDCAccess)
+	if err != nil {
+		t.Fatalf("expected an OIDC access token, got %v", err)
+	}
+	if len(claims.Roles) > 0 || len(claims.Permissions) > 0 || claims.Scope != "openid email profile" {
+		t.Fatalf("expected only scopes on the token, got %+v", claims)
+	}
+
+	if rr := serveRequest(t, app, http.MethodGet, "/oauth/userinfo", nil, tokens.AccessToken); rr.Code != http.StatusOK {
+		t.Fatalf("expected userinfo to accept the token, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serveRequest(t, app, http.MethodPost, "/validate", nil, tokens.AccessToken); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected /validate to refuse the token, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serveRequest(t, app, http.MethodGet, "/users", nil, tokens.AccessToken); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected /users to refuse the token, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestOIDCUserInfoRefusesEndedAccess(t *testing.T) {
+	tests := []struct {
+		name string
+		end  func(app *Config, repo *data.MemoryRepository, id int, token string) string
+	}{
+		{name: "revoked session", end: func(app *Config, repo *data.MemoryRepository, id int, token string) string {
+			_ = repo.RevokeSessions(id)
+			return token
+		}},
+		{name: "deactivated account", end: func(app *Config, repo *data.MemoryRepository, id int, token string) string {
+			// deactivating through the repository leaves the session open
+			user, _ := repo.GetOne(id)
+			user.Active = 0
+			_ = repo.Update(*user)
+			return token
+		}},
+		{name: "token without a session", end: func(app *Config, repo *data.MemoryRepository, id int, token string) string {
+			withoutSession, _ := app.Tokens.IssueOIDCAccess(data.User{ID: id}, "", "openid email")
+			return withoutSession
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, repo, id := newOIDCTestApp(t)
+			rr := exchangeCode(t, app, authorizeCode(t, app, authorizeParams("notes", testOIDCRedirectURI)), testCodeVerifier)
+			var tokens oidcTokenResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil || rr.Code != http.StatusOK {
+				t.Fatalf("expected tokens, got %d: %s", rr.Code, rr.Body.String())
+			}
+
+			token := tt.end(app, repo, id, tokens.AccessToken)
+			if rr := serveRequest(t, app, http.MethodGet, "/oauth/userinfo", nil, token); rr.Code != http.StatusUnauthorized {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusUnauthorized, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestOIDCTokenRejectsBadExchanges(t *testing.T) {
+	app, _, _ := newOIDCTestApp(t)
+	params := authorizeParams("notes", testOIDCRedirectURI)
+
+	tests := []struct {
+		name           string
+		clientID       string
+		secret         string
+		change         func(form url.Values)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:           "wrong verifier",
+			change:         func(form url.Values) { form.Set("code_verifier", strings.Repeat("a", 43)) },
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  oauthErrorInvalidGrant,
+		},
+		{
+			name:           "missing verifier",
+			change:         func(form url.Values) { form.Del("code_verifier") },
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  oauthErrorInvalidGrant,
+		},
+		{
+			name:           "wrong secret",
+			secret:         "guess",
+			expectedStatus: http.StatusUnauthorized,
+			expectedError:  oauthErrorInvalidClient,
+		},
+		{
+			name:           "other client",
+			clientID:       "spa",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  oauthErrorInvalidGrant,
+		},
+		{
+			name:           "other redirect uri",
+			change:         func(form url.Values) { form.Set("redirect_uri", "https://notes.example/other") },
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  oauthErrorInvalidGrant,
+		},
+		{
+			name:           "unsupported grant",
+			change:         func(form url.Values) { form.Set("grant_type", "password") },
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  oauthErrorUnsupportedGrantType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{
+				"grant_type":    {"authorization_code"},
+				"code":          {authorizeCode(t, app, params)},
+				"redirect_uri":  {testOIDCRedirectURI},
+				"code_verifier": {testCodeVerifier},
+			}
+			if tt.change != nil {
+				tt.change(form)
+			}
+			clientID, secret := "notes", testOIDCSecret
+			if tt.clientID != "" {
+				clientID, secret = tt.clientID, ""
+			}
+			if tt.secret != "" {
+				secret = tt.secret
+			}
+
+			rr := serveForm(t, app, "/oauth/token", form, func(req *http.Request) {
+				req.SetBasicAuth(clientID, secret)
+			})
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if code := decodeOAuthError(t, rr); code != tt.expectedError {
+				t.Errorf("expected error %q, got %q", tt.expectedError, code)
+			}
+		})
+	}
+}
+
+func TestOIDCAuthorizeRejectsBadRequests(t *testing.T) {
+	app, _, _ := newOIDCTestApp(t)
+
+	tests := []struct {
+		name          string
+		change        func(params url.Values)
+		expectedError string
+	}{
+		{name: "unknown client", change: func(params url.Values) { params.Set("client_id", "evil") }},
+		{name: "unregistered redirect", change: func(params url.Values) { params.Set("redirect_uri", "https://evil.example/") }},
+		{name: "implicit flow", change: func(params url.Values) { params.Set("response_type", "token") }, expectedError: oauthErrorUnsupportedResponse},
+		{name: "missing openid scope", change: func(params url.Values) { params.Set("scope", "email") }, expectedError: oauthErrorInvalidScope},
+		{name: "missing pkce", change: func(params url.Values) { params.Del("code_challenge") }, expectedError: oauthErrorInvalidRequest},
+		{name: "plain pkce", change: func(params url.Values) { params.Set("code_challenge_method", "plain") }, expectedError: oauthErrorInvalidRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := authorizeParams("notes", testOIDCRedirectURI)
+			tt.change(params)
+
+			rr := serveRequest(t, app, http.MethodGet, "/oauth/authorize?"+params.Encode(), nil, "")
+
+			// untrusted redirect targets are never redirected to
+			if tt.expectedError == "" {
+				if rr.Code != http.StatusBadRequest || rr.Header().Get("Location") != "" {
+					t.Fatalf("expected status %d without a redirect, got %d", http.StatusBadRequest, rr.Code)
+				}
+				return
+			}
+
+			query := redirectParams(t, rr, testOIDCRedirectURI)
+			if query.Get("error") != tt.expectedError || query.Get("state") != "xyz" {
+				t.Fatalf("expected error %q with the state, got %v", tt.expectedError, query)
+			}
+		})
+	}
+}
+
+func TestOIDCAuthorizeLoginRefusals(t *testing.T) {
+	tests := []struct {
+		name           string
+		setup          func(app *Config, repo *data.MemoryRepository, id int)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name: "unverified email",
+			setup: func(app *Config, repo *data.MemoryRepository, id int) {
+				app.EmailVerification = emailVerificationRequire
+			},
+			expectedStatus: http.StatusForbidden,
+			expectedError:  "Verify your email address before logging in.",
+		},
+		{
+			name: "inactive account",
+			setup: func(app *Config, repo *data.MemoryRepository, id int) {
+				user, _ := repo.GetOne(id)
+				user.Active = 0
+				_ = repo.Update(*user)
+			},
+			expectedStatus: http.StatusForbidden,
+			expectedError:  "This account has been deactivated.",
+		},
+		{
+			name: "locked out",
+			setup: func(app *Config, repo *data.MemoryRepository, id int) {
+				app.Limiter = NewLoginLimiter(1, defaultIPLockoutThreshold, time.Minute, time.Minute)
+				app.Limiter.RecordFailure("me@here.com", "")
+			},
+			expectedStatus: http.StatusTooManyRequests,
+			expectedError:  "Too many failed login attempts.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, repo, id := newOIDCTestApp(t)
+			tt.setup(app, repo, id)
+
+			form := url.Values{"email": {"me@here.com"}, "password": {"long-enough"}}
+			for name, values := range authorizeParams("notes", testOIDCRedirectURI) {
+				form[name] = values
+			}
+
+			rr := serveForm(t, app, "/oauth/authorize", form, nil)
+			if rr.Code != tt.expectedStatus || !strings.Contains(rr.Body.String(), tt.expectedError) {
+				t.Fatalf("expected %d with %q, got %d: %s", tt.expectedStatus, tt.expectedError, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestOIDCAuthorizeWithSecondFactor(t *testing.T) {
+	app, _, _ := newOIDCTestApp(t)
+
+	secret, confirmedStep, _ := enrollTOTP(t, app, loginFrom(t, app, "test").AccessToken)
+
+	params := authorizeParams("spa", "https://spa.example/")
+	form := url.Values{"email": {"me@here.com"}, "password": {"long-enough"}}
+	for name, values := range params {
+		form[name] = values
+	}
+
+	rr := serveForm(t, app, "/oauth/authorize", form, nil)
+	match := challengeTokenPattern.FindStringSubmatch(rr.Body.String())
+	if rr.Code != http.StatusOK || match == nil {
+		t.Fatalf("expected the code page, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	form = url.Values{"challenge_token": {match[1]}, "code": {"000000"}}
+	for name, values := range params {
+		form[name] = values
+	}
+	rr = serveForm(t, app, "/oauth/authorize", form, nil)
+	if rr.Code != http.StatusUnauthorized || !challengeTokenPattern.MatchString(rr.Body.String()) {
+		t.Fatalf("expected the code page again for a wrong code, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	nextCode, _ := totpCode(secret, confirmedStep+1)
+	form.Set("code", nextCode)
+	query := redirectParams(t, serveForm(t, app, "/oauth/authorize", form, nil), "https://spa.example/")
+	if query.Get("code") == "" {
+		t.Fatalf("expected an authorization code, got %v", query)
+	}
+
+	// public clients exchange codes with PKCE alone
+	rr = serveForm(t, app, "/oauth/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"spa"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {"https://spa.example/"},
+		"code_verifier": {testCodeVerifier},
+	}, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+}
+
+func TestSupportedScopes(t *testing.T) {
+	tests := []struct {
+		scopes   string
+		expected string
+	}{
+		{scopes: "openid", expected: "openid"},
+		{scopes: "openid  email openid offline_access", expected: "openid email"},
+		{scopes: "", expected: ""},
+	}
+
+	for _, tt := range tests {
+		if got := supportedScopes(tt.scopes); got != tt.expected {
+			t.Errorf("supportedScopes(%q) = %q, expected %q", tt.scopes, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Package main configures the password policy and builds breached-password lists.
+package main
+
+import (
+	"authentication-service/data"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// breachedPasswordsNone disables the breached-password check.
+const breachedPasswordsNone = "none"
+
+const breachedPasswordsUsage = "usage: authApp breached-passwords <passwords.txt> <list.bin>"
+
+// passwordPolicy returns the configured policy, or the default one.
+func (app *Config) passwordPolicy() *data.PasswordPolicy {
+	if app.PasswordPolicy == nil {
+		return data.NewPasswordPolicy()
+	}
+
+	return app.PasswordPolicy
+}
+
+// passwordPolicyFromEnv configures which new passwords are accepted.
+// BREACHED_PASSWORDS_FILE replaces the bundled list with one built by the
+// breached-passwords subcommand, or disables the check when set to none.
+func passwordPolicyFromEnv() (*data.PasswordPolicy, error) {
+	policy := data.NewPasswordPolicy()
+	policy.MinLength = getenvInt("PASSWORD_MIN_LENGTH", policy.MinLength)
+	policy.MinCharacterClasses = getenvInt("PASSWORD_MIN_CHARACTER_CLASSES", policy.MinCharacterClasses)
+	policy.CheckEmail = getenv("PASSWORD_CHECK_EMAIL", "true") == "true"
+
+	if policy.MinLength < 1 {
+		return nil, errors.New("PASSWORD_MIN_LENGTH must be at least 1")
+	}
+	if policy.MinCharacterClasses < 1 || policy.MinCharacterClasses > 4 {
+		return nil, errors.New("PASSWORD_MIN_CHARACTER_CLASSES must be between 1 and 4")
+	}
+
+	switch path := getenv("BREACHED_PASSWORDS_FILE", ""); path {
+	case "":
+	case breachedPasswordsNone:
+		policy.Breached = nil
+	default:
+		breached, err := data.OpenBreachedPasswords(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BREACHED_PASSWORDS_FILE: %w", err)
+		}
+		log.Printf("Loaded %d breached password hashes from %s", breached.Len(), path)
+		policy.Breached = breached
+	}
+
+	return policy, nil
+}
+
+// runBreachedPasswordsCommand handles `authApp breached-passwords in out`,
+// turning a list of passwords or SHA-1 hashes into a list for
+// BREACHED_PASSWORDS_FILE.
+func runBreachedPasswordsCommand(args []string) error {
+	if len(args) != 2 {
+		return errors.New(breachedPasswordsUsage)
+	}
+
+	in, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+
+	count, err := data.WriteBreachedPasswords(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("Wrote %d breached password hashes to %s", count, args[1])
+
+	return nil
+}
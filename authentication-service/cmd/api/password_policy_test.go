@@ -0,0 +1,105 @@
+// Package main contains tests for password policy configuration.
+package main
+
+import (
+	"authentication-service/data"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyFromEnv(t *testing.T) {
+	t.Setenv("PASSWORD_MIN_LENGTH", "12")
+	t.Setenv("PASSWORD_MIN_CHARACTER_CLASSES", "3")
+	t.Setenv("PASSWORD_CHECK_EMAIL", "false")
+	t.Setenv("BREACHED_PASSWORDS_FILE", breachedPasswordsNone)
+
+	policy, err := passwordPolicyFromEnv()
+	if err != nil {
+		t.Fatalf("failed to configure password policy: %v", err)
+	}
+	if policy.MinLength != 12 || policy.MinCharacterClasses != 3 || policy.CheckEmail || policy.Breached != nil {
+		t.Fatalf("expected the configured policy, got %+v", policy)
+	}
+}
+
+func TestBcryptCapsPasswordLength(t *testing.T) {
+	t.Setenv("PASSWORD_HASH_ALGORITHM", data.HashAlgorithmBcrypt)
+	t.Setenv("BCRYPT_COST", "4")
+
+	app := Config{Tokens: NewTokenManager([]byte("test-secret"), 0, 0)}
+	if err := app.setupRepository(repositoryDriverMemory, nil); err != nil {
+		t.Fatalf("failed to set up the repository: %v", err)
+	}
+	if app.PasswordPolicy.MaxBytes != 72 {
+		t.Fatalf("expected bcrypt to cap passwords at 72 bytes, got %d", app.PasswordPolicy.MaxBytes)
+	}
+
+	body := map[string]string{"email": "long@here.com", "password": strings.Repeat("long-password-", 6)}
+	if rr := serveRequest(t, &app, http.MethodPost, "/users", body, ""); rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusUnprocessableEntity, rr.Code, rr.Body.String())
+	}
+}
+
+func TestPasswordPolicyFromEnvRejectsBadSettings(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		value string
+	}{
+		{name: "zero length", key: "PASSWORD_MIN_LENGTH", value: "0"},
+		{name: "too many classes", key: "PASSWORD_MIN_CHARACTER_CLASSES", value: "5"},
+		{name: "missing list", key: "BREACHED_PASSWORDS_FILE", value: filepath.Join(t.TempDir(), "missing.bin")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.key, tt.value)
+
+			if _, err := passwordPolicyFromEnv(); err == nil {
+				t.Fatalf("expected %s=%s to be rejected", tt.key, tt.value)
+			}
+		})
+	}
+}
+
+func TestBreachedPasswordsCommand(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "passwords.txt")
+	out := filepath.Join(dir, "breached.bin")
+	_ = os.WriteFile(in, []byte("tr0ub4dor&3\nlong-enough\n"), 0o600)
+
+	if err := runBreachedPasswordsCommand([]string{in}); err == nil {
+		t.Fatal("expected a usage error without an output file")
+	}
+	if err := runBreachedPasswordsCommand([]string{in, out}); err != nil {
+		t.Fatalf("failed to build breached list: %v", err)
+	}
+
+	t.Setenv("BREACHED_PASSWORDS_FILE", out)
+	policy, err := passwordPolicyFromEnv()
+	if err != nil {
+		t.Fatalf("failed to load breached list: %v", err)
+	}
+	defer policy.Breached.Close()
+
+	// the file replaces the bundled list
+	tests := []struct {
+		password string
+		breached bool
+	}{
+		{password: "long-enough", breached: true},
+		{password: "password123", breached: false},
+	}
+
+	for _, tt := range tests {
+		var policyErr *data.PasswordPolicyError
+		err := policy.Check(tt.password, "")
+		if breached := errors.As(err, &policyErr); breached != tt.breached {
+			t.Errorf("expected %q breached=%v, got %v", tt.password, tt.breached, err)
+		}
+	}
+}
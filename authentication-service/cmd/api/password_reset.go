@@ -0,0 +1,252 @@
+// Package main implements the forgot-password and reset-confirmation flow.
+package main
+
+import (
+	"authentication-service/data"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// errorCodeTooManyResetRequests refuses password reset requests from an IP
+// that has made too many.
+const errorCodeTooManyResetRequests = "too_many_reset_requests"
+
+const (
+	defaultMailServiceURL   = "http://mail-service/send"
+	defaultPasswordResetURL = "http://localhost:8082/reset-password"
+	defaultPasswordResetTTL = 30 * time.Minute
+)
+
+// hashResetToken returns the value stored for a reset token. Tokens are 256
+// random bits, so an unsalted SHA-256 is enough to keep them unusable at rest.
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// handleForgotPassword mails a reset link to the account with the given
+// email. The reply is sent before the account is looked up, so neither its
+// body nor its timing reveals whether the address is registered.
+func (app *Config) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.decodeJSON(w, r, &requestPayload)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if retryAfter, allowed := app.Limiter.AllowPasswordReset(app.clientIP(r)); !allowed {
+		seconds := int(math.Ceil(retryAfter.Seconds()))
+		app.writeLoginError(w, &loginError{
+			Err:        fmt.Errorf("too many password reset requests, try again in %d seconds", seconds),
+			Code:       errorCodeTooManyResetRequests,
+			Status:     http.StatusTooManyRequests,
+			RetryAfter: retryAfter,
+		})
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "If the account exists, a password reset link has been sent",
+	}
+	_ = app.writeJSON(w, http.StatusAccepted, payload)
+
+	go app.sendPasswordReset(strings.TrimSpace(requestPayload.Email))
+}
+
+// sendPasswordReset stores a new reset token for the account with email, if
+// there is one, and mails its link. Failures are only logged, since the
+// caller has already been answered.
+func (app *Config) sendPasswordReset(email string) {
+	user, err := app.Repository.GetByEmail(email)
+	if err != nil {
+		return
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		log.Println("Error creating password reset token:", err)
+		return
+	}
+
+	err = app.Repository.InsertPasswordReset(data.PasswordReset{
+		UserID:    user.ID,
+		TokenHash: hashResetToken(token),
+		ExpiresAt: time.Now().Add(app.passwordResetTTL()),
+	})
+	if err != nil {
+		log.Println("Error storing password reset token:", err)
+		return
+	}
+
+	err = app.sendPasswordResetMail(user.Email, token)
+	if err != nil {
+		log.Println("Error sending password reset mail:", err)
+	}
+}
+
+func (app *Config) handleConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	err := app.decodeJSON(w, r, &requestPayload)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if requestPayload.Token == "" {
+		_ = app.writeValidationErrorJSON(w, validationErrors{"token": "is required"})
+		return
+	}
+	tokenHash := hashResetToken(requestPayload.Token)
+
+	// the token is only used once the new password passes the policy, which
+	// needs the owner's email
+	reset, err := app.Repository.GetPasswordReset(tokenHash)
+	if err != nil {
+		app.writeResetTokenError(w, err)
+		return
+	}
+
+	user, err := app.Repository.GetOne(reset.UserID)
+	if err != nil {
+		app.writeRepositoryError(w, err)
+		return
+	}
+
+	errs := validationErrors{}
+	err = errs.checkPassword(app.passwordPolicy(), "password", requestPayload.Password, user.Email)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+	if !errs.valid() {
+		_ = app.writeValidationErrorJSON(w, errs)
+		return
+	}
+
+	// the token is used up in the same transaction that stores the password,
+	// so a failed reset leaves it redeemable
+	err = app.Repository.RedeemPasswordReset(tokenHash, requestPayload.Password, *user)
+	if err != nil {
+		app.writeResetTokenError(w, err)
+		return
+	}
+	app.auditUser(r, user, data.AuditEventPasswordChange, data.AuditOutcomeSuccess, "")
+
+	// whoever knew the old password may still hold a session
+	err = app.Repository.RevokeSessions(user.ID)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "Password has been reset",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *Config) sendPasswordResetMail(to, token string) error {
+	resetURL := app.PasswordResetURL
+	if resetURL == "" {
+		resetURL = defaultPasswordResetURL
+	}
+
+	link, err := url.Parse(resetURL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return app.sendMail(to, "Reset your password", fmt.Sprintf(
+		"We received a request to reset your password. Use the link below within %s to choose a new one:\n\n%s\n\nIf you did not request this, you can ignore this email.",
+		app.passwordResetTTL(),
+		link.String(),
+	))
+}
+
+// sendMail delivers a message through mail-service's /send endpoint.
+func (app *Config) sendMail(to, subject, message string) error {
+	jsonData, err := json.Marshal(struct {
+		To      string `json:"to"`
+		Subject string `json:"subject"`
+		Message string `json:"message"`
+	}{
+		To:      to,
+		Subject: subject,
+		Message: message,
+	})
+	if err != nil {
+		return err
+	}
+
+	mailServiceURL := app.MailServiceURL
+	if mailServiceURL == "" {
+		mailServiceURL = defaultMailServiceURL
+	}
+
+	request, err := http.NewRequest(http.MethodPost, mailServiceURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	client := app.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("mail service returned status %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// writeResetTokenError reports a reset token that cannot be redeemed as a bad
+// request, and any other error as writeRepositoryError does.
+func (app *Config) writeResetTokenError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, data.ErrResetTokenInvalid),
+		errors.Is(err, data.ErrResetTokenUsed),
+		errors.Is(err, data.ErrResetTokenExpired):
+		_ = app.writeErrorJSON(w, err, http.StatusBadRequest)
+	default:
+		app.writeRepositoryError(w, err)
+	}
+}
+
+func (app *Config) passwordResetTTL() time.Duration {
+	if app.PasswordResetTTL <= 0 {
+		return defaultPasswordResetTTL
+	}
+
+	return app.PasswordResetTTL
+}
@@ -0,0 +1,163 @@
+// Package main contains tests for the password reset flow.
+package main
+
+import (
+	"authentication-service/data"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestHandleForgotPasswordMailsResetLink(t *testing.T) {
+	var sentMail struct {
+		To      string `json:"to"`
+		Subject string `json:"subject"`
+		Message string `json:"message"`
+	}
+
+	defer func(client *http.Client) { testApp.HTTPClient = client }(testApp.HTTPClient)
+	mailed := make(chan struct{})
+	testApp.HTTPClient = newTestHTTPClient(func(req *http.Request) *http.Response {
+		_ = json.NewDecoder(req.Body).Decode(&sentMail)
+		close(mailed)
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"error":false}`)),
+			Header:     make(http.Header),
+		}
+	})
+	testApp.PasswordResetURL = "http://front-end/reset"
+
+	body, _ := json.Marshal(map[string]string{"email": "me@here.com"})
+	req, _ := http.NewRequest("POST", "/password-reset", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(testApp.handleForgotPassword)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, rr.Code)
+	}
+
+	// the mail is sent after the reply
+	select {
+	case <-mailed:
+	case <-time.After(time.Second):
+		t.Fatal("expected a reset mail to be sent")
+	}
+	if sentMail.To != "me@here.com" {
+		t.Fatalf("expected reset mail to me@here.com, got %q", sentMail.To)
+	}
+
+	link := regexp.MustCompile(`http://front-end/reset\?token=\S+`).FindString(sentMail.Message)
+	if link == "" {
+		t.Fatalf("expected reset link in message, got %q", sentMail.Message)
+	}
+
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("failed to parse reset link: %v", err)
+	}
+
+	// the mailed token must redeem exactly once
+	token := parsed.Query().Get("token")
+	if rr := confirmPasswordReset(t, token, "new-password"); rr.Code != http.StatusOK {
+		t.Fatalf("expected mailed token to be accepted, got %d", rr.Code)
+	}
+}
+
+func TestHandleForgotPasswordLimitsRequestsPerIP(t *testing.T) {
+	app, _ := newRolesTestApp(t)
+	app.Limiter = NewLoginLimiter(5, 2, time.Minute, time.Minute)
+
+	for i, expected := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusTooManyRequests} {
+		rr := serveRequest(t, app, http.MethodPost, "/password-reset", map[string]string{"email": "nobody@here.com"}, "")
+		if rr.Code != expected {
+			t.Fatalf("request %d: expected status %d, got %d", i+1, expected, rr.Code)
+		}
+		if expected == http.StatusTooManyRequests && rr.Header().Get("Retry-After") == "" {
+			t.Fatal("expected a Retry-After header")
+		}
+	}
+
+	// asking for resets never locks anyone out of logging in
+	if _, locked := app.Limiter.Locked("nobody@here.com", "192.0.2.1"); locked {
+		t.Fatal("expected logins to stay unlocked")
+	}
+}
+
+func TestHandleConfirmPasswordReset(t *testing.T) {
+	repo := testApp.Repository
+
+	_ = repo.InsertPasswordReset(data.PasswordReset{
+		UserID:    1,
+		TokenHash: hashResetToken("valid-token"),
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	_ = repo.InsertPasswordReset(data.PasswordReset{
+		UserID:    1,
+		TokenHash: hashResetToken("expired-token"),
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+	_ = repo.InsertPasswordReset(data.PasswordReset{
+		UserID:    1,
+		TokenHash: hashResetToken("retried-token"),
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+
+	// cases run in order: the second use of valid-token must be rejected, and
+	// retried-token must survive the passwords the policy rejects
+	tests := []struct {
+		name           string
+		token          string
+		password       string
+		expectedStatus int
+		expectedError  string
+	}{
+		{name: "valid token", token: "valid-token", password: "new-password", expectedStatus: http.StatusOK},
+		{name: "reused token", token: "valid-token", password: "new-password", expectedStatus: http.StatusBadRequest, expectedError: data.ErrResetTokenUsed.Error()},
+		{name: "expired token", token: "expired-token", password: "new-password", expectedStatus: http.StatusBadRequest, expectedError: data.ErrResetTokenExpired.Error()},
+		{name: "unknown token", token: "unknown-token", password: "new-password", expectedStatus: http.StatusBadRequest, expectedError: data.ErrResetTokenInvalid.Error()},
+		{name: "weak password", token: "retried-token", password: "short", expectedStatus: http.StatusUnprocessableEntity, expectedError: "validation failed"},
+		{name: "breached password", token: "retried-token", password: "password123", expectedStatus: http.StatusUnprocessableEntity, expectedError: "validation failed"},
+		{name: "retried with a good password", token: "retried-token", password: "new-password", expectedStatus: http.StatusOK},
+		{name: "missing token", password: "new-password", expectedStatus: http.StatusUnprocessableEntity, expectedError: "validation failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := confirmPasswordReset(t, tt.token, tt.password)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+
+			var response JsonResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode JSON response: %v", err)
+			}
+			if tt.expectedError != "" && response.Message != tt.expectedError {
+				t.Fatalf("expected error %q, got %q", tt.expectedError, response.Message)
+			}
+		})
+	}
+}
+
+func confirmPasswordReset(t *testing.T, token, password string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]string{"token": token, "password": password})
+	req, _ := http.NewRequest("POST", "/password-reset/confirm", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(testApp.handleConfirmPasswordReset)
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
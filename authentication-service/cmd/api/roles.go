@@ -0,0 +1,85 @@
+// Package main exposes role assignment and attaches roles to issued tokens.
+package main
+
+import (
+	"authentication-service/data"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type setRolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+// loadAuthorization fills in the roles and permissions user holds. Under the
+// restrict email verification policy, unverified users hold no permissions.
+func (app *Config) loadAuthorization(user *data.User) error {
+	authorization, err := app.Repository.GetAuthorization(user.ID)
+	if err != nil {
+		return err
+	}
+
+	user.Roles = authorization.Roles
+	user.Permissions = authorization.Permissions
+	if app.EmailVerification == emailVerificationRestrict && !user.EmailVerified() {
+		user.Permissions = []string{}
+	}
+
+	return nil
+}
+
+// handleSetUserRoles replaces the roles of the {id} user. Callers need the
+// users:manage permission; the change applies from the user's next token.
+func (app *Config) handleSetUserRoles(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = app.writeErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return
+	}
+
+	var requestPayload setRolesRequest
+
+	err = app.decodeJSON(w, r, &requestPayload)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	for i, role := range requestPayload.Roles {
+		requestPayload.Roles[i] = strings.TrimSpace(role)
+	}
+
+	user, err := app.Repository.GetOne(userID)
+	if err != nil {
+		app.writeRepositoryError(w, err)
+		return
+	}
+
+	err = app.Repository.SetRoles(user.ID, requestPayload.Roles)
+	if errors.Is(err, data.ErrUnknownRole) {
+		_ = app.writeValidationErrorJSON(w, validationErrors{"roles": err.Error()})
+		return
+	}
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	err = app.loadAuthorization(user)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "Updated roles for user " + user.Email,
+		Data:    user,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,120 @@
+// Package main contains tests for role assignment and role-carrying tokens.
+package main
+
+import (
+	"authentication-service/data"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newRolesTestApp(t *testing.T) (*Config, *data.MemoryRepository) {
+	t.Helper()
+
+	repo := data.NewMemoryRepository()
+	repo.Hasher = &data.PasswordHasher{Algorithm: data.HashAlgorithmBcrypt, BcryptCost: bcrypt.MinCost}
+
+	app := &Config{
+		Repository: repo,
+		Tokens:     NewTokenManager([]byte("test-secret"), 0, 0),
+		Limiter:    NewLoginLimiter(defaultAccountLockoutThreshold, defaultIPLockoutThreshold, time.Minute, time.Minute),
+		HTTPClient: newTestHTTPClient(func(req *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusAccepted,
+				Body:       io.NopCloser(bytes.NewBufferString(`{"error":false}`)),
+				Header:     make(http.Header),
+			}
+		}),
+	}
+
+	return app, repo
+}
+
+func TestAuthenticateIssuesTokensWithRoles(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+
+	id, _ := repo.Insert(data.User{Email: "mailer@here.com", Password: "long-enough", Active: 1})
+	_ = repo.SetRoles(id, []string{data.RoleMailer})
+
+	rr := serveRequest(t, app, http.MethodPost, "/authenticate", map[string]string{"email": "mailer@here.com", "password": "long-enough"}, "")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rr.Code, rr.Body.String())
+	}
+
+	claims, err := app.Tokens.Verify(decodeAuthResponse(t, rr).AccessToken, tokenTypeAccess)
+	if err != nil {
+		t.Fatalf("expected a valid access token, got %v", err)
+	}
+	if !slices.Equal(claims.Roles, []string{data.RoleMailer}) {
+		t.Fatalf("expected mailer role in token, got %v", claims.Roles)
+	}
+	if !claims.HasPermission(data.PermissionMailSend) || claims.HasPermission(data.PermissionUsersList) {
+		t.Fatalf("expected only mailer permissions, got %v", claims.Permissions)
+	}
+}
+
+func TestHandleSetUserRoles(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+
+	id, _ := repo.Insert(data.User{Email: "me@here.com", Password: "long-enough", Active: 1})
+	path := "/users/" + strconv.Itoa(id) + "/roles"
+
+	adminToken, _ := app.Tokens.IssuePair(data.User{ID: 99, Permissions: []string{data.PermissionUsersManage}}, "")
+	userToken, _ := app.Tokens.IssuePair(data.User{ID: id, Permissions: []string{data.PermissionLogsWrite}}, "")
+
+	tests := []struct {
+		name           string
+		path           string
+		token          string
+		roles          []string
+		expectedStatus int
+	}{
+		{name: "without permission", path: path, token: userToken.AccessToken, roles: []string{data.RoleAdmin}, expectedStatus: http.StatusForbidden},
+		{name: "unknown role", path: path, token: adminToken.AccessToken, roles: []string{"wizard"}, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "unknown user", path: "/users/404/roles", token: adminToken.AccessToken, roles: []string{data.RoleUser}, expectedStatus: http.StatusNotFound},
+		{name: "grant mailer", path: path, token: adminToken.AccessToken, roles: []string{data.RoleUser, data.RoleMailer}, expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serveRequest(t, app, http.MethodPut, tt.path, setRolesRequest{Roles: tt.roles}, tt.token)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	authorization, _ := repo.GetAuthorization(id)
+	if !slices.Equal(authorization.Roles, []string{data.RoleMailer, data.RoleUser}) {
+		t.Fatalf("expected mailer and user roles, got %v", authorization.Roles)
+	}
+}
+
+func TestHandleValidateTokenReturnsPermissions(t *testing.T) {
+	app, _ := newRolesTestApp(t)
+
+	pair, _ := app.Tokens.IssuePair(data.User{ID: 7, Roles: []string{data.RoleAdmin}, Permissions: []string{data.PermissionUsersList}}, "")
+
+	rr := serveRequest(t, app, http.MethodPost, "/validate", nil, pair.AccessToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	var response struct {
+		Data tokenIdentity `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+	if !slices.Equal(response.Data.Permissions, []string{data.PermissionUsersList}) {
+		t.Fatalf("expected users:list permission, got %v", response.Data.Permissions)
+	}
+}
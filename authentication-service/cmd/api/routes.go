@@ -2,6 +2,7 @@
 package main
 
 import (
+	"authentication-service/data"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -25,6 +26,55 @@ func (app *Config) routes() http.Handler {
 	mux.Use(middleware.Heartbeat("/ping"))
 
 	mux.Post("/authenticate", app.handleAuthenticate)
+	mux.Post("/authenticate/second-factor", app.handleSecondFactor)
+	mux.Post("/refresh", app.handleRefreshToken)
+	mux.Post("/validate", app.handleValidateToken)
+
+	mux.Post("/password-reset", app.handleForgotPassword)
+	mux.Post("/password-reset/confirm", app.handleConfirmPasswordReset)
+
+	mux.Post("/email-verification", app.handleResendEmailVerification)
+	mux.Post("/email-verification/confirm", app.handleConfirmEmailVerification)
+
+	mux.Post("/api-keys/validate", app.handleValidateAPIKey)
+
+	mux.Get("/.well-known/openid-configuration", app.handleOIDCDiscovery)
+	mux.Get("/.well-known/jwks.json", app.handleJWKS)
+	mux.Get("/oauth/authorize", app.handleAuthorize)
+	mux.Post("/oauth/authorize", app.handleAuthorizeLogin)
+	mux.Post("/oauth/token", app.handleOIDCToken)
+	mux.With(app.requireOIDCAccessToken).Get("/oauth/userinfo", app.handleOIDCUserInfo)
+	mux.With(app.requireOIDCAccessToken).Post("/oauth/userinfo", app.handleOIDCUserInfo)
+
+	mux.Post("/users", app.handleRegisterUser)
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.requireAccessToken)
+
+		mux.With(app.requirePermission(data.PermissionUsersList)).Get("/users", app.handleListUsers)
+		mux.With(app.requirePermission(data.PermissionUsersList)).Get("/users/export", app.handleExportUsers)
+		mux.With(app.requirePermission(data.PermissionUsersManage)).Post("/users/import", app.handleImportUsers)
+		mux.Get("/users/{id}", app.handleGetUser)
+		mux.Put("/users/{id}", app.handleUpdateUser)
+		mux.Delete("/users/{id}", app.handleDeactivateUser)
+		mux.Get("/users/{id}/audit", app.handleListAuditEvents)
+		mux.With(app.requirePermission(data.PermissionUsersManage)).Put("/users/{id}/roles", app.handleSetUserRoles)
+
+		mux.Get("/sessions", app.handleListSessions)
+		mux.Delete("/sessions", app.handleRevokeSessions)
+		mux.Delete("/sessions/{id}", app.handleRevokeSession)
+
+		mux.Post("/totp/enroll", app.handleEnrollTOTP)
+		mux.Post("/totp/confirm", app.handleConfirmTOTP)
+
+		mux.Route("/api-keys", func(mux chi.Router) {
+			mux.Use(app.requirePermission(data.PermissionAPIKeysManage))
+
+			mux.Get("/", app.handleListAPIKeys)
+			mux.Post("/", app.handleCreateAPIKey)
+			mux.Post("/{id}/rotate", app.handleRotateAPIKey)
+			mux.Delete("/{id}", app.handleRevokeAPIKey)
+		})
+	})
 
 	return mux
 }
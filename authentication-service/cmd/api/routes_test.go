@@ -14,7 +14,7 @@ func TestRoutesExist(t *testing.T) {
 	testRoutes := testApp.routes()
 	chiRoutes := testRoutes.(chi.Router)
 
-	routes := []string{"/authenticate"}
+	routes := []string{"/authenticate", "/refresh", "/validate", "/users", "/users/export", "/users/import", "/users/{id}", "/users/{id}/roles", "/users/{id}/audit", "/password-reset", "/password-reset/confirm", "/authenticate/second-factor", "/totp/enroll", "/totp/confirm", "/email-verification", "/email-verification/confirm", "/sessions", "/sessions/{id}", "/api-keys/", "/api-keys/{id}", "/api-keys/{id}/rotate", "/api-keys/validate", "/.well-known/openid-configuration", "/.well-known/jwks.json", "/oauth/authorize", "/oauth/token", "/oauth/userinfo"}
 
 	for _, route := range routes {
 		assertRouteExists(t, chiRoutes, route)
@@ -0,0 +1,188 @@
+// Package main tracks login sessions and lets users list and revoke them.
+package main
+
+import (
+	"authentication-service/data"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// sessionTouchInterval limits how often a session's last-seen time is
+	// written, since every validated request would otherwise update it.
+	sessionTouchInterval = time.Minute
+
+	maxUserAgentLength = 255
+)
+
+var errSessionRevoked = errors.New("session has been revoked")
+
+// sessionView is a session as shown to its owner.
+type sessionView struct {
+	*data.Session
+	Current bool `json:"current"`
+}
+
+// startSession records a new login by user from the client that sent r.
+func (app *Config) startSession(r *http.Request, user *data.User) (string, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = app.Repository.CreateSession(data.Session{
+		ID:         id,
+		UserID:     user.ID,
+		UserAgent:  truncateUserAgent(r.UserAgent()),
+		IP:         app.clientIP(r),
+		CreatedAt:  now,
+		LastSeenAt: now,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// checkSession rejects claims whose session has been revoked, and records
+// the session as seen. Access tokens issued before sessions existed carry no
+// session and are accepted until they expire; refreshing refuses them.
+func (app *Config) checkSession(claims TokenClaims) error {
+	if claims.SessionID == "" {
+		return nil
+	}
+
+	session, err := app.Repository.GetSession(claims.SessionID)
+	if errors.Is(err, data.ErrSessionNotFound) {
+		return errSessionRevoked
+	}
+	if err != nil {
+		return err
+	}
+
+	userID, err := claims.UserID()
+	if err != nil || userID != session.UserID || !session.Active() {
+		return errSessionRevoked
+	}
+
+	if now := time.Now(); now.Sub(session.LastSeenAt) >= sessionTouchInterval {
+		if err := app.Repository.TouchSession(session.ID, now); err != nil {
+			log.Println("Error updating session last seen time:", err)
+		}
+	}
+
+	return nil
+}
+
+// writeSessionError responds to a failed checkSession.
+func (app *Config) writeSessionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errSessionRevoked) {
+		_ = app.writeErrorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	_ = app.writeErrorJSON(w, err)
+}
+
+// handleListSessions lists the caller's active sessions, flagging the one
+// their token belongs to.
+func (app *Config) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+	userID, err := claims.UserID()
+	if err != nil {
+		_ = app.writeErrorJSON(w, errInvalidToken, http.StatusUnauthorized)
+		return
+	}
+
+	sessions, err := app.Repository.ListSessions(userID)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	views := make([]sessionView, 0, len(sessions))
+	for _, session := range sessions {
+		views = append(views, sessionView{Session: session, Current: session.ID == claims.SessionID})
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "Sessions",
+		Data:    views,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// handleRevokeSession revokes one of the caller's sessions.
+func (app *Config) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+	userID, err := claims.UserID()
+	if err != nil {
+		_ = app.writeErrorJSON(w, errInvalidToken, http.StatusUnauthorized)
+		return
+	}
+
+	err = app.Repository.RevokeSession(userID, chi.URLParam(r, "id"))
+	if errors.Is(err, data.ErrSessionNotFound) {
+		_ = app.writeErrorJSON(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "Session revoked",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// handleRevokeSessions revokes all of the caller's sessions, including the
+// current one.
+func (app *Config) handleRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+	userID, err := claims.UserID()
+	if err != nil {
+		_ = app.writeErrorJSON(w, errInvalidToken, http.StatusUnauthorized)
+		return
+	}
+
+	err = app.Repository.RevokeSessions(userID)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "All sessions revoked",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// truncateUserAgent keeps user agents within the column size.
+func truncateUserAgent(userAgent string) string {
+	return truncateUTF8(userAgent, maxUserAgentLength)
+}
+
+// truncateUTF8 cuts value to at most n bytes without splitting a multi-byte
+// character.
+func truncateUTF8(value string, n int) string {
+	if len(value) <= n {
+		return value
+	}
+
+	return strings.ToValidUTF8(value[:n], "")
+}
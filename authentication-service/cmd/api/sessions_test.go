@@ -0,0 +1,182 @@
+// Package main contains tests for login sessions and their revocation.
+package main
+
+import (
+	"authentication-service/data"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// loginFrom authenticates with userAgent and returns the issued tokens.
+func loginFrom(t *testing.T, app *Config, userAgent string) TokenPair {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]string{"email": "me@here.com", "password": "long-enough"})
+	req := httptest.NewRequest(http.MethodPost, "/authenticate", bytes.NewBuffer(body))
+	req.Header.Set("User-Agent", userAgent)
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rr.Code, rr.Body.String())
+	}
+
+	return decodeAuthResponse(t, rr)
+}
+
+func listSessions(t *testing.T, app *Config, token string) []sessionView {
+	t.Helper()
+
+	rr := serveRequest(t, app, http.MethodGet, "/sessions", nil, token)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d listing sessions, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var response struct {
+		Data []sessionView `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+
+	return response.Data
+}
+
+func TestSessionRevocation(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+	_, _ = repo.Insert(data.User{Email: "me@here.com", Password: "long-enough", Active: 1})
+
+	laptop := loginFrom(t, app, "laptop-browser")
+	phone := loginFrom(t, app, "phone-app")
+
+	sessions := listSessions(t, app, laptop.AccessToken)
+	if len(sessions) != 2 {
+		t.Fatalf("expected two sessions, got %d", len(sessions))
+	}
+
+	var phoneSessionID string
+	for _, session := range sessions {
+		if session.UserAgent == "laptop-browser" && !session.Current {
+			t.Fatalf("expected the laptop session to be current")
+		}
+		if session.UserAgent == "phone-app" {
+			phoneSessionID = session.ID
+		}
+	}
+
+	rr := serveRequest(t, app, http.MethodDelete, "/sessions/"+phoneSessionID, nil, laptop.AccessToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d revoking, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	rr = serveRequest(t, app, http.MethodDelete, "/sessions/"+phoneSessionID, nil, laptop.AccessToken)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d revoking twice, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           any
+		token          string
+		expectedStatus int
+	}{
+		{name: "revoked access token", method: http.MethodPost, path: "/validate", token: phone.AccessToken, expectedStatus: http.StatusUnauthorized},
+		{name: "revoked refresh token", method: http.MethodPost, path: "/refresh", body: map[string]string{"refresh_token": phone.RefreshToken}, expectedStatus: http.StatusUnauthorized},
+		{name: "revoked token on a protected route", method: http.MethodGet, path: "/sessions", token: phone.AccessToken, expectedStatus: http.StatusUnauthorized},
+		{name: "other session still valid", method: http.MethodPost, path: "/validate", token: laptop.AccessToken, expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serveRequest(t, app, tt.method, tt.path, tt.body, tt.token)
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	rr = serveRequest(t, app, http.MethodDelete, "/sessions", nil, laptop.AccessToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d revoking all, got %d", http.StatusOK, rr.Code)
+	}
+	rr = serveRequest(t, app, http.MethodPost, "/validate", nil, laptop.AccessToken)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the current session to be revoked too, got %d", rr.Code)
+	}
+}
+
+func TestRefreshKeepsSession(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+	id, _ := repo.Insert(data.User{Email: "me@here.com", Password: "long-enough", Active: 1})
+
+	pair := loginFrom(t, app, "laptop-browser")
+	rr := serveRequest(t, app, http.MethodPost, "/refresh", map[string]string{"refresh_token": pair.RefreshToken}, "")
+	refreshed := decodeAuthResponse(t, rr)
+
+	before, _ := app.Tokens.Verify(pair.AccessToken, tokenTypeAccess)
+	after, _ := app.Tokens.Verify(refreshed.AccessToken, tokenTypeAccess)
+	if before.SessionID == "" || before.SessionID != after.SessionID {
+		t.Fatalf("expected refreshed tokens to keep session %q, got %q", before.SessionID, after.SessionID)
+	}
+
+	if sessions, _ := repo.ListSessions(id); len(sessions) != 1 {
+		t.Fatalf("expected refreshing to keep one session, got %d", len(sessions))
+	}
+}
+
+func TestRefreshRejectsTokensWithoutSession(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+	id, _ := repo.Insert(data.User{Email: "me@here.com", Password: "long-enough", Active: 1})
+
+	// tokens issued before sessions existed could never be revoked
+	legacy, _ := app.Tokens.IssuePair(data.User{ID: id, Email: "me@here.com"}, "")
+	rr := serveRequest(t, app, http.MethodPost, "/refresh", map[string]string{"refresh_token": legacy.RefreshToken}, "")
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusUnauthorized, rr.Code, rr.Body.String())
+	}
+
+	if sessions, _ := repo.ListSessions(id); len(sessions) != 0 {
+		t.Fatalf("expected no session to be started, got %d", len(sessions))
+	}
+	events, _ := repo.ListAuditEvents(id, 0, 10)
+	if len(events) != 1 || events[0].Event != data.AuditEventTokenRefresh || events[0].Reason != auditReasonInvalidToken {
+		t.Fatalf("expected a failed refresh in the audit trail, got %+v", events)
+	}
+}
+
+func TestDeactivationRevokesSessions(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+	id, _ := repo.Insert(data.User{Email: "me@here.com", Password: "long-enough", Active: 1})
+
+	pair := loginFrom(t, app, "laptop-browser")
+	_ = loginFrom(t, app, "phone-app")
+
+	rr := serveRequest(t, app, http.MethodDelete, "/users/"+strconv.Itoa(id), nil, pair.AccessToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	if sessions, _ := repo.ListSessions(id); len(sessions) != 0 {
+		t.Fatalf("expected deactivation to revoke every session, got %d left", len(sessions))
+	}
+}
+
+func TestTruncateUserAgent(t *testing.T) {
+	short := "Mozilla/5.0"
+	if got := truncateUserAgent(short); got != short {
+		t.Fatalf("expected short user agent unchanged, got %q", got)
+	}
+
+	long := strings.Repeat("a", maxUserAgentLength-1) + "é"
+	got := truncateUserAgent(long)
+	if len(got) > maxUserAgentLength || !utf8.ValidString(got) {
+		t.Fatalf("expected at most %d bytes of valid UTF-8, got %d bytes", maxUserAgentLength, len(got))
+	}
+}
@@ -3,6 +3,9 @@ package main
 
 import (
 	"authentication-service/data"
+	"bytes"
+	"io"
+	"net/http"
 	"os"
 	"testing"
 )
@@ -12,6 +15,16 @@ var testApp Config
 func TestMain(m *testing.M) {
 	repo := data.NewPostgresTestRepository(nil)
 	testApp.Repository = repo
+	testApp.Tokens = NewTokenManager([]byte("test-secret"), 0, 0)
+	testApp.Limiter = NewLoginLimiter(defaultAccountLockoutThreshold, defaultIPLockoutThreshold, defaultLockoutWindow, defaultLockoutDuration)
+	// registration mails a verification link; keep it off the network
+	testApp.HTTPClient = newTestHTTPClient(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"error":false}`)),
+			Header:     make(http.Header),
+		}
+	})
 
 	os.Exit(m.Run())
 }
@@ -0,0 +1,148 @@
+// Package main signs OpenID Connect ID tokens with rotating RSA keys.
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSigningKeyRotation = 24 * time.Hour
+	signingKeyBits            = 2048
+)
+
+type signingKey struct {
+	ID        string
+	Private   *rsa.PrivateKey
+	CreatedAt time.Time
+}
+
+// jsonWebKey is the public half of a signing key as published in the JWKS.
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+// jsonWebKeySet is the body of the JWKS endpoint.
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// SigningKeys holds the RSA keys ID tokens are signed with. The newest key
+// signs; when it is older than RotateEvery a new key takes over, and the old
+// one stays published for another RotateEvery so tokens it signed can still
+// be verified. Keys only live in memory, so a restart starts a fresh set.
+type SigningKeys struct {
+	RotateEvery time.Duration
+
+	mu   sync.Mutex
+	keys []*signingKey // newest first
+	now  func() time.Time
+}
+
+func NewSigningKeys(rotateEvery time.Duration) *SigningKeys {
+	if rotateEvery <= 0 {
+		rotateEvery = defaultSigningKeyRotation
+	}
+
+	return &SigningKeys{
+		RotateEvery: rotateEvery,
+		now:         time.Now,
+	}
+}
+
+// Sign returns claims as an RS256 JSON Web Token signed with the current key.
+func (sk *SigningKeys) Sign(claims any) (string, error) {
+	sk.mu.Lock()
+	key, err := sk.rotate()
+	sk.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": key.ID})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key.Private, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// JWKS returns the public keys relying parties may see signatures from.
+func (sk *SigningKeys) JWKS() (jsonWebKeySet, error) {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+
+	if _, err := sk.rotate(); err != nil {
+		return jsonWebKeySet{}, err
+	}
+
+	set := jsonWebKeySet{Keys: make([]jsonWebKey, 0, len(sk.keys))}
+	for _, key := range sk.keys {
+		public := key.Private.PublicKey
+		set.Keys = append(set.Keys, jsonWebKey{
+			KeyType:   "RSA",
+			Use:       "sig",
+			Algorithm: "RS256",
+			KeyID:     key.ID,
+			Modulus:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		})
+	}
+
+	return set, nil
+}
+
+// rotate returns the key to sign with, generating one when there is none or
+// the newest is due for rotation, and drops keys that have been replaced for
+// longer than RotateEvery. Callers must hold sk.mu.
+func (sk *SigningKeys) rotate() (*signingKey, error) {
+	now := sk.now()
+
+	if len(sk.keys) == 0 || now.Sub(sk.keys[0].CreatedAt) >= sk.RotateEvery {
+		private, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		id, err := randomHex(8)
+		if err != nil {
+			return nil, err
+		}
+
+		sk.keys = append([]*signingKey{{ID: id, Private: private, CreatedAt: now}}, sk.keys...)
+	}
+
+	// keys[i] was replaced when keys[i-1] was created
+	for i := 1; i < len(sk.keys); i++ {
+		if now.Sub(sk.keys[i-1].CreatedAt) >= sk.RotateEvery {
+			sk.keys = sk.keys[:i]
+			break
+		}
+	}
+
+	return sk.keys[0], nil
+}
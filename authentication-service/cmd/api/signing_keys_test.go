@@ -0,0 +1,152 @@
+// Package main contains tests for ID token signing keys.
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyJWT checks token's RS256 signature against the key in set named by
+// its header and decodes its payload into claims.
+func verifyJWT(set jsonWebKeySet, token string, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("token does not have three parts")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Algorithm != "RS256" {
+		return fmt.Errorf("unexpected alg %q", header.Algorithm)
+	}
+
+	var public *rsa.PublicKey
+	for _, key := range set.Keys {
+		if key.KeyID != header.KeyID {
+			continue
+		}
+		n, _ := base64.RawURLEncoding.DecodeString(key.Modulus)
+		e, _ := base64.RawURLEncoding.DecodeString(key.Exponent)
+		public = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if public == nil {
+		return fmt.Errorf("key %q is not in the key set", header.KeyID)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature); err != nil {
+		return err
+	}
+
+	return decodeJWTPart(parts[1], claims)
+}
+
+func decodeJWTPart(part string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(raw, v)
+}
+
+func keyIDs(set jsonWebKeySet) []string {
+	ids := []string{}
+	for _, key := range set.Keys {
+		ids = append(ids, key.KeyID)
+	}
+
+	return ids
+}
+
+func TestSigningKeysSignVerifiableTokens(t *testing.T) {
+	keys := NewSigningKeys(time.Hour)
+
+	token, err := keys.Sign(map[string]string{"sub": "1"})
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+
+	set, err := keys.JWKS()
+	if err != nil {
+		t.Fatalf("failed to build key set: %v", err)
+	}
+	if len(set.Keys) != 1 || set.Keys[0].KeyType != "RSA" || set.Keys[0].Use != "sig" {
+		t.Fatalf("expected one RSA signing key, got %+v", set.Keys)
+	}
+
+	var claims map[string]string
+	if err := verifyJWT(set, token, &claims); err != nil {
+		t.Fatalf("expected the token to verify: %v", err)
+	}
+	if claims["sub"] != "1" {
+		t.Errorf("expected sub 1, got %q", claims["sub"])
+	}
+
+	parts := strings.Split(token, ".")
+	forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"2"}`)) + "." + parts[2]
+	if err := verifyJWT(set, forged, &claims); err == nil {
+		t.Error("expected a forged payload to fail verification")
+	}
+}
+
+func TestSigningKeysRotate(t *testing.T) {
+	now := time.Now()
+	keys := NewSigningKeys(time.Hour)
+	keys.now = func() time.Time { return now }
+
+	first, _ := keys.JWKS()
+	if len(first.Keys) != 1 {
+		t.Fatalf("expected one key, got %d", len(first.Keys))
+	}
+
+	// within the rotation period the same key keeps signing
+	now = now.Add(30 * time.Minute)
+	set, _ := keys.JWKS()
+	if got := keyIDs(set); len(got) != 1 || got[0] != first.Keys[0].KeyID {
+		t.Fatalf("expected the first key only, got %v", got)
+	}
+
+	// after rotation the old key is still published so its tokens verify
+	oldToken, _ := keys.Sign(map[string]string{"sub": "1"})
+	now = now.Add(45 * time.Minute)
+	newToken, _ := keys.Sign(map[string]string{"sub": "1"})
+
+	set, _ = keys.JWKS()
+	if got := keyIDs(set); len(got) != 2 || got[1] != first.Keys[0].KeyID {
+		t.Fatalf("expected a new key followed by the first, got %v", got)
+	}
+	var claims map[string]string
+	for _, token := range []string{oldToken, newToken} {
+		if err := verifyJWT(set, token, &claims); err != nil {
+			t.Errorf("expected the token to verify: %v", err)
+		}
+	}
+
+	// a rotation period after being replaced the old key is dropped
+	now = now.Add(time.Hour)
+	set, _ = keys.JWKS()
+	for _, id := range keyIDs(set) {
+		if id == first.Keys[0].KeyID {
+			t.Fatalf("expected the first key to be retired, got %v", keyIDs(set))
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Package main issues and verifies signed session tokens for authenticated users.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"authentication-service/data"
+)
+
+const (
+	tokenTypeAccess  = "access"
+	tokenTypeRefresh = "refresh"
+	// tokenTypeOIDCAccess is issued to OpenID Connect clients by the token
+	// endpoint. It carries scopes instead of roles and permissions, and is
+	// only accepted by the userinfo endpoint.
+	tokenTypeOIDCAccess = "oidc_access"
+	// tokenTypeChallenge proves the password step of a login that still
+	// needs a second factor. It grants no access on its own.
+	tokenTypeChallenge = "challenge"
+	// tokenTypeEmailVerification is mailed to prove ownership of the email
+	// claim.
+	tokenTypeEmailVerification = "email_verification"
+
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 7 * 24 * time.Hour
+	challengeTokenTTL      = 5 * time.Minute
+	defaultTokenIssuer     = "authentication-service"
+)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token has expired")
+)
+
+// TokenClaims is the payload carried inside every signed token.
+type TokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Email     string `json:"email,omitempty"`
+	Type      string `json:"typ"`
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// SessionID links access and refresh tokens to the login that issued
+	// them, so revoking the session rejects both.
+	SessionID string `json:"sid,omitempty"`
+	// Scope lists the OpenID Connect scopes granted to an OIDC access token.
+	Scope string `json:"scope,omitempty"`
+
+	// Roles and Permissions are only carried by access tokens; a refresh
+	// reloads them so role changes apply on the next token.
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// UserID returns the numeric user ID stored in the subject claim.
+func (c TokenClaims) UserID() (int, error) {
+	return strconv.Atoi(c.Subject)
+}
+
+// HasPermission reports whether the token grants permission.
+func (c TokenClaims) HasPermission(permission string) bool {
+	return slices.Contains(c.Permissions, permission)
+}
+
+// TokenPair is returned to clients after a successful login or refresh.
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// tokenIdentity is the verified caller returned by the validate endpoint.
+type tokenIdentity struct {
+	UserID      int      `json:"user_id"`
+	Email       string   `json:"email"`
+	ExpiresAt   int64    `json:"expires_at"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+
+	return strings.TrimSpace(token), true
+}
+
+// TokenManager signs and verifies HS256 JSON Web Tokens.
+type TokenManager struct {
+	Secret     []byte
+	Issuer     string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	now        func() time.Time
+}
+
+func NewTokenManager(secret []byte, accessTTL, refreshTTL time.Duration) *TokenManager {
+	if accessTTL <= 0 {
+		accessTTL = defaultAccessTokenTTL
+	}
+	if refreshTTL <= 0 {
+		refreshTTL = defaultRefreshTokenTTL
+	}
+
+	return &TokenManager{
+		Secret:     secret,
+		Issuer:     defaultTokenIssuer,
+		AccessTTL:  accessTTL,
+		RefreshTTL: refreshTTL,
+		now:        time.Now,
+	}
+}
+
+// IssuePair creates a fresh access and refresh token for user in sessionID.
+func (tm *TokenManager) IssuePair(user data.User, sessionID string) (TokenPair, error) {
+	accessToken, err := tm.issueForSession(user, tokenTypeAccess, tm.AccessTTL, sessionID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	refreshToken, err := tm.issueForSession(user, tokenTypeRefresh, tm.RefreshTTL, sessionID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(tm.AccessTTL / time.Second),
+	}, nil
+}
+
+// IssueOIDCAccess creates an access token for user in sessionID that carries
+// only the OpenID Connect scopes a client was granted.
+func (tm *TokenManager) IssueOIDCAccess(user data.User, sessionID, scope string) (string, error) {
+	claims, err := tm.newClaims(user, tokenTypeOIDCAccess, tm.AccessTTL, sessionID)
+	if err != nil {
+		return "", err
+	}
+	claims.Scope = scope
+
+	return tm.encode(claims)
+}
+
+// IssueChallenge creates a short-lived token that lets user complete a login
+// with a second factor.
+func (tm *TokenManager) IssueChallenge(user data.User) (string, error) {
+	return tm.issue(user, tokenTypeChallenge, challengeTokenTTL)
+}
+
+// IssueEmailVerification creates a token proving user received mail at their
+// current address.
+func (tm *TokenManager) IssueEmailVerification(user data.User, ttl time.Duration) (string, error) {
+	return tm.issue(user, tokenTypeEmailVerification, ttl)
+}
+
+// Verify checks the signature, expiry and type of token and returns its claims.
+func (tm *TokenManager) Verify(token, expectedType string) (TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return TokenClaims{}, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return TokenClaims{}, errInvalidToken
+	}
+	if !hmac.Equal(signature, tm.sign(parts[0]+"."+parts[1])) {
+		return TokenClaims{}, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return TokenClaims{}, errInvalidToken
+	}
+
+	var claims TokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return TokenClaims{}, errInvalidToken
+	}
+
+	if claims.Issuer != tm.Issuer || claims.Type != expectedType {
+		return TokenClaims{}, errInvalidToken
+	}
+	if tm.now().Unix() >= claims.ExpiresAt {
+		return TokenClaims{}, errExpiredToken
+	}
+
+	return claims, nil
+}
+
+func (tm *TokenManager) issue(user data.User, tokenType string, ttl time.Duration) (string, error) {
+	return tm.issueForSession(user, tokenType, ttl, "")
+}
+
+func (tm *TokenManager) issueForSession(user data.User, tokenType string, ttl time.Duration, sessionID string) (string, error) {
+	claims, err := tm.newClaims(user, tokenType, ttl, sessionID)
+	if err != nil {
+		return "", err
+	}
+
+	return tm.encode(claims)
+}
+
+func (tm *TokenManager) newClaims(user data.User, tokenType string, ttl time.Duration, sessionID string) (TokenClaims, error) {
+	id, err := randomTokenID()
+	if err != nil {
+		return TokenClaims{}, err
+	}
+
+	issuedAt := tm.now()
+	claims := TokenClaims{
+		Issuer:    tm.Issuer,
+		Subject:   strconv.Itoa(user.ID),
+		Email:     user.Email,
+		Type:      tokenType,
+		ID:        id,
+		IssuedAt:  issuedAt.Unix(),
+		ExpiresAt: issuedAt.Add(ttl).Unix(),
+		SessionID: sessionID,
+	}
+	if tokenType == tokenTypeAccess {
+		claims.Roles = user.Roles
+		claims.Permissions = user.Permissions
+	}
+
+	return claims, nil
+}
+
+func (tm *TokenManager) encode(claims TokenClaims) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(tm.sign(unsigned)), nil
+}
+
+func (tm *TokenManager) sign(value string) []byte {
+	mac := hmac.New(sha256.New, tm.Secret)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+func randomTokenID() (string, error) {
+	return randomHex(16)
+}
+
+// randomHex returns n cryptographically random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,91 @@
+// Package main verifies signed session token issuance and validation.
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"authentication-service/data"
+)
+
+func TestTokenManagerIssuesVerifiableTokens(t *testing.T) {
+	tm := NewTokenManager([]byte("secret"), time.Minute, time.Hour)
+
+	pair, err := tm.IssuePair(data.User{ID: 7, Email: "me@here.com"}, "")
+	if err != nil {
+		t.Fatalf("expected no error issuing tokens, got %v", err)
+	}
+
+	if pair.TokenType != "Bearer" {
+		t.Fatalf("expected Bearer token type, got %q", pair.TokenType)
+	}
+	if pair.ExpiresIn != 60 {
+		t.Fatalf("expected expires_in 60, got %d", pair.ExpiresIn)
+	}
+
+	claims, err := tm.Verify(pair.AccessToken, tokenTypeAccess)
+	if err != nil {
+		t.Fatalf("expected access token to verify, got %v", err)
+	}
+
+	userID, err := claims.UserID()
+	if err != nil || userID != 7 {
+		t.Fatalf("expected user ID 7, got %d (%v)", userID, err)
+	}
+	if claims.Email != "me@here.com" {
+		t.Fatalf("expected email claim, got %q", claims.Email)
+	}
+
+	if _, err := tm.Verify(pair.RefreshToken, tokenTypeRefresh); err != nil {
+		t.Fatalf("expected refresh token to verify, got %v", err)
+	}
+}
+
+func TestTokenManagerRejectsInvalidTokens(t *testing.T) {
+	tm := NewTokenManager([]byte("secret"), time.Minute, time.Hour)
+
+	pair, err := tm.IssuePair(data.User{ID: 1, Email: "me@here.com"}, "")
+	if err != nil {
+		t.Fatalf("expected no error issuing tokens, got %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		manager      *TokenManager
+		token        string
+		expectedType string
+	}{
+		{name: "malformed", manager: tm, token: "not-a-token", expectedType: tokenTypeAccess},
+		{name: "tampered signature", manager: tm, token: pair.AccessToken + "x", expectedType: tokenTypeAccess},
+		{name: "wrong secret", manager: NewTokenManager([]byte("other"), 0, 0), token: pair.AccessToken, expectedType: tokenTypeAccess},
+		{name: "refresh used as access", manager: tm, token: pair.RefreshToken, expectedType: tokenTypeAccess},
+		{name: "access used as refresh", manager: tm, token: pair.AccessToken, expectedType: tokenTypeRefresh},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.manager.Verify(tt.token, tt.expectedType); !errors.Is(err, errInvalidToken) {
+				t.Fatalf("expected errInvalidToken, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTokenManagerRejectsExpiredTokens(t *testing.T) {
+	tm := NewTokenManager([]byte("secret"), time.Minute, time.Hour)
+
+	pair, err := tm.IssuePair(data.User{ID: 1, Email: "me@here.com"}, "")
+	if err != nil {
+		t.Fatalf("expected no error issuing tokens, got %v", err)
+	}
+
+	tm.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+	if _, err := tm.Verify(pair.AccessToken, tokenTypeAccess); !errors.Is(err, errExpiredToken) {
+		t.Fatalf("expected errExpiredToken, got %v", err)
+	}
+	if _, err := tm.Verify(pair.RefreshToken, tokenTypeRefresh); err != nil {
+		t.Fatalf("expected refresh token to outlive access token, got %v", err)
+	}
+}
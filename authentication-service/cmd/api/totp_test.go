@@ -0,0 +1,125 @@
+// Package main verifies TOTP code generation, verification and recovery codes.
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the base32 form of the RFC 6238 SHA-1 test key "12345678901234567890".
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeMatchesRFC6238Vectors(t *testing.T) {
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{unix: 59, expected: "287082"},
+		{unix: 1111111109, expected: "081804"},
+		{unix: 1234567890, expected: "005924"},
+		{unix: 2000000000, expected: "279037"},
+	}
+
+	for _, tt := range tests {
+		code, err := totpCode(rfc6238Secret, totpStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("expected code at %d, got %v", tt.unix, err)
+		}
+		if code != tt.expected {
+			t.Fatalf("expected code %s at %d, got %s", tt.expected, tt.unix, code)
+		}
+	}
+}
+
+func TestVerifyTOTPAcceptsAdjacentSteps(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := totpStep(now)
+
+	tests := []struct {
+		name     string
+		step     int64
+		expected bool
+	}{
+		{name: "previous step", step: step - 1, expected: true},
+		{name: "current step", step: step, expected: true},
+		{name: "next step", step: step + 1, expected: true},
+		{name: "two steps ago", step: step - 2, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _ := totpCode(rfc6238Secret, tt.step)
+
+			matched, ok := verifyTOTP(rfc6238Secret, code, now)
+			if ok != tt.expected {
+				t.Fatalf("expected valid=%v, got %v", tt.expected, ok)
+			}
+			if ok && matched != tt.step {
+				t.Fatalf("expected matched step %d, got %d", tt.step, matched)
+			}
+		})
+	}
+
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := verifyTOTP(rfc6238Secret, code, now); ok {
+			t.Fatalf("expected %q to be rejected", code)
+		}
+	}
+}
+
+func TestGenerateTOTPSecretIsUsable(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("expected secret, got %v", err)
+	}
+	if len(secret) != 32 {
+		t.Fatalf("expected a 32 character base32 secret, got %q", secret)
+	}
+	if _, err := totpCode(secret, 1); err != nil {
+		t.Fatalf("expected generated secret to produce codes, got %v", err)
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("Go Microservices", "me@here.com", rfc6238Secret)
+
+	if !strings.HasPrefix(uri, "otpauth://totp/Go%20Microservices:me@here.com?") {
+		t.Fatalf("unexpected otpauth label in %q", uri)
+	}
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("expected a parseable URI, got %v", err)
+	}
+	query := parsed.Query()
+	if query.Get("secret") != rfc6238Secret || query.Get("issuer") != "Go Microservices" || query.Get("digits") != "6" || query.Get("period") != "30" {
+		t.Fatalf("unexpected otpauth parameters %v", query)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatalf("expected recovery codes, got %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("expected %d codes, got %d", recoveryCodeCount, len(codes))
+	}
+
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 19 || strings.Count(code, "-") != 3 {
+			t.Fatalf("expected xxxx-xxxx-xxxx-xxxx, got %q", code)
+		}
+		if seen[code] {
+			t.Fatalf("expected unique codes, got %q twice", code)
+		}
+		seen[code] = true
+	}
+
+	if hashRecoveryCode("3F2A-91C0 7be4-05d1") != hashRecoveryCode("3f2a-91c0-7be4-05d1") {
+		t.Fatalf("expected recovery code hashing to ignore case, dashes and spaces")
+	}
+}
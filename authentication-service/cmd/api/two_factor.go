@@ -0,0 +1,286 @@
+// Package main implements TOTP enrollment and the second step of a two-factor login.
+package main
+
+import (
+	"authentication-service/data"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	errorCodeSecondFactorRequired = "second_factor_required"
+	errorCodeInvalidSecondFactor  = "invalid_second_factor"
+)
+
+var errInvalidSecondFactor = errors.New("invalid one-time code or recovery code")
+
+// secondFactorChallenge is returned by /authenticate when the password was
+// correct but the account also needs a TOTP or recovery code.
+type secondFactorChallenge struct {
+	ChallengeToken string   `json:"challenge_token"`
+	ExpiresIn      int64    `json:"expires_in"`
+	Methods        []string `json:"methods"`
+}
+
+// totpEnrollment is returned when a user starts enrolling an authenticator.
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// handleEnrollTOTP creates a new TOTP secret for the caller. The secret only
+// protects logins once it is confirmed with a code.
+func (app *Config) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+	userID, err := claims.UserID()
+	if err != nil {
+		_ = app.writeErrorJSON(w, errInvalidToken, http.StatusUnauthorized)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	err = app.Repository.SaveTOTPSecret(userID, secret)
+	if err != nil {
+		app.writeTOTPError(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "Scan the URI with an authenticator app and confirm with a code",
+		Data: totpEnrollment{
+			Secret: secret,
+			URI:    totpURI(app.totpIssuer(), claims.Email, secret),
+		},
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, payload)
+}
+
+// handleConfirmTOTP activates the caller's pending enrollment and returns the
+// recovery codes. They are only shown once.
+func (app *Config) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromContext(r.Context())
+	userID, err := claims.UserID()
+	if err != nil {
+		_ = app.writeErrorJSON(w, errInvalidToken, http.StatusUnauthorized)
+		return
+	}
+
+	var requestPayload struct {
+		Code string `json:"code"`
+	}
+
+	err = app.decodeJSON(w, r, &requestPayload)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	enrollment, err := app.Repository.GetTOTP(userID)
+	if err != nil {
+		app.writeTOTPError(w, err)
+		return
+	}
+	if enrollment.Confirmed() {
+		app.writeTOTPError(w, data.ErrTOTPAlreadyConfirmed)
+		return
+	}
+
+	step, ok := verifyTOTP(enrollment.Secret, requestPayload.Code, time.Now())
+	if !ok {
+		_ = app.writeValidationErrorJSON(w, validationErrors{"code": "is invalid or has expired"})
+		return
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	err = app.Repository.ConfirmTOTP(userID, step, hashes)
+	if err != nil {
+		app.writeTOTPError(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "Two-factor authentication enabled; store the recovery codes somewhere safe",
+		Data: struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}{RecoveryCodes: codes},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// handleSecondFactor completes a login started by /authenticate with either a
+// TOTP code or an unused recovery code. Wrong codes count towards the same
+// lockout as wrong passwords.
+func (app *Config) handleSecondFactor(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	err := app.decodeJSON(w, r, &requestPayload)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	claims, err := app.Tokens.Verify(requestPayload.ChallengeToken, tokenTypeChallenge)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := claims.UserID()
+	if err != nil {
+		_ = app.writeErrorJSON(w, errInvalidToken, http.StatusUnauthorized)
+		return
+	}
+
+	if retryAfter, locked := app.Limiter.Locked(claims.Email, app.clientIP(r)); locked {
+		app.audit(r, data.AuditEvent{UserID: userID, Email: claims.Email, Event: data.AuditEventSecondFactor, Outcome: data.AuditOutcomeFailure, Reason: errorCodeAccountLocked})
+		app.writeLoginError(w, lockedOutError(retryAfter))
+		return
+	}
+
+	user, err := app.Repository.GetOne(userID)
+	if err != nil {
+		_ = app.writeErrorJSON(w, errInvalidToken, http.StatusUnauthorized)
+		return
+	}
+	if user.Active == 0 {
+		app.auditUser(r, user, data.AuditEventSecondFactor, data.AuditOutcomeFailure, errorCodeAccountInactive)
+		_ = app.writeErrorCodeJSON(w, errAccountInactive, errorCodeAccountInactive, http.StatusForbidden)
+		return
+	}
+
+	err = app.checkSecondFactor(r, user, requestPayload.Code, requestPayload.RecoveryCode)
+	if errors.Is(err, errInvalidSecondFactor) {
+		app.recordLoginFailure(r, data.AuditEvent{UserID: user.ID, Email: claims.Email, Event: data.AuditEventSecondFactor, Reason: errorCodeInvalidSecondFactor})
+		_ = app.writeErrorCodeJSON(w, err, errorCodeInvalidSecondFactor, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+	app.Limiter.RecordSuccess(claims.Email)
+
+	app.completeLogin(w, r, user)
+}
+
+// checkSecondFactor accepts an unused recovery code or a TOTP code for a step
+// that has not been used before, auditing recovery code use. Any rejection
+// is errInvalidSecondFactor.
+func (app *Config) checkSecondFactor(r *http.Request, user *data.User, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		err := app.Repository.ConsumeRecoveryCode(user.ID, hashRecoveryCode(recoveryCode))
+		if errors.Is(err, data.ErrRecoveryCodeInvalid) {
+			return errInvalidSecondFactor
+		}
+		if err == nil {
+			app.auditUser(r, user, data.AuditEventRecoveryCode, data.AuditOutcomeSuccess, "")
+		}
+		return err
+	}
+
+	enrollment, err := app.Repository.GetTOTP(user.ID)
+	if errors.Is(err, data.ErrTOTPNotEnrolled) {
+		return errInvalidSecondFactor
+	}
+	if err != nil {
+		return err
+	}
+
+	step, ok := verifyTOTP(enrollment.Secret, code, time.Now())
+	if !ok {
+		return errInvalidSecondFactor
+	}
+
+	err = app.Repository.UseTOTPStep(user.ID, step)
+	if errors.Is(err, data.ErrTOTPCodeReused) {
+		return errInvalidSecondFactor
+	}
+
+	return err
+}
+
+// requiresSecondFactor reports whether user has a confirmed TOTP enrollment.
+func (app *Config) requiresSecondFactor(user *data.User) (bool, error) {
+	enrollment, err := app.Repository.GetTOTP(user.ID)
+	if errors.Is(err, data.ErrTOTPNotEnrolled) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return enrollment.Confirmed(), nil
+}
+
+func (app *Config) writeSecondFactorChallenge(w http.ResponseWriter, user *data.User) {
+	challenge, err := app.issueSecondFactorChallenge(user)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Code:    errorCodeSecondFactorRequired,
+		Message: "A one-time code is required to finish logging in",
+		Data:    challenge,
+	}
+
+	_ = app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// issueSecondFactorChallenge starts the second step of user's login.
+func (app *Config) issueSecondFactorChallenge(user *data.User) (secondFactorChallenge, error) {
+	token, err := app.Tokens.IssueChallenge(*user)
+	if err != nil {
+		return secondFactorChallenge{}, err
+	}
+
+	return secondFactorChallenge{
+		ChallengeToken: token,
+		ExpiresIn:      int64(challengeTokenTTL / time.Second),
+		Methods:        []string{"totp", "recovery_code"},
+	}, nil
+}
+
+func (app *Config) writeTOTPError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, data.ErrTOTPAlreadyConfirmed):
+		_ = app.writeErrorJSON(w, err, http.StatusConflict)
+	case errors.Is(err, data.ErrTOTPNotEnrolled):
+		_ = app.writeErrorJSON(w, err, http.StatusNotFound)
+	default:
+		app.writeRepositoryError(w, err)
+	}
+}
+
+func (app *Config) totpIssuer() string {
+	if app.TOTPIssuer == "" {
+		return defaultTOTPIssuer
+	}
+
+	return app.TOTPIssuer
+}
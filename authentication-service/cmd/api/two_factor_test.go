@@ -0,0 +1,170 @@
+// Package main contains tests for TOTP enrollment and two-factor logins.
+package main
+
+import (
+	"authentication-service/data"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// enrollTOTP enrolls and confirms a second factor for the user with token and
+// returns the secret, the step used to confirm it and the recovery codes.
+func enrollTOTP(t *testing.T, app *Config, token string) (string, int64, []string) {
+	t.Helper()
+
+	rr := serveRequest(t, app, http.MethodPost, "/totp/enroll", nil, token)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d enrolling, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var enrollment struct {
+		Data totpEnrollment `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &enrollment); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+	secret := enrollment.Data.Secret
+
+	rr = serveRequest(t, app, http.MethodPost, "/totp/confirm", map[string]string{"code": "000000x"}, token)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status %d for a bad code, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+
+	step := totpStep(time.Now())
+	code, _ := totpCode(secret, step)
+	rr = serveRequest(t, app, http.MethodPost, "/totp/confirm", map[string]string{"code": code}, token)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d confirming, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var confirmed struct {
+		Data struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &confirmed); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+
+	return secret, step, confirmed.Data.RecoveryCodes
+}
+
+func decodeChallenge(t *testing.T, rr *httptest.ResponseRecorder) secondFactorChallenge {
+	t.Helper()
+
+	var response struct {
+		Code string                `json:"code"`
+		Data secondFactorChallenge `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+	if response.Code != errorCodeSecondFactorRequired || response.Data.ChallengeToken == "" {
+		t.Fatalf("expected a second factor challenge, got %s", rr.Body.String())
+	}
+
+	return response.Data
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+
+	id, _ := repo.Insert(data.User{Email: "me@here.com", Password: "long-enough", Active: 1})
+	credentials := map[string]string{"email": "me@here.com", "password": "long-enough"}
+
+	rr := serveRequest(t, app, http.MethodPost, "/authenticate", credentials, "")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rr.Code, rr.Body.String())
+	}
+	token := decodeAuthResponse(t, rr).AccessToken
+
+	secret, confirmedStep, recoveryCodes := enrollTOTP(t, app, token)
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodeCount, len(recoveryCodes))
+	}
+
+	rr = serveRequest(t, app, http.MethodPost, "/totp/enroll", nil, token)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected status %d re-enrolling, got %d", http.StatusConflict, rr.Code)
+	}
+
+	rr = serveRequest(t, app, http.MethodPost, "/authenticate", credentials, "")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rr.Code, rr.Body.String())
+	}
+	challenge := decodeChallenge(t, rr).ChallengeToken
+
+	if _, err := app.Tokens.Verify(challenge, tokenTypeAccess); err == nil {
+		t.Fatalf("expected the challenge token not to work as an access token")
+	}
+
+	replayedCode, _ := totpCode(secret, confirmedStep)
+	nextCode, _ := totpCode(secret, confirmedStep+1)
+
+	tests := []struct {
+		name           string
+		body           map[string]string
+		expectedStatus int
+	}{
+		{name: "missing challenge", body: map[string]string{"code": nextCode}, expectedStatus: http.StatusUnauthorized},
+		{name: "access token as challenge", body: map[string]string{"challenge_token": token, "code": nextCode}, expectedStatus: http.StatusUnauthorized},
+		{name: "wrong code", body: map[string]string{"challenge_token": challenge, "code": "000000"}, expectedStatus: http.StatusUnauthorized},
+		{name: "replayed code", body: map[string]string{"challenge_token": challenge, "code": replayedCode}, expectedStatus: http.StatusUnauthorized},
+		{name: "valid code", body: map[string]string{"challenge_token": challenge, "code": nextCode}, expectedStatus: http.StatusAccepted},
+		{name: "same code again", body: map[string]string{"challenge_token": challenge, "code": nextCode}, expectedStatus: http.StatusUnauthorized},
+		{name: "recovery code", body: map[string]string{"challenge_token": challenge, "recovery_code": recoveryCodes[0]}, expectedStatus: http.StatusAccepted},
+		{name: "used recovery code", body: map[string]string{"challenge_token": challenge, "recovery_code": recoveryCodes[0]}, expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serveRequest(t, app, http.MethodPost, "/authenticate/second-factor", tt.body, "")
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+
+			if rr.Code == http.StatusAccepted {
+				claims, err := app.Tokens.Verify(decodeAuthResponse(t, rr).AccessToken, tokenTypeAccess)
+				if userID, _ := claims.UserID(); err != nil || userID != id {
+					t.Fatalf("expected an access token for user %d, got %d (%v)", id, userID, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSecondFactorFailuresCountTowardsLockout(t *testing.T) {
+	app, repo := newRolesTestApp(t)
+	app.Limiter = NewLoginLimiter(2, defaultIPLockoutThreshold, time.Minute, time.Minute)
+
+	_, _ = repo.Insert(data.User{Email: "me@here.com", Password: "long-enough", Active: 1})
+	credentials := map[string]string{"email": "me@here.com", "password": "long-enough"}
+
+	rr := serveRequest(t, app, http.MethodPost, "/authenticate", credentials, "")
+	secret, step, _ := enrollTOTP(t, app, decodeAuthResponse(t, rr).AccessToken)
+
+	rr = serveRequest(t, app, http.MethodPost, "/authenticate", credentials, "")
+	challenge := decodeChallenge(t, rr).ChallengeToken
+
+	for i := 0; i < 2; i++ {
+		rr = serveRequest(t, app, http.MethodPost, "/authenticate/second-factor", map[string]string{"challenge_token": challenge, "code": "000000"}, "")
+		if code := decodeErrorCode(t, rr); code != errorCodeInvalidSecondFactor {
+			t.Fatalf("expected %s, got %s", errorCodeInvalidSecondFactor, code)
+		}
+	}
+
+	// a correct password must not reset the count while codes are failing
+	rr = serveRequest(t, app, http.MethodPost, "/authenticate", credentials, "")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d after failed codes, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	code, _ := totpCode(secret, step+1)
+	rr = serveRequest(t, app, http.MethodPost, "/authenticate/second-factor", map[string]string{"challenge_token": challenge, "code": code}, "")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d while locked, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+}
@@ -0,0 +1,280 @@
+// Package main defines HTTP handlers for user registration and profile management.
+package main
+
+import (
+	"authentication-service/data"
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultUserPageSize = 50
+	maxUserPageSize     = 200
+)
+
+var (
+	errUserNotFound = errors.New("user not found")
+	errForbidden    = errors.New("not allowed to access this user")
+)
+
+type registerUserRequest struct {
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Password  string `json:"password"`
+}
+
+type updateUserRequest struct {
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+func (app *Config) handleRegisterUser(w http.ResponseWriter, r *http.Request) {
+	var requestPayload registerUserRequest
+
+	err := app.decodeJSON(w, r, &requestPayload)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	requestPayload.Email = strings.TrimSpace(requestPayload.Email)
+
+	errs := validationErrors{}
+	errs.checkEmail("email", requestPayload.Email)
+	err = errs.checkPassword(app.passwordPolicy(), "password", requestPayload.Password, requestPayload.Email)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+	errs.checkName("first_name", requestPayload.FirstName)
+	errs.checkName("last_name", requestPayload.LastName)
+	if !errs.valid() {
+		_ = app.writeValidationErrorJSON(w, errs)
+		return
+	}
+
+	user := data.User{
+		Email:     requestPayload.Email,
+		FirstName: requestPayload.FirstName,
+		LastName:  requestPayload.LastName,
+		Password:  requestPayload.Password,
+		Active:    1,
+	}
+
+	user.ID, err = app.Repository.Insert(user)
+	if err != nil {
+		app.writeRepositoryError(w, err)
+		return
+	}
+	app.sendEmailVerification(user)
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "Registered user " + user.Email,
+		Data:    user,
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, payload)
+}
+
+// handleListUsers returns a page of users. They can be filtered by active,
+// email_prefix, created_after and created_before, and sorted by last name,
+// email or creation time, with a leading "-" for descending order. cursor
+// takes the next_cursor of the previous page.
+func (app *Config) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	query := data.UserQuery{
+		EmailPrefix: params.Get("email_prefix"),
+		Cursor:      params.Get("cursor"),
+	}
+
+	errs := validationErrors{}
+	query.Active = errs.checkQueryBool("active", params.Get("active"))
+	query.CreatedAfter = errs.checkQueryTime("created_after", params.Get("created_after"))
+	query.CreatedBefore = errs.checkQueryTime("created_before", params.Get("created_before"))
+	query.Limit = errs.checkQueryInt("limit", params.Get("limit"), defaultUserPageSize, 1, maxUserPageSize)
+	query.Sort, query.Descending = strings.CutPrefix(params.Get("sort"), "-")
+	if query.Sort != "" && !slices.Contains(data.UserSorts, query.Sort) {
+		errs.add("sort", "must be one of "+strings.Join(data.UserSorts, ", ")+", optionally prefixed with -")
+	}
+	if !errs.valid() {
+		_ = app.writeValidationErrorJSON(w, errs)
+		return
+	}
+
+	page, err := app.Repository.ListUsers(query)
+	if errors.Is(err, data.ErrInvalidCursor) {
+		errs.add("cursor", "must be the next_cursor of a page with the same sort")
+		_ = app.writeValidationErrorJSON(w, errs)
+		return
+	}
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "Users",
+		Data:    page,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *Config) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.loadAuthorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.loadAuthorization(user)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "User " + user.Email,
+		Data:    user,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *Config) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	var requestPayload updateUserRequest
+
+	err := app.decodeJSON(w, r, &requestPayload)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	requestPayload.Email = strings.TrimSpace(requestPayload.Email)
+
+	errs := validationErrors{}
+	if requestPayload.Email != "" {
+		errs.checkEmail("email", requestPayload.Email)
+	}
+	errs.checkName("first_name", requestPayload.FirstName)
+	errs.checkName("last_name", requestPayload.LastName)
+	if !errs.valid() {
+		_ = app.writeValidationErrorJSON(w, errs)
+		return
+	}
+
+	user, ok := app.loadAuthorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	// only overwrite the fields the caller supplied
+	if requestPayload.Email != "" {
+		user.Email = requestPayload.Email
+	}
+	if requestPayload.FirstName != "" {
+		user.FirstName = requestPayload.FirstName
+	}
+	if requestPayload.LastName != "" {
+		user.LastName = requestPayload.LastName
+	}
+
+	err = app.Repository.Update(*user)
+	if err != nil {
+		app.writeRepositoryError(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "Updated user " + user.Email,
+		Data:    user,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *Config) handleDeactivateUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.loadAuthorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	user.Active = 0
+
+	err := app.Repository.Update(*user)
+	if err != nil {
+		app.writeRepositoryError(w, err)
+		return
+	}
+
+	err = app.Repository.RevokeSessions(user.ID)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "Deactivated user " + user.Email,
+		Data:    user,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// loadAuthorizedUser fetches the {id} user, allowing callers to access only
+// their own account. It writes the error response itself when it returns false.
+func (app *Config) loadAuthorizedUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = app.writeErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		_ = app.writeErrorJSON(w, errors.New("missing bearer token"), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	callerID, err := claims.UserID()
+	if err != nil || callerID != userID {
+		_ = app.writeErrorJSON(w, errForbidden, http.StatusForbidden)
+		return nil, false
+	}
+
+	user, err := app.Repository.GetOne(userID)
+	if err != nil {
+		app.writeRepositoryError(w, err)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// writeRepositoryError maps data-layer errors onto HTTP status codes.
+func (app *Config) writeRepositoryError(w http.ResponseWriter, err error) {
+	var policyErr *data.PasswordPolicyError
+	switch {
+	case errors.As(err, &policyErr):
+		_ = app.writeValidationErrorJSON(w, validationErrors{"password": strings.Join(policyErr.Violations, "; ")})
+	case errors.Is(err, data.ErrDuplicateEmail):
+		_ = app.writeErrorJSON(w, err, http.StatusConflict)
+	case errors.Is(err, sql.ErrNoRows):
+		_ = app.writeErrorJSON(w, errUserNotFound, http.StatusNotFound)
+	default:
+		_ = app.writeErrorJSON(w, err)
+	}
+}
@@ -0,0 +1,288 @@
+// Package main contains tests for the user registration and profile API.
+package main
+
+import (
+	"authentication-service/data"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHandleRegisterUser(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           map[string]string
+		expectedStatus int
+		invalidField   string
+	}{
+		{
+			name:           "valid registration",
+			body:           map[string]string{"email": "new@here.com", "password": "long-enough", "first_name": "New"},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "invalid email",
+			body:           map[string]string{"email": "not-an-email", "password": "long-enough"},
+			expectedStatus: http.StatusUnprocessableEntity,
+			invalidField:   "email",
+		},
+		{
+			name:           "short password",
+			body:           map[string]string{"email": "new@here.com", "password": "short"},
+			expectedStatus: http.StatusUnprocessableEntity,
+			invalidField:   "password",
+		},
+		{
+			name:           "breached password",
+			body:           map[string]string{"email": "new@here.com", "password": "password123"},
+			expectedStatus: http.StatusUnprocessableEntity,
+			invalidField:   "password",
+		},
+		{
+			name:           "password based on email",
+			body:           map[string]string{"email": "jane.doe@here.com", "password": "JaneDoe-2026"},
+			expectedStatus: http.StatusUnprocessableEntity,
+			invalidField:   "password",
+		},
+		{
+			name:           "duplicate email",
+			body:           map[string]string{"email": data.TestDuplicateEmail, "password": "long-enough"},
+			expectedStatus: http.StatusConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serveUserRequest(t, http.MethodPost, "/users", tt.body, "")
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+
+			if tt.invalidField == "" {
+				return
+			}
+
+			var response struct {
+				Data map[string]string `json:"data"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode JSON response: %v", err)
+			}
+			if _, ok := response.Data[tt.invalidField]; !ok {
+				t.Fatalf("expected a validation error for %s, got %v", tt.invalidField, response.Data)
+			}
+		})
+	}
+}
+
+func TestUserProfileEndpointsRequireOwnership(t *testing.T) {
+	token := issueTestAccessToken(t, data.User{ID: 1, Email: "me@here.com"})
+	adminToken := issueTestAccessToken(t, data.User{ID: 3, Email: "admin@here.com", Permissions: []string{data.PermissionUsersList}})
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           any
+		token          string
+		expectedStatus int
+	}{
+		{name: "get own profile", method: http.MethodGet, path: "/users/1", token: token, expectedStatus: http.StatusOK},
+		{name: "get without token", method: http.MethodGet, path: "/users/1", expectedStatus: http.StatusUnauthorized},
+		{name: "get another user", method: http.MethodGet, path: "/users/2", token: token, expectedStatus: http.StatusForbidden},
+		{name: "invalid id", method: http.MethodGet, path: "/users/abc", token: token, expectedStatus: http.StatusBadRequest},
+		{name: "update own profile", method: http.MethodPut, path: "/users/1", body: map[string]string{"first_name": "Renamed"}, token: token, expectedStatus: http.StatusOK},
+		{name: "update to taken email", method: http.MethodPut, path: "/users/1", body: map[string]string{"email": data.TestDuplicateEmail}, token: token, expectedStatus: http.StatusConflict},
+		{name: "update with invalid email", method: http.MethodPut, path: "/users/1", body: map[string]string{"email": "nope"}, token: token, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "deactivate own account", method: http.MethodDelete, path: "/users/1", token: token, expectedStatus: http.StatusOK},
+		{name: "list users without permission", method: http.MethodGet, path: "/users", token: token, expectedStatus: http.StatusForbidden},
+		{name: "list users as admin", method: http.MethodGet, path: "/users", token: adminToken, expectedStatus: http.StatusOK},
+		{name: "list users without token", method: http.MethodGet, path: "/users", expectedStatus: http.StatusUnauthorized},
+		{name: "list users with invalid filters", method: http.MethodGet, path: "/users?active=maybe&created_after=yesterday&sort=password&limit=0", token: adminToken, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "list users with invalid cursor", method: http.MethodGet, path: "/users?cursor=nope", token: adminToken, expectedStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serveUserRequest(t, tt.method, tt.path, tt.body, tt.token)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleDeactivateUserClearsActiveFlag(t *testing.T) {
+	token := issueTestAccessToken(t, data.User{ID: 1, Email: "me@here.com"})
+
+	rr := serveUserRequest(t, http.MethodDelete, "/users/1", nil, token)
+
+	var response struct {
+		Data data.User `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+	if response.Data.Active != 0 {
+		t.Fatalf("expected user to be inactive, got active=%d", response.Data.Active)
+	}
+}
+
+func TestUserLifecycleWithMemoryRepository(t *testing.T) {
+	repo := data.NewMemoryRepository()
+	repo.Hasher = &data.PasswordHasher{Algorithm: data.HashAlgorithmBcrypt, BcryptCost: bcrypt.MinCost}
+
+	app := Config{
+		Repository: repo,
+		Tokens:     testApp.Tokens,
+		Limiter:    NewLoginLimiter(defaultAccountLockoutThreshold, defaultIPLockoutThreshold, defaultLockoutWindow, defaultLockoutDuration),
+		HTTPClient: newTestHTTPClient(func(req *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusAccepted,
+				Body:       io.NopCloser(bytes.NewBufferString(`{"error":false}`)),
+				Header:     make(http.Header),
+			}
+		}),
+	}
+
+	rr := serveRequest(t, &app, http.MethodPost, "/users", map[string]string{"email": "life@here.com", "password": "long-enough", "last_name": "Before"}, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d on register, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	credentials := func(password string) map[string]string {
+		return map[string]string{"email": "life@here.com", "password": password}
+	}
+
+	rr = serveRequest(t, &app, http.MethodPost, "/authenticate", credentials("wrong-password"), "")
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d for a wrong password, got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	rr = serveRequest(t, &app, http.MethodPost, "/authenticate", credentials("long-enough"), "")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d for the right password, got %d: %s", http.StatusAccepted, rr.Code, rr.Body.String())
+	}
+	token := decodeAuthResponse(t, rr).AccessToken
+
+	user, _ := repo.GetByEmail("life@here.com")
+	path := "/users/" + strconv.Itoa(user.ID)
+
+	rr = serveRequest(t, &app, http.MethodPut, path, map[string]string{"last_name": "After"}, token)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d on update, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if user, _ = repo.GetOne(user.ID); user.LastName != "After" {
+		t.Fatalf("expected the update to persist, got last name %q", user.LastName)
+	}
+
+	rr = serveRequest(t, &app, http.MethodDelete, path, nil, token)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d on deactivate, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	rr = serveRequest(t, &app, http.MethodPost, "/authenticate", credentials("long-enough"), "")
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d after deactivation, got %d", http.StatusForbidden, rr.Code)
+	}
+
+	rr = serveRequest(t, &app, http.MethodPost, "/authenticate", map[string]string{"email": "nobody@here.com", "password": "long-enough"}, "")
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d for an unknown user, got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+func issueTestAccessToken(t *testing.T, user data.User) string {
+	t.Helper()
+
+	pair, err := testApp.Tokens.IssuePair(user, "")
+	if err != nil {
+		t.Fatalf("failed to issue tokens: %v", err)
+	}
+
+	return pair.AccessToken
+}
+
+func serveUserRequest(t *testing.T, method, path string, body any, token string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	return serveRequest(t, &testApp, method, path, body, token)
+}
+
+func serveRequest(t *testing.T, app *Config, method, path string, body any, token string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewBuffer(payload))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+
+	app.routes().ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestHandleListUsersPages(t *testing.T) {
+	app, repo, token := newBulkTestApp(t)
+	for _, email := range []string{"carol@here.com", "bob@here.com", "dave@here.com", "CAT@here.com"} {
+		_, _ = repo.Insert(data.User{Email: email, Password: "long-enough", Active: 1})
+	}
+	_, _ = repo.Insert(data.User{Email: "alice@here.com", Password: "long-enough"})
+
+	var emails []string
+	path := "/users?sort=-email&limit=2&active=true"
+	for pages := 0; path != ""; pages++ {
+		if pages > 3 {
+			t.Fatalf("expected the pages to end, got %v", emails)
+		}
+
+		rr := serveRequest(t, app, http.MethodGet, path, nil, token)
+		var response struct {
+			Data data.UserPage `json:"data"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("expected a page of users, got %d: %s", rr.Code, rr.Body.String())
+		}
+		for _, user := range response.Data.Users {
+			emails = append(emails, user.Email)
+		}
+
+		path = ""
+		if response.Data.NextCursor != "" {
+			path = "/users?sort=-email&limit=2&active=true&cursor=" + url.QueryEscape(response.Data.NextCursor)
+		}
+	}
+
+	if fmt.Sprint(emails) != "[me@here.com dave@here.com carol@here.com bob@here.com CAT@here.com]" {
+		t.Fatalf("expected active users by descending email, got %v", emails)
+	}
+
+	rr := serveRequest(t, app, http.MethodGet, "/users?email_prefix=ca&created_after=2000-01-01T00:00:00Z", nil, token)
+	var response struct {
+		Data data.UserPage `json:"data"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &response)
+	if len(response.Data.Users) != 2 || response.Data.NextCursor != "" {
+		t.Fatalf("expected carol and CAT, got %s", rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "password") {
+		t.Fatalf("expected no password hashes, got %s", rr.Body.String())
+	}
+}
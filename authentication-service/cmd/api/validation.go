@@ -0,0 +1,167 @@
+// Package main contains request validation helpers for authentication-service.
+package main
+
+import (
+	"authentication-service/data"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxNameLength    = 255
+	maxAPIKeyNameLen = 100
+)
+
+// validationErrors maps request field names to a human-readable problem.
+type validationErrors map[string]string
+
+func (v validationErrors) add(field, message string) {
+	if _, exists := v[field]; !exists {
+		v[field] = message
+	}
+}
+
+func (v validationErrors) valid() bool {
+	return len(v) == 0
+}
+
+// err describes every problem on one line, for command-line use.
+func (v validationErrors) err() error {
+	fields := make([]string, 0, len(v))
+	for field := range v {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+
+	problems := make([]string, len(fields))
+	for i, field := range fields {
+		problems[i] = field + " " + v[field]
+	}
+
+	return errors.New(strings.Join(problems, "; "))
+}
+
+func (v validationErrors) checkEmail(field, email string) {
+	if strings.TrimSpace(email) == "" {
+		v.add(field, "is required")
+		return
+	}
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		v.add(field, "must be a valid email address")
+	}
+}
+
+// checkPassword adds every rule of policy that password breaks for the
+// account with email. It returns an error only if the policy could not be
+// checked.
+func (v validationErrors) checkPassword(policy *data.PasswordPolicy, field, password, email string) error {
+	violations, err := policy.Violations(password, email)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		v.add(field, strings.Join(violations, "; "))
+	}
+
+	return nil
+}
+
+func (v validationErrors) checkName(field, name string) {
+	if len(name) > maxNameLength {
+		v.add(field, "must be at most 255 characters long")
+	}
+}
+
+func (v validationErrors) checkAPIKeyName(field, name string) {
+	if name == "" {
+		v.add(field, "is required")
+		return
+	}
+	if len(name) > maxAPIKeyNameLen {
+		v.add(field, "must be at most 100 characters long")
+	}
+}
+
+func (v validationErrors) checkScopes(field string, scopes []string) {
+	if len(scopes) == 0 {
+		v.add(field, "must include at least one scope")
+		return
+	}
+
+	for _, scope := range scopes {
+		if !slices.Contains(data.APIKeyScopes, scope) {
+			v.add(field, "must only include "+strings.Join(data.APIKeyScopes, ", "))
+			return
+		}
+	}
+}
+
+// checkQueryInt parses an optional whole-number query parameter, returning
+// fallback when it is absent. A max of zero means there is no upper bound.
+func (v validationErrors) checkQueryInt(field, value string, fallback, min, max int) int {
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	switch {
+	case err != nil || n < min:
+		v.add(field, fmt.Sprintf("must be a whole number of at least %d", min))
+	case max > 0 && n > max:
+		v.add(field, fmt.Sprintf("must be at most %d", max))
+	default:
+		return n
+	}
+
+	return fallback
+}
+
+// checkQueryBool parses an optional true or false query parameter, returning
+// nil when it is absent.
+func (v validationErrors) checkQueryBool(field, value string) *bool {
+	if value == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		v.add(field, "must be true or false")
+		return nil
+	}
+
+	return &b
+}
+
+// checkQueryTime parses an optional RFC 3339 query parameter, returning the
+// zero time when it is absent.
+func (v validationErrors) checkQueryTime(field, value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		v.add(field, "must be an RFC 3339 time such as 2024-01-31T00:00:00Z")
+	}
+
+	return t
+}
+
+// writeValidationErrorJSON responds with 422 and the per-field problems.
+func (app *Config) writeValidationErrorJSON(w http.ResponseWriter, errs validationErrors) error {
+	payload := JsonResponse{
+		Error:   true,
+		Message: "validation failed",
+		Data:    errs,
+	}
+
+	return app.writeJSON(w, http.StatusUnprocessableEntity, payload)
+}
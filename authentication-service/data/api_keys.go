@@ -0,0 +1,255 @@
+// Package data stores hashed API keys for service-to-service callers.
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scopes an API key can be granted. They are checked per broker action.
+const (
+	ScopeLogWrite = "log:write"
+	ScopeMailSend = "mail:send"
+)
+
+// APIKeyScopes lists every scope an API key can be granted.
+var APIKeyScopes = []string{ScopeLogWrite, ScopeMailSend}
+
+// ErrAPIKeyNotFound is returned for unknown and revoked API keys.
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey identifies a service rather than a user. Only KeyHash is stored;
+// Prefix is the start of the key, kept so keys can be told apart.
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  int        `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Active reports whether the key has not been revoked.
+func (key *APIKey) Active() bool {
+	return key.RevokedAt == nil
+}
+
+// HasScope reports whether the key grants scope.
+func (key *APIKey) HasScope(scope string) bool {
+	return slices.Contains(key.Scopes, scope)
+}
+
+// InsertAPIKey stores a new key and returns its ID.
+func (repo *PostgresRepository) InsertAPIKey(key APIKey) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into api_keys (name, prefix, key_hash, scopes, created_by, created_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	var createdBy sql.NullInt64
+	if key.CreatedBy != 0 {
+		createdBy = sql.NullInt64{Int64: int64(key.CreatedBy), Valid: true}
+	}
+
+	var id int
+	err := repo.Conn.QueryRowContext(ctx, stmt,
+		key.Name,
+		key.Prefix,
+		key.KeyHash,
+		strings.Join(key.Scopes, " "),
+		createdBy,
+		key.CreatedAt,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetAPIKeyByHash returns the active key with the given hash.
+func (repo *PostgresRepository) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, name, prefix, key_hash, scopes, created_by, created_at, rotated_at, last_used_at, revoked_at
+		from api_keys where key_hash = $1 and revoked_at is null`
+
+	key, err := scanAPIKey(repo.Conn.QueryRowContext(ctx, query, keyHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// ListAPIKeys returns the active keys, newest first.
+func (repo *PostgresRepository) ListAPIKeys() ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, name, prefix, key_hash, scopes, created_by, created_at, rotated_at, last_used_at, revoked_at
+		from api_keys where revoked_at is null order by created_at desc, id desc`
+
+	rows, err := repo.Conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// RotateAPIKey replaces the secret of an active key, keeping its name and
+// scopes. The old key stops working immediately.
+func (repo *PostgresRepository) RotateAPIKey(id int, prefix, keyHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update api_keys set prefix = $1, key_hash = $2, rotated_at = $3
+		where id = $4 and revoked_at is null`
+
+	result, err := repo.Conn.ExecContext(ctx, stmt, prefix, keyHash, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return apiKeyAffected(result)
+}
+
+// RevokeAPIKey revokes an active key.
+func (repo *PostgresRepository) RevokeAPIKey(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update api_keys set revoked_at = $1 where id = $2 and revoked_at is null`
+
+	result, err := repo.Conn.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return apiKeyAffected(result)
+}
+
+// TouchAPIKey records that a key was used at usedAt.
+func (repo *PostgresRepository) TouchAPIKey(id int, usedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := repo.Conn.ExecContext(ctx, `update api_keys set last_used_at = $1 where id = $2`, usedAt, id)
+
+	return err
+}
+
+func apiKeyAffected(result sql.Result) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	var key APIKey
+	var scopes string
+	var createdBy sql.NullInt64
+	var rotatedAt, lastUsedAt, revokedAt sql.NullTime
+
+	err := row.Scan(
+		&key.ID,
+		&key.Name,
+		&key.Prefix,
+		&key.KeyHash,
+		&scopes,
+		&createdBy,
+		&key.CreatedAt,
+		&rotatedAt,
+		&lastUsedAt,
+		&revokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	key.Scopes = strings.Fields(scopes)
+	key.CreatedBy = int(createdBy.Int64)
+	key.RotatedAt = nullTime(rotatedAt)
+	key.LastUsedAt = nullTime(lastUsedAt)
+	key.RevokedAt = nullTime(revokedAt)
+
+	return &key, nil
+}
+
+// apiKeyMap holds API keys for the in-memory repositories. Callers must
+// serialise access to it.
+type apiKeyMap map[int]APIKey
+
+func (keys apiKeyMap) insert(key APIKey) int {
+	key.ID = len(keys) + 1
+	key.Scopes = append([]string{}, key.Scopes...)
+	keys[key.ID] = key
+
+	return key.ID
+}
+
+func (keys apiKeyMap) byHash(keyHash string) (*APIKey, error) {
+	for _, key := range keys {
+		if key.KeyHash == keyHash && key.Active() {
+			return &key, nil
+		}
+	}
+
+	return nil, ErrAPIKeyNotFound
+}
+
+func (keys apiKeyMap) list() []*APIKey {
+	list := []*APIKey{}
+	for _, key := range keys {
+		if key.Active() {
+			list = append(list, &key)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID > list[j].ID
+	})
+
+	return list
+}
+
+func (keys apiKeyMap) update(id int, change func(key *APIKey)) error {
+	key, ok := keys[id]
+	if !ok || !key.Active() {
+		return ErrAPIKeyNotFound
+	}
+	change(&key)
+	keys[id] = key
+
+	return nil
+}
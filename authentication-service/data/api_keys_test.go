@@ -0,0 +1,74 @@
+// Package data verifies API key storage in the in-memory repository.
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryRepositoryAPIKeys(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+	userID, _ := repo.Insert(User{Email: "me@here.com", Password: "secret-password"})
+
+	scopes := []string{ScopeLogWrite}
+	first, _ := repo.InsertAPIKey(APIKey{Name: "first", Prefix: "mk_1", KeyHash: "hash-1", Scopes: scopes, CreatedBy: userID})
+	second, _ := repo.InsertAPIKey(APIKey{Name: "second", Prefix: "mk_2", KeyHash: "hash-2", Scopes: []string{ScopeMailSend}})
+	scopes[0] = "changed"
+
+	key, err := repo.GetAPIKeyByHash("hash-1")
+	if err != nil || key.ID != first || !key.HasScope(ScopeLogWrite) || key.HasScope(ScopeMailSend) {
+		t.Fatalf("expected key %d with its own copy of scopes, got %+v, %v", first, key, err)
+	}
+
+	keys, _ := repo.ListAPIKeys()
+	if len(keys) != 2 || keys[0].ID != second {
+		t.Fatalf("expected newest key first, got %+v", keys)
+	}
+
+	if err := repo.RotateAPIKey(first, "mk_3", "hash-3"); err != nil {
+		t.Fatalf("expected rotate to succeed, got %v", err)
+	}
+	if _, err := repo.GetAPIKeyByHash("hash-1"); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Fatalf("expected the old hash to stop working, got %v", err)
+	}
+	if key, _ := repo.GetAPIKeyByHash("hash-3"); key.RotatedAt == nil || key.Name != "first" {
+		t.Fatalf("expected the rotated key to keep its name, got %+v", key)
+	}
+
+	usedAt := time.Now()
+	_ = repo.TouchAPIKey(first, usedAt)
+	if key, _ := repo.GetAPIKeyByHash("hash-3"); key.LastUsedAt == nil || !key.LastUsedAt.Equal(usedAt) {
+		t.Fatalf("expected last used time to be recorded, got %+v", key.LastUsedAt)
+	}
+
+	tests := []struct {
+		name        string
+		id          int
+		expectedErr error
+	}{
+		{name: "active key", id: second, expectedErr: nil},
+		{name: "already revoked", id: second, expectedErr: ErrAPIKeyNotFound},
+		{name: "unknown key", id: 99, expectedErr: ErrAPIKeyNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := repo.RevokeAPIKey(tt.id); !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("expected %v, got %v", tt.expectedErr, err)
+			}
+		})
+	}
+
+	if _, err := repo.GetAPIKeyByHash("hash-2"); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Fatalf("expected a revoked key to be hidden, got %v", err)
+	}
+	if err := repo.RotateAPIKey(second, "mk_4", "hash-4"); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Fatalf("expected rotating a revoked key to fail, got %v", err)
+	}
+
+	_ = repo.DeleteByID(userID)
+	if key, _ := repo.GetAPIKeyByHash("hash-3"); key.CreatedBy != 0 {
+		t.Fatalf("expected keys to outlive their creator, got created_by %d", key.CreatedBy)
+	}
+}
@@ -0,0 +1,131 @@
+// Package data stores the audit trail of authentication events.
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Audited events.
+const (
+	AuditEventLogin          = "login"
+	AuditEventSecondFactor   = "second_factor"
+	AuditEventLockout        = "lockout"
+	AuditEventPasswordChange = "password_change"
+	AuditEventTokenRefresh   = "token_refresh"
+	// AuditEventRecoveryCode records a second factor answered with a
+	// recovery code, which is worth spotting since each can be used once.
+	AuditEventRecoveryCode = "recovery_code"
+)
+
+// Outcomes of an audited event.
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// AuditEvent records one authentication attempt. UserID is zero when the
+// attempt could not be tied to an account, such as a login with an unknown
+// email; Email then holds what was tried. Reason explains a failure.
+type AuditEvent struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	Event     string    `json:"event"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// InsertAuditEvent appends an event to the audit trail.
+func (repo *PostgresRepository) InsertAuditEvent(event AuditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into audit_events (user_id, email, event, outcome, reason, ip, user_agent, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	var userID sql.NullInt64
+	if event.UserID != 0 {
+		userID = sql.NullInt64{Int64: int64(event.UserID), Valid: true}
+	}
+
+	_, err := repo.Conn.ExecContext(ctx, stmt,
+		userID,
+		event.Email,
+		event.Event,
+		event.Outcome,
+		event.Reason,
+		event.IP,
+		event.UserAgent,
+		event.CreatedAt,
+	)
+
+	return err
+}
+
+// ListAuditEvents returns up to limit of a user's events, newest first.
+// A non-zero before only returns events older than the event with that ID.
+func (repo *PostgresRepository) ListAuditEvents(userID, before, limit int) ([]*AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, email, event, outcome, reason, ip, user_agent, created_at
+		from audit_events where user_id = $1 and ($2 = 0 or id < $2)
+		order by id desc limit $3`
+
+	rows, err := repo.Conn.QueryContext(ctx, query, userID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+	for rows.Next() {
+		var event AuditEvent
+		var eventUserID sql.NullInt64
+
+		err := rows.Scan(
+			&event.ID,
+			&eventUserID,
+			&event.Email,
+			&event.Event,
+			&event.Outcome,
+			&event.Reason,
+			&event.IP,
+			&event.UserAgent,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		event.UserID = int(eventUserID.Int64)
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+// auditTrail holds audit events for the in-memory repositories, oldest
+// first. Callers must serialise access to it.
+type auditTrail []AuditEvent
+
+func (trail *auditTrail) insert(event AuditEvent) {
+	event.ID = len(*trail) + 1
+	*trail = append(*trail, event)
+}
+
+func (trail auditTrail) list(userID, before, limit int) []*AuditEvent {
+	events := []*AuditEvent{}
+	for i := len(trail) - 1; i >= 0 && len(events) < limit; i-- {
+		event := trail[i]
+		if event.UserID == userID && (before == 0 || event.ID < before) {
+			events = append(events, &event)
+		}
+	}
+
+	return events
+}
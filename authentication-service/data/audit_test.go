@@ -0,0 +1,63 @@
+// Package data verifies audit trail storage in the in-memory repository.
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRepositoryAuditEvents(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+	id, _ := repo.Insert(User{Email: "me@here.com", Password: "secret-password"})
+	otherID, _ := repo.Insert(User{Email: "you@there.com", Password: "secret-password"})
+
+	now := time.Now()
+	for _, event := range []AuditEvent{
+		{UserID: id, Event: AuditEventLogin, Outcome: AuditOutcomeFailure, Reason: "invalid_credentials", CreatedAt: now},
+		{UserID: otherID, Event: AuditEventLogin, Outcome: AuditOutcomeSuccess, CreatedAt: now},
+		{Email: "nobody@here.com", Event: AuditEventLogin, Outcome: AuditOutcomeFailure, CreatedAt: now},
+		{UserID: id, Event: AuditEventLogin, Outcome: AuditOutcomeSuccess, CreatedAt: now},
+		{UserID: id, Event: AuditEventTokenRefresh, Outcome: AuditOutcomeSuccess, CreatedAt: now},
+	} {
+		if err := repo.InsertAuditEvent(event); err != nil {
+			t.Fatalf("failed to insert audit event: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name           string
+		before         int
+		limit          int
+		expectedEvents []string
+	}{
+		{name: "newest first", limit: 10, expectedEvents: []string{AuditEventTokenRefresh, AuditEventLogin, AuditEventLogin}},
+		{name: "limited", limit: 2, expectedEvents: []string{AuditEventTokenRefresh, AuditEventLogin}},
+		{name: "before a cursor", before: 4, limit: 10, expectedEvents: []string{AuditEventLogin}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := repo.ListAuditEvents(id, tt.before, tt.limit)
+			if err != nil {
+				t.Fatalf("failed to list audit events: %v", err)
+			}
+			if len(events) != len(tt.expectedEvents) {
+				t.Fatalf("expected %d events, got %+v", len(tt.expectedEvents), events)
+			}
+			for i, event := range events {
+				if event.UserID != id || event.Event != tt.expectedEvents[i] {
+					t.Errorf("event %d: expected %s for user %d, got %+v", i, tt.expectedEvents[i], id, event)
+				}
+			}
+		})
+	}
+
+	// the trail outlives the user
+	_ = repo.DeleteByID(id)
+	if events, _ := repo.ListAuditEvents(id, 0, 10); len(events) != 0 {
+		t.Fatalf("expected no events for a deleted user, got %+v", events)
+	}
+	if len(repo.audit) != 5 {
+		t.Fatalf("expected deleting a user to keep its audit events, got %d", len(repo.audit))
+	}
+}
@@ -0,0 +1,335 @@
+// Package data looks passwords up in an offline list of breached passwords.
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// breachedListMagic starts every breached-password list. It is followed by
+// the sorted, distinct first eight bytes of the SHA-1 of each password.
+const breachedListMagic = "BPWH0001"
+
+const breachedEntrySize = 8
+
+// ErrInvalidBreachedList is returned for files not written by
+// WriteBreachedPasswords.
+var ErrInvalidBreachedList = errors.New("invalid breached password list")
+
+//go:embed breached/common-passwords.txt
+var commonPasswords string
+
+// BreachedPasswords answers whether a password appears in a breached-password
+// list. Lookups binary search the list where it is stored, so a file with
+// hundreds of millions of entries is never loaded into memory. Truncated
+// hashes make a false positive possible but vanishingly unlikely.
+type BreachedPasswords struct {
+	list  io.ReaderAt
+	count int
+	file  *os.File
+}
+
+// OpenBreachedPasswords opens a list written by WriteBreachedPasswords.
+func OpenBreachedPasswords(path string) (*BreachedPasswords, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	list, err := newBreachedPasswords(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	list.file = file
+
+	return list, nil
+}
+
+var bundledBreachedPasswords = sync.OnceValue(func() *BreachedPasswords {
+	var buf bytes.Buffer
+	if _, err := WriteBreachedPasswords(&buf, strings.NewReader(commonPasswords)); err != nil {
+		panic(err)
+	}
+
+	list, err := newBreachedPasswords(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		panic(err)
+	}
+
+	return list
+})
+
+// BundledBreachedPasswords returns the built-in list of the most common
+// passwords. It is small; production deployments should provide a full list.
+func BundledBreachedPasswords() *BreachedPasswords {
+	return bundledBreachedPasswords()
+}
+
+func newBreachedPasswords(list io.ReaderAt, size int64) (*BreachedPasswords, error) {
+	header := make([]byte, len(breachedListMagic))
+	if _, err := list.ReadAt(header, 0); err != nil || string(header) != breachedListMagic {
+		return nil, ErrInvalidBreachedList
+	}
+
+	entries := size - int64(len(breachedListMagic))
+	if entries%breachedEntrySize != 0 {
+		return nil, ErrInvalidBreachedList
+	}
+
+	return &BreachedPasswords{list: list, count: int(entries / breachedEntrySize)}, nil
+}
+
+// Len returns the number of distinct entries in the list.
+func (b *BreachedPasswords) Len() int {
+	return b.count
+}
+
+// Contains reports whether password is in the list. An error means the list
+// could not be read.
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	want := breachedHash(sha1.Sum([]byte(password)))
+
+	var readErr error
+	entry := make([]byte, breachedEntrySize)
+	read := func(i int) uint64 {
+		offset := int64(len(breachedListMagic)) + int64(i)*breachedEntrySize
+		if _, err := b.list.ReadAt(entry, offset); err != nil && readErr == nil {
+			readErr = err
+		}
+		return binary.BigEndian.Uint64(entry)
+	}
+
+	i := sort.Search(b.count, func(i int) bool { return read(i) >= want })
+	found := i < b.count && read(i) == want
+	if readErr != nil {
+		return false, readErr
+	}
+
+	return found, nil
+}
+
+// Close releases the file behind a list from OpenBreachedPasswords.
+func (b *BreachedPasswords) Close() error {
+	if b.file == nil {
+		return nil
+	}
+
+	return b.file.Close()
+}
+
+// breachedChunkEntries is how many hashes WriteBreachedPasswords sorts in
+// memory at once: 32 MiB of them.
+const breachedChunkEntries = 4 << 20
+
+// WriteBreachedPasswords reads one password per line from r and writes them
+// to w in the format OpenBreachedPasswords reads. Lines that are already a
+// hex SHA-1, optionally followed by ":count" as in the Have I Been Pwned
+// downloads, are taken as hashes. It returns the number of distinct entries.
+// Hashes are sorted in chunks of bounded size, spilled to temporary files and
+// merged, so an input of any size fits in memory.
+func WriteBreachedPasswords(w io.Writer, r io.Reader) (int, error) {
+	return writeBreachedPasswords(w, r, breachedChunkEntries)
+}
+
+func writeBreachedPasswords(w io.Writer, r io.Reader, chunkEntries int) (int, error) {
+	var chunks []*os.File
+	defer func() {
+		for _, chunk := range chunks {
+			chunk.Close()
+			os.Remove(chunk.Name())
+		}
+	}()
+
+	hashes := make([]uint64, 0, min(chunkEntries, 1024))
+	spill := func() error {
+		chunk, err := os.CreateTemp("", "breached-*.chunk")
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, chunk)
+
+		slices.Sort(hashes)
+		entries := newBreachedWriter(chunk)
+		for _, hash := range hashes {
+			if err := entries.add(hash); err != nil {
+				return err
+			}
+		}
+		hashes = hashes[:0]
+		if err := entries.out.Flush(); err != nil {
+			return err
+		}
+
+		_, err = chunk.Seek(0, io.SeekStart)
+		return err
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		if sum, ok := parseSHA1Line(line); ok {
+			hashes = append(hashes, breachedHash(sum))
+		} else {
+			hashes = append(hashes, breachedHash(sha1.Sum([]byte(line))))
+		}
+
+		if len(hashes) == chunkEntries {
+			if err := spill(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	entries := newBreachedWriter(w)
+	if _, err := entries.out.WriteString(breachedListMagic); err != nil {
+		return 0, err
+	}
+
+	// a list that fits in one chunk never touches the disk
+	if len(chunks) == 0 {
+		slices.Sort(hashes)
+		for _, hash := range hashes {
+			if err := entries.add(hash); err != nil {
+				return 0, err
+			}
+		}
+	} else {
+		if len(hashes) > 0 {
+			if err := spill(); err != nil {
+				return 0, err
+			}
+		}
+		if err := mergeBreachedChunks(chunks, entries.add); err != nil {
+			return 0, err
+		}
+	}
+
+	return entries.count, entries.out.Flush()
+}
+
+// breachedWriter writes sorted hashes as list entries, skipping repeats.
+type breachedWriter struct {
+	out   *bufio.Writer
+	entry [breachedEntrySize]byte
+	count int
+	last  uint64
+}
+
+func newBreachedWriter(w io.Writer) *breachedWriter {
+	return &breachedWriter{out: bufio.NewWriter(w)}
+}
+
+func (bw *breachedWriter) add(hash uint64) error {
+	if bw.count > 0 && hash == bw.last {
+		return nil
+	}
+	bw.count++
+	bw.last = hash
+
+	binary.BigEndian.PutUint64(bw.entry[:], hash)
+	_, err := bw.out.Write(bw.entry[:])
+	return err
+}
+
+// mergeBreachedChunks passes the entries of sorted chunk files to add in
+// order.
+func mergeBreachedChunks(chunks []*os.File, add func(uint64) error) error {
+	readers := make([]*bufio.Reader, len(chunks))
+	heads := make(breachedHeap, 0, len(chunks))
+	entry := make([]byte, breachedEntrySize)
+	next := func(i int) error {
+		_, err := io.ReadFull(readers[i], entry)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		heap.Push(&heads, breachedHead{hash: binary.BigEndian.Uint64(entry), chunk: i})
+		return nil
+	}
+
+	for i, chunk := range chunks {
+		readers[i] = bufio.NewReader(chunk)
+		if err := next(i); err != nil {
+			return err
+		}
+	}
+	for heads.Len() > 0 {
+		head := heap.Pop(&heads).(breachedHead)
+		if err := add(head.hash); err != nil {
+			return err
+		}
+		if err := next(head.chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// breachedHead is the next entry of a chunk being merged.
+type breachedHead struct {
+	hash  uint64
+	chunk int
+}
+
+// breachedHeap orders chunk heads by hash for container/heap.
+type breachedHeap []breachedHead
+
+func (h breachedHeap) Len() int           { return len(h) }
+func (h breachedHeap) Less(i, j int) bool { return h[i].hash < h[j].hash }
+func (h breachedHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *breachedHeap) Push(x any)        { *h = append(*h, x.(breachedHead)) }
+func (h *breachedHeap) Pop() any {
+	old := *h
+	head := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return head
+}
+
+// parseSHA1Line decodes a "HEX" or "HEX:count" line of a hashed list.
+func parseSHA1Line(line string) ([sha1.Size]byte, bool) {
+	var sum [sha1.Size]byte
+
+	hash, count, hasCount := strings.Cut(line, ":")
+	if len(hash) != hex.EncodedLen(sha1.Size) || (hasCount && strings.Trim(count, "0123456789") != "") {
+		return sum, false
+	}
+	if _, err := hex.Decode(sum[:], []byte(hash)); err != nil {
+		return sum, false
+	}
+
+	return sum, true
+}
+
+func breachedHash(sum [sha1.Size]byte) uint64 {
+	return binary.BigEndian.Uint64(sum[:breachedEntrySize])
+}
@@ -0,0 +1,137 @@
+// Package data verifies the on-disk breached-password list.
+package data
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeBreachedList(t *testing.T, lines ...string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if _, err := WriteBreachedPasswords(&buf, strings.NewReader(strings.Join(lines, "\n"))); err != nil {
+		t.Fatalf("failed to write breached list: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "breached.bin")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatalf("failed to save breached list: %v", err)
+	}
+
+	return path
+}
+
+func TestBreachedPasswordsRoundTrip(t *testing.T) {
+	hashed := sha1.Sum([]byte("hashed-in-the-list"))
+	path := writeBreachedList(t,
+		"hunter2",
+		"correct horse battery staple",
+		"hunter2",
+		"",
+		strings.ToUpper(hex.EncodeToString(hashed[:]))+":42",
+		"windows-line\r",
+	)
+
+	list, err := OpenBreachedPasswords(path)
+	if err != nil {
+		t.Fatalf("failed to open breached list: %v", err)
+	}
+	defer list.Close()
+
+	if list.Len() != 4 {
+		t.Fatalf("expected 4 distinct entries, got %d", list.Len())
+	}
+
+	tests := []struct {
+		password string
+		expected bool
+	}{
+		{password: "hunter2", expected: true},
+		{password: "correct horse battery staple", expected: true},
+		{password: "hashed-in-the-list", expected: true},
+		{password: "windows-line", expected: true},
+		{password: "Hunter2", expected: false},
+		{password: "not-in-the-list", expected: false},
+		{password: "", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			found, err := list.Contains(tt.password)
+			if err != nil {
+				t.Fatalf("failed to look up password: %v", err)
+			}
+			if found != tt.expected {
+				t.Fatalf("expected Contains=%v, got %v", tt.expected, found)
+			}
+		})
+	}
+}
+
+func TestWriteBreachedPasswordsMergesChunks(t *testing.T) {
+	var lines []string
+	for i := range 50 {
+		// every password twice, in separate chunks
+		lines = append(lines, fmt.Sprintf("password-%d", i), fmt.Sprintf("password-%d", 49-i))
+	}
+	input := strings.Join(lines, "\n")
+
+	var inMemory, merged bytes.Buffer
+	want, err := WriteBreachedPasswords(&inMemory, strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("failed to write breached list: %v", err)
+	}
+	got, err := writeBreachedPasswords(&merged, strings.NewReader(input), 7)
+	if err != nil {
+		t.Fatalf("failed to write breached list in chunks: %v", err)
+	}
+
+	if want != 50 || got != want || !bytes.Equal(merged.Bytes(), inMemory.Bytes()) {
+		t.Fatalf("expected chunked output to match, got %d entries (want %d)", got, want)
+	}
+}
+
+func TestOpenBreachedPasswordsRejectsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{name: "plain text", contents: "password\n123456\n"},
+		{name: "truncated entry", contents: breachedListMagic + "1234"},
+		{name: "empty", contents: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			_ = os.WriteFile(path, []byte(tt.contents), 0o600)
+
+			if _, err := OpenBreachedPasswords(path); !errors.Is(err, ErrInvalidBreachedList) {
+				t.Fatalf("expected ErrInvalidBreachedList, got %v", err)
+			}
+		})
+	}
+}
+
+func TestBundledBreachedPasswords(t *testing.T) {
+	list := BundledBreachedPasswords()
+	if list.Len() == 0 {
+		t.Fatal("expected the bundled list to have entries")
+	}
+
+	for _, password := range []string{"123456", "password", "qwerty123"} {
+		if found, _ := list.Contains(password); !found {
+			t.Errorf("expected %q in the bundled list", password)
+		}
+	}
+}
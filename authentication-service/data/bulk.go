@@ -0,0 +1,129 @@
+// Package data inserts users in batches and streams them back out.
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// exportTimeout bounds EachUser, which runs as long as the caller consumes rows.
+const exportTimeout = 10 * time.Minute
+
+// BatchInsertError reports the user that stopped InsertBatch. Nothing from
+// the batch was stored.
+type BatchInsertError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchInsertError) Error() string {
+	return fmt.Sprintf("user %d of the batch: %v", e.Index+1, e.Err)
+}
+
+func (e *BatchInsertError) Unwrap() error {
+	return e.Err
+}
+
+// InsertBatch stores users in one transaction, as Insert would one by one,
+// and returns their IDs in order. If any user is rejected, none are stored.
+func (repo *PostgresRepository) InsertBatch(users []User) ([]int, error) {
+	// hash before the transaction starts so it is not held open meanwhile
+	hashes := make([]string, len(users))
+	for i, user := range users {
+		if err := repo.Policy.Check(user.Password, user.Email); err != nil {
+			return nil, &BatchInsertError{Index: i, Err: err}
+		}
+
+		hash, err := repo.Hasher.Hash(user.Password)
+		if err != nil {
+			return nil, &BatchInsertError{Index: i, Err: err}
+		}
+		hashes[i] = hash
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := repo.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids := make([]int, len(users))
+	now := time.Now()
+	for i, user := range users {
+		stmt := `insert into users (email, first_name, last_name, password, user_active, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+		err = tx.QueryRowContext(ctx, stmt,
+			user.Email,
+			user.FirstName,
+			user.LastName,
+			hashes[i],
+			user.Active,
+			now,
+			now,
+		).Scan(&ids[i])
+		if err != nil {
+			return nil, &BatchInsertError{Index: i, Err: translateError(err)}
+		}
+
+		stmt = `insert into user_roles (user_id, role_id) select $1, id from roles where name = $2`
+		_, err = tx.ExecContext(ctx, stmt, ids[i], DefaultRole)
+		if err != nil {
+			return nil, &BatchInsertError{Index: i, Err: err}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// EachUser calls fn with every user in GetAll order, reading one row at a
+// time so that exports never hold every user in memory. It stops at the
+// first error fn returns.
+func (repo *PostgresRepository) EachUser(fn func(*User) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at, email_verified_at
+	from users order by last_name, id`
+
+	rows, err := repo.Conn.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		var verifiedAt sql.NullTime
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.Active,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&verifiedAt,
+		)
+		if err != nil {
+			return err
+		}
+		user.EmailVerifiedAt = nullTime(verifiedAt)
+
+		if err := fn(&user); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,95 @@
+// Package data verifies batch inserts and streaming in the in-memory repository.
+package data
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMemoryRepositoryInsertBatch(t *testing.T) {
+	tests := []struct {
+		name          string
+		batch         []User
+		expectedIndex int
+		expectedErr   error
+	}{
+		{
+			name:          "all new",
+			batch:         []User{{Email: "a@here.com", Password: "long-enough"}, {Email: "b@here.com", Password: "long-enough"}},
+			expectedIndex: -1,
+		},
+		{
+			name:          "already registered",
+			batch:         []User{{Email: "a@here.com", Password: "long-enough"}, {Email: "taken@here.com", Password: "long-enough"}},
+			expectedIndex: 1,
+			expectedErr:   ErrDuplicateEmail,
+		},
+		{
+			name:          "repeated in the batch",
+			batch:         []User{{Email: "a@here.com", Password: "long-enough"}, {Email: "a@here.com", Password: "long-enough"}},
+			expectedIndex: 1,
+			expectedErr:   ErrDuplicateEmail,
+		},
+		{
+			name:          "password against the policy",
+			batch:         []User{{Email: "a@here.com", Password: "short"}, {Email: "b@here.com", Password: "long-enough"}},
+			expectedIndex: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTestMemoryRepository(t)
+			_, _ = repo.Insert(User{Email: "taken@here.com", Password: "long-enough"})
+
+			ids, err := repo.InsertBatch(tt.batch)
+			users, _ := repo.GetAll()
+
+			if tt.expectedIndex < 0 {
+				if err != nil || len(ids) != len(tt.batch) || len(users) != 1+len(tt.batch) {
+					t.Fatalf("expected the batch to be stored, got %v, %v", ids, err)
+				}
+				if auth, _ := repo.GetAuthorization(ids[0]); len(auth.Roles) != 1 || auth.Roles[0] != DefaultRole {
+					t.Fatalf("expected imported users to get the default role, got %+v", auth)
+				}
+				return
+			}
+
+			var batchErr *BatchInsertError
+			if !errors.As(err, &batchErr) || batchErr.Index != tt.expectedIndex {
+				t.Fatalf("expected user %d to be rejected, got %v", tt.expectedIndex, err)
+			}
+			if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("expected %v, got %v", tt.expectedErr, err)
+			}
+			if len(users) != 1 {
+				t.Fatalf("expected nothing from the batch to be stored, got %d users", len(users))
+			}
+		})
+	}
+}
+
+func TestMemoryRepositoryEachUser(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+	_, _ = repo.Insert(User{Email: "b@here.com", LastName: "B", Password: "long-enough"})
+	_, _ = repo.Insert(User{Email: "a@here.com", LastName: "A", Password: "long-enough"})
+
+	var emails []string
+	err := repo.EachUser(func(user *User) error {
+		emails = append(emails, user.Email)
+		return nil
+	})
+	if err != nil || len(emails) != 2 || emails[0] != "a@here.com" {
+		t.Fatalf("expected users sorted by last name, got %v, %v", emails, err)
+	}
+
+	stop := errors.New("stop")
+	visited := 0
+	err = repo.EachUser(func(user *User) error {
+		visited++
+		return stop
+	})
+	if !errors.Is(err, stop) || visited != 1 {
+		t.Fatalf("expected EachUser to stop at the first error, got %v after %d users", err, visited)
+	}
+}
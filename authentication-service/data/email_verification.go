@@ -0,0 +1,34 @@
+// Package data records which users have verified their email address.
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// MarkEmailVerified records that a user owns email. It fails with
+// sql.ErrNoRows when the user no longer has that address, so a link sent
+// before an email change cannot verify the new one.
+func (repo *PostgresRepository) MarkEmailVerified(userID int, email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set email_verified_at = coalesce(email_verified_at, $1)
+		where id = $2 and email = $3`
+
+	result, err := repo.Conn.ExecContext(ctx, stmt, time.Now(), userID, email)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+// Package data verifies email verification state in the in-memory repository.
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestMemoryRepositoryEmailVerification(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+
+	id, _ := repo.Insert(User{Email: "me@here.com", Password: "secret-password"})
+	user, _ := repo.GetOne(id)
+	if user.EmailVerified() {
+		t.Fatalf("expected new users to start unverified")
+	}
+
+	tests := []struct {
+		name          string
+		userID        int
+		email         string
+		expectedError error
+	}{
+		{name: "unknown user", userID: 99, email: "me@here.com", expectedError: sql.ErrNoRows},
+		{name: "different address", userID: id, email: "old@here.com", expectedError: sql.ErrNoRows},
+		{name: "current address", userID: id, email: "me@here.com"},
+		{name: "already verified", userID: id, email: "me@here.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := repo.MarkEmailVerified(tt.userID, tt.email); !errors.Is(err, tt.expectedError) {
+				t.Fatalf("expected error %v, got %v", tt.expectedError, err)
+			}
+		})
+	}
+
+	user, _ = repo.GetOne(id)
+	if !user.EmailVerified() {
+		t.Fatalf("expected user to be verified")
+	}
+
+	user.FirstName = "Renamed"
+	_ = repo.Update(*user)
+	if user, _ = repo.GetOne(id); !user.EmailVerified() {
+		t.Fatalf("expected a profile update to keep verification")
+	}
+
+	user.Email = "moved@here.com"
+	_ = repo.Update(*user)
+	if user, _ = repo.GetOne(id); user.EmailVerified() {
+		t.Fatalf("expected an email change to clear verification")
+	}
+}
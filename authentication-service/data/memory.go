@@ -0,0 +1,678 @@
+// Package data provides a thread-safe in-memory repository for tests and local development.
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryRepository implements Repository without a database. It behaves like
+// PostgresRepository: passwords are hashed and upgraded on login, emails are
+// unique, and missing users are reported as sql.ErrNoRows. Data is lost on
+// restart.
+type MemoryRepository struct {
+	// Hasher hashes new passwords; tests can swap in a cheaper one.
+	Hasher *PasswordHasher
+	Policy *PasswordPolicy
+
+	mu          sync.RWMutex
+	nextID      int
+	nextResetID int
+	users       map[int]User
+	roles       map[int][]string
+	resets      map[string]PasswordReset
+	totp        map[int]TOTPEnrollment
+	// recoveryCodes maps a user to their recovery code hashes and whether
+	// each one has been used.
+	recoveryCodes map[int]map[string]bool
+	sessions      sessionMap
+	apiKeys       apiKeyMap
+	audit         auditTrail
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		Hasher:      NewPasswordHasher(),
+		Policy:      NewPasswordPolicy(),
+		nextID:      1,
+		nextResetID: 1,
+		users:       make(map[int]User),
+		roles:       make(map[int][]string),
+		resets:      make(map[string]PasswordReset),
+		totp:        make(map[int]TOTPEnrollment),
+
+		recoveryCodes: make(map[int]map[string]bool),
+		sessions:      make(sessionMap),
+		apiKeys:       make(apiKeyMap),
+	}
+}
+
+// GetAll returns a slice of all users, sorted by last name
+func (repo *MemoryRepository) GetAll() ([]*User, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	users := make([]*User, 0, len(repo.users))
+	for _, user := range repo.users {
+		users = append(users, &user)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].LastName != users[j].LastName {
+			return users[i].LastName < users[j].LastName
+		}
+		return users[i].ID < users[j].ID
+	})
+
+	return users, nil
+}
+
+// GetByEmail returns one user by email
+func (repo *MemoryRepository) GetByEmail(email string) (*User, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	for _, user := range repo.users {
+		if user.Email == email {
+			return &user, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// GetOne returns one user by id
+func (repo *MemoryRepository) GetOne(id int) (*User, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	user, ok := repo.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &user, nil
+}
+
+// Update stores the profile fields of user. The password is left unchanged;
+// use ResetPassword for that. Changing the email clears its verification.
+func (repo *MemoryRepository) Update(user User) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	existing, ok := repo.users[user.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if repo.emailTaken(user.Email, user.ID) {
+		return ErrDuplicateEmail
+	}
+
+	if existing.Email != user.Email {
+		existing.EmailVerifiedAt = nil
+	}
+	existing.Email = user.Email
+	existing.FirstName = user.FirstName
+	existing.LastName = user.LastName
+	existing.Active = user.Active
+	existing.UpdatedAt = time.Now()
+	repo.users[user.ID] = existing
+
+	return nil
+}
+
+// DeleteByID deletes one user, along with their password reset tokens,
+// second factor and sessions. Audit events are kept but lose their user.
+func (repo *MemoryRepository) DeleteByID(id int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	delete(repo.users, id)
+	delete(repo.roles, id)
+	delete(repo.totp, id)
+	delete(repo.recoveryCodes, id)
+	for sessionID, session := range repo.sessions {
+		if session.UserID == id {
+			delete(repo.sessions, sessionID)
+		}
+	}
+	for hash, reset := range repo.resets {
+		if reset.UserID == id {
+			delete(repo.resets, hash)
+		}
+	}
+	for keyID, key := range repo.apiKeys {
+		if key.CreatedBy == id {
+			key.CreatedBy = 0
+			repo.apiKeys[keyID] = key
+		}
+	}
+	for i := range repo.audit {
+		if repo.audit[i].UserID == id {
+			repo.audit[i].UserID = 0
+		}
+	}
+
+	return nil
+}
+
+// Insert stores a new user with a hashed password and returns its ID.
+func (repo *MemoryRepository) Insert(user User) (int, error) {
+	if err := repo.Policy.Check(user.Password, user.Email); err != nil {
+		return 0, err
+	}
+
+	hashedPassword, err := repo.Hasher.Hash(user.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if repo.emailTaken(user.Email, 0) {
+		return 0, ErrDuplicateEmail
+	}
+
+	now := time.Now()
+	user.ID = repo.nextID
+	user.Password = hashedPassword
+	user.EmailVerifiedAt = nil
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	repo.users[user.ID] = user
+	repo.roles[user.ID] = []string{DefaultRole}
+	repo.nextID++
+
+	return user.ID, nil
+}
+
+// InsertBatch stores users as Insert would one by one and returns their IDs
+// in order. If any user is rejected, none are stored.
+func (repo *MemoryRepository) InsertBatch(users []User) ([]int, error) {
+	hashes := make([]string, len(users))
+	for i, user := range users {
+		if err := repo.Policy.Check(user.Password, user.Email); err != nil {
+			return nil, &BatchInsertError{Index: i, Err: err}
+		}
+
+		hash, err := repo.Hasher.Hash(user.Password)
+		if err != nil {
+			return nil, &BatchInsertError{Index: i, Err: err}
+		}
+		hashes[i] = hash
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	seen := make(map[string]bool, len(users))
+	for i, user := range users {
+		if seen[user.Email] || repo.emailTaken(user.Email, 0) {
+			return nil, &BatchInsertError{Index: i, Err: ErrDuplicateEmail}
+		}
+		seen[user.Email] = true
+	}
+
+	ids := make([]int, len(users))
+	now := time.Now()
+	for i, user := range users {
+		user.ID = repo.nextID
+		user.Password = hashes[i]
+		user.EmailVerifiedAt = nil
+		user.CreatedAt = now
+		user.UpdatedAt = now
+		repo.users[user.ID] = user
+		repo.roles[user.ID] = []string{DefaultRole}
+		repo.nextID++
+		ids[i] = user.ID
+	}
+
+	return ids, nil
+}
+
+// EachUser calls fn with every user in GetAll order, stopping at the first
+// error fn returns.
+func (repo *MemoryRepository) EachUser(fn func(*User) error) error {
+	users, err := repo.GetAll()
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListUsers returns a page of users matching query.
+func (repo *MemoryRepository) ListUsers(query UserQuery) (*UserPage, error) {
+	users, err := repo.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	return listUsers(users, query)
+}
+
+// ResetPassword replaces a user's password hash after checking the password
+// against the policy.
+func (repo *MemoryRepository) ResetPassword(password string, user User) error {
+	if err := repo.Policy.Check(password, user.Email); err != nil {
+		return err
+	}
+
+	return repo.storePassword(password, user)
+}
+
+func (repo *MemoryRepository) storePassword(password string, user User) error {
+	hashedPassword, err := repo.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	existing, ok := repo.users[user.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	existing.Password = hashedPassword
+	repo.users[user.ID] = existing
+
+	return nil
+}
+
+// PasswordMatches compares plainText with the user's stored hash, upgrading
+// the hash when it was made with older settings.
+func (repo *MemoryRepository) PasswordMatches(plainText string, user User) (bool, error) {
+	valid, err := repo.Hasher.Verify(plainText, user.Password)
+	if err != nil || !valid {
+		return false, err
+	}
+
+	if repo.Hasher.NeedsRehash(user.Password) {
+		// as in PostgresRepository, a failed upgrade never fails the login
+		if err := repo.storePassword(plainText, user); err != nil {
+			log.Println("Error upgrading password hash:", err)
+		}
+	}
+
+	return true, nil
+}
+
+// MarkEmailVerified records that a user owns email.
+func (repo *MemoryRepository) MarkEmailVerified(userID int, email string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	user, ok := repo.users[userID]
+	if !ok || user.Email != email {
+		return sql.ErrNoRows
+	}
+	if user.EmailVerifiedAt == nil {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+		repo.users[userID] = user
+	}
+
+	return nil
+}
+
+// InsertPasswordReset stores a new reset token hash for a user.
+func (repo *MemoryRepository) InsertPasswordReset(reset PasswordReset) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if _, ok := repo.users[reset.UserID]; !ok {
+		return sql.ErrNoRows
+	}
+
+	reset.ID = repo.nextResetID
+	reset.CreatedAt = time.Now()
+	repo.resets[reset.TokenHash] = reset
+	repo.nextResetID++
+
+	return nil
+}
+
+// GetPasswordReset applies the same expiry rules as Postgres.
+func (repo *MemoryRepository) GetPasswordReset(tokenHash string) (*PasswordReset, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	reset, ok := repo.resets[tokenHash]
+	if !ok {
+		return nil, ErrResetTokenInvalid
+	}
+	if err := reset.checkUsable(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return &reset, nil
+}
+
+// RedeemPasswordReset applies the same single-use and expiry rules as
+// Postgres, and uses the token only when the password is stored.
+func (repo *MemoryRepository) RedeemPasswordReset(tokenHash, password string, user User) error {
+	if err := repo.Policy.Check(password, user.Email); err != nil {
+		return err
+	}
+
+	hashedPassword, err := repo.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	reset, ok := repo.resets[tokenHash]
+	if !ok || reset.UserID != user.ID {
+		return ErrResetTokenInvalid
+	}
+
+	now := time.Now()
+	if err := reset.checkUsable(now); err != nil {
+		return err
+	}
+
+	existing, ok := repo.users[user.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	existing.Password = hashedPassword
+	repo.users[user.ID] = existing
+
+	reset.UsedAt = &now
+	repo.resets[tokenHash] = reset
+
+	return nil
+}
+
+// GetAuthorization returns the roles held by a user and the permissions
+// DefaultRolePermissions grants them.
+func (repo *MemoryRepository) GetAuthorization(userID int) (Authorization, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	if _, ok := repo.users[userID]; !ok {
+		return Authorization{}, sql.ErrNoRows
+	}
+
+	return authorizationFor(repo.roles[userID]), nil
+}
+
+// SetRoles replaces the roles held by a user.
+func (repo *MemoryRepository) SetRoles(userID int, roles []string) error {
+	unique := make([]string, 0, len(roles))
+	seen := make(map[string]bool)
+	for _, role := range roles {
+		if _, ok := DefaultRolePermissions[role]; !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownRole, role)
+		}
+		if !seen[role] {
+			seen[role] = true
+			unique = append(unique, role)
+		}
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if _, ok := repo.users[userID]; !ok {
+		return sql.ErrNoRows
+	}
+	repo.roles[userID] = unique
+
+	return nil
+}
+
+// GetTOTP returns the TOTP enrollment of a user.
+func (repo *MemoryRepository) GetTOTP(userID int) (*TOTPEnrollment, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	enrollment, ok := repo.totp[userID]
+	if !ok {
+		return nil, ErrTOTPNotEnrolled
+	}
+
+	return &enrollment, nil
+}
+
+// SaveTOTPSecret starts an enrollment, replacing any unconfirmed secret.
+func (repo *MemoryRepository) SaveTOTPSecret(userID int, secret string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if _, ok := repo.users[userID]; !ok {
+		return sql.ErrNoRows
+	}
+	if enrollment, ok := repo.totp[userID]; ok && enrollment.Confirmed() {
+		return ErrTOTPAlreadyConfirmed
+	}
+
+	repo.totp[userID] = TOTPEnrollment{UserID: userID, Secret: secret, CreatedAt: time.Now()}
+
+	return nil
+}
+
+// ConfirmTOTP activates a user's enrollment and replaces their recovery codes.
+func (repo *MemoryRepository) ConfirmTOTP(userID int, step int64, recoveryCodeHashes []string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	enrollment, ok := repo.totp[userID]
+	if !ok {
+		return ErrTOTPNotEnrolled
+	}
+	if enrollment.Confirmed() {
+		return ErrTOTPAlreadyConfirmed
+	}
+
+	now := time.Now()
+	enrollment.ConfirmedAt = &now
+	enrollment.LastUsedStep = step
+	repo.totp[userID] = enrollment
+
+	codes := make(map[string]bool, len(recoveryCodeHashes))
+	for _, codeHash := range recoveryCodeHashes {
+		codes[codeHash] = false
+	}
+	repo.recoveryCodes[userID] = codes
+
+	return nil
+}
+
+// UseTOTPStep records step as the latest accepted code for a user.
+func (repo *MemoryRepository) UseTOTPStep(userID int, step int64) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	enrollment, ok := repo.totp[userID]
+	if !ok || !enrollment.Confirmed() || step <= enrollment.LastUsedStep {
+		return ErrTOTPCodeReused
+	}
+	enrollment.LastUsedStep = step
+	repo.totp[userID] = enrollment
+
+	return nil
+}
+
+// ConsumeRecoveryCode marks an unused recovery code as used.
+func (repo *MemoryRepository) ConsumeRecoveryCode(userID int, codeHash string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	used, ok := repo.recoveryCodes[userID][codeHash]
+	if !ok || used {
+		return ErrRecoveryCodeInvalid
+	}
+	repo.recoveryCodes[userID][codeHash] = true
+
+	return nil
+}
+
+// CreateSession stores a new session.
+func (repo *MemoryRepository) CreateSession(session Session) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if _, ok := repo.users[session.UserID]; !ok {
+		return sql.ErrNoRows
+	}
+	repo.sessions[session.ID] = session
+
+	return nil
+}
+
+// GetSession returns one session by ID, revoked or not.
+func (repo *MemoryRepository) GetSession(id string) (*Session, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	session, ok := repo.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	return &session, nil
+}
+
+// ListSessions returns a user's active sessions, most recently used first.
+func (repo *MemoryRepository) ListSessions(userID int) ([]*Session, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	return repo.sessions.list(userID), nil
+}
+
+// TouchSession records that a session was used at seenAt.
+func (repo *MemoryRepository) TouchSession(id string, seenAt time.Time) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if session, ok := repo.sessions[id]; ok {
+		session.LastSeenAt = seenAt
+		repo.sessions[id] = session
+	}
+
+	return nil
+}
+
+// RevokeSession revokes one of a user's active sessions.
+func (repo *MemoryRepository) RevokeSession(userID int, id string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.sessions.revoke(userID, id, time.Now())
+}
+
+// RevokeSessions revokes every active session of a user.
+func (repo *MemoryRepository) RevokeSessions(userID int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	repo.sessions.revokeAll(userID, time.Now())
+
+	return nil
+}
+
+// InsertAPIKey stores a new key and returns its ID.
+func (repo *MemoryRepository) InsertAPIKey(key APIKey) (int, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.apiKeys.insert(key), nil
+}
+
+// GetAPIKeyByHash returns the active key with the given hash.
+func (repo *MemoryRepository) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	return repo.apiKeys.byHash(keyHash)
+}
+
+// ListAPIKeys returns the active keys, newest first.
+func (repo *MemoryRepository) ListAPIKeys() ([]*APIKey, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	return repo.apiKeys.list(), nil
+}
+
+// RotateAPIKey replaces the secret of an active key.
+func (repo *MemoryRepository) RotateAPIKey(id int, prefix, keyHash string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	now := time.Now()
+	return repo.apiKeys.update(id, func(key *APIKey) {
+		key.Prefix = prefix
+		key.KeyHash = keyHash
+		key.RotatedAt = &now
+	})
+}
+
+// RevokeAPIKey revokes an active key.
+func (repo *MemoryRepository) RevokeAPIKey(id int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	now := time.Now()
+	return repo.apiKeys.update(id, func(key *APIKey) {
+		key.RevokedAt = &now
+	})
+}
+
+// TouchAPIKey records that a key was used at usedAt.
+func (repo *MemoryRepository) TouchAPIKey(id int, usedAt time.Time) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	_ = repo.apiKeys.update(id, func(key *APIKey) {
+		key.LastUsedAt = &usedAt
+	})
+
+	return nil
+}
+
+// emailTaken reports whether another user already has email. Callers must
+// hold repo.mu.
+func (repo *MemoryRepository) emailTaken(email string, exceptID int) bool {
+	for id, user := range repo.users {
+		if id != exceptID && user.Email == email {
+			return true
+		}
+	}
+
+	return false
+}
+
+// InsertAuditEvent appends an event to the audit trail.
+func (repo *MemoryRepository) InsertAuditEvent(event AuditEvent) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	repo.audit.insert(event)
+
+	return nil
+}
+
+// ListAuditEvents returns up to limit of a user's events, newest first.
+func (repo *MemoryRepository) ListAuditEvents(userID, before, limit int) ([]*AuditEvent, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	return repo.audit.list(userID, before, limit), nil
+}
@@ -0,0 +1,196 @@
+// Package data verifies the in-memory repository behaves like the Postgres one.
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ Repository = (*MemoryRepository)(nil)
+
+func newTestMemoryRepository(t *testing.T) *MemoryRepository {
+	t.Helper()
+
+	repo := NewMemoryRepository()
+	repo.Hasher = &PasswordHasher{Algorithm: HashAlgorithmBcrypt, BcryptCost: bcrypt.MinCost}
+
+	return repo
+}
+
+func TestMemoryRepositoryInsertAndLookup(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+
+	id, err := repo.Insert(User{Email: "me@here.com", FirstName: "Me", Password: "secret-password", Active: 1})
+	if err != nil {
+		t.Fatalf("expected insert to succeed, got %v", err)
+	}
+
+	user, err := repo.GetByEmail("me@here.com")
+	if err != nil {
+		t.Fatalf("expected user by email, got %v", err)
+	}
+	if user.ID != id || user.FirstName != "Me" {
+		t.Fatalf("expected inserted user %d, got %+v", id, user)
+	}
+	if user.Password == "secret-password" {
+		t.Fatalf("expected password to be hashed")
+	}
+
+	matches, err := repo.PasswordMatches("secret-password", *user)
+	if err != nil || !matches {
+		t.Fatalf("expected password to match, got %v, %v", matches, err)
+	}
+	matches, err = repo.PasswordMatches("wrong-password", *user)
+	if err != nil || matches {
+		t.Fatalf("expected wrong password not to match, got %v, %v", matches, err)
+	}
+
+	_, err = repo.Insert(User{Email: "me@here.com", Password: "another-password"})
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Fatalf("expected ErrDuplicateEmail, got %v", err)
+	}
+}
+
+func TestMemoryRepositoryMissingUsers(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{name: "get by email", call: func() error { _, err := repo.GetByEmail("nobody@here.com"); return err }},
+		{name: "get one", call: func() error { _, err := repo.GetOne(99); return err }},
+		{name: "update", call: func() error { return repo.Update(User{ID: 99, Email: "nobody@here.com"}) }},
+		{name: "reset password", call: func() error { return repo.ResetPassword("new-password", User{ID: 99}) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("expected sql.ErrNoRows, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryRepositoryUpdateDeleteAndReset(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+
+	id, _ := repo.Insert(User{Email: "me@here.com", LastName: "Zed", Password: "old-password"})
+	otherID, _ := repo.Insert(User{Email: "other@here.com", LastName: "Abe", Password: "old-password"})
+
+	err := repo.Update(User{ID: id, Email: "other@here.com"})
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Fatalf("expected ErrDuplicateEmail, got %v", err)
+	}
+
+	err = repo.Update(User{ID: id, Email: "renamed@here.com", LastName: "Zed", Active: 0})
+	if err != nil {
+		t.Fatalf("expected update to succeed, got %v", err)
+	}
+
+	user, _ := repo.GetOne(id)
+	if user.Email != "renamed@here.com" {
+		t.Fatalf("expected updated email, got %q", user.Email)
+	}
+
+	err = repo.ResetPassword("new-password", *user)
+	if err != nil {
+		t.Fatalf("expected password reset to succeed, got %v", err)
+	}
+	user, _ = repo.GetOne(id)
+	if matches, _ := repo.PasswordMatches("new-password", *user); !matches {
+		t.Fatalf("expected new password to match")
+	}
+
+	users, _ := repo.GetAll()
+	if len(users) != 2 || users[0].ID != otherID {
+		t.Fatalf("expected users sorted by last name, got %+v", users)
+	}
+
+	_ = repo.DeleteByID(id)
+	if _, err := repo.GetOne(id); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected deleted user to be gone, got %v", err)
+	}
+}
+
+func TestMemoryRepositoryPasswordResets(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+	id, _ := repo.Insert(User{Email: "me@here.com", Password: "old-password"})
+	otherID, _ := repo.Insert(User{Email: "other@here.com", Password: "old-password"})
+	user, _ := repo.GetOne(id)
+
+	_ = repo.InsertPasswordReset(PasswordReset{UserID: id, TokenHash: "live", ExpiresAt: time.Now().Add(time.Hour)})
+	_ = repo.InsertPasswordReset(PasswordReset{UserID: id, TokenHash: "stale", ExpiresAt: time.Now().Add(-time.Hour)})
+	_ = repo.InsertPasswordReset(PasswordReset{UserID: otherID, TokenHash: "theirs", ExpiresAt: time.Now().Add(time.Hour)})
+
+	tests := []struct {
+		name           string
+		tokenHash      string
+		password       string
+		expectedError  error
+		policyRejected bool
+	}{
+		{name: "rejected password keeps the token", tokenHash: "live", password: "short", policyRejected: true},
+		{name: "valid token", tokenHash: "live", password: "new-password"},
+		{name: "reused token", tokenHash: "live", password: "newer-password", expectedError: ErrResetTokenUsed},
+		{name: "expired token", tokenHash: "stale", password: "new-password", expectedError: ErrResetTokenExpired},
+		{name: "unknown token", tokenHash: "missing", password: "new-password", expectedError: ErrResetTokenInvalid},
+		{name: "another user's token", tokenHash: "theirs", password: "new-password", expectedError: ErrResetTokenInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := repo.RedeemPasswordReset(tt.tokenHash, tt.password, *user)
+			if tt.policyRejected {
+				var policyErr *PasswordPolicyError
+				if !errors.As(err, &policyErr) {
+					t.Fatalf("expected a policy error, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("expected error %v, got %v", tt.expectedError, err)
+			}
+		})
+	}
+
+	stored, _ := repo.GetOne(id)
+	if ok, _ := repo.PasswordMatches("new-password", *stored); !ok {
+		t.Fatal("expected the redeemed token to set the new password")
+	}
+
+	err := repo.InsertPasswordReset(PasswordReset{UserID: 99, TokenHash: "orphan"})
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows for unknown user, got %v", err)
+	}
+}
+
+func TestMemoryRepositoryConcurrentInserts(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var successes int
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := repo.Insert(User{Email: "race@here.com", Password: "secret-password"}); err == nil {
+				mu.Lock()
+				successes++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if successes != 1 {
+		t.Fatalf("expected exactly one insert to win, got %d", successes)
+	}
+}
@@ -0,0 +1,12 @@
+-- users holds accounts that can authenticate against the service. The table
+-- may predate migrations, so creation is skipped when it already exists.
+create table if not exists users (
+    id serial primary key,
+    email varchar(255) not null unique,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    password varchar(60) not null,
+    user_active integer not null default 0,
+    created_at timestamp without time zone not null default now(),
+    updated_at timestamp without time zone not null default now()
+);
@@ -0,0 +1,11 @@
+-- password_resets stores hashes of single-use password reset tokens.
+create table if not exists password_resets (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    token_hash char(64) not null unique,
+    expires_at timestamp with time zone not null,
+    used_at timestamp with time zone,
+    created_at timestamp with time zone not null default now()
+);
+
+create index if not exists password_resets_user_id_idx on password_resets (user_id);
@@ -0,0 +1,40 @@
+-- roles group permissions; users hold any number of roles.
+create table if not exists roles (
+    id serial primary key,
+    name varchar(64) not null unique
+);
+
+create table if not exists permissions (
+    id serial primary key,
+    name varchar(64) not null unique
+);
+
+create table if not exists role_permissions (
+    role_id integer not null references roles (id) on delete cascade,
+    permission_id integer not null references permissions (id) on delete cascade,
+    primary key (role_id, permission_id)
+);
+
+create table if not exists user_roles (
+    user_id integer not null references users (id) on delete cascade,
+    role_id integer not null references roles (id) on delete cascade,
+    primary key (user_id, role_id)
+);
+
+insert into roles (name) values ('admin'), ('mailer'), ('user')
+    on conflict (name) do nothing;
+
+insert into permissions (name) values ('users:list'), ('users:manage'), ('logs:read'), ('logs:write'), ('mail:send')
+    on conflict (name) do nothing;
+
+insert into role_permissions (role_id, permission_id)
+    select r.id, p.id from roles r, permissions p
+    where (r.name = 'admin')
+       or (r.name = 'mailer' and p.name in ('mail:send', 'logs:write'))
+       or (r.name = 'user' and p.name = 'logs:write')
+    on conflict do nothing;
+
+-- existing accounts keep the access every signed-in user had before roles
+insert into user_roles (user_id, role_id)
+    select u.id, r.id from users u, roles r where r.name = 'user'
+    on conflict do nothing;
@@ -0,0 +1,2 @@
+-- only safe once every stored hash is bcrypt again
+alter table users alter column password type varchar(60);
@@ -0,0 +1,18 @@
+-- user_totp holds each user's TOTP secret; it only guards logins once confirmed.
+create table if not exists user_totp (
+    user_id integer primary key references users (id) on delete cascade,
+    secret varchar(64) not null,
+    confirmed_at timestamp with time zone,
+    last_used_step bigint not null default 0,
+    created_at timestamp with time zone not null default now()
+);
+
+-- totp_recovery_codes stores hashes of single-use recovery codes.
+create table if not exists totp_recovery_codes (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    code_hash char(64) not null,
+    used_at timestamp with time zone,
+    created_at timestamp with time zone not null default now(),
+    unique (user_id, code_hash)
+);
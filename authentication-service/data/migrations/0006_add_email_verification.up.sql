@@ -0,0 +1,5 @@
+-- email_verified_at is set once a user follows their verification link.
+alter table users add column if not exists email_verified_at timestamp with time zone;
+
+-- accounts created before verification existed are trusted as they are
+update users set email_verified_at = created_at where email_verified_at is null;
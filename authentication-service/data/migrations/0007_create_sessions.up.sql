@@ -0,0 +1,12 @@
+-- sessions records each login so its tokens can be listed and revoked.
+create table if not exists sessions (
+    id char(32) primary key,
+    user_id integer not null references users (id) on delete cascade,
+    user_agent varchar(255) not null default '',
+    ip varchar(64) not null default '',
+    created_at timestamp with time zone not null default now(),
+    last_seen_at timestamp with time zone not null default now(),
+    revoked_at timestamp with time zone
+);
+
+create index if not exists sessions_user_id_idx on sessions (user_id);
@@ -0,0 +1,3 @@
+delete from permissions where name = 'api_keys:manage';
+
+drop table if exists api_keys;
@@ -0,0 +1,22 @@
+-- api_keys identifies services that call the broker without a user. Only a
+-- hash of each key is stored; prefix is kept so keys can be told apart.
+create table if not exists api_keys (
+    id serial primary key,
+    name varchar(100) not null,
+    prefix varchar(16) not null,
+    key_hash char(64) not null unique,
+    scopes varchar(255) not null default '',
+    created_by integer references users (id) on delete set null,
+    created_at timestamp with time zone not null default now(),
+    rotated_at timestamp with time zone,
+    last_used_at timestamp with time zone,
+    revoked_at timestamp with time zone
+);
+
+insert into permissions (name) values ('api_keys:manage')
+    on conflict (name) do nothing;
+
+insert into role_permissions (role_id, permission_id)
+    select r.id, p.id from roles r, permissions p
+    where r.name = 'admin' and p.name = 'api_keys:manage'
+    on conflict do nothing;
@@ -0,0 +1,23 @@
+-- audit_events records every login, failure, lockout, password change and
+-- token refresh. Rows outlive their user so the trail cannot be erased.
+create table if not exists audit_events (
+    id bigserial primary key,
+    user_id integer references users (id) on delete set null,
+    email varchar(255) not null default '',
+    event varchar(32) not null,
+    outcome varchar(16) not null,
+    reason varchar(64) not null default '',
+    ip varchar(64) not null default '',
+    user_agent varchar(255) not null default '',
+    created_at timestamp with time zone not null default now()
+);
+
+create index if not exists audit_events_user_id_idx on audit_events (user_id, id desc);
+
+insert into permissions (name) values ('audit:read')
+    on conflict (name) do nothing;
+
+insert into role_permissions (role_id, permission_id)
+    select r.id, p.id from roles r, permissions p
+    where r.name = 'admin' and p.name = 'audit:read'
+    on conflict do nothing;
@@ -0,0 +1,3 @@
+drop index if exists users_lower_email_pattern_idx;
+drop index if exists users_created_at_id_idx;
+drop index if exists users_last_name_id_idx;
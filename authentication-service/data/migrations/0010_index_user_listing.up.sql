@@ -0,0 +1,7 @@
+-- Keyset pagination of users reads these indexes in either direction for
+-- each sort order.
+create index if not exists users_last_name_id_idx on users (last_name, id);
+create index if not exists users_created_at_id_idx on users (created_at, id);
+-- The email prefix filter matches lower(email) with like, which neither the
+-- unique email index nor a default-collation index can serve.
+create index if not exists users_lower_email_pattern_idx on users (lower(email) text_pattern_ops);
@@ -0,0 +1,106 @@
+// Package data verifies parsing and ordering of the embedded schema migrations.
+package data
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrationsEmbedded(t *testing.T) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		t.Fatalf("expected embedded migrations to load, got %v", err)
+	}
+
+	if len(migrations) == 0 {
+		t.Fatalf("expected at least one embedded migration")
+	}
+	if migrations[0].Version != 1 || migrations[0].Name != "create_users" {
+		t.Fatalf("expected first migration 1_create_users, got %d_%s", migrations[0].Version, migrations[0].Name)
+	}
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version <= migrations[i-1].Version {
+			t.Fatalf("expected increasing versions, got %d after %d", migrations[i].Version, migrations[i-1].Version)
+		}
+	}
+}
+
+func TestParseMigrations(t *testing.T) {
+	tests := []struct {
+		name          string
+		files         fstest.MapFS
+		expectedOrder []int
+		expectedError string
+	}{
+		{
+			name: "orders by numeric version",
+			files: fstest.MapFS{
+				"10_later.up.sql":   {Data: []byte("select 10")},
+				"10_later.down.sql": {Data: []byte("select -10")},
+				"2_early.up.sql":    {Data: []byte("select 2")},
+				"2_early.down.sql":  {Data: []byte("select -2")},
+				"README.md":         {Data: []byte("ignored")},
+			},
+			expectedOrder: []int{2, 10},
+		},
+		{
+			name: "missing down migration",
+			files: fstest.MapFS{
+				"1_users.up.sql": {Data: []byte("select 1")},
+			},
+			expectedError: "both up and down SQL are required",
+		},
+		{
+			name: "unknown direction",
+			files: fstest.MapFS{
+				"1_users.sideways.sql": {Data: []byte("select 1")},
+			},
+			expectedError: "expected an .up.sql or .down.sql suffix",
+		},
+		{
+			name: "missing version",
+			files: fstest.MapFS{
+				"users.up.sql": {Data: []byte("select 1")},
+			},
+			expectedError: "expected a <version>_<name> file name",
+		},
+		{
+			name: "conflicting names for one version",
+			files: fstest.MapFS{
+				"1_users.up.sql":      {Data: []byte("select 1")},
+				"1_accounts.down.sql": {Data: []byte("select -1")},
+			},
+			expectedError: "conflicting names",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := parseMigrations(tt.files)
+
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Fatalf("expected error containing %q, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if len(migrations) != len(tt.expectedOrder) {
+				t.Fatalf("expected %d migrations, got %d", len(tt.expectedOrder), len(migrations))
+			}
+			for i, version := range tt.expectedOrder {
+				if migrations[i].Version != version {
+					t.Fatalf("expected version %d at position %d, got %d", version, i, migrations[i].Version)
+				}
+				if migrations[i].Up == "" || migrations[i].Down == "" {
+					t.Fatalf("expected up and down SQL for version %d", version)
+				}
+			}
+		})
+	}
+}
@@ -8,18 +8,47 @@ import (
 	"log"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/jackc/pgconn"
 )
 
 const dbTimeout = time.Second * 3
 
+// uniqueViolation is the Postgres error code raised by unique constraints.
+const uniqueViolation = "23505"
+
+// ErrDuplicateEmail is returned when a user with the same email already exists.
+var ErrDuplicateEmail = errors.New("a user with this email already exists")
+
+// translateError maps driver errors onto the package's sentinel errors.
+func translateError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return ErrDuplicateEmail
+	}
+
+	return err
+}
+
+// nullTime converts a nullable timestamp column into an optional time.
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+
+	return &t.Time
+}
+
 type PostgresRepository struct {
-	Conn *sql.DB
+	Conn   *sql.DB
+	Hasher *PasswordHasher
+	Policy *PasswordPolicy
 }
 
 func NewPostgresRepository(pool *sql.DB) *PostgresRepository {
 	return &PostgresRepository{
-		Conn: pool,
+		Conn:   pool,
+		Hasher: NewPasswordHasher(),
+		Policy: NewPasswordPolicy(),
 	}
 }
 
@@ -33,6 +62,18 @@ type User struct {
 	Active    int       `json:"active"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	// EmailVerifiedAt is nil until the user follows their verification link.
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+
+	// Roles and Permissions are filled from GetAuthorization when needed.
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// EmailVerified reports whether the user has confirmed they own their address.
+func (user *User) EmailVerified() bool {
+	return user.EmailVerifiedAt != nil
 }
 
 // GetAll returns a slice of all users, sorted by last name
@@ -40,7 +81,7 @@ func (repo *PostgresRepository) GetAll() ([]*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at
+	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at, email_verified_at
 	from users order by last_name`
 
 	rows, err := repo.Conn.QueryContext(ctx, query)
@@ -53,6 +94,7 @@ func (repo *PostgresRepository) GetAll() ([]*User, error) {
 
 	for rows.Next() {
 		var user User
+		var verifiedAt sql.NullTime
 		err := rows.Scan(
 			&user.ID,
 			&user.Email,
@@ -62,11 +104,13 @@ func (repo *PostgresRepository) GetAll() ([]*User, error) {
 			&user.Active,
 			&user.CreatedAt,
 			&user.UpdatedAt,
+			&verifiedAt,
 		)
 		if err != nil {
 			log.Println("Error scanning", err)
 			return nil, err
 		}
+		user.EmailVerifiedAt = nullTime(verifiedAt)
 
 		users = append(users, &user)
 	}
@@ -79,9 +123,10 @@ func (repo *PostgresRepository) GetByEmail(email string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at from users where email = $1`
+	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at, email_verified_at from users where email = $1`
 
 	var user User
+	var verifiedAt sql.NullTime
 	row := repo.Conn.QueryRowContext(ctx, query, email)
 
 	err := row.Scan(
@@ -93,11 +138,13 @@ func (repo *PostgresRepository) GetByEmail(email string) (*User, error) {
 		&user.Active,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&verifiedAt,
 	)
 
 	if err != nil {
 		return nil, err
 	}
+	user.EmailVerifiedAt = nullTime(verifiedAt)
 
 	return &user, nil
 }
@@ -107,9 +154,10 @@ func (repo *PostgresRepository) GetOne(id int) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at from users where id = $1`
+	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at, email_verified_at from users where id = $1`
 
 	var user User
+	var verifiedAt sql.NullTime
 	row := repo.Conn.QueryRowContext(ctx, query, id)
 
 	err := row.Scan(
@@ -121,22 +169,25 @@ func (repo *PostgresRepository) GetOne(id int) (*User, error) {
 		&user.Active,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&verifiedAt,
 	)
 
 	if err != nil {
 		return nil, err
 	}
+	user.EmailVerifiedAt = nullTime(verifiedAt)
 
 	return &user, nil
 }
 
 // Update updates one user in the database, using the information
-// stored in the receiver u
+// stored in the receiver u. Changing the email clears its verification.
 func (repo *PostgresRepository) Update(user User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
 	stmt := `update users set
+		email_verified_at = case when email = $1 then email_verified_at end,
 		email = $1,
 		first_name = $2,
 		last_name = $3,
@@ -155,7 +206,7 @@ func (repo *PostgresRepository) Update(user User) error {
 	)
 
 	if err != nil {
-		return err
+		return translateError(err)
 	}
 
 	return nil
@@ -181,15 +232,26 @@ func (repo *PostgresRepository) Insert(user User) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	if err := repo.Policy.Check(user.Password, user.Email); err != nil {
+		return 0, err
+	}
+
+	hashedPassword, err := repo.Hasher.Hash(user.Password)
 	if err != nil {
 		return 0, err
 	}
+
+	tx, err := repo.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
 	var newID int
 	stmt := `insert into users (email, first_name, last_name, password, user_active, created_at, updated_at)
 		values ($1, $2, $3, $4, $5, $6, $7) returning id`
 
-	err = repo.Conn.QueryRowContext(ctx, stmt,
+	err = tx.QueryRowContext(ctx, stmt,
 		user.Email,
 		user.FirstName,
 		user.LastName,
@@ -200,18 +262,38 @@ func (repo *PostgresRepository) Insert(user User) (int, error) {
 	).Scan(&newID)
 
 	if err != nil {
+		return 0, translateError(err)
+	}
+
+	stmt = `insert into user_roles (user_id, role_id) select $1, id from roles where name = $2`
+	_, err = tx.ExecContext(ctx, stmt, newID, DefaultRole)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
 		return 0, err
 	}
 
 	return newID, nil
 }
 
-// ResetPassword is the method we will use to change a user's password.
+// ResetPassword replaces a user's password after checking it against the
+// password policy.
 func (repo *PostgresRepository) ResetPassword(password string, user User) error {
+	if err := repo.Policy.Check(password, user.Email); err != nil {
+		return err
+	}
+
+	return repo.storePassword(password, user)
+}
+
+// storePassword hashes and stores password without checking the policy.
+func (repo *PostgresRepository) storePassword(password string, user User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	hashedPassword, err := repo.Hasher.Hash(password)
 	if err != nil {
 		return err
 	}
@@ -225,18 +307,20 @@ func (repo *PostgresRepository) ResetPassword(password string, user User) error
 	return nil
 }
 
-// PasswordMatches uses Go's bcrypt package to compare a user supplied password
-// with the hash we have stored for a given user in the database. If the password
-// and hash match, we return true; otherwise, we return false.
+// PasswordMatches compares a user supplied password with the hash we have
+// stored for a given user in the database. When it matches a hash made with
+// an older algorithm or weaker settings, the hash is upgraded in place.
 func (repo *PostgresRepository) PasswordMatches(plainText string, user User) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(plainText))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			// invalid password
-			return false, nil
-		default:
-			return false, err
+	valid, err := repo.Hasher.Verify(plainText, user.Password)
+	if err != nil || !valid {
+		return false, err
+	}
+
+	if repo.Hasher.NeedsRehash(user.Password) {
+		// the login has already succeeded, so a failed upgrade is only logged;
+		// the policy is skipped so that it never blocks an upgrade
+		if err := repo.storePassword(plainText, user); err != nil {
+			log.Println("Error upgrading password hash:", err)
 		}
 	}
 
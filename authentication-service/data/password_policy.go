@@ -0,0 +1,151 @@
+// Package data checks new passwords against the password policy.
+package data
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultMinPasswordLength = 8
+	// minEmailPartLength keeps short local parts such as "me" from
+	// rejecting every password that happens to contain them.
+	minEmailPartLength = 3
+)
+
+// PasswordPolicyError lists the rules a password breaks. Each violation reads
+// as a continuation of "password", such as "must be at least 8 characters long".
+type PasswordPolicyError struct {
+	Violations []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "password " + strings.Join(e.Violations, "; ")
+}
+
+// PasswordPolicy decides which new passwords are acceptable. Existing
+// passwords are not rechecked, so tightening it does not lock anyone out.
+type PasswordPolicy struct {
+	MinLength int
+	// MinCharacterClasses is how many of lowercase letters, uppercase
+	// letters, digits and symbols a password must mix, from 1 to 4.
+	MinCharacterClasses int
+	// CheckEmail rejects passwords built from the account's email address.
+	CheckEmail bool
+	// Breached rejects passwords found in the list; nil skips the check.
+	Breached *BreachedPasswords
+	// MaxBytes rejects passwords longer than the hasher accepts, such as
+	// bcrypt's 72 bytes; zero allows any length.
+	MaxBytes int
+}
+
+// NewPasswordPolicy returns the default policy: at least 8 characters, not
+// derived from the email address and not in the bundled breached list.
+func NewPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength:           defaultMinPasswordLength,
+		MinCharacterClasses: 1,
+		CheckEmail:          true,
+		Breached:            BundledBreachedPasswords(),
+	}
+}
+
+// Check returns a *PasswordPolicyError if password breaks the policy for the
+// account with email.
+func (p *PasswordPolicy) Check(password, email string) error {
+	violations, err := p.Violations(password, email)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+
+	return nil
+}
+
+// Violations returns the rules password breaks for the account with email.
+// An error means the breached-password list could not be read.
+func (p *PasswordPolicy) Violations(password, email string) ([]string, error) {
+	if password == "" {
+		return []string{"is required"}, nil
+	}
+
+	var violations []string
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		violations = append(violations, fmt.Sprintf("must be at most %d bytes long", p.MaxBytes))
+	}
+	if characterClasses(password) < p.MinCharacterClasses {
+		violations = append(violations, fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinCharacterClasses))
+	}
+	if p.CheckEmail && resemblesEmail(password, email) {
+		violations = append(violations, "must not be based on your email address")
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err == nil && !breached && strings.ToLower(password) != password {
+			breached, err = p.Breached.Contains(strings.ToLower(password))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("checking breached passwords: %w", err)
+		}
+		if breached {
+			violations = append(violations, "is too common or has appeared in a data breach")
+		}
+	}
+
+	return violations, nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			classes++
+		}
+	}
+
+	return classes
+}
+
+// resemblesEmail reports whether password contains, or is contained in, the
+// email's local part once case and punctuation are ignored.
+func resemblesEmail(password, email string) bool {
+	local, _, _ := strings.Cut(email, "@")
+	local = lettersAndDigits(local)
+	password = lettersAndDigits(password)
+	if len(local) < minEmailPartLength || password == "" {
+		return false
+	}
+
+	return strings.Contains(password, local) || strings.Contains(local, password)
+}
+
+func lettersAndDigits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
@@ -0,0 +1,97 @@
+// Package data verifies the password policy and its enforcement by the repository.
+package data
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyViolations(t *testing.T) {
+	strict := &PasswordPolicy{MinLength: 12, MinCharacterClasses: 3, CheckEmail: true, Breached: BundledBreachedPasswords()}
+
+	tests := []struct {
+		name               string
+		policy             *PasswordPolicy
+		password           string
+		email              string
+		expectedViolations []string
+	}{
+		{name: "acceptable", policy: NewPasswordPolicy(), password: "long-enough", email: "me@here.com"},
+		{name: "empty", policy: NewPasswordPolicy(), password: "", expectedViolations: []string{"is required"}},
+		{name: "too short", policy: NewPasswordPolicy(), password: "short", expectedViolations: []string{"must be at least 8 characters long"}},
+		{name: "length counts characters", policy: NewPasswordPolicy(), password: "ééééééé", expectedViolations: []string{"must be at least 8 characters long"}},
+		{name: "breached", policy: NewPasswordPolicy(), password: "password123", expectedViolations: []string{"is too common or has appeared in a data breach"}},
+		{name: "breached ignoring case", policy: NewPasswordPolicy(), password: "PASSWORD123", expectedViolations: []string{"is too common or has appeared in a data breach"}},
+		{name: "contains the email", policy: NewPasswordPolicy(), password: "Jane.Doe-2026", email: "jane.doe@here.com", expectedViolations: []string{"must not be based on your email address"}},
+		{name: "part of the email", policy: NewPasswordPolicy(), password: "jonathansmi", email: "jonathan.smith@here.com", expectedViolations: []string{"must not be based on your email address"}},
+		{name: "short local part ignored", policy: NewPasswordPolicy(), password: "me-me-me-me", email: "me@here.com"},
+		{name: "email check disabled", policy: &PasswordPolicy{MinLength: 8, MinCharacterClasses: 1}, password: "jane.doe-2026", email: "jane.doe@here.com"},
+		{name: "too few classes", policy: strict, password: "all-lowercase-words", expectedViolations: []string{"must mix at least 3 of lowercase letters, uppercase letters, digits and symbols"}},
+		{name: "enough classes", policy: strict, password: "Mixed-classes-9"},
+		{name: "longer than the hasher takes", policy: &PasswordPolicy{MinLength: 8, MinCharacterClasses: 1, MaxBytes: maxBcryptPasswordBytes}, password: strings.Repeat("é", 37), expectedViolations: []string{"must be at most 72 bytes long"}},
+		{name: "as long as the hasher takes", policy: &PasswordPolicy{MinLength: 8, MinCharacterClasses: 1, MaxBytes: maxBcryptPasswordBytes}, password: strings.Repeat("é", 36)},
+		{
+			name:     "several rules",
+			policy:   strict,
+			password: "password",
+			expectedViolations: []string{
+				"must be at least 12 characters long",
+				"must mix at least 3 of lowercase letters, uppercase letters, digits and symbols",
+				"is too common or has appeared in a data breach",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations, err := tt.policy.Violations(tt.password, tt.email)
+			if err != nil {
+				t.Fatalf("failed to check password: %v", err)
+			}
+			if !slices.Equal(violations, tt.expectedViolations) {
+				t.Fatalf("expected %q, got %q", tt.expectedViolations, violations)
+			}
+		})
+	}
+}
+
+func TestMemoryRepositoryEnforcesPasswordPolicy(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+
+	var policyErr *PasswordPolicyError
+	if _, err := repo.Insert(User{Email: "me@here.com"}); !errors.As(err, &policyErr) {
+		t.Fatalf("expected an empty password to be rejected, got %v", err)
+	}
+
+	id, err := repo.Insert(User{Email: "me@here.com", Password: "secret-password"})
+	if err != nil {
+		t.Fatalf("failed to insert user: %v", err)
+	}
+	user, _ := repo.GetOne(id)
+
+	if err := repo.ResetPassword("123456", *user); !errors.As(err, &policyErr) {
+		t.Fatalf("expected a breached password to be rejected, got %v", err)
+	}
+	if matches, _ := repo.PasswordMatches("secret-password", *user); !matches {
+		t.Fatalf("expected a rejected reset to keep the old password")
+	}
+}
+
+func TestPasswordPolicyDoesNotBlockHashUpgrades(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+	id, _ := repo.Insert(User{Email: "me@here.com", Password: "secret-password"})
+
+	// a stricter policy applies to new passwords, not existing ones
+	repo.Policy = &PasswordPolicy{MinLength: 32, MinCharacterClasses: 4}
+	repo.Hasher = &PasswordHasher{Algorithm: HashAlgorithmArgon2id, Argon2id: testArgon2idParams}
+
+	user, _ := repo.GetOne(id)
+	if matches, err := repo.PasswordMatches("secret-password", *user); err != nil || !matches {
+		t.Fatalf("expected login to succeed, got %v, %v", matches, err)
+	}
+	if upgraded, _ := repo.GetOne(id); upgraded.Password == user.Password {
+		t.Fatalf("expected the hash to be upgraded despite the stricter policy")
+	}
+}
@@ -0,0 +1,160 @@
+// Package data implements storage for single-use password reset tokens.
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrResetTokenInvalid = errors.New("password reset token is invalid")
+	ErrResetTokenUsed    = errors.New("password reset token has already been used")
+	ErrResetTokenExpired = errors.New("password reset token has expired")
+)
+
+// PasswordReset is a single-use password reset token. Only a hash of the
+// token is stored, so a leaked table cannot be used to reset passwords.
+type PasswordReset struct {
+	ID        int
+	UserID    int
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// checkUsable reports why reset can no longer be redeemed at now, if at all.
+func (reset *PasswordReset) checkUsable(now time.Time) error {
+	if reset.UsedAt != nil {
+		return ErrResetTokenUsed
+	}
+	if !now.Before(reset.ExpiresAt) {
+		return ErrResetTokenExpired
+	}
+
+	return nil
+}
+
+// InsertPasswordReset stores a new reset token hash for a user.
+func (repo *PostgresRepository) InsertPasswordReset(reset PasswordReset) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into password_resets (user_id, token_hash, expires_at, created_at)
+		values ($1, $2, $3, $4)`
+
+	_, err := repo.Conn.ExecContext(ctx, stmt,
+		reset.UserID,
+		reset.TokenHash,
+		reset.ExpiresAt,
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetPasswordReset returns the token with the given hash without using it.
+// Unknown, already used and expired tokens are rejected.
+func (repo *PostgresRepository) GetPasswordReset(tokenHash string) (*PasswordReset, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, token_hash, expires_at, used_at, created_at
+		from password_resets where token_hash = $1`
+
+	reset, err := scanPasswordReset(repo.Conn.QueryRowContext(ctx, query, tokenHash))
+	if err != nil {
+		return nil, err
+	}
+	if err := reset.checkUsable(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return reset, nil
+}
+
+// RedeemPasswordReset sets the password of the token's owner, user, and
+// marks the token with the given hash as used, in one transaction, so a
+// failed reset leaves the token redeemable. Unknown, already used and expired
+// tokens are rejected, as are passwords the policy refuses.
+func (repo *PostgresRepository) RedeemPasswordReset(tokenHash, password string, user User) error {
+	if err := repo.Policy.Check(password, user.Email); err != nil {
+		return err
+	}
+
+	hashedPassword, err := repo.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := repo.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `select id, user_id, token_hash, expires_at, used_at, created_at
+		from password_resets where token_hash = $1 for update`
+
+	reset, err := scanPasswordReset(tx.QueryRowContext(ctx, query, tokenHash))
+	if err != nil {
+		return err
+	}
+	if reset.UserID != user.ID {
+		return ErrResetTokenInvalid
+	}
+
+	now := time.Now()
+	if err := reset.checkUsable(now); err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `update users set password = $1 where id = $2`, hashedPassword, user.ID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.ExecContext(ctx, `update password_resets set used_at = $1 where id = $2`, now, reset.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func scanPasswordReset(row *sql.Row) (*PasswordReset, error) {
+	var reset PasswordReset
+	var usedAt sql.NullTime
+	err := row.Scan(
+		&reset.ID,
+		&reset.UserID,
+		&reset.TokenHash,
+		&reset.ExpiresAt,
+		&usedAt,
+		&reset.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrResetTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if usedAt.Valid {
+		reset.UsedAt = &usedAt.Time
+	}
+
+	return &reset, nil
+}
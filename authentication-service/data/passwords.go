@@ -0,0 +1,206 @@
+// Package data hashes and verifies passwords with argon2id or bcrypt.
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	HashAlgorithmArgon2id = "argon2id"
+	HashAlgorithmBcrypt   = "bcrypt"
+)
+
+const defaultBcryptCost = 12
+
+// maxBcryptPasswordBytes is the most bcrypt accepts; longer passwords fail
+// to hash.
+const maxBcryptPasswordBytes = 72
+
+// ErrUnsupportedHash is returned for stored hashes in an unknown format.
+var ErrUnsupportedHash = errors.New("unsupported password hash format")
+
+// Argon2idParams tunes argon2id. Memory is in KiB.
+type Argon2idParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2idParams follows the OWASP baseline for argon2id.
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// PasswordHasher hashes new passwords with Algorithm and verifies hashes made
+// by any supported algorithm. Stored hashes are self-describing: argon2id
+// hashes use the PHC string format ($argon2id$v=19$m=...,t=...,p=...$salt$key)
+// and bcrypt hashes carry their own $2a$/$2b$ prefix and cost.
+type PasswordHasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2id   Argon2idParams
+}
+
+// NewPasswordHasher returns a hasher using argon2id with default parameters.
+func NewPasswordHasher() *PasswordHasher {
+	return &PasswordHasher{
+		Algorithm:  HashAlgorithmArgon2id,
+		BcryptCost: defaultBcryptCost,
+		Argon2id:   DefaultArgon2idParams,
+	}
+}
+
+// MaxPasswordBytes is the longest password, in bytes, that Algorithm can
+// hash, or zero when there is no limit.
+func (h *PasswordHasher) MaxPasswordBytes() int {
+	if h.Algorithm == HashAlgorithmBcrypt {
+		return maxBcryptPasswordBytes
+	}
+
+	return 0
+}
+
+// Hash encodes password with the configured algorithm.
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	switch h.Algorithm {
+	case HashAlgorithmArgon2id:
+		return h.hashArgon2id(password)
+	case HashAlgorithmBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	default:
+		return "", fmt.Errorf("unknown password hash algorithm %q", h.Algorithm)
+	}
+}
+
+// Verify reports whether password matches the stored hash encoded.
+func (h *PasswordHasher) Verify(password, encoded string) (bool, error) {
+	switch hashAlgorithm(encoded) {
+	case HashAlgorithmArgon2id:
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, err
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(candidate, key) == 1, nil
+	case HashAlgorithmBcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	default:
+		return false, ErrUnsupportedHash
+	}
+}
+
+// NeedsRehash reports whether encoded was made with a different algorithm or
+// weaker settings than the hasher is configured for.
+func (h *PasswordHasher) NeedsRehash(encoded string) bool {
+	algorithm := hashAlgorithm(encoded)
+	if algorithm != h.Algorithm {
+		return algorithm != ""
+	}
+
+	switch algorithm {
+	case HashAlgorithmArgon2id:
+		params, _, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false
+		}
+		return params.Memory < h.Argon2id.Memory ||
+			params.Iterations < h.Argon2id.Iterations ||
+			params.Parallelism < h.Argon2id.Parallelism ||
+			uint32(len(key)) < h.Argon2id.KeyLength
+	case HashAlgorithmBcrypt:
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err == nil && cost < h.BcryptCost
+	}
+
+	return false
+}
+
+func (h *PasswordHasher) hashArgon2id(password string) (string, error) {
+	params := h.Argon2id
+	if params.Iterations < 1 || params.Parallelism < 1 || params.KeyLength < 16 || params.SaltLength < 8 {
+		return "", errors.New("argon2id needs at least 1 iteration, 1 thread, a 16 byte key and an 8 byte salt")
+	}
+
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		params.Memory,
+		params.Iterations,
+		params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// hashAlgorithm identifies the algorithm that produced encoded, or "".
+func hashAlgorithm(encoded string) string {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return HashAlgorithmArgon2id
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return HashAlgorithmBcrypt
+	default:
+		return ""
+	}
+}
+
+func decodeArgon2id(encoded string) (Argon2idParams, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return Argon2idParams{}, nil, nil, ErrUnsupportedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2idParams{}, nil, nil, ErrUnsupportedHash
+	}
+
+	var params Argon2idParams
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	// argon2.IDKey panics on parameters it cannot use
+	if err != nil || params.Iterations < 1 || params.Parallelism < 1 || params.Memory < 8*uint32(params.Parallelism) {
+		return Argon2idParams{}, nil, nil, ErrUnsupportedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2idParams{}, nil, nil, ErrUnsupportedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return Argon2idParams{}, nil, nil, ErrUnsupportedHash
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
@@ -0,0 +1,134 @@
+// Package data verifies password hashing, verification and rehash detection.
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2idParams keeps argon2id fast enough for unit tests.
+var testArgon2idParams = Argon2idParams{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestPasswordHasherRoundTrip(t *testing.T) {
+	tests := []struct {
+		name           string
+		hasher         *PasswordHasher
+		expectedPrefix string
+	}{
+		{name: "argon2id", hasher: &PasswordHasher{Algorithm: HashAlgorithmArgon2id, Argon2id: testArgon2idParams}, expectedPrefix: "$argon2id$v=19$m=64,t=1,p=1$"},
+		{name: "bcrypt", hasher: &PasswordHasher{Algorithm: HashAlgorithmBcrypt, BcryptCost: bcrypt.MinCost}, expectedPrefix: "$2a$04$"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := tt.hasher.Hash("correct horse")
+			if err != nil {
+				t.Fatalf("expected hash to succeed, got %v", err)
+			}
+			if !strings.HasPrefix(encoded, tt.expectedPrefix) {
+				t.Fatalf("expected hash to start with %q, got %q", tt.expectedPrefix, encoded)
+			}
+
+			if valid, err := tt.hasher.Verify("correct horse", encoded); err != nil || !valid {
+				t.Fatalf("expected password to verify, got %v, %v", valid, err)
+			}
+			if valid, err := tt.hasher.Verify("wrong horse", encoded); err != nil || valid {
+				t.Fatalf("expected wrong password to fail, got %v, %v", valid, err)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherVerifiesEitherAlgorithm(t *testing.T) {
+	legacy, _ := (&PasswordHasher{Algorithm: HashAlgorithmBcrypt, BcryptCost: bcrypt.MinCost}).Hash("secret")
+	hasher := &PasswordHasher{Algorithm: HashAlgorithmArgon2id, Argon2id: testArgon2idParams}
+
+	if valid, err := hasher.Verify("secret", legacy); err != nil || !valid {
+		t.Fatalf("expected an argon2id hasher to verify bcrypt hashes, got %v, %v", valid, err)
+	}
+}
+
+func TestPasswordHasherRejectsMalformedHashes(t *testing.T) {
+	hasher := &PasswordHasher{Algorithm: HashAlgorithmArgon2id, Argon2id: testArgon2idParams}
+
+	for _, encoded := range []string{
+		"",
+		"plain-text",
+		"$argon2id$v=19$m=64,t=1,p=1$only-salt",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=0$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$!!!",
+	} {
+		if _, err := hasher.Verify("secret", encoded); !errors.Is(err, ErrUnsupportedHash) {
+			t.Fatalf("expected ErrUnsupportedHash for %q, got %v", encoded, err)
+		}
+	}
+}
+
+func TestPasswordHasherNeedsRehash(t *testing.T) {
+	weakBcrypt, _ := (&PasswordHasher{Algorithm: HashAlgorithmBcrypt, BcryptCost: bcrypt.MinCost}).Hash("secret")
+	strongBcrypt, _ := (&PasswordHasher{Algorithm: HashAlgorithmBcrypt, BcryptCost: bcrypt.MinCost + 1}).Hash("secret")
+	weakArgon, _ := (&PasswordHasher{Algorithm: HashAlgorithmArgon2id, Argon2id: testArgon2idParams}).Hash("secret")
+
+	strongerParams := testArgon2idParams
+	strongerParams.Iterations = 2
+
+	tests := []struct {
+		name     string
+		hasher   *PasswordHasher
+		encoded  string
+		expected bool
+	}{
+		{name: "bcrypt below configured cost", hasher: &PasswordHasher{Algorithm: HashAlgorithmBcrypt, BcryptCost: bcrypt.MinCost + 1}, encoded: weakBcrypt, expected: true},
+		{name: "bcrypt at configured cost", hasher: &PasswordHasher{Algorithm: HashAlgorithmBcrypt, BcryptCost: bcrypt.MinCost + 1}, encoded: strongBcrypt, expected: false},
+		{name: "bcrypt when argon2id is preferred", hasher: &PasswordHasher{Algorithm: HashAlgorithmArgon2id, Argon2id: testArgon2idParams}, encoded: strongBcrypt, expected: true},
+		{name: "argon2id with current params", hasher: &PasswordHasher{Algorithm: HashAlgorithmArgon2id, Argon2id: testArgon2idParams}, encoded: weakArgon, expected: false},
+		{name: "argon2id with fewer iterations", hasher: &PasswordHasher{Algorithm: HashAlgorithmArgon2id, Argon2id: strongerParams}, encoded: weakArgon, expected: true},
+		{name: "unknown format", hasher: &PasswordHasher{Algorithm: HashAlgorithmArgon2id, Argon2id: testArgon2idParams}, encoded: "plain-text", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hasher.NeedsRehash(tt.encoded); got != tt.expected {
+				t.Fatalf("expected NeedsRehash=%v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestMemoryRepositoryUpgradesHashOnLogin(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+	id, _ := repo.Insert(User{Email: "me@here.com", Password: "secret-password"})
+
+	repo.Hasher = &PasswordHasher{Algorithm: HashAlgorithmArgon2id, Argon2id: testArgon2idParams}
+
+	user, _ := repo.GetOne(id)
+	if matches, err := repo.PasswordMatches("secret-password", *user); err != nil || !matches {
+		t.Fatalf("expected legacy hash to match, got %v, %v", matches, err)
+	}
+
+	user, _ = repo.GetOne(id)
+	if !strings.HasPrefix(user.Password, "$argon2id$") {
+		t.Fatalf("expected hash to be upgraded to argon2id, got %q", user.Password)
+	}
+	if matches, _ := repo.PasswordMatches("secret-password", *user); !matches {
+		t.Fatalf("expected upgraded hash to match")
+	}
+}
+
+func TestMemoryRepositoryLoginSurvivesFailedUpgrade(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+	id, _ := repo.Insert(User{Email: "me@here.com", Password: "secret-password"})
+	user, _ := repo.GetOne(id)
+
+	// the upgrade fails because the user is gone by the time it is stored
+	_ = repo.DeleteByID(id)
+	repo.Hasher = &PasswordHasher{Algorithm: HashAlgorithmArgon2id, Argon2id: testArgon2idParams}
+
+	if matches, err := repo.PasswordMatches("secret-password", *user); err != nil || !matches {
+		t.Fatalf("expected the login to succeed, got %v, %v", matches, err)
+	}
+}
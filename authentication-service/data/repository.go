@@ -1,14 +1,44 @@
 // Package data defines contracts used by the authentication service data layer.
 package data
 
+import "time"
+
 // Repository describes the persistence operations used by authentication handlers.
 type Repository interface {
 	GetAll() ([]*User, error)
+	ListUsers(query UserQuery) (*UserPage, error)
 	GetByEmail(email string) (*User, error)
 	GetOne(id int) (*User, error)
 	Update(user User) error
 	DeleteByID(id int) error
 	Insert(user User) (int, error)
+	InsertBatch(users []User) ([]int, error)
+	EachUser(fn func(*User) error) error
 	ResetPassword(password string, user User) error
 	PasswordMatches(plainText string, user User) (bool, error)
+	MarkEmailVerified(userID int, email string) error
+	InsertPasswordReset(reset PasswordReset) error
+	GetPasswordReset(tokenHash string) (*PasswordReset, error)
+	RedeemPasswordReset(tokenHash, password string, user User) error
+	GetAuthorization(userID int) (Authorization, error)
+	SetRoles(userID int, roles []string) error
+	GetTOTP(userID int) (*TOTPEnrollment, error)
+	SaveTOTPSecret(userID int, secret string) error
+	ConfirmTOTP(userID int, step int64, recoveryCodeHashes []string) error
+	UseTOTPStep(userID int, step int64) error
+	ConsumeRecoveryCode(userID int, codeHash string) error
+	CreateSession(session Session) error
+	GetSession(id string) (*Session, error)
+	ListSessions(userID int) ([]*Session, error)
+	TouchSession(id string, seenAt time.Time) error
+	RevokeSession(userID int, id string) error
+	RevokeSessions(userID int) error
+	InsertAPIKey(key APIKey) (int, error)
+	GetAPIKeyByHash(keyHash string) (*APIKey, error)
+	ListAPIKeys() ([]*APIKey, error)
+	RotateAPIKey(id int, prefix, keyHash string) error
+	RevokeAPIKey(id int) error
+	TouchAPIKey(id int, usedAt time.Time) error
+	InsertAuditEvent(event AuditEvent) error
+	ListAuditEvents(userID, before, limit int) ([]*AuditEvent, error)
 }
@@ -0,0 +1,167 @@
+// Package data stores user roles and the permissions they grant.
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Roles seeded by the 0003_create_roles migration.
+const (
+	RoleAdmin  = "admin"
+	RoleMailer = "mailer"
+	RoleUser   = "user"
+)
+
+// Permissions granted through roles.
+const (
+	PermissionUsersList   = "users:list"
+	PermissionUsersManage = "users:manage"
+	PermissionLogsRead    = "logs:read"
+	PermissionLogsWrite   = "logs:write"
+	PermissionMailSend    = "mail:send"
+	// PermissionAPIKeysManage lets a user mint, rotate and revoke API keys.
+	PermissionAPIKeysManage = "api_keys:manage"
+	// PermissionAuditRead lets a user read the audit trail of any account.
+	PermissionAuditRead = "audit:read"
+)
+
+// DefaultRole is assigned to every newly registered user.
+const DefaultRole = RoleUser
+
+// ErrUnknownRole is returned when assigning a role that does not exist.
+var ErrUnknownRole = errors.New("unknown role")
+
+// DefaultRolePermissions mirrors the grants seeded by the roles migration and
+// backs repositories that have no roles table.
+var DefaultRolePermissions = map[string][]string{
+	RoleAdmin: {
+		PermissionAPIKeysManage,
+		PermissionAuditRead,
+		PermissionLogsRead,
+		PermissionLogsWrite,
+		PermissionMailSend,
+		PermissionUsersList,
+		PermissionUsersManage,
+	},
+	RoleMailer: {PermissionLogsWrite, PermissionMailSend},
+	RoleUser:   {PermissionLogsWrite},
+}
+
+// Authorization is the set of roles a user holds and the permissions they grant.
+type Authorization struct {
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+// authorizationFor resolves roles against DefaultRolePermissions.
+func authorizationFor(roles []string) Authorization {
+	granted := make(map[string]bool)
+	for _, role := range roles {
+		for _, permission := range DefaultRolePermissions[role] {
+			granted[permission] = true
+		}
+	}
+
+	authorization := Authorization{
+		Roles:       append([]string{}, roles...),
+		Permissions: make([]string, 0, len(granted)),
+	}
+	for permission := range granted {
+		authorization.Permissions = append(authorization.Permissions, permission)
+	}
+	sort.Strings(authorization.Roles)
+	sort.Strings(authorization.Permissions)
+
+	return authorization
+}
+
+// GetAuthorization returns the roles and permissions held by a user.
+func (repo *PostgresRepository) GetAuthorization(userID int) (Authorization, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	authorization := Authorization{Roles: []string{}, Permissions: []string{}}
+
+	roleQuery := `select r.name from user_roles ur
+		join roles r on r.id = ur.role_id
+		where ur.user_id = $1 order by r.name`
+	roles, err := repo.queryNames(ctx, roleQuery, userID)
+	if err != nil {
+		return Authorization{}, err
+	}
+	authorization.Roles = append(authorization.Roles, roles...)
+
+	permissionQuery := `select distinct p.name from user_roles ur
+		join role_permissions rp on rp.role_id = ur.role_id
+		join permissions p on p.id = rp.permission_id
+		where ur.user_id = $1 order by p.name`
+	permissions, err := repo.queryNames(ctx, permissionQuery, userID)
+	if err != nil {
+		return Authorization{}, err
+	}
+	authorization.Permissions = append(authorization.Permissions, permissions...)
+
+	return authorization, nil
+}
+
+// SetRoles replaces the roles held by a user.
+func (repo *PostgresRepository) SetRoles(userID int, roles []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := repo.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from user_roles where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, role := range roles {
+		result, err := tx.ExecContext(ctx, `insert into user_roles (user_id, role_id)
+			select $1, id from roles where name = $2
+			on conflict do nothing`, userID, role)
+		if err != nil {
+			return err
+		}
+
+		// a known role inserts one row, or none if it was listed twice
+		if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+			var exists bool
+			err = tx.QueryRowContext(ctx, `select exists (select 1 from roles where name = $1)`, role).Scan(&exists)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("%w: %s", ErrUnknownRole, role)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (repo *PostgresRepository) queryNames(ctx context.Context, query string, args ...any) ([]string, error) {
+	rows, err := repo.Conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
@@ -0,0 +1,61 @@
+// Package data verifies role resolution and role assignment.
+package data
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestAuthorizationFor(t *testing.T) {
+	tests := []struct {
+		name                string
+		roles               []string
+		expectedPermissions []string
+	}{
+		{name: "no roles", roles: nil, expectedPermissions: []string{}},
+		{name: "user", roles: []string{RoleUser}, expectedPermissions: []string{PermissionLogsWrite}},
+		{name: "overlapping roles", roles: []string{RoleUser, RoleMailer}, expectedPermissions: []string{PermissionLogsWrite, PermissionMailSend}},
+		{name: "unknown role grants nothing", roles: []string{"wizard"}, expectedPermissions: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authorization := authorizationFor(tt.roles)
+
+			if !slices.Equal(authorization.Permissions, tt.expectedPermissions) {
+				t.Fatalf("expected permissions %v, got %v", tt.expectedPermissions, authorization.Permissions)
+			}
+		})
+	}
+}
+
+func TestMemoryRepositoryRoles(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+	id, _ := repo.Insert(User{Email: "me@here.com", Password: "secret-password"})
+
+	authorization, err := repo.GetAuthorization(id)
+	if err != nil {
+		t.Fatalf("expected authorization, got %v", err)
+	}
+	if !slices.Equal(authorization.Roles, []string{DefaultRole}) {
+		t.Fatalf("expected new users to get the default role, got %v", authorization.Roles)
+	}
+
+	err = repo.SetRoles(id, []string{RoleAdmin, RoleAdmin})
+	if err != nil {
+		t.Fatalf("expected roles to be set, got %v", err)
+	}
+	authorization, _ = repo.GetAuthorization(id)
+	if !slices.Equal(authorization.Roles, []string{RoleAdmin}) {
+		t.Fatalf("expected duplicate roles to collapse, got %v", authorization.Roles)
+	}
+	if !slices.Contains(authorization.Permissions, PermissionUsersManage) {
+		t.Fatalf("expected admin permissions, got %v", authorization.Permissions)
+	}
+
+	err = repo.SetRoles(id, []string{"wizard"})
+	if !errors.Is(err, ErrUnknownRole) {
+		t.Fatalf("expected ErrUnknownRole, got %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+// Package data stores login sessions so issued tokens can be revoked.
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrSessionNotFound is returned for unknown sessions and sessions that
+// belong to another user.
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is one login. Every token issued for it carries its ID, so revoking
+// the session invalidates them all.
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     int        `json:"user_id"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Active reports whether the session has not been revoked.
+func (session *Session) Active() bool {
+	return session.RevokedAt == nil
+}
+
+// CreateSession stores a new session.
+func (repo *PostgresRepository) CreateSession(session Session) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into sessions (id, user_id, user_agent, ip, created_at, last_seen_at)
+		values ($1, $2, $3, $4, $5, $6)`
+
+	_, err := repo.Conn.ExecContext(ctx, stmt,
+		session.ID,
+		session.UserID,
+		session.UserAgent,
+		session.IP,
+		session.CreatedAt,
+		session.LastSeenAt,
+	)
+
+	return err
+}
+
+// GetSession returns one session by ID, revoked or not.
+func (repo *PostgresRepository) GetSession(id string) (*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, user_agent, ip, created_at, last_seen_at, revoked_at
+		from sessions where id = $1`
+
+	session, err := scanSession(repo.Conn.QueryRowContext(ctx, query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// ListSessions returns a user's active sessions, most recently used first.
+func (repo *PostgresRepository) ListSessions(userID int) ([]*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, user_agent, ip, created_at, last_seen_at, revoked_at
+		from sessions where user_id = $1 and revoked_at is null
+		order by last_seen_at desc`
+
+	rows, err := repo.Conn.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// TouchSession records that a session was used at seenAt.
+func (repo *PostgresRepository) TouchSession(id string, seenAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := repo.Conn.ExecContext(ctx, `update sessions set last_seen_at = $1 where id = $2`, seenAt, id)
+
+	return err
+}
+
+// RevokeSession revokes one of a user's active sessions.
+func (repo *PostgresRepository) RevokeSession(userID int, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update sessions set revoked_at = $1
+		where id = $2 and user_id = $3 and revoked_at is null`
+
+	result, err := repo.Conn.ExecContext(ctx, stmt, time.Now(), id, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// RevokeSessions revokes every active session of a user.
+func (repo *PostgresRepository) RevokeSessions(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update sessions set revoked_at = $1 where user_id = $2 and revoked_at is null`
+
+	_, err := repo.Conn.ExecContext(ctx, stmt, time.Now(), userID)
+
+	return err
+}
+
+// sessionMap holds sessions for the in-memory repositories. Callers must
+// serialise access to it.
+type sessionMap map[string]Session
+
+func (sessions sessionMap) list(userID int) []*Session {
+	list := []*Session{}
+	for _, session := range sessions {
+		if session.UserID == userID && session.Active() {
+			list = append(list, &session)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastSeenAt.After(list[j].LastSeenAt)
+	})
+
+	return list
+}
+
+func (sessions sessionMap) revoke(userID int, id string, now time.Time) error {
+	session, ok := sessions[id]
+	if !ok || session.UserID != userID || !session.Active() {
+		return ErrSessionNotFound
+	}
+	session.RevokedAt = &now
+	sessions[id] = session
+
+	return nil
+}
+
+func (sessions sessionMap) revokeAll(userID int, now time.Time) {
+	for id, session := range sessions {
+		if session.UserID == userID && session.Active() {
+			session.RevokedAt = &now
+			sessions[id] = session
+		}
+	}
+}
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSession(row rowScanner) (*Session, error) {
+	var session Session
+	var revokedAt sql.NullTime
+
+	err := row.Scan(
+		&session.ID,
+		&session.UserID,
+		&session.UserAgent,
+		&session.IP,
+		&session.CreatedAt,
+		&session.LastSeenAt,
+		&revokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	session.RevokedAt = nullTime(revokedAt)
+
+	return &session, nil
+}
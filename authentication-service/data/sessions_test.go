@@ -0,0 +1,73 @@
+// Package data verifies session storage in the in-memory repository.
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryRepositorySessions(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+	id, _ := repo.Insert(User{Email: "me@here.com", Password: "secret-password"})
+	otherID, _ := repo.Insert(User{Email: "you@there.com", Password: "secret-password"})
+
+	now := time.Now()
+	if err := repo.CreateSession(Session{ID: "orphan", UserID: 99, CreatedAt: now, LastSeenAt: now}); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows for unknown user, got %v", err)
+	}
+
+	_ = repo.CreateSession(Session{ID: "older", UserID: id, CreatedAt: now, LastSeenAt: now.Add(-time.Hour)})
+	_ = repo.CreateSession(Session{ID: "newer", UserID: id, CreatedAt: now, LastSeenAt: now})
+	_ = repo.CreateSession(Session{ID: "other", UserID: otherID, CreatedAt: now, LastSeenAt: now})
+
+	sessions, _ := repo.ListSessions(id)
+	if len(sessions) != 2 || sessions[0].ID != "newer" || sessions[1].ID != "older" {
+		t.Fatalf("expected sessions ordered by last seen, got %+v", sessions)
+	}
+
+	_ = repo.TouchSession("older", now.Add(time.Minute))
+	sessions, _ = repo.ListSessions(id)
+	if sessions[0].ID != "older" {
+		t.Fatalf("expected touched session first, got %q", sessions[0].ID)
+	}
+
+	tests := []struct {
+		name        string
+		userID      int
+		sessionID   string
+		expectedErr error
+	}{
+		{name: "another user's session", userID: id, sessionID: "other", expectedErr: ErrSessionNotFound},
+		{name: "unknown session", userID: id, sessionID: "missing", expectedErr: ErrSessionNotFound},
+		{name: "own session", userID: id, sessionID: "older", expectedErr: nil},
+		{name: "already revoked", userID: id, sessionID: "older", expectedErr: ErrSessionNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := repo.RevokeSession(tt.userID, tt.sessionID); !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("expected %v, got %v", tt.expectedErr, err)
+			}
+		})
+	}
+
+	revoked, err := repo.GetSession("older")
+	if err != nil || revoked.Active() {
+		t.Fatalf("expected a revoked session to still be readable, got %+v, %v", revoked, err)
+	}
+
+	_ = repo.RevokeSessions(id)
+	if sessions, _ := repo.ListSessions(id); len(sessions) != 0 {
+		t.Fatalf("expected no active sessions, got %d", len(sessions))
+	}
+	if sessions, _ := repo.ListSessions(otherID); len(sessions) != 1 {
+		t.Fatalf("expected other user's session untouched, got %d", len(sessions))
+	}
+
+	_ = repo.DeleteByID(otherID)
+	if _, err := repo.GetSession("other"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected sessions removed with their user, got %v", err)
+	}
+}
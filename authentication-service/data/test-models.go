@@ -3,16 +3,30 @@ package data
 
 import (
 	"database/sql"
+	"fmt"
+	"sync"
 	"time"
 )
 
+// TestDuplicateEmail is rejected by PostgresTestRepository as already registered.
+const TestDuplicateEmail = "taken@here.com"
+
 type PostgresTestRepository struct {
 	Conn *sql.DB
+
+	mu       sync.Mutex
+	resets   map[string]*PasswordReset
+	sessions sessionMap
+	apiKeys  apiKeyMap
+	audit    auditTrail
 }
 
 func NewPostgresTestRepository(db *sql.DB) *PostgresTestRepository {
 	return &PostgresTestRepository{
-		Conn: db,
+		Conn:     db,
+		resets:   make(map[string]*PasswordReset),
+		sessions: make(sessionMap),
+		apiKeys:  make(apiKeyMap),
 	}
 }
 
@@ -25,6 +39,7 @@ func (repo *PostgresTestRepository) GetAll() ([]*User, error) {
 
 // GetByEmail returns one user by email
 func (repo *PostgresTestRepository) GetByEmail(email string) (*User, error) {
+	verifiedAt := time.Now()
 	user := User{
 		ID:        1,
 		FirstName: "First",
@@ -34,6 +49,8 @@ func (repo *PostgresTestRepository) GetByEmail(email string) (*User, error) {
 		Active:    1,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
+
+		EmailVerifiedAt: &verifiedAt,
 	}
 
 	return &user, nil
@@ -41,6 +58,7 @@ func (repo *PostgresTestRepository) GetByEmail(email string) (*User, error) {
 
 // GetOne returns one user by id
 func (repo *PostgresTestRepository) GetOne(id int) (*User, error) {
+	verifiedAt := time.Now()
 	user := User{
 		ID:        1,
 		FirstName: "First",
@@ -50,6 +68,8 @@ func (repo *PostgresTestRepository) GetOne(id int) (*User, error) {
 		Active:    1,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
+
+		EmailVerifiedAt: &verifiedAt,
 	}
 
 	return &user, nil
@@ -58,6 +78,10 @@ func (repo *PostgresTestRepository) GetOne(id int) (*User, error) {
 // Update updates one user in the database, using the information
 // stored in the receiver u
 func (repo *PostgresTestRepository) Update(user User) error {
+	if user.Email == TestDuplicateEmail {
+		return ErrDuplicateEmail
+	}
+
 	return nil
 }
 
@@ -68,9 +92,37 @@ func (repo *PostgresTestRepository) DeleteByID(id int) error {
 
 // Insert inserts a new user into the database, and returns the ID of the newly inserted row
 func (repo *PostgresTestRepository) Insert(user User) (int, error) {
+	if user.Email == TestDuplicateEmail {
+		return 0, ErrDuplicateEmail
+	}
+
 	return 2, nil
 }
 
+// InsertBatch rejects a batch holding TestDuplicateEmail and otherwise
+// numbers the users from 2, like Insert.
+func (repo *PostgresTestRepository) InsertBatch(users []User) ([]int, error) {
+	ids := make([]int, len(users))
+	for i, user := range users {
+		if user.Email == TestDuplicateEmail {
+			return nil, &BatchInsertError{Index: i, Err: ErrDuplicateEmail}
+		}
+		ids[i] = i + 2
+	}
+
+	return ids, nil
+}
+
+// EachUser has no users to visit, like GetAll.
+func (repo *PostgresTestRepository) EachUser(fn func(*User) error) error {
+	return nil
+}
+
+// ListUsers returns an empty page, like GetAll, after checking the query.
+func (repo *PostgresTestRepository) ListUsers(query UserQuery) (*UserPage, error) {
+	return listUsers(nil, query)
+}
+
 // ResetPassword is the method we will use to change a user's password.
 func (repo *PostgresTestRepository) ResetPassword(password string, user User) error {
 	return nil
@@ -82,3 +134,237 @@ func (repo *PostgresTestRepository) ResetPassword(password string, user User) er
 func (repo *PostgresTestRepository) PasswordMatches(plainText string, user User) (bool, error) {
 	return true, nil
 }
+
+// MarkEmailVerified accepts any verification for the fixture user.
+func (repo *PostgresTestRepository) MarkEmailVerified(userID int, email string) error {
+	return nil
+}
+
+// GetAuthorization grants every fixture user the default role.
+func (repo *PostgresTestRepository) GetAuthorization(userID int) (Authorization, error) {
+	return authorizationFor([]string{DefaultRole}), nil
+}
+
+// SetRoles accepts any known role without storing it.
+func (repo *PostgresTestRepository) SetRoles(userID int, roles []string) error {
+	for _, role := range roles {
+		if _, ok := DefaultRolePermissions[role]; !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownRole, role)
+		}
+	}
+
+	return nil
+}
+
+// InsertPasswordReset keeps the reset token in memory so tests can redeem it.
+func (repo *PostgresTestRepository) InsertPasswordReset(reset PasswordReset) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	reset.CreatedAt = time.Now()
+	repo.resets[reset.TokenHash] = &reset
+
+	return nil
+}
+
+// GetPasswordReset applies the same expiry rules as Postgres.
+func (repo *PostgresTestRepository) GetPasswordReset(tokenHash string) (*PasswordReset, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	reset, ok := repo.resets[tokenHash]
+	if !ok {
+		return nil, ErrResetTokenInvalid
+	}
+	if err := reset.checkUsable(time.Now()); err != nil {
+		return nil, err
+	}
+
+	found := *reset
+	return &found, nil
+}
+
+// RedeemPasswordReset applies the same single-use and expiry rules as
+// Postgres without storing the password.
+func (repo *PostgresTestRepository) RedeemPasswordReset(tokenHash, password string, user User) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	reset, ok := repo.resets[tokenHash]
+	if !ok || reset.UserID != user.ID {
+		return ErrResetTokenInvalid
+	}
+
+	now := time.Now()
+	if err := reset.checkUsable(now); err != nil {
+		return err
+	}
+	reset.UsedAt = &now
+
+	return nil
+}
+
+// GetTOTP reports that fixture users have no second factor.
+func (repo *PostgresTestRepository) GetTOTP(userID int) (*TOTPEnrollment, error) {
+	return nil, ErrTOTPNotEnrolled
+}
+
+// SaveTOTPSecret accepts the secret without storing it.
+func (repo *PostgresTestRepository) SaveTOTPSecret(userID int, secret string) error {
+	return nil
+}
+
+// ConfirmTOTP fails because no enrollment is ever stored.
+func (repo *PostgresTestRepository) ConfirmTOTP(userID int, step int64, recoveryCodeHashes []string) error {
+	return ErrTOTPNotEnrolled
+}
+
+// UseTOTPStep fails because no enrollment is ever stored.
+func (repo *PostgresTestRepository) UseTOTPStep(userID int, step int64) error {
+	return ErrTOTPCodeReused
+}
+
+// ConsumeRecoveryCode fails because no recovery codes are ever stored.
+func (repo *PostgresTestRepository) ConsumeRecoveryCode(userID int, codeHash string) error {
+	return ErrRecoveryCodeInvalid
+}
+
+// CreateSession keeps the session in memory so tokens issued for it validate.
+func (repo *PostgresTestRepository) CreateSession(session Session) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	repo.sessions[session.ID] = session
+
+	return nil
+}
+
+// GetSession returns a session stored by CreateSession.
+func (repo *PostgresTestRepository) GetSession(id string) (*Session, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	session, ok := repo.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	return &session, nil
+}
+
+// ListSessions returns a user's active sessions.
+func (repo *PostgresTestRepository) ListSessions(userID int) ([]*Session, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.sessions.list(userID), nil
+}
+
+// TouchSession records that a session was used at seenAt.
+func (repo *PostgresTestRepository) TouchSession(id string, seenAt time.Time) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if session, ok := repo.sessions[id]; ok {
+		session.LastSeenAt = seenAt
+		repo.sessions[id] = session
+	}
+
+	return nil
+}
+
+// RevokeSession revokes one of a user's active sessions.
+func (repo *PostgresTestRepository) RevokeSession(userID int, id string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.sessions.revoke(userID, id, time.Now())
+}
+
+// RevokeSessions revokes every active session of a user.
+func (repo *PostgresTestRepository) RevokeSessions(userID int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	repo.sessions.revokeAll(userID, time.Now())
+
+	return nil
+}
+
+// InsertAPIKey stores a new key and returns its ID.
+func (repo *PostgresTestRepository) InsertAPIKey(key APIKey) (int, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.apiKeys.insert(key), nil
+}
+
+// GetAPIKeyByHash returns the active key with the given hash.
+func (repo *PostgresTestRepository) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.apiKeys.byHash(keyHash)
+}
+
+// ListAPIKeys returns the active keys, newest first.
+func (repo *PostgresTestRepository) ListAPIKeys() ([]*APIKey, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.apiKeys.list(), nil
+}
+
+// RotateAPIKey replaces the secret of an active key.
+func (repo *PostgresTestRepository) RotateAPIKey(id int, prefix, keyHash string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	now := time.Now()
+	return repo.apiKeys.update(id, func(key *APIKey) {
+		key.Prefix = prefix
+		key.KeyHash = keyHash
+		key.RotatedAt = &now
+	})
+}
+
+// RevokeAPIKey revokes an active key.
+func (repo *PostgresTestRepository) RevokeAPIKey(id int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	now := time.Now()
+	return repo.apiKeys.update(id, func(key *APIKey) {
+		key.RevokedAt = &now
+	})
+}
+
+// TouchAPIKey records that a key was used at usedAt.
+func (repo *PostgresTestRepository) TouchAPIKey(id int, usedAt time.Time) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	_ = repo.apiKeys.update(id, func(key *APIKey) {
+		key.LastUsedAt = &usedAt
+	})
+
+	return nil
+}
+
+// InsertAuditEvent appends an event to the audit trail.
+func (repo *PostgresTestRepository) InsertAuditEvent(event AuditEvent) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	repo.audit.insert(event)
+
+	return nil
+}
+
+// ListAuditEvents returns up to limit of a user's events, newest first.
+func (repo *PostgresTestRepository) ListAuditEvents(userID, before, limit int) ([]*AuditEvent, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.audit.list(userID, before, limit), nil
+}
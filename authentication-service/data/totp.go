@@ -0,0 +1,176 @@
+// Package data stores TOTP second-factor secrets and recovery codes.
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrTOTPNotEnrolled      = errors.New("two-factor authentication is not enrolled")
+	ErrTOTPAlreadyConfirmed = errors.New("two-factor authentication is already enabled")
+	ErrTOTPCodeReused       = errors.New("one-time code has already been used")
+	ErrRecoveryCodeInvalid  = errors.New("recovery code is invalid or has already been used")
+)
+
+// TOTPEnrollment is a user's TOTP secret. It only guards logins once it has
+// been confirmed with a code. LastUsedStep is the most recent accepted time
+// step, so a code cannot be replayed within its validity window.
+type TOTPEnrollment struct {
+	UserID       int
+	Secret       string
+	ConfirmedAt  *time.Time
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+// Confirmed reports whether the enrollment is active.
+func (enrollment *TOTPEnrollment) Confirmed() bool {
+	return enrollment.ConfirmedAt != nil
+}
+
+// GetTOTP returns the TOTP enrollment of a user.
+func (repo *PostgresRepository) GetTOTP(userID int) (*TOTPEnrollment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select user_id, secret, confirmed_at, last_used_step, created_at
+		from user_totp where user_id = $1`
+
+	var enrollment TOTPEnrollment
+	var confirmedAt sql.NullTime
+	err := repo.Conn.QueryRowContext(ctx, query, userID).Scan(
+		&enrollment.UserID,
+		&enrollment.Secret,
+		&confirmedAt,
+		&enrollment.LastUsedStep,
+		&enrollment.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if confirmedAt.Valid {
+		enrollment.ConfirmedAt = &confirmedAt.Time
+	}
+
+	return &enrollment, nil
+}
+
+// SaveTOTPSecret starts an enrollment, replacing any unconfirmed secret.
+// Confirmed enrollments are left untouched.
+func (repo *PostgresRepository) SaveTOTPSecret(userID int, secret string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into user_totp (user_id, secret, created_at) values ($1, $2, $3)
+		on conflict (user_id) do update
+		set secret = excluded.secret, last_used_step = 0, created_at = excluded.created_at
+		where user_totp.confirmed_at is null`
+
+	result, err := repo.Conn.ExecContext(ctx, stmt, userID, secret, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return ErrTOTPAlreadyConfirmed
+	}
+
+	return nil
+}
+
+// ConfirmTOTP activates a user's enrollment, records step as used and
+// replaces their recovery codes with recoveryCodeHashes.
+func (repo *PostgresRepository) ConfirmTOTP(userID int, step int64, recoveryCodeHashes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := repo.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var confirmedAt sql.NullTime
+	err = tx.QueryRowContext(ctx, `select confirmed_at from user_totp where user_id = $1 for update`, userID).Scan(&confirmedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	if confirmedAt.Valid {
+		return ErrTOTPAlreadyConfirmed
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `update user_totp set confirmed_at = $1, last_used_step = $2 where user_id = $3`, now, step, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from totp_recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, codeHash := range recoveryCodeHashes {
+		_, err = tx.ExecContext(ctx, `insert into totp_recovery_codes (user_id, code_hash, created_at) values ($1, $2, $3)`, userID, codeHash, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records step as the latest accepted code for a user. Steps at
+// or before the last accepted one are rejected with ErrTOTPCodeReused.
+func (repo *PostgresRepository) UseTOTPStep(userID int, step int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_totp set last_used_step = $1
+		where user_id = $2 and confirmed_at is not null and last_used_step < $1`
+
+	result, err := repo.Conn.ExecContext(ctx, stmt, step, userID)
+	if err != nil {
+		return err
+	}
+
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return ErrTOTPCodeReused
+	}
+
+	return nil
+}
+
+// ConsumeRecoveryCode marks the unused recovery code with the given hash as
+// used. Unknown and already used codes are rejected.
+func (repo *PostgresRepository) ConsumeRecoveryCode(userID int, codeHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update totp_recovery_codes set used_at = $1
+		where user_id = $2 and code_hash = $3 and used_at is null`
+
+	result, err := repo.Conn.ExecContext(ctx, stmt, time.Now(), userID, codeHash)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecoveryCodeInvalid
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+// Package data verifies TOTP enrollment storage in the in-memory repository.
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestMemoryRepositoryTOTPEnrollment(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+	id, _ := repo.Insert(User{Email: "me@here.com", Password: "secret-password"})
+
+	if _, err := repo.GetTOTP(id); !errors.Is(err, ErrTOTPNotEnrolled) {
+		t.Fatalf("expected ErrTOTPNotEnrolled, got %v", err)
+	}
+	if err := repo.ConfirmTOTP(id, 1, nil); !errors.Is(err, ErrTOTPNotEnrolled) {
+		t.Fatalf("expected ErrTOTPNotEnrolled confirming, got %v", err)
+	}
+	if err := repo.SaveTOTPSecret(99, "SECRET"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows for unknown user, got %v", err)
+	}
+
+	_ = repo.SaveTOTPSecret(id, "FIRST")
+	_ = repo.SaveTOTPSecret(id, "SECOND")
+	enrollment, _ := repo.GetTOTP(id)
+	if enrollment.Secret != "SECOND" || enrollment.Confirmed() {
+		t.Fatalf("expected an unconfirmed replacement secret, got %+v", enrollment)
+	}
+	if err := repo.UseTOTPStep(id, 10); !errors.Is(err, ErrTOTPCodeReused) {
+		t.Fatalf("expected unconfirmed enrollments to reject codes, got %v", err)
+	}
+
+	if err := repo.ConfirmTOTP(id, 10, []string{"hash-a", "hash-b"}); err != nil {
+		t.Fatalf("expected confirm to succeed, got %v", err)
+	}
+	if err := repo.SaveTOTPSecret(id, "THIRD"); !errors.Is(err, ErrTOTPAlreadyConfirmed) {
+		t.Fatalf("expected ErrTOTPAlreadyConfirmed, got %v", err)
+	}
+	if err := repo.ConfirmTOTP(id, 11, nil); !errors.Is(err, ErrTOTPAlreadyConfirmed) {
+		t.Fatalf("expected ErrTOTPAlreadyConfirmed confirming twice, got %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		call          func() error
+		expectedError error
+	}{
+		{name: "confirmed step", call: func() error { return repo.UseTOTPStep(id, 10) }, expectedError: ErrTOTPCodeReused},
+		{name: "later step", call: func() error { return repo.UseTOTPStep(id, 11) }},
+		{name: "earlier step", call: func() error { return repo.UseTOTPStep(id, 9) }, expectedError: ErrTOTPCodeReused},
+		{name: "recovery code", call: func() error { return repo.ConsumeRecoveryCode(id, "hash-a") }},
+		{name: "used recovery code", call: func() error { return repo.ConsumeRecoveryCode(id, "hash-a") }, expectedError: ErrRecoveryCodeInvalid},
+		{name: "unknown recovery code", call: func() error { return repo.ConsumeRecoveryCode(id, "hash-z") }, expectedError: ErrRecoveryCodeInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); !errors.Is(err, tt.expectedError) {
+				t.Fatalf("expected error %v, got %v", tt.expectedError, err)
+			}
+		})
+	}
+
+	_ = repo.DeleteByID(id)
+	if err := repo.ConsumeRecoveryCode(id, "hash-b"); !errors.Is(err, ErrRecoveryCodeInvalid) {
+		t.Fatalf("expected recovery codes to be deleted with the user, got %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+// Package data lists users a page at a time with keyset pagination.
+package data
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Orders ListUsers can sort by. Ties are broken by ID.
+const (
+	UserSortLastName  = "last_name"
+	UserSortEmail     = "email"
+	UserSortCreatedAt = "created_at"
+)
+
+// UserSorts lists every order ListUsers accepts.
+var UserSorts = []string{UserSortLastName, UserSortEmail, UserSortCreatedAt}
+
+// ErrInvalidCursor is returned for a cursor that was not issued for the same
+// sort order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// UserQuery selects a page of users. Zero fields do not filter, and an empty
+// Sort means UserSortLastName. EmailPrefix matches regardless of case, and
+// the created-at range includes CreatedAfter but not CreatedBefore. Cursor
+// is the NextCursor of the previous page.
+type UserQuery struct {
+	Active        *bool
+	EmailPrefix   string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Sort          string
+	Descending    bool
+	Cursor        string
+	Limit         int
+}
+
+// UserPage is one page of users. NextCursor is empty on the last page.
+type UserPage struct {
+	Users      []*User `json:"users"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// userCursor is the position of the last user on a page, in the order it
+// was listed in. It is sent to clients as base64-encoded JSON.
+type userCursor struct {
+	Sort       string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	Key        string `json:"k"`
+	ID         int    `json:"i"`
+}
+
+func (query UserQuery) sort() string {
+	if query.Sort == "" {
+		return UserSortLastName
+	}
+
+	return query.Sort
+}
+
+// validate checks the sort order and limit, and decodes the cursor, which
+// is nil on the first page.
+func (query UserQuery) validate() (*userCursor, error) {
+	if !slices.Contains(UserSorts, query.sort()) {
+		return nil, fmt.Errorf("unknown sort %q", query.Sort)
+	}
+	if query.Limit < 1 {
+		return nil, errors.New("limit must be positive")
+	}
+	if query.Cursor == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor userCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil || cursor.ID < 1 {
+		return nil, ErrInvalidCursor
+	}
+	if cursor.Sort != query.sort() || cursor.Descending != query.Descending {
+		return nil, ErrInvalidCursor
+	}
+	if cursor.Sort == UserSortCreatedAt {
+		if _, err := time.Parse(time.RFC3339Nano, cursor.Key); err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	return &cursor, nil
+}
+
+// position returns where user falls in the query's order.
+func (query UserQuery) position(user *User) userCursor {
+	cursor := userCursor{Sort: query.sort(), Descending: query.Descending, ID: user.ID}
+	switch cursor.Sort {
+	case UserSortEmail:
+		cursor.Key = user.Email
+	case UserSortCreatedAt:
+		cursor.Key = user.CreatedAt.UTC().Format(time.RFC3339Nano)
+	default:
+		cursor.Key = user.LastName
+	}
+
+	return cursor
+}
+
+// encode returns the cursor as an opaque token.
+func (cursor userCursor) encode() string {
+	raw, _ := json.Marshal(cursor)
+
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// key returns the sort value as a query argument.
+func (cursor userCursor) key() any {
+	if cursor.Sort == UserSortCreatedAt {
+		createdAt, _ := time.Parse(time.RFC3339Nano, cursor.Key)
+		return createdAt
+	}
+
+	return cursor.Key
+}
+
+// compare orders a and b as the query lists them.
+func (query UserQuery) compare(a, b userCursor) int {
+	var order int
+	if a.Sort == UserSortCreatedAt {
+		order = a.key().(time.Time).Compare(b.key().(time.Time))
+	} else {
+		order = strings.Compare(a.Key, b.Key)
+	}
+	if order == 0 {
+		order = cmp.Compare(a.ID, b.ID)
+	}
+	if query.Descending {
+		return -order
+	}
+
+	return order
+}
+
+// matches reports whether user passes the query's filters.
+func (query UserQuery) matches(user *User) bool {
+	if query.Active != nil && (user.Active == 1) != *query.Active {
+		return false
+	}
+	if !strings.HasPrefix(strings.ToLower(user.Email), strings.ToLower(query.EmailPrefix)) {
+		return false
+	}
+	if !query.CreatedAfter.IsZero() && user.CreatedAt.Before(query.CreatedAfter) {
+		return false
+	}
+	if !query.CreatedBefore.IsZero() && !user.CreatedAt.Before(query.CreatedBefore) {
+		return false
+	}
+
+	return true
+}
+
+// page cuts a page from users, which were fetched in order with one more
+// than the limit when there is a next page.
+func (query UserQuery) page(users []*User) *UserPage {
+	page := &UserPage{Users: users}
+	if len(users) > query.Limit {
+		page.Users = users[:query.Limit]
+		page.NextCursor = query.position(page.Users[query.Limit-1]).encode()
+	}
+
+	return page
+}
+
+// listUsers pages through users in memory the way ListUsers does in SQL.
+func listUsers(users []*User, query UserQuery) (*UserPage, error) {
+	cursor, err := query.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	matching := []*User{}
+	for _, user := range users {
+		if query.matches(user) && (cursor == nil || query.compare(query.position(user), *cursor) > 0) {
+			matching = append(matching, user)
+		}
+	}
+	slices.SortFunc(matching, func(a, b *User) int {
+		return query.compare(query.position(a), query.position(b))
+	})
+	if len(matching) > query.Limit+1 {
+		matching = matching[:query.Limit+1]
+	}
+
+	return query.page(matching), nil
+}
+
+// likePrefix escapes the LIKE wildcards in prefix and appends one.
+func likePrefix(prefix string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+	return escaper.Replace(prefix) + "%"
+}
+
+// ListUsers returns a page of users matching query. Pages after the first
+// continue from the cursor's position, so users added or removed meanwhile
+// never shift later pages.
+func (repo *PostgresRepository) ListUsers(query UserQuery) (*UserPage, error) {
+	cursor, err := query.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var conditions []string
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if query.Active != nil {
+		active := 0
+		if *query.Active {
+			active = 1
+		}
+		conditions = append(conditions, "user_active = "+arg(active))
+	}
+	if query.EmailPrefix != "" {
+		conditions = append(conditions, "lower(email) like "+arg(likePrefix(strings.ToLower(query.EmailPrefix)))+` escape '\'`)
+	}
+	if !query.CreatedAfter.IsZero() {
+		conditions = append(conditions, "created_at >= "+arg(query.CreatedAfter))
+	}
+	if !query.CreatedBefore.IsZero() {
+		conditions = append(conditions, "created_at < "+arg(query.CreatedBefore))
+	}
+
+	// the sort is one of UserSorts, which are all column names
+	column, direction, after := query.sort(), "asc", ">"
+	if query.Descending {
+		direction, after = "desc", "<"
+	}
+	if cursor != nil {
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s (%s, %s)", column, after, arg(cursor.key()), arg(cursor.ID)))
+	}
+
+	stmt := `select id, email, first_name, last_name, password, user_active, created_at, updated_at, email_verified_at
+	from users`
+	if len(conditions) > 0 {
+		stmt += " where " + strings.Join(conditions, " and ")
+	}
+	stmt += fmt.Sprintf(" order by %s %s, id %s limit %s", column, direction, direction, arg(query.Limit+1))
+
+	rows, err := repo.Conn.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		var verifiedAt sql.NullTime
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.Active,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&verifiedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		user.EmailVerifiedAt = nullTime(verifiedAt)
+
+		users = append(users, &user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return query.page(users), nil
+}
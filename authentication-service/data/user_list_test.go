@@ -0,0 +1,134 @@
+// Package data verifies keyset pagination of users.
+package data
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func listedIDs(page *UserPage) []int {
+	ids := make([]int, len(page.Users))
+	for i, user := range page.Users {
+		ids[i] = user.ID
+	}
+
+	return ids
+}
+
+func TestListUsers(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	users := []*User{
+		{ID: 1, Email: "ada@here.com", LastName: "Lovelace", Active: 1, CreatedAt: day.Add(48 * time.Hour)},
+		{ID: 2, Email: "Grace@here.com", LastName: "Hopper", Active: 1, CreatedAt: day},
+		{ID: 3, Email: "alan@here.com", LastName: "Turing", Active: 0, CreatedAt: day.Add(24 * time.Hour)},
+		{ID: 4, Email: "a_b@here.com", LastName: "Hopper", Active: 1, CreatedAt: day.Add(24 * time.Hour)},
+	}
+	active := true
+
+	tests := []struct {
+		name        string
+		query       UserQuery
+		expectedIDs []int
+	}{
+		{name: "last name then id", query: UserQuery{Limit: 10}, expectedIDs: []int{2, 4, 1, 3}},
+		{name: "descending", query: UserQuery{Sort: UserSortLastName, Descending: true, Limit: 10}, expectedIDs: []int{3, 1, 4, 2}},
+		{name: "email", query: UserQuery{Sort: UserSortEmail, Limit: 10}, expectedIDs: []int{2, 4, 1, 3}},
+		{name: "created at", query: UserQuery{Sort: UserSortCreatedAt, Limit: 10}, expectedIDs: []int{2, 3, 4, 1}},
+		{name: "active", query: UserQuery{Active: &active, Limit: 10}, expectedIDs: []int{2, 4, 1}},
+		{name: "email prefix ignores case", query: UserQuery{EmailPrefix: "GRA", Limit: 10}, expectedIDs: []int{2}},
+		{name: "email prefix", query: UserQuery{EmailPrefix: "a", Limit: 10}, expectedIDs: []int{4, 1, 3}},
+		{name: "created range", query: UserQuery{CreatedAfter: day.Add(24 * time.Hour), CreatedBefore: day.Add(48 * time.Hour), Limit: 10}, expectedIDs: []int{4, 3}},
+		{name: "limit", query: UserQuery{Limit: 2}, expectedIDs: []int{2, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := listUsers(users, tt.query)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if fmt.Sprint(listedIDs(page)) != fmt.Sprint(tt.expectedIDs) {
+				t.Fatalf("expected users %v, got %v", tt.expectedIDs, listedIDs(page))
+			}
+		})
+	}
+}
+
+func TestListUsersPages(t *testing.T) {
+	for _, sort := range UserSorts {
+		for _, descending := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s descending=%v", sort, descending), func(t *testing.T) {
+				repo := newTestMemoryRepository(t)
+				for i := range 7 {
+					_, _ = repo.Insert(User{Email: fmt.Sprintf("user%d@here.com", 7-i), LastName: []string{"A", "B"}[i%2], Password: "long-enough"})
+				}
+
+				query := UserQuery{Sort: sort, Descending: descending, Limit: 7}
+				all, _ := repo.ListUsers(query)
+				if all.NextCursor != "" || len(all.Users) != 7 {
+					t.Fatalf("expected one full page, got %d users and cursor %q", len(all.Users), all.NextCursor)
+				}
+
+				var paged []int
+				query.Limit = 3
+				for pages := 0; ; pages++ {
+					if pages > 3 {
+						t.Fatalf("expected the pages to end, got %v", paged)
+					}
+					page, err := repo.ListUsers(query)
+					if err != nil {
+						t.Fatalf("expected no error, got %v", err)
+					}
+					paged = append(paged, listedIDs(page)...)
+					if page.NextCursor == "" {
+						break
+					}
+					query.Cursor = page.NextCursor
+				}
+
+				if fmt.Sprint(paged) != fmt.Sprint(listedIDs(all)) {
+					t.Fatalf("expected pages to list %v, got %v", listedIDs(all), paged)
+				}
+			})
+		}
+	}
+}
+
+func TestListUsersRejectsQueries(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+	_, _ = repo.Insert(User{Email: "a@here.com", Password: "long-enough"})
+	_, _ = repo.Insert(User{Email: "b@here.com", Password: "long-enough"})
+	page, _ := repo.ListUsers(UserQuery{Sort: UserSortEmail, Limit: 1})
+
+	tests := []struct {
+		name        string
+		query       UserQuery
+		expectedErr error
+	}{
+		{name: "unknown sort", query: UserQuery{Sort: "password", Limit: 1}},
+		{name: "no limit", query: UserQuery{}},
+		{name: "garbage cursor", query: UserQuery{Cursor: "not a cursor", Limit: 1}, expectedErr: ErrInvalidCursor},
+		{name: "cursor without a user", query: UserQuery{Cursor: base64.RawURLEncoding.EncodeToString([]byte(`{"s":"last_name"}`)), Limit: 1}, expectedErr: ErrInvalidCursor},
+		{name: "cursor for another sort", query: UserQuery{Sort: UserSortLastName, Cursor: page.NextCursor, Limit: 1}, expectedErr: ErrInvalidCursor},
+		{name: "cursor for another direction", query: UserQuery{Sort: UserSortEmail, Descending: true, Cursor: page.NextCursor, Limit: 1}, expectedErr: ErrInvalidCursor},
+		{name: "bad created at", query: UserQuery{Sort: UserSortCreatedAt, Cursor: base64.RawURLEncoding.EncodeToString([]byte(`{"s":"created_at","k":"yesterday","i":1}`)), Limit: 1}, expectedErr: ErrInvalidCursor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := repo.ListUsers(tt.query)
+			if err == nil || (tt.expectedErr != nil && !errors.Is(err, tt.expectedErr)) {
+				t.Fatalf("expected an error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLikePrefix(t *testing.T) {
+	if escaped := likePrefix(`a_b%c\`); escaped != `a\_b\%c\\%` {
+		t.Fatalf("expected LIKE wildcards to be escaped, got %q", escaped)
+	}
+}
@@ -0,0 +1,302 @@
+// Package main registers the actions /handle dispatches and describes them on /actions.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Transports an action can use to reach its downstream service.
+const (
+	transportHTTP = "http"
+	transportRPC  = "rpc"
+	transportGRPC = "grpc"
+	transportAMQP = "amqp"
+)
+
+var errInvalidAction = errors.New("invalid action")
+
+// RequestPayload is a /handle request: the action's name and its payload,
+// which clients send under a key named after the action, as in
+// {"action":"mail","mail":{"to":"..."}}.
+type RequestPayload struct {
+	Action  string
+	Payload json.RawMessage
+}
+
+func (requestPayload *RequestPayload) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	if raw, ok := fields["action"]; ok {
+		if err := json.Unmarshal(raw, &requestPayload.Action); err != nil {
+			return err
+		}
+	}
+	requestPayload.Payload = fields[requestPayload.Action]
+
+	return nil
+}
+
+func (requestPayload RequestPayload) MarshalJSON() ([]byte, error) {
+	fields := map[string]any{"action": requestPayload.Action}
+	if len(requestPayload.Payload) > 0 {
+		fields[requestPayload.Action] = requestPayload.Payload
+	}
+
+	return json.Marshal(fields)
+}
+
+// action is one /handle action as registered in actions and described by
+// GET /actions.
+type action struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Payload     []actionField `json:"payload"`
+	// Protected actions need a verified caller, and Permission, if set,
+	// must be granted by their token.
+	Protected  bool   `json:"authentication_required"`
+	Permission string `json:"permission,omitempty"`
+	// OperationPermissions are needed on top of Permission by the
+	// operations they name.
+	OperationPermissions map[string]string `json:"operation_permissions,omitempty"`
+	// APIKeyScope is the scope an API key needs; keys cannot call actions
+	// without one.
+	APIKeyScope string   `json:"api_key_scope,omitempty"`
+	Transports  []string `json:"transports"`
+
+	// serve decodes and validates the raw payload and handles the request,
+	// or returns the status and error to reply with.
+	serve func(app *Config, ctx context.Context, w http.ResponseWriter, raw json.RawMessage) (int, error)
+}
+
+// actionField describes one field of an action's payload.
+type actionField struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required,omitempty"`
+
+	// field is the index of the struct field in the payload type.
+	field int
+}
+
+// actionSpec declares an action whose payload decodes into a P. Required
+// lists payload fields, by JSON name, that must not be empty; Validate, if
+// set, checks anything more. Actions with OperationPermissions name the
+// operation of a payload with Operation.
+type actionSpec[P any] struct {
+	Description          string
+	Protected            bool
+	Permission           string
+	OperationPermissions map[string]string
+	Operation            func(payload P) string
+	APIKeyScope          string
+	Transports           []string
+	Required             []string
+	Validate             func(payload P) error
+	Handle               func(app *Config, ctx context.Context, w http.ResponseWriter, payload P)
+}
+
+// actionRegistry maps action names to actions.
+type actionRegistry map[string]*action
+
+// actions is every action /handle accepts. A new downstream service only
+// needs a payload type, a handler and an entry here.
+var actions = newActionRegistry()
+
+func newActionRegistry() actionRegistry {
+	registry := actionRegistry{}
+
+	registerAction(registry, "auth", actionSpec[AuthPayload]{
+		Description: "Log in with an email and password, or answer a second-factor challenge.",
+		Transports:  []string{transportHTTP, transportGRPC},
+		Validate:    validateAuthPayload,
+		Handle:      (*Config).forwardAuthRequest,
+	})
+	registerAction(registry, "refresh", actionSpec[RefreshPayload]{
+		Description: "Exchange a refresh token for new tokens.",
+		Transports:  []string{transportHTTP},
+		Required:    []string{"refresh_token"},
+		Handle:      (*Config).forwardRefreshRequest,
+	})
+	registerAction(registry, "register", actionSpec[RegisterPayload]{
+		Description: "Create an account.",
+		Transports:  []string{transportHTTP},
+		Handle: func(app *Config, ctx context.Context, w http.ResponseWriter, payload RegisterPayload) {
+			app.relayToAuthService(ctx, w, http.MethodPost, "/users", payload)
+		},
+	})
+	registerAction(registry, "user", actionSpec[UserPayload]{
+		Description:          "Read, update or deactivate the caller's account, manage their sessions, or list users.",
+		Protected:            true,
+		OperationPermissions: map[string]string{"list": "users:list"},
+		Operation:            func(payload UserPayload) string { return payload.Operation },
+		Transports:           []string{transportHTTP},
+		Required:             []string{"operation"},
+		Handle:               (*Config).forwardUserRequest,
+	})
+	registerAction(registry, "log", actionSpec[LogPayload]{
+		Description: "Write an entry to logger-service over the configured transports, or over transport if given.",
+		Protected:   true,
+		Permission:  "logs:write",
+		APIKeyScope: "log:write",
+		Transports:  logTransports,
+		Validate:    validateLogPayload,
+		Handle:      (*Config).writeLog,
+	})
+	registerAction(registry, "mail", actionSpec[MailPayload]{
+		Description: "Send an email through mail-service.",
+		Protected:   true,
+		Permission:  "mail:send",
+		APIKeyScope: "mail:send",
+		Transports:  []string{transportHTTP},
+		Required:    []string{"to", "subject", "message"},
+		Handle:      (*Config).forwardMailRequest,
+	})
+
+	return registry
+}
+
+// registerAction adds spec to registry as name. It panics on a spec that
+// could never be served, so mistakes surface at startup.
+func registerAction[P any](registry actionRegistry, name string, spec actionSpec[P]) {
+	if name == "" || name == "action" || registry[name] != nil {
+		panic(fmt.Sprintf("action %q is reserved or already registered", name))
+	}
+	if len(spec.OperationPermissions) > 0 && spec.Operation == nil {
+		panic(fmt.Sprintf("action %q has operation permissions but no Operation", name))
+	}
+
+	fields, index := describePayload(reflect.TypeFor[P]())
+	for _, required := range spec.Required {
+		i, ok := index[required]
+		if !ok {
+			panic(fmt.Sprintf("action %q requires unknown field %q", name, required))
+		}
+		fields[i].Required = true
+	}
+
+	registry[name] = &action{
+		Name:        name,
+		Description: spec.Description,
+		Payload:     fields,
+		Protected:   spec.Protected,
+		Permission:  spec.Permission,
+		APIKeyScope: spec.APIKeyScope,
+		Transports:  spec.Transports,
+
+		OperationPermissions: spec.OperationPermissions,
+		serve: func(app *Config, ctx context.Context, w http.ResponseWriter, raw json.RawMessage) (int, error) {
+			var payload P
+			if len(raw) > 0 {
+				if err := json.Unmarshal(raw, &payload); err != nil {
+					return http.StatusBadRequest, fmt.Errorf("invalid %s payload: %w", name, err)
+				}
+			}
+
+			value := reflect.ValueOf(payload)
+			for _, required := range spec.Required {
+				if value.Field(fields[index[required]].field).IsZero() {
+					return http.StatusBadRequest, fmt.Errorf("%s is required", required)
+				}
+			}
+			if spec.Validate != nil {
+				if err := spec.Validate(payload); err != nil {
+					return http.StatusBadRequest, err
+				}
+			}
+			if spec.Operation != nil {
+				if status, err := checkPermission(ctx, spec.OperationPermissions[spec.Operation(payload)]); err != nil {
+					return status, err
+				}
+			}
+
+			spec.Handle(app, ctx, w, payload)
+			return http.StatusOK, nil
+		},
+	}
+}
+
+// describePayload lists the JSON fields of a payload struct, along with
+// the position of each in the list by name.
+func describePayload(payloadType reflect.Type) ([]actionField, map[string]int) {
+	fields := []actionField{}
+	index := map[string]int{}
+
+	for i := range payloadType.NumField() {
+		field := payloadType.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		index[name] = len(fields)
+		fields = append(fields, actionField{Name: name, Type: jsonType(field.Type), field: i})
+	}
+
+	return fields, index
+}
+
+// jsonType names the JSON type a Go field is sent as.
+func jsonType(fieldType reflect.Type) string {
+	switch fieldType.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// validateAuthPayload accepts a login or an answer to a challenge.
+func validateAuthPayload(payload AuthPayload) error {
+	if payload.ChallengeToken != "" {
+		if payload.Code == "" && payload.RecoveryCode == "" {
+			return errors.New("code or recovery_code is required with challenge_token")
+		}
+		return nil
+	}
+	if payload.Email == "" || payload.Pass == "" {
+		return errors.New("email and password are required")
+	}
+
+	return nil
+}
+
+// handleListActions describes every action /handle accepts.
+func (app *Config) handleListActions(w http.ResponseWriter, r *http.Request) {
+	described := make([]*action, 0, len(actions))
+	for _, registered := range actions {
+		described = append(described, registered)
+	}
+	slices.SortFunc(described, func(a, b *action) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "Actions",
+		Data:    described,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
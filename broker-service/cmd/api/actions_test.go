@@ -0,0 +1,176 @@
+// Package main verifies the broker action registry and its description.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleListActions(t *testing.T) {
+	app := Config{}
+
+	req := httptest.NewRequest(http.MethodGet, "/actions", http.NoBody)
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	var response struct {
+		Data []action `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode actions: %v", err)
+	}
+
+	var names []string
+	described := map[string]action{}
+	for _, listed := range response.Data {
+		names = append(names, listed.Name)
+		described[listed.Name] = listed
+	}
+	if len(names) != len(actions) || names[0] != "auth" || names[len(names)-1] != "user" {
+		t.Fatalf("expected every action sorted by name, got %v", names)
+	}
+
+	mail := described["mail"]
+	if !mail.Protected || mail.Permission != "mail:send" || mail.APIKeyScope != "mail:send" || len(mail.Transports) != 1 || mail.Transports[0] != transportHTTP {
+		t.Fatalf("unexpected mail description %+v", mail)
+	}
+	required := map[string]bool{}
+	for _, field := range mail.Payload {
+		if field.Type != "string" {
+			t.Fatalf("expected mail fields to be strings, got %+v", field)
+		}
+		required[field.Name] = field.Required
+	}
+	if len(required) != 4 || required["from"] || !required["to"] || !required["subject"] || !required["message"] {
+		t.Fatalf("unexpected mail payload %+v", mail.Payload)
+	}
+
+	if user := described["user"]; user.OperationPermissions["list"] != "users:list" {
+		t.Fatalf("expected listing users to need users:list, got %+v", user.OperationPermissions)
+	}
+	for _, field := range described["user"].Payload {
+		if field.Name == "query" && field.Type != "object" {
+			t.Fatalf("expected the user query to be an object, got %+v", field)
+		}
+	}
+}
+
+func TestHandleSubmissionValidatesPayloads(t *testing.T) {
+	authServer := newTestAuthServer(t)
+	app := Config{AuthServiceURL: authServer.URL + "/authenticate"}
+
+	tests := []struct {
+		name            string
+		body            string
+		token           string
+		expectedStatus  int
+		expectedMessage string
+	}{
+		{name: "missing required field", body: `{"action":"mail","mail":{"to":"c@d.com","subject":"s"}}`, token: "mailer-token", expectedStatus: http.StatusBadRequest, expectedMessage: "message is required"},
+		{name: "missing payload", body: `{"action":"refresh"}`, expectedStatus: http.StatusBadRequest, expectedMessage: "refresh_token is required"},
+		{name: "wrong type", body: `{"action":"mail","mail":{"to":1}}`, token: "mailer-token", expectedStatus: http.StatusBadRequest},
+		{name: "login without password", body: `{"action":"auth","auth":{"email":"me@example.com"}}`, expectedStatus: http.StatusBadRequest, expectedMessage: "email and password are required"},
+		{name: "challenge without code", body: `{"action":"auth","auth":{"challenge_token":"t"}}`, expectedStatus: http.StatusBadRequest, expectedMessage: "code or recovery_code is required with challenge_token"},
+		{name: "user without operation", body: `{"action":"user","user":{}}`, token: "good-token", expectedStatus: http.StatusBadRequest, expectedMessage: "operation is required"},
+		{name: "permission is checked first", body: `{"action":"mail","mail":{}}`, token: "good-token", expectedStatus: http.StatusForbidden},
+		{name: "valid payload", body: `{"action":"user","user":{"operation":"get"}}`, token: "good-token", expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/handle", bytes.NewBufferString(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rr := httptest.NewRecorder()
+
+			app.routes().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if response := decodeJSONResponse(t, rr); tt.expectedMessage != "" && response.Message != tt.expectedMessage {
+				t.Fatalf("expected message %q, got %q", tt.expectedMessage, response.Message)
+			}
+		})
+	}
+}
+
+func TestRegisteredActionIsDispatched(t *testing.T) {
+	type echoPayload struct {
+		Text string `json:"text"`
+	}
+
+	registerAction(actions, "echo", actionSpec[echoPayload]{
+		Transports: []string{transportHTTP},
+		Required:   []string{"text"},
+		Handle: func(app *Config, ctx context.Context, w http.ResponseWriter, payload echoPayload) {
+			_ = app.writeJSON(w, http.StatusOK, JsonResponse{Message: payload.Text})
+		},
+	})
+	t.Cleanup(func() { delete(actions, "echo") })
+
+	app := Config{}
+	req := httptest.NewRequest(http.MethodPost, "/handle", bytes.NewBufferString(`{"action":"echo","echo":{"text":"hello"}}`))
+	rr := httptest.NewRecorder()
+	app.handleSubmission(rr, req)
+
+	if response := decodeJSONResponse(t, rr); rr.Code != http.StatusOK || response.Message != "hello" {
+		t.Fatalf("expected the new action to answer, got %d %q", rr.Code, response.Message)
+	}
+
+	// API keys cannot call an action without a scope
+	if status, err := actions["echo"].authorize(context.WithValue(context.Background(), apiKeyContextKey, testAPIKeys["log-key"])); status != http.StatusForbidden || err != errAPIKeyNotAllowed {
+		t.Fatalf("expected API keys to be refused, got %d %v", status, err)
+	}
+}
+
+func TestRegisterActionRejectsBadSpecs(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		spec   actionSpec[LogPayload]
+	}{
+		{name: "already registered", action: "log"},
+		{name: "reserved name", action: "action"},
+		{name: "unknown required field", action: "other", spec: actionSpec[LogPayload]{Required: []string{"level"}}},
+		{name: "operation permissions without operation", action: "other", spec: actionSpec[LogPayload]{OperationPermissions: map[string]string{"write": "logs:write"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected registering %q to panic", tt.action)
+				}
+			}()
+
+			registerAction(newActionRegistry(), tt.action, tt.spec)
+		})
+	}
+}
+
+func TestRequestPayloadJSON(t *testing.T) {
+	var requestPayload RequestPayload
+	err := json.Unmarshal([]byte(`{"action":"log","log":{"name":"n"},"mail":{"to":"x"}}`), &requestPayload)
+	if err != nil || requestPayload.Action != "log" || string(requestPayload.Payload) != `{"name":"n"}` {
+		t.Fatalf("expected the log payload only, got %+v, %v", requestPayload, err)
+	}
+
+	encoded, _ := json.Marshal(requestPayload)
+	if string(encoded) != `{"action":"log","log":{"name":"n"}}` {
+		t.Fatalf("expected the payload under the action's name, got %s", encoded)
+	}
+
+	if err := json.Unmarshal([]byte(`{"action":7}`), &requestPayload); err == nil {
+		t.Fatalf("expected a non-string action to be rejected")
+	}
+}
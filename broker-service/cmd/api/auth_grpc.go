@@ -0,0 +1,211 @@
+// Package main calls authentication-service over gRPC when AUTH_TRANSPORT is grpc.
+package main
+
+import (
+	"broker/auth"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	authTransportHTTP = transportHTTP
+	authTransportGRPC = transportGRPC
+)
+
+// forwardedUserAgentKey carries the end user's user agent to
+// authentication-service; gRPC reserves user-agent for the broker's own.
+const forwardedUserAgentKey = "x-forwarded-user-agent"
+
+// authGRPCTimeout bounds each attempt to call authentication-service over
+// gRPC.
+const authGRPCTimeout = 5 * time.Second
+
+// newAuthGRPCClient returns a client for the AuthService at addr. The
+// connection is established lazily and shared by every request.
+func newAuthGRPCClient(addr string) (auth.AuthServiceClient, error) {
+	conn, err := newGRPCClientConn(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.NewAuthServiceClient(conn), nil
+}
+
+// grpcUser mirrors the user JSON authentication-service returns over HTTP.
+type grpcUser struct {
+	ID            int64    `json:"id"`
+	Email         string   `json:"email"`
+	FirstName     string   `json:"first_name,omitempty"`
+	LastName      string   `json:"last_name,omitempty"`
+	Active        int      `json:"active"`
+	EmailVerified bool     `json:"email_verified"`
+	Roles         []string `json:"roles,omitempty"`
+	Permissions   []string `json:"permissions,omitempty"`
+}
+
+// authenticateViaGRPC handles the first step of the auth action with the
+// AuthService Authenticate call. Replies match the HTTP transport's.
+func (app *Config) authenticateViaGRPC(ctx context.Context, w http.ResponseWriter, authPayload AuthPayload) {
+	var response *auth.AuthenticateResponse
+	err := app.breaker(dependencyAuthGRPC).call(ctx, noRetries, func() error {
+		callCtx, cancel := context.WithTimeout(clientMetadata(ctx), authGRPCTimeout)
+		defer cancel()
+
+		var err error
+		response, err = app.AuthGRPC.Authenticate(callCtx, &auth.AuthenticateRequest{
+			Email:    authPayload.Email,
+			Password: authPayload.Pass,
+		})
+		return err
+	})
+	if err != nil {
+		app.writeAuthGRPCError(w, err)
+		return
+	}
+
+	if challenge := response.GetChallenge(); challenge != nil {
+		_ = app.writeJSON(w, http.StatusOK, JsonResponse{
+			Code:    secondFactorRequiredCode,
+			Message: "A one-time code is required to finish logging in",
+			Data: map[string]any{
+				"challenge_token": challenge.GetChallengeToken(),
+				"expires_in":      challenge.GetExpiresIn(),
+				"methods":         challenge.GetMethods(),
+			},
+		})
+		return
+	}
+	if response.GetAccessToken() == "" {
+		_ = app.writeErrorJSON(w, errors.New("auth service did not issue an access token"), http.StatusBadGateway)
+		return
+	}
+
+	user, err := json.Marshal(userFromGRPC(response.GetUser()))
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	var payload JsonResponse
+	payload.Error = false
+	payload.Message = "Authenticated!"
+	payload.Data = AuthResult{
+		User:         user,
+		AccessToken:  response.GetAccessToken(),
+		RefreshToken: response.GetRefreshToken(),
+		TokenType:    response.GetTokenType(),
+		ExpiresIn:    response.GetExpiresIn(),
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// verifyTokenViaGRPC is verifyToken over the AuthService ValidateToken call.
+func (app *Config) verifyTokenViaGRPC(ctx context.Context, token string) (TokenIdentity, int, error) {
+	var response *auth.ValidateTokenResponse
+	err := app.breaker(dependencyAuthGRPC).call(ctx, idempotentRetries, func() error {
+		callCtx, cancel := context.WithTimeout(ctx, authGRPCTimeout)
+		defer cancel()
+
+		var err error
+		response, err = app.AuthGRPC.ValidateToken(callCtx, &auth.ValidateTokenRequest{AccessToken: token})
+		return err
+	})
+	if status.Code(err) == codes.Unauthenticated {
+		return TokenIdentity{}, http.StatusUnauthorized, errors.New("invalid or expired token")
+	}
+	if err != nil && downstreamStatus(err) == http.StatusServiceUnavailable {
+		return TokenIdentity{}, http.StatusServiceUnavailable, err
+	}
+	if err != nil {
+		return TokenIdentity{}, http.StatusBadGateway, errors.New("error calling auth service")
+	}
+	if response.GetUserId() == 0 {
+		return TokenIdentity{}, http.StatusUnauthorized, errors.New("invalid or expired token")
+	}
+
+	return TokenIdentity{
+		UserID:      int(response.GetUserId()),
+		Email:       response.GetEmail(),
+		ExpiresAt:   response.GetExpiresAt(),
+		Roles:       response.GetRoles(),
+		Permissions: response.GetPermissions(),
+	}, http.StatusOK, nil
+}
+
+// writeAuthGRPCError relays a refused login with the same status, code and
+// Retry-After hint authentication-service would have sent over HTTP.
+func (app *Config) writeAuthGRPCError(w http.ResponseWriter, err error) {
+	if downstreamStatus(err) == http.StatusServiceUnavailable {
+		_ = app.writeErrorJSON(w, err, http.StatusServiceUnavailable)
+		return
+	}
+
+	st := status.Convert(err)
+
+	var httpStatus int
+	switch st.Code() {
+	case codes.Unauthenticated:
+		httpStatus = http.StatusUnauthorized
+	case codes.PermissionDenied:
+		httpStatus = http.StatusForbidden
+	case codes.ResourceExhausted:
+		httpStatus = http.StatusTooManyRequests
+	default:
+		_ = app.writeErrorJSON(w, errors.New("error calling auth service"), http.StatusBadGateway)
+		return
+	}
+
+	payload := JsonResponse{Error: true, Message: st.Message()}
+	if payload.Message == "" {
+		payload.Message = "invalid credentials"
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			payload.Code = info.GetReason()
+			if retryAfter := info.GetMetadata()["retry_after"]; retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+		}
+	}
+
+	_ = app.writeJSON(w, httpStatus, payload)
+}
+
+// clientMetadata is setClientHeaders for gRPC calls.
+func clientMetadata(ctx context.Context) context.Context {
+	if ip, ok := ctx.Value(clientIPContextKey).(string); ok && ip != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", ip)
+	}
+	if userAgent, ok := ctx.Value(userAgentContextKey).(string); ok && userAgent != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, forwardedUserAgentKey, userAgent)
+	}
+
+	return ctx
+}
+
+func userFromGRPC(user *auth.User) grpcUser {
+	active := 0
+	if user.GetActive() {
+		active = 1
+	}
+
+	return grpcUser{
+		ID:            user.GetId(),
+		Email:         user.GetEmail(),
+		FirstName:     user.GetFirstName(),
+		LastName:      user.GetLastName(),
+		Active:        active,
+		EmailVerified: user.GetEmailVerified(),
+		Roles:         user.GetRoles(),
+		Permissions:   user.GetPermissions(),
+	}
+}
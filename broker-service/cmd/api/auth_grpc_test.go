@@ -0,0 +1,210 @@
+// Package main contains tests for calling authentication-service over gRPC.
+package main
+
+import (
+	"broker/auth"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcTestAuthServer accepts me@example.com/secret and the token "access",
+// asks two@example.com for a second factor and locks out locked@example.com.
+type grpcTestAuthServer struct {
+	auth.UnimplementedAuthServiceServer
+	metadata chan metadata.MD
+}
+
+func (s grpcTestAuthServer) Authenticate(ctx context.Context, req *auth.AuthenticateRequest) (*auth.AuthenticateResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.metadata <- md
+
+	switch {
+	case req.GetEmail() == "two@example.com":
+		return &auth.AuthenticateResponse{
+			Challenge: &auth.SecondFactorChallenge{ChallengeToken: "challenge", ExpiresIn: 300, Methods: []string{"totp"}},
+		}, nil
+	case req.GetEmail() == "locked@example.com":
+		st, _ := status.New(codes.ResourceExhausted, "too many failed login attempts").WithDetails(&errdetails.ErrorInfo{
+			Reason:   "account_locked",
+			Domain:   "authentication-service",
+			Metadata: map[string]string{"retry_after": "60"},
+		})
+		return nil, st.Err()
+	case req.GetEmail() == "inactive@example.com":
+		return nil, status.Error(codes.PermissionDenied, "account is inactive")
+	case req.GetEmail() != "me@example.com" || req.GetPassword() != "secret":
+		st, _ := status.New(codes.Unauthenticated, "invalid credentials").WithDetails(&errdetails.ErrorInfo{Reason: "invalid_credentials"})
+		return nil, st.Err()
+	}
+
+	return &auth.AuthenticateResponse{
+		User:         &auth.User{Id: 123, Email: "me@example.com", Active: true, Roles: []string{"user"}},
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		TokenType:    "Bearer",
+		ExpiresIn:    900,
+	}, nil
+}
+
+func (grpcTestAuthServer) ValidateToken(ctx context.Context, req *auth.ValidateTokenRequest) (*auth.ValidateTokenResponse, error) {
+	switch req.GetAccessToken() {
+	case "access":
+		return &auth.ValidateTokenResponse{UserId: 123, Email: "me@example.com", Permissions: []string{"logs:write"}}, nil
+	case "broken":
+		return nil, status.Error(codes.Internal, "database is down")
+	}
+
+	return nil, status.Error(codes.Unauthenticated, "invalid or expired token")
+}
+
+func newGRPCAuthTestApp(t *testing.T) (*Config, chan metadata.MD) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start gRPC listener: %v", err)
+	}
+
+	received := make(chan metadata.MD, 1)
+	grpcServer := grpc.NewServer()
+	auth.RegisterAuthServiceServer(grpcServer, grpcTestAuthServer{metadata: received})
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	t.Cleanup(grpcServer.Stop)
+
+	client, err := newAuthGRPCClient(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to create gRPC client: %v", err)
+	}
+
+	return &Config{AuthGRPC: client}, received
+}
+
+func TestForwardAuthRequestViaGRPC(t *testing.T) {
+	app, received := newGRPCAuthTestApp(t)
+
+	ctx := context.WithValue(context.Background(), clientIPContextKey, "203.0.113.7")
+	ctx = context.WithValue(ctx, userAgentContextKey, "test-browser/1.0")
+
+	rr := httptest.NewRecorder()
+	app.forwardAuthRequest(ctx, rr, AuthPayload{Email: "me@example.com", Pass: "secret"})
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	result := decodeAuthResultData(t, rr)
+	if result.AccessToken != "access" || result.RefreshToken != "refresh" || result.ExpiresIn != 900 {
+		t.Fatalf("expected tokens to be passed through, got %+v", result)
+	}
+
+	var user grpcUser
+	if err := json.Unmarshal(result.User, &user); err != nil || user.ID != 123 || user.Active != 1 {
+		t.Fatalf("expected the user in HTTP form, got %s", result.User)
+	}
+
+	md := <-received
+	if got := md.Get("x-forwarded-for"); len(got) != 1 || got[0] != "203.0.113.7" {
+		t.Fatalf("expected the client address to be forwarded, got %v", got)
+	}
+	if got := md.Get(forwardedUserAgentKey); len(got) != 1 || got[0] != "test-browser/1.0" {
+		t.Fatalf("expected the client user agent to be forwarded, got %v", got)
+	}
+}
+
+func TestForwardAuthRequestViaGRPCRefusals(t *testing.T) {
+	app, received := newGRPCAuthTestApp(t)
+
+	tests := []struct {
+		name               string
+		email              string
+		expectedStatus     int
+		expectedCode       string
+		expectedRetryAfter string
+	}{
+		{name: "second factor", email: "two@example.com", expectedStatus: http.StatusOK, expectedCode: secondFactorRequiredCode},
+		{name: "wrong password", email: "me@example.com", expectedStatus: http.StatusUnauthorized, expectedCode: "invalid_credentials"},
+		{name: "inactive", email: "inactive@example.com", expectedStatus: http.StatusForbidden},
+		{name: "locked out", email: "locked@example.com", expectedStatus: http.StatusTooManyRequests, expectedCode: "account_locked", expectedRetryAfter: "60"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			app.forwardAuthRequest(context.Background(), rr, AuthPayload{Email: tt.email, Pass: "wrong"})
+			<-received
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			response := decodeJSONResponse(t, rr)
+			if response.Code != tt.expectedCode {
+				t.Fatalf("expected code %q, got %q", tt.expectedCode, response.Code)
+			}
+			if got := rr.Header().Get("Retry-After"); got != tt.expectedRetryAfter {
+				t.Fatalf("expected Retry-After %q, got %q", tt.expectedRetryAfter, got)
+			}
+		})
+	}
+}
+
+func TestForwardAuthRequestViaGRPCKeepsSecondFactorOnHTTP(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/authenticate/second-factor" {
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(JsonResponse{
+			Message: "ok",
+			Data:    map[string]any{"access_token": "access", "refresh_token": "refresh"},
+		})
+	}))
+	defer authServer.Close()
+
+	app, _ := newGRPCAuthTestApp(t)
+	app.AuthServiceURL = authServer.URL + "/authenticate"
+
+	rr := httptest.NewRecorder()
+	app.forwardAuthRequest(context.Background(), rr, AuthPayload{ChallengeToken: "challenge", Code: "123456"})
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestVerifyTokenViaGRPC(t *testing.T) {
+	app, _ := newGRPCAuthTestApp(t)
+
+	tests := []struct {
+		name           string
+		token          string
+		expectedStatus int
+	}{
+		{name: "valid token", token: "access", expectedStatus: http.StatusOK},
+		{name: "invalid token", token: "expired", expectedStatus: http.StatusUnauthorized},
+		{name: "auth service failure", token: "broken", expectedStatus: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, status, err := app.verifyToken(context.Background(), tt.token)
+			if status != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d (%v)", tt.expectedStatus, status, err)
+			}
+			if tt.expectedStatus == http.StatusOK && (identity.UserID != 123 || !identity.HasPermission("logs:write")) {
+				t.Fatalf("expected the caller's identity, got %+v", identity)
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+// Package main guards downstream calls with per-dependency circuit breakers and retries.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/rpc"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Dependencies the broker keeps a circuit breaker for.
+const (
+	dependencyAuth       = "authentication-service"
+	dependencyAuthGRPC   = "authentication-service/grpc"
+	dependencyMail       = "mail-service"
+	dependencyLoggerHTTP = "logger-service/http"
+	dependencyLoggerRPC  = "logger-service/rpc"
+	dependencyLoggerGRPC = "logger-service/grpc"
+	dependencyRabbitMQ   = "rabbitmq"
+)
+
+// dependencies lists every dependency in the order /status reports them.
+var dependencies = []string{
+	dependencyAuth,
+	dependencyAuthGRPC,
+	dependencyMail,
+	dependencyLoggerHTTP,
+	dependencyLoggerRPC,
+	dependencyLoggerGRPC,
+	dependencyRabbitMQ,
+}
+
+// Defaults for BREAKER_THRESHOLD and BREAKER_COOLDOWN.
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// Circuit breaker states.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// retryPolicy bounds how often a failed call is sent again. Delays grow
+// from BaseDelay to MaxDelay and each is drawn at random below its bound.
+type retryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+var (
+	// noRetries is for calls that must not be repeated, such as sending
+	// mail or a login, which counts towards lockout.
+	noRetries = retryPolicy{Attempts: 1}
+	// idempotentRetries is for reads and other calls that are safe to send
+	// twice.
+	idempotentRetries = retryPolicy{Attempts: 3, BaseDelay: 50 * time.Millisecond, MaxDelay: 500 * time.Millisecond}
+)
+
+// retryPolicyFor returns the policy for an HTTP call with method.
+func retryPolicyFor(method string) retryPolicy {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return idempotentRetries
+	default:
+		return noRetries
+	}
+}
+
+// unavailableError is returned without calling a dependency whose breaker
+// is open.
+type unavailableError struct {
+	Dependency string
+	RetryAfter time.Duration
+}
+
+func (e *unavailableError) Error() string {
+	if e.RetryAfter <= 0 {
+		return fmt.Sprintf("%s is unavailable (circuit half-open, waiting on a trial request)", e.Dependency)
+	}
+
+	return fmt.Sprintf("%s is unavailable (circuit open, retry in %s)", e.Dependency, e.RetryAfter.Round(time.Second))
+}
+
+// downstreamStatus is the status to reply with when a downstream call
+// fails: 503 when its breaker refused it, 504 when the request ran out of
+// time, whether locally or at a gRPC server, 502 otherwise.
+func downstreamStatus(err error) int {
+	var unavailable *unavailableError
+	if errors.As(err, &unavailable) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, context.DeadlineExceeded) || status.Code(err) == codes.DeadlineExceeded {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+// serverStatusError is an HTTP response that counts against a dependency.
+type serverStatusError struct {
+	Dependency string
+	StatusCode int
+}
+
+func (e *serverStatusError) Error() string {
+	return fmt.Sprintf("%s returned status %d", e.Dependency, e.StatusCode)
+}
+
+// countsAsFailure reports whether err means the dependency is unhealthy,
+// as opposed to a caller giving up or a well-formed refusal. A timeout counts
+// as a failure here; call leaves out those where the caller's own deadline
+// ran out.
+func countsAsFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var unavailable *unavailableError
+	var serverError rpc.ServerError
+	if errors.As(err, &unavailable) || errors.As(err, &serverError) {
+		return false
+	}
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+			return true
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// circuitBreaker stops calls to a dependency after Threshold consecutive
+// failures. After Cooldown it lets one trial call through: success closes
+// the circuit and failure opens it again.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// breakerStatus is one dependency as reported by GET /status.
+type breakerStatus struct {
+	Dependency          string     `json:"dependency"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RetryIn             float64    `json:"retry_in_seconds,omitempty"`
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		state:     breakerClosed,
+	}
+}
+
+// allow reports whether a call may be sent now.
+func (breaker *circuitBreaker) allow() error {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	switch breaker.state {
+	case breakerOpen:
+		wait := breaker.cooldown - breaker.now().Sub(breaker.openedAt)
+		if wait > 0 {
+			return &unavailableError{Dependency: breaker.name, RetryAfter: wait}
+		}
+		breaker.state = breakerHalfOpen
+		breaker.probing = true
+	case breakerHalfOpen:
+		if breaker.probing {
+			return &unavailableError{Dependency: breaker.name}
+		}
+		breaker.probing = true
+	}
+
+	return nil
+}
+
+// record updates the breaker with the outcome of a call it allowed.
+func (breaker *circuitBreaker) record(err error) {
+	// a caller that gave up says nothing about the dependency
+	if errors.Is(err, context.Canceled) {
+		breaker.release()
+		return
+	}
+
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if !countsAsFailure(err) {
+		breaker.state = breakerClosed
+		breaker.failures = 0
+		breaker.probing = false
+		return
+	}
+
+	breaker.failures++
+	if breaker.state == breakerHalfOpen || breaker.failures >= breaker.threshold {
+		breaker.state = breakerOpen
+		breaker.openedAt = breaker.now()
+		breaker.probing = false
+	}
+}
+
+// release ends a call it allowed without recording an outcome, so a
+// half-open circuit lets another trial through.
+func (breaker *circuitBreaker) release() {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	breaker.probing = false
+}
+
+func (breaker *circuitBreaker) status() breakerStatus {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	current := breakerStatus{
+		Dependency:          breaker.name,
+		State:               breaker.state,
+		ConsecutiveFailures: breaker.failures,
+	}
+	if breaker.state != breakerClosed {
+		openedAt := breaker.openedAt
+		current.OpenedAt = &openedAt
+	}
+	if breaker.state == breakerOpen {
+		current.RetryIn = max(breaker.cooldown-breaker.now().Sub(breaker.openedAt), 0).Seconds()
+	}
+
+	return current
+}
+
+// call runs fn, retrying failures under policy, while the breaker allows
+// it. ctx is the caller's: fn may bound each attempt with a shorter timeout,
+// which counts against the dependency when it expires, but a failure after
+// ctx itself ends is the caller running out of time and is not recorded. A
+// nil breaker only retries.
+func (breaker *circuitBreaker) call(ctx context.Context, policy retryPolicy, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		if breaker != nil {
+			if err := breaker.allow(); err != nil {
+				return err
+			}
+		}
+
+		err := fn()
+		callerDone := err != nil && ctx.Err() != nil
+		if breaker != nil {
+			if callerDone {
+				breaker.release()
+			} else {
+				breaker.record(err)
+			}
+		}
+		if callerDone || !countsAsFailure(err) || attempt >= policy.Attempts {
+			return err
+		}
+
+		var delay time.Duration
+		if bound := min(policy.BaseDelay<<(attempt-1), policy.MaxDelay); bound > 0 {
+			delay = rand.N(bound)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// breakerRegistry holds a circuit breaker for every dependency.
+type breakerRegistry map[string]*circuitBreaker
+
+func newBreakerRegistry(threshold int, cooldown time.Duration) breakerRegistry {
+	registry := breakerRegistry{}
+	for _, name := range dependencies {
+		registry[name] = newCircuitBreaker(name, threshold, cooldown)
+	}
+
+	return registry
+}
+
+// breaker returns the breaker for dependency; nil, which never trips, when
+// the app has none.
+func (app *Config) breaker(dependency string) *circuitBreaker {
+	return app.Breakers[dependency]
+}
+
+// doHTTP sends request to dependency through its breaker. Server errors
+// count as failures and are retried under policy; the last response is
+// returned either way so callers can relay it.
+func (app *Config) doHTTP(dependency string, request *http.Request, policy retryPolicy) (*http.Response, error) {
+	var response *http.Response
+	attempts := 0
+
+	err := app.breaker(dependency).call(request.Context(), policy, func() error {
+		attempts++
+		if response != nil {
+			_ = response.Body.Close()
+			response = nil
+		}
+
+		// the transport consumes the body even when it fails to connect, so
+		// every attempt after the first sends a fresh copy
+		attempt := request
+		if attempts > 1 {
+			attempt = request.Clone(request.Context())
+			if request.GetBody != nil {
+				body, err := request.GetBody()
+				if err != nil {
+					return err
+				}
+				attempt.Body = body
+			}
+		}
+
+		var err error
+		response, err = app.downstreamHTTPClient().Do(attempt)
+		if err != nil {
+			return err
+		}
+		if response.StatusCode >= http.StatusInternalServerError {
+			return &serverStatusError{Dependency: dependency, StatusCode: response.StatusCode}
+		}
+
+		return nil
+	})
+
+	var serverStatus *serverStatusError
+	if response != nil && (err == nil || errors.As(err, &serverStatus)) {
+		return response, nil
+	}
+	if response != nil {
+		_ = response.Body.Close()
+	}
+
+	return nil, err
+}
+
+// handleStatus reports the circuit breaker of every dependency.
+func (app *Config) handleStatus(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]breakerStatus, 0, len(app.Breakers))
+	for _, breaker := range app.Breakers {
+		statuses = append(statuses, breaker.status())
+	}
+	slices.SortFunc(statuses, func(a, b breakerStatus) int {
+		return slices.Index(dependencies, a.Dependency) - slices.Index(dependencies, b.Dependency)
+	})
+
+	var open []string
+	for _, current := range statuses {
+		if current.State != breakerClosed {
+			open = append(open, current.Dependency)
+		}
+	}
+
+	payload := JsonResponse{
+		Error:   false,
+		Message: "All dependencies available",
+		Data:    statuses,
+	}
+	if len(open) > 0 {
+		payload.Message = "Unavailable: " + strings.Join(open, ", ")
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,350 @@
+// Package main verifies circuit breakers, retries and the dependency status endpoint.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fastRetries is idempotentRetries without the waiting.
+var fastRetries = retryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	breaker := newCircuitBreaker("mail-service", 2, 10*time.Second)
+	breaker.now = func() time.Time { return clock }
+	failure := errors.New("connection refused")
+
+	breaker.record(failure)
+	if err := breaker.allow(); err != nil || breaker.status().State != breakerClosed {
+		t.Fatalf("expected one failure to keep the circuit closed, got %v", err)
+	}
+	breaker.record(failure)
+
+	var unavailable *unavailableError
+	err := breaker.allow()
+	if !errors.As(err, &unavailable) || unavailable.RetryAfter != 10*time.Second || err.Error() != "mail-service is unavailable (circuit open, retry in 10s)" {
+		t.Fatalf("expected the open circuit to refuse calls, got %v", err)
+	}
+	if current := breaker.status(); current.State != breakerOpen || current.ConsecutiveFailures != 2 || current.RetryIn != 10 {
+		t.Fatalf("unexpected status %+v", current)
+	}
+
+	clock = clock.Add(10 * time.Second)
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("expected a trial call after the cooldown, got %v", err)
+	}
+	if err := breaker.allow(); !errors.As(err, &unavailable) || breaker.status().State != breakerHalfOpen {
+		t.Fatalf("expected one trial call at a time, got %v", err)
+	}
+
+	breaker.record(failure)
+	if err := breaker.allow(); err == nil || breaker.status().State != breakerOpen {
+		t.Fatalf("expected a failed trial to open the circuit again, got %v", err)
+	}
+
+	clock = clock.Add(10 * time.Second)
+	_ = breaker.allow()
+	breaker.record(context.Canceled)
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("expected a cancelled trial to let another through, got %v", err)
+	}
+	breaker.record(nil)
+	if current := breaker.status(); current.State != breakerClosed || current.ConsecutiveFailures != 0 || current.OpenedAt != nil {
+		t.Fatalf("expected a successful trial to close the circuit, got %+v", current)
+	}
+}
+
+func TestCountsAsFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "success", err: nil},
+		{name: "network error", err: errors.New("connection refused"), expected: true},
+		{name: "timeout", err: context.DeadlineExceeded, expected: true},
+		{name: "server error status", err: &serverStatusError{StatusCode: http.StatusInternalServerError}, expected: true},
+		{name: "caller gone", err: context.Canceled},
+		{name: "rpc method error", err: rpc.ServerError("bad payload")},
+		{name: "grpc unavailable", err: status.Error(codes.Unavailable, "down"), expected: true},
+		{name: "grpc refusal", err: status.Error(codes.Unauthenticated, "bad token")},
+		{name: "open circuit", err: &unavailableError{Dependency: "mail-service"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if failed := countsAsFailure(tt.err); failed != tt.expected {
+				t.Fatalf("expected %v, got %v", tt.expected, failed)
+			}
+		})
+	}
+}
+
+func TestDownstreamStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{name: "network error", err: errors.New("connection refused"), expected: http.StatusBadGateway},
+		{name: "open circuit", err: &unavailableError{Dependency: "mail-service"}, expected: http.StatusServiceUnavailable},
+		{name: "timeout", err: fmt.Errorf("calling: %w", context.DeadlineExceeded), expected: http.StatusGatewayTimeout},
+		{name: "grpc deadline", err: status.Error(codes.DeadlineExceeded, "deadline exceeded"), expected: http.StatusGatewayTimeout},
+		{name: "grpc unavailable", err: status.Error(codes.Unavailable, "down"), expected: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := downstreamStatus(tt.err); code != tt.expected {
+				t.Fatalf("expected %d, got %d", tt.expected, code)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerTimeouts(t *testing.T) {
+	tests := []struct {
+		name          string
+		callerTimeout time.Duration
+		trips         bool
+	}{
+		{name: "attempt timed out", trips: true},
+		{name: "caller ran out of time", callerTimeout: time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.callerTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.callerTimeout)
+				defer cancel()
+			}
+
+			breaker := newCircuitBreaker("logger-service/grpc", 1, time.Minute)
+			err := breaker.call(ctx, noRetries, func() error {
+				attemptCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+				defer cancel()
+				<-attemptCtx.Done()
+				return attemptCtx.Err()
+			})
+
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("expected the timeout to be returned, got %v", err)
+			}
+			if tripped := breaker.status().State == breakerOpen; tripped != tt.trips {
+				t.Fatalf("expected tripped=%v, got %+v", tt.trips, breaker.status())
+			}
+		})
+	}
+}
+
+func TestDoHTTPRetries(t *testing.T) {
+	tests := []struct {
+		name             string
+		method           string
+		policy           retryPolicy
+		failures         int32
+		expectedStatus   int
+		expectedAttempts int32
+	}{
+		{name: "read recovers", method: http.MethodGet, policy: fastRetries, failures: 2, expectedStatus: http.StatusOK, expectedAttempts: 3},
+		{name: "update resends its body", method: http.MethodPut, policy: fastRetries, failures: 1, expectedStatus: http.StatusOK, expectedAttempts: 2},
+		{name: "retries are bounded", method: http.MethodGet, policy: fastRetries, failures: 5, expectedStatus: http.StatusServiceUnavailable, expectedAttempts: 3},
+		{name: "writes are sent once", method: http.MethodPost, policy: noRetries, failures: 1, expectedStatus: http.StatusServiceUnavailable, expectedAttempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if body, _ := io.ReadAll(r.Body); string(body) != "payload" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if attempts.Add(1) <= tt.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			app := Config{Breakers: newBreakerRegistry(10, time.Minute)}
+			request, _ := http.NewRequest(tt.method, server.URL, bytes.NewBufferString("payload"))
+
+			response, err := app.doHTTP(dependencyMail, request, tt.policy)
+			if err != nil {
+				t.Fatalf("expected the last response, got %v", err)
+			}
+			_ = response.Body.Close()
+
+			if response.StatusCode != tt.expectedStatus || attempts.Load() != tt.expectedAttempts {
+				t.Fatalf("expected %d after %d attempts, got %d after %d", tt.expectedStatus, tt.expectedAttempts, response.StatusCode, attempts.Load())
+			}
+		})
+	}
+}
+
+// failingFirstTransport fails the first request like a refused connection,
+// after the body has been read, and sends the rest.
+type failingFirstTransport struct {
+	calls atomic.Int32
+}
+
+func (transport *failingFirstTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if transport.calls.Add(1) == 1 {
+		_, _ = io.Copy(io.Discard, request.Body)
+		_ = request.Body.Close()
+		return nil, errors.New("connection refused")
+	}
+
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+func TestDoHTTPResendsBodyAfterConnectionError(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+	}))
+	defer server.Close()
+
+	transport := &failingFirstTransport{}
+	app := Config{
+		HTTPClient: &http.Client{Transport: transport},
+		Breakers:   newBreakerRegistry(10, time.Minute),
+	}
+	request, _ := http.NewRequest(http.MethodPut, server.URL, bytes.NewBufferString("payload"))
+
+	response, err := app.doHTTP(dependencyAuth, request, fastRetries)
+	if err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	_ = response.Body.Close()
+
+	if transport.calls.Load() != 2 || received != "payload" {
+		t.Fatalf("expected the body to be resent on the second attempt, got %q after %d attempts", received, transport.calls.Load())
+	}
+}
+
+func TestDoHTTPStopsRetryingWhenCircuitOpens(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	app := Config{Breakers: newBreakerRegistry(2, time.Minute)}
+	request, _ := http.NewRequest(http.MethodGet, server.URL, http.NoBody)
+
+	_, err := app.doHTTP(dependencyAuth, request, fastRetries)
+	if downstreamStatus(err) != http.StatusServiceUnavailable || attempts.Load() != 2 {
+		t.Fatalf("expected the breaker to cut retries short, got %v after %d attempts", err, attempts.Load())
+	}
+}
+
+func TestDownstreamFailsFastWhenCircuitOpen(t *testing.T) {
+	var mailCalls atomic.Int32
+	mailServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mailCalls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer mailServer.Close()
+	authServer := newTestAuthServer(t)
+
+	app := Config{
+		AuthServiceURL: authServer.URL + "/authenticate",
+		MailServiceURL: mailServer.URL,
+		Breakers:       newBreakerRegistry(2, 30*time.Second),
+	}
+
+	send := func() *httptest.ResponseRecorder {
+		body := `{"action":"mail","mail":{"to":"c@d.com","subject":"s","message":"m"}}`
+		req := httptest.NewRequest(http.MethodPost, "/handle", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer mailer-token")
+		rr := httptest.NewRecorder()
+		app.routes().ServeHTTP(rr, req)
+		return rr
+	}
+
+	for range 2 {
+		if rr := send(); rr.Code != http.StatusBadGateway {
+			t.Fatalf("expected mail-service errors to be relayed, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := send()
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "30" {
+		t.Fatalf("expected 503 with Retry-After, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if message := decodeJSONResponse(t, rr).Message; !strings.HasPrefix(message, "mail-service is unavailable") {
+		t.Fatalf("expected the message to name mail-service, got %q", message)
+	}
+	if mailCalls.Load() != 2 {
+		t.Fatalf("expected the open circuit to spare mail-service, got %d calls", mailCalls.Load())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/status", http.NoBody)
+	rr = httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, req)
+
+	var response struct {
+		Message string          `json:"message"`
+		Data    []breakerStatus `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode status: %v", err)
+	}
+	if rr.Code != http.StatusOK || response.Message != "Unavailable: mail-service" || len(response.Data) != len(dependencies) {
+		t.Fatalf("unexpected status %d %+v", rr.Code, response)
+	}
+	for i, current := range response.Data {
+		expectedState := breakerClosed
+		if current.Dependency == dependencyMail {
+			expectedState = breakerOpen
+		}
+		if current.Dependency != dependencies[i] || current.State != expectedState {
+			t.Fatalf("unexpected breaker %+v", current)
+		}
+	}
+}
+
+func TestWriteLogSkipsOpenTransport(t *testing.T) {
+	app, _ := newLogTestApp(t)
+	app.Breakers = newBreakerRegistry(1, time.Minute)
+	app.LogTransports = []string{transportRPC, transportAMQP}
+	app.LoggerRPCAddr = "127.0.0.1:1"
+	connectTestLogger(t, app)
+	var clients []*rpc.Client
+	dials := countDials(app.LoggerRPC, &clients)
+
+	for range 2 {
+		rr := httptest.NewRecorder()
+		app.writeLog(context.Background(), rr, LogPayload{Name: "event"})
+
+		if rr.Code != http.StatusAccepted || decodeLogResult(t, rr).Transport != transportAMQP {
+			t.Fatalf("expected the entry to fall back to amqp, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	if dials.Load() != 1 || app.Breakers[dependencyLoggerRPC].status().State != breakerOpen {
+		t.Fatalf("expected the open rpc circuit to skip logger-service, got %d dials", dials.Load())
+	}
+}
@@ -0,0 +1,45 @@
+// Package main bounds each broker request with a deadline that its downstream calls share.
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// defaultRequestTimeout is used when REQUEST_TIMEOUT is not set.
+const defaultRequestTimeout = 10 * time.Second
+
+// credentialCheckHops is the number of downstream calls a protected request
+// makes in turn: checking its token or API key, then serving the action.
+const credentialCheckHops = 2
+
+// requestBudget gives each request RequestTimeout to finish, downstream
+// calls included. The deadline also ends when the client goes away, since
+// it derives from the request's own context.
+func (app *Config) requestBudget(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.RequestTimeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), app.RequestTimeout)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// hopContext bounds ctx to an even share of what is left of its deadline
+// when hops downstream calls, this one included, may still be made, so an
+// early hop that hangs leaves time for the rest. Without a deadline the
+// call is only bound to ctx's cancellation.
+func hopContext(ctx context.Context, hops int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || hops <= 1 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(hops))
+}
@@ -0,0 +1,253 @@
+// Package main verifies that request deadlines and cancellation reach every downstream call.
+package main
+
+import (
+	"broker/logs"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// hangingServer holds every request until the caller gives up, and reports
+// when each arrives and when it is cancelled.
+type hangingServer struct {
+	arrived   chan struct{}
+	cancelled chan struct{}
+}
+
+func newHangingServer() *hangingServer {
+	return &hangingServer{arrived: make(chan struct{}, 10), cancelled: make(chan struct{}, 10)}
+}
+
+func (server *hangingServer) hang(ctx context.Context) {
+	server.arrived <- struct{}{}
+	<-ctx.Done()
+	server.cancelled <- struct{}{}
+}
+
+func (server *hangingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the server only notices a client hanging up once the body is read
+	_, _ = io.Copy(io.Discard, r.Body)
+	server.hang(r.Context())
+}
+
+// hangingLogServer is a logger-service gRPC server that hangs.
+type hangingLogServer struct {
+	logs.UnimplementedLogServiceServer
+	*hangingServer
+}
+
+func (server hangingLogServer) Write(ctx context.Context, req *logs.LogRequest) (*logs.LogResponse, error) {
+	server.hang(ctx)
+	return nil, ctx.Err()
+}
+
+// hangingRPCServer is a logger-service RPC server that hangs until release
+// is closed; net/rpc servers never learn that a caller gave up.
+type hangingRPCServer struct {
+	arrived chan struct{}
+	release chan struct{}
+}
+
+func (server hangingRPCServer) LogInfo(payload RPCPayload, result *string) error {
+	server.arrived <- struct{}{}
+	<-server.release
+	return nil
+}
+
+func waitFor(t *testing.T, signal chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-signal:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestHopContext(t *testing.T) {
+	unbounded, cancel := hopContext(context.Background(), 3)
+	defer cancel()
+	if _, ok := unbounded.Deadline(); ok {
+		t.Fatalf("expected no deadline without a budget")
+	}
+
+	budget, cancelBudget := context.WithTimeout(context.Background(), time.Second)
+	defer cancelBudget()
+
+	tests := []struct {
+		hops     int
+		expected time.Duration
+	}{
+		{hops: 1, expected: time.Second},
+		{hops: 2, expected: 500 * time.Millisecond},
+		{hops: 4, expected: 250 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		ctx, cancel := hopContext(budget, tt.hops)
+		deadline, _ := ctx.Deadline()
+		cancel()
+
+		if share := time.Until(deadline); share > tt.expected || share < tt.expected-100*time.Millisecond {
+			t.Fatalf("expected %d hops to get %s each, got %s", tt.hops, tt.expected, share)
+		}
+	}
+}
+
+func TestForwardingStopsWhenClientCancels(t *testing.T) {
+	hanging := newHangingServer()
+	httpServer := httptest.NewServer(hanging)
+	defer httpServer.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start gRPC listener: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	logs.RegisterLogServiceServer(grpcServer, hangingLogServer{hangingServer: hanging})
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	defer grpcServer.Stop()
+
+	app := &Config{
+		AuthServiceURL:   httpServer.URL + "/authenticate",
+		MailServiceURL:   httpServer.URL + "/send",
+		LoggerServiceURL: httpServer.URL + "/log",
+		LoggerGRPCAddr:   listener.Addr().String(),
+	}
+	connectTestLogger(t, app)
+
+	tests := []struct {
+		name    string
+		forward func(ctx context.Context, w http.ResponseWriter)
+	}{
+		{name: "mail", forward: func(ctx context.Context, w http.ResponseWriter) {
+			app.forwardMailRequest(ctx, w, MailPayload{To: "c@d.com", Subject: "s", Message: "m"})
+		}},
+		{name: "auth", forward: func(ctx context.Context, w http.ResponseWriter) {
+			app.forwardAuthRequest(ctx, w, AuthPayload{Email: "me@example.com", Pass: "secret"})
+		}},
+		{name: "refresh", forward: func(ctx context.Context, w http.ResponseWriter) {
+			app.forwardRefreshRequest(ctx, w, RefreshPayload{RefreshToken: "token"})
+		}},
+		{name: "user", forward: func(ctx context.Context, w http.ResponseWriter) {
+			app.forwardUserRequest(ctx, w, UserPayload{Operation: "sessions"})
+		}},
+		{name: "token check", forward: func(ctx context.Context, w http.ResponseWriter) {
+			_, _, _ = app.verifyToken(ctx, "token")
+		}},
+		{name: "log over http", forward: func(ctx context.Context, w http.ResponseWriter) {
+			app.writeLog(ctx, w, LogPayload{Name: "event", Transport: transportHTTP})
+		}},
+		{name: "log over grpc", forward: func(ctx context.Context, w http.ResponseWriter) {
+			app.writeLog(ctx, w, LogPayload{Name: "event", Transport: transportGRPC})
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				tt.forward(ctx, httptest.NewRecorder())
+			}()
+
+			waitFor(t, hanging.arrived, "the downstream call")
+			cancel()
+			waitFor(t, hanging.cancelled, "the downstream call to be cancelled")
+			waitFor(t, done, "the handler to return")
+		})
+	}
+}
+
+func TestLogViaRPCReturnsWhenClientCancels(t *testing.T) {
+	hanging := hangingRPCServer{arrived: make(chan struct{}, 1), release: make(chan struct{})}
+	server := rpc.NewServer()
+	if err := server.RegisterName("RPCServer", hanging); err != nil {
+		t.Fatalf("failed to register RPC server: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start RPC listener: %v", err)
+	}
+	defer listener.Close()
+	defer close(hanging.release)
+	go server.Accept(listener)
+
+	app := &Config{LoggerRPCAddr: listener.Addr().String()}
+	connectTestLogger(t, app)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-hanging.arrived
+		cancel()
+	}()
+
+	if _, err := app.logViaRPC(ctx, LogPayload{Name: "event"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the call to end with the request, got %v", err)
+	}
+}
+
+func TestRequestBudget(t *testing.T) {
+	hanging := newHangingServer()
+	slowServer := httptest.NewServer(hanging)
+	defer slowServer.Close()
+	authServer := newTestAuthServer(t)
+
+	tests := []struct {
+		name           string
+		authServiceURL string
+		expectedHang   time.Duration
+	}{
+		{name: "slow action", authServiceURL: authServer.URL + "/authenticate", expectedHang: 200 * time.Millisecond},
+		{name: "slow token check gets half the budget", authServiceURL: slowServer.URL + "/authenticate", expectedHang: 100 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := Config{
+				AuthServiceURL: tt.authServiceURL,
+				MailServiceURL: slowServer.URL,
+				RequestTimeout: 200 * time.Millisecond,
+				Breakers:       newBreakerRegistry(1, time.Minute),
+			}
+
+			body := `{"action":"mail","mail":{"to":"c@d.com","subject":"s","message":"m"}}`
+			req := httptest.NewRequest(http.MethodPost, "/handle", bytes.NewBufferString(body))
+			req.Header.Set("Authorization", "Bearer mailer-token")
+			rr := httptest.NewRecorder()
+
+			start := time.Now()
+			app.routes().ServeHTTP(rr, req)
+			elapsed := time.Since(start)
+
+			waitFor(t, hanging.arrived, "the slow call")
+			waitFor(t, hanging.cancelled, "the slow call to be cancelled")
+			if rr.Code != http.StatusGatewayTimeout {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusGatewayTimeout, rr.Code, rr.Body.String())
+			}
+			if elapsed < tt.expectedHang-20*time.Millisecond || elapsed > tt.expectedHang+time.Second {
+				t.Fatalf("expected the request to give up after about %s, took %s", tt.expectedHang, elapsed)
+			}
+			// running out of budget is not the dependency's fault
+			for _, breaker := range app.Breakers {
+				if current := breaker.status(); current.State != breakerClosed || current.ConsecutiveFailures != 0 {
+					t.Fatalf("expected every circuit to stay closed, got %+v", current)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+// Package main keeps long-lived gRPC and net/rpc connections to downstream services.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials/insecure"
+
+	// registers the client side of grpc.health.v1 health checking
+	_ "google.golang.org/grpc/health"
+)
+
+// defaultRPCPoolSize is the number of net/rpc connections kept to
+// logger-service when LOGGER_RPC_POOL_SIZE is not set.
+const defaultRPCPoolSize = 4
+
+// Delays between attempts to redial a net/rpc connection that failed.
+const (
+	rpcRedialBaseDelay = 100 * time.Millisecond
+	rpcRedialMaxDelay  = 5 * time.Second
+)
+
+// grpcServiceConfig spreads calls over every address the target resolves
+// to and watches each connection with the grpc.health.v1 service, so calls
+// skip servers that report NOT_SERVING. Servers without the health service
+// are treated as healthy.
+const grpcServiceConfig = `{"loadBalancingConfig":[{"round_robin":{}}],"healthCheckConfig":{"serviceName":""}}`
+
+var errLoggerNotConnected = errors.New("no client for logger-service")
+
+// newGRPCClientConn returns a connection to addr meant to be shared by every
+// request. It connects lazily and reconnects with backoff when the server
+// goes away.
+func newGRPCClientConn(addr string) (*grpc.ClientConn, error) {
+	return grpc.NewClient(
+		addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(grpcServiceConfig),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  100 * time.Millisecond,
+				Multiplier: 1.6,
+				Jitter:     0.2,
+				MaxDelay:   5 * time.Second,
+			},
+			MinConnectTimeout: 3 * time.Second,
+		}),
+	)
+}
+
+// rpcPool spreads net/rpc calls to one address over a fixed number of
+// long-lived connections. Each connection is dialed on first use, and one
+// that breaks is redialed with exponential backoff.
+type rpcPool struct {
+	addr  string
+	slots []rpcSlot
+	next  atomic.Uint64
+
+	// dial opens a connection; tests replace it.
+	dial func(ctx context.Context, addr string) (*rpc.Client, error)
+}
+
+// rpcSlot holds one pooled connection, or when the last dial failed, the
+// time the next may be attempted.
+type rpcSlot struct {
+	mu       sync.Mutex
+	client   *rpc.Client
+	failures int
+	retryAt  time.Time
+	lastErr  error
+}
+
+// newRPCPool returns a pool of size connections to addr. Nothing is dialed
+// until the first call.
+func newRPCPool(addr string, size int) *rpcPool {
+	if size < 1 {
+		size = 1
+	}
+
+	return &rpcPool{
+		addr:  addr,
+		slots: make([]rpcSlot, size),
+		dial: func(ctx context.Context, addr string) (*rpc.Client, error) {
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+
+			return rpc.NewClient(conn), nil
+		},
+	}
+}
+
+// Call invokes method on one of the pooled connections. A connection that
+// was already closed is replaced and the call sent again, since the server
+// never saw it; a call that fails after it was sent is not retried.
+func (pool *rpcPool) Call(ctx context.Context, method string, args any, reply any) error {
+	slot := &pool.slots[pool.next.Add(1)%uint64(len(pool.slots))]
+
+	for attempt := 0; ; attempt++ {
+		client, err := slot.connect(ctx, pool)
+		if err != nil {
+			return err
+		}
+
+		call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if call.Error == nil {
+			return nil
+		}
+		if _, ok := call.Error.(rpc.ServerError); ok {
+			return call.Error
+		}
+
+		slot.discard(client)
+		if !errors.Is(call.Error, rpc.ErrShutdown) || attempt > 0 {
+			return call.Error
+		}
+	}
+}
+
+// Close closes every pooled connection.
+func (pool *rpcPool) Close() error {
+	for i := range pool.slots {
+		slot := &pool.slots[i]
+		slot.mu.Lock()
+		if slot.client != nil {
+			_ = slot.client.Close()
+			slot.client = nil
+		}
+		slot.mu.Unlock()
+	}
+
+	return nil
+}
+
+// connect returns the slot's connection, dialing one unless the slot is
+// still backing off from a failed dial.
+func (slot *rpcSlot) connect(ctx context.Context, pool *rpcPool) (*rpc.Client, error) {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+
+	if slot.client != nil {
+		return slot.client, nil
+	}
+	if wait := time.Until(slot.retryAt); wait > 0 {
+		return nil, fmt.Errorf("reconnecting to %s in %s: %w", pool.addr, wait.Round(time.Millisecond), slot.lastErr)
+	}
+
+	client, err := pool.dial(ctx, pool.addr)
+	if errors.Is(err, context.Canceled) {
+		return nil, err
+	}
+	if err != nil {
+		delay := min(rpcRedialBaseDelay<<min(slot.failures, 16), rpcRedialMaxDelay)
+		slot.failures++
+		slot.retryAt = time.Now().Add(delay)
+		slot.lastErr = err
+		return nil, err
+	}
+
+	slot.client = client
+	slot.failures = 0
+	slot.retryAt = time.Time{}
+	slot.lastErr = nil
+
+	return client, nil
+}
+
+// discard closes client and clears it from the slot, unless another call
+// has already replaced it.
+func (slot *rpcSlot) discard(client *rpc.Client) {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+
+	if slot.client == client {
+		slot.client = nil
+	}
+	_ = client.Close()
+}
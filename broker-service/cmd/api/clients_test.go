@@ -0,0 +1,249 @@
+// Package main verifies the shared downstream connections and measures what they save.
+package main
+
+import (
+	"broker/logs"
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// countingListener counts the connections a test server accepts.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (listener *countingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err == nil {
+		listener.accepted.Add(1)
+	}
+
+	return conn, err
+}
+
+// countDials makes pool count its dials and keep the clients it opens.
+func countDials(pool *rpcPool, clients *[]*rpc.Client) *atomic.Int32 {
+	var dials atomic.Int32
+	dial := pool.dial
+	pool.dial = func(ctx context.Context, addr string) (*rpc.Client, error) {
+		dials.Add(1)
+		client, err := dial(ctx, addr)
+		if err == nil {
+			*clients = append(*clients, client)
+		}
+		return client, err
+	}
+
+	return &dials
+}
+
+func TestRPCPoolSharesConnections(t *testing.T) {
+	addr, stop := startTestRPCServer(t)
+	defer stop()
+
+	pool := newRPCPool(addr, 2)
+	defer pool.Close()
+	var clients []*rpc.Client
+	dials := countDials(pool, &clients)
+
+	for range 10 {
+		var result string
+		if err := pool.Call(context.Background(), "RPCServer.LogInfo", RPCPayload{Name: "event"}, &result); err != nil {
+			t.Fatalf("expected the call to succeed, got %v", err)
+		}
+	}
+
+	if dials.Load() != 2 {
+		t.Fatalf("expected 10 calls to share 2 connections, got %d dials", dials.Load())
+	}
+}
+
+func TestRPCPoolReplacesClosedConnection(t *testing.T) {
+	addr, stop := startTestRPCServer(t)
+	defer stop()
+
+	pool := newRPCPool(addr, 1)
+	defer pool.Close()
+	var clients []*rpc.Client
+	dials := countDials(pool, &clients)
+
+	var result string
+	if err := pool.Call(context.Background(), "RPCServer.LogInfo", RPCPayload{Name: "event"}, &result); err != nil {
+		t.Fatalf("expected the call to succeed, got %v", err)
+	}
+	_ = clients[0].Close()
+
+	if err := pool.Call(context.Background(), "RPCServer.LogInfo", RPCPayload{Name: "again"}, &result); err != nil {
+		t.Fatalf("expected the call to be sent on a new connection, got %v", err)
+	}
+	if dials.Load() != 2 || result != "Processed payload via RPC: again" {
+		t.Fatalf("expected one redial, got %d dials and %q", dials.Load(), result)
+	}
+}
+
+func TestRPCPoolBacksOff(t *testing.T) {
+	addr, stop := startTestRPCServer(t)
+	defer stop()
+
+	pool := newRPCPool(addr, 1)
+	defer pool.Close()
+	down := true
+	var dials int
+	pool.dial = func(ctx context.Context, addr string) (*rpc.Client, error) {
+		dials++
+		if down {
+			return nil, errors.New("connection refused")
+		}
+		return rpc.Dial("tcp", addr)
+	}
+
+	var result string
+	if err := pool.Call(context.Background(), "RPCServer.LogInfo", RPCPayload{}, &result); err == nil || err.Error() != "connection refused" {
+		t.Fatalf("expected the dial error, got %v", err)
+	}
+	err := pool.Call(context.Background(), "RPCServer.LogInfo", RPCPayload{}, &result)
+	if err == nil || !strings.Contains(err.Error(), "reconnecting to "+addr) || dials != 1 {
+		t.Fatalf("expected the call to fail without dialing, got %v after %d dials", err, dials)
+	}
+
+	slot := &pool.slots[0]
+	if slot.failures != 1 || time.Until(slot.retryAt) > rpcRedialBaseDelay {
+		t.Fatalf("expected the first retry after %s, got %s", rpcRedialBaseDelay, time.Until(slot.retryAt))
+	}
+	slot.retryAt = time.Now()
+	_ = pool.Call(context.Background(), "RPCServer.LogInfo", RPCPayload{}, &result)
+	if slot.failures != 2 || time.Until(slot.retryAt) <= rpcRedialBaseDelay {
+		t.Fatalf("expected the delay to grow, got %s", time.Until(slot.retryAt))
+	}
+
+	down = false
+	slot.retryAt = time.Now()
+	if err := pool.Call(context.Background(), "RPCServer.LogInfo", RPCPayload{}, &result); err != nil || slot.failures != 0 {
+		t.Fatalf("expected the pool to reconnect, got %v with %d failures", err, slot.failures)
+	}
+}
+
+func TestLogViaGRPCSharesHealthCheckedConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start gRPC listener: %v", err)
+	}
+	counting := &countingListener{Listener: listener}
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	grpcServer := grpc.NewServer()
+	logs.RegisterLogServiceServer(grpcServer, grpcTestLogServer{})
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	go func() {
+		_ = grpcServer.Serve(counting)
+	}()
+	defer grpcServer.Stop()
+
+	app := &Config{LoggerGRPCAddr: listener.Addr().String()}
+	connectTestLogger(t, app)
+
+	if _, err := app.logViaGRPC(context.Background(), LogPayload{Name: "event"}); err == nil {
+		t.Fatalf("expected no calls to a server that is not serving")
+	}
+
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := app.logViaGRPC(context.Background(), LogPayload{Name: "event"})
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected calls once the server is serving, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for range 10 {
+		if _, err := app.logViaGRPC(context.Background(), LogPayload{Name: "event"}); err != nil {
+			t.Fatalf("expected the call to succeed, got %v", err)
+		}
+	}
+	if counting.accepted.Load() != 1 {
+		t.Fatalf("expected every call to share one connection, got %d", counting.accepted.Load())
+	}
+}
+
+// The "dial per request" benchmarks repeat what the broker did before the
+// connections were shared. Compare them with:
+//
+//	go test ./cmd/api -run '^$' -bench 'LogVia'
+func BenchmarkLogViaRPC(b *testing.B) {
+	addr, stop := startTestRPCServer(b)
+	defer stop()
+	payload := RPCPayload{Name: "event", Data: "payload"}
+
+	b.Run("dial per request", func(b *testing.B) {
+		for b.Loop() {
+			client, err := rpc.Dial("tcp", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var result string
+			if err := client.Call("RPCServer.LogInfo", payload, &result); err != nil {
+				b.Fatal(err)
+			}
+			_ = client.Close()
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		pool := newRPCPool(addr, defaultRPCPoolSize)
+		defer pool.Close()
+
+		for b.Loop() {
+			var result string
+			if err := pool.Call(context.Background(), "RPCServer.LogInfo", payload, &result); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkLogViaGRPC(b *testing.B) {
+	addr, stop := startTestGRPCServer(b)
+	defer stop()
+	request := &logs.LogRequest{LogEntry: &logs.Log{Name: "event", Data: "payload"}}
+
+	b.Run("dial per request", func(b *testing.B) {
+		for b.Loop() {
+			conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := logs.NewLogServiceClient(conn).Write(context.Background(), request, grpc.WaitForReady(true)); err != nil {
+				b.Fatal(err)
+			}
+			_ = conn.Close()
+		}
+	})
+
+	b.Run("shared", func(b *testing.B) {
+		app := &Config{LoggerGRPCAddr: addr}
+		connectTestLogger(b, app)
+
+		for b.Loop() {
+			if _, err := app.LoggerGRPC.Write(context.Background(), request); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -2,28 +2,18 @@
 package main
 
 import (
-	"broker/event"
-	"broker/logs"
 	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"net/rpc"
+	"net/url"
+	"strconv"
 	"time"
-
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
-type RequestPayload struct {
-	Action string      `json:"action"`
-	Auth   AuthPayload `json:"auth,omitempty"`
-	Log    LogPayload  `json:"log,omitempty"`
-	Mail   MailPayload `json:"mail,omitempty"`
-}
-
 type MailPayload struct {
 	From    string `json:"from"`
 	To      string `json:"to"`
@@ -31,14 +21,62 @@ type MailPayload struct {
 	Message string `json:"message"`
 }
 
+// AuthPayload starts a login with Email and Pass. When authentication-service
+// answers with a second factor challenge, the client sends ChallengeToken
+// back with either a TOTP Code or a RecoveryCode to finish it.
 type AuthPayload struct {
-	Email string `json:"email"`
-	Pass  string `json:"password"`
+	Email          string `json:"email,omitempty"`
+	Pass           string `json:"password,omitempty"`
+	ChallengeToken string `json:"challenge_token,omitempty"`
+	Code           string `json:"code,omitempty"`
+	RecoveryCode   string `json:"recovery_code,omitempty"`
 }
 
+// secondFactorRequiredCode marks an authentication-service reply that carries
+// a challenge instead of tokens.
+const secondFactorRequiredCode = "second_factor_required"
+
+type RefreshPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type RegisterPayload struct {
+	Email     string `json:"email"`
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+	Password  string `json:"password"`
+}
+
+// UserPayload operates on the caller's own account. Operation is one of
+// "get", "update", "deactivate", "sessions", "revoke_session" or
+// "revoke_all_sessions"; the profile fields apply to "update" and SessionID
+// to "revoke_session". "list" returns a page of every user, and Query holds
+// its filters, sort and cursor as authentication-service query parameters.
+type UserPayload struct {
+	Operation string            `json:"operation"`
+	Email     string            `json:"email,omitempty"`
+	FirstName string            `json:"first_name,omitempty"`
+	LastName  string            `json:"last_name,omitempty"`
+	SessionID string            `json:"session_id,omitempty"`
+	Query     map[string]string `json:"query,omitempty"`
+}
+
+// AuthResult is the token-bearing payload returned by authentication-service.
+type AuthResult struct {
+	User         json.RawMessage `json:"user"`
+	AccessToken  string          `json:"access_token"`
+	RefreshToken string          `json:"refresh_token"`
+	TokenType    string          `json:"token_type"`
+	ExpiresIn    int64           `json:"expires_in"`
+}
+
+// LogPayload is an entry for logger-service. Transport, when set, overrides
+// the configured transports for this entry; like LOG_TRANSPORT it is one
+// transport or a comma-separated list to try in order.
 type LogPayload struct {
-	Name string `json:"name"`
-	Data string `json:"data"`
+	Name      string `json:"name"`
+	Data      string `json:"data"`
+	Transport string `json:"transport,omitempty"`
 }
 
 func (app *Config) downstreamHTTPClient() *http.Client {
@@ -49,6 +87,23 @@ func (app *Config) downstreamHTTPClient() *http.Client {
 	return &http.Client{Timeout: 5 * time.Second}
 }
 
+// authServiceEndpoint resolves path, which may carry a query, against the host
+// of AuthServiceURL so every authentication-service route shares one
+// configured address.
+func (app *Config) authServiceEndpoint(path string) (string, error) {
+	base, err := url.Parse(app.AuthServiceURL)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+
+	return base.ResolveReference(ref).String(), nil
+}
+
 func (app *Config) handleBroker(w http.ResponseWriter, r *http.Request) {
 	payload := JsonResponse{
 		Error:   false,
@@ -70,39 +125,40 @@ func (app *Config) handleSubmission(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	switch requestPayload.Action {
-	case "auth":
-		app.forwardAuthRequest(w, requestPayload.Auth)
-	case "log":
-		// app.logViaRabbitMQ(w, requestPayload.Log)
-		app.logViaRPC(w, requestPayload.Log)
-	case "mail":
-		app.forwardMailRequest(w, requestPayload.Mail)
-	default:
-		err := app.writeErrorJSON(w, errors.New("invalid action"), http.StatusBadRequest)
-		if err != nil {
-			return
-		}
+	registered, ok := actions[requestPayload.Action]
+	if !ok {
+		_ = app.writeErrorJSON(w, errInvalidAction, http.StatusBadRequest)
+		return
+	}
+
+	if status, err := registered.authorize(r.Context()); err != nil {
+		_ = app.writeErrorJSON(w, err, status)
+		return
+	}
+
+	if status, err := registered.serve(app, r.Context(), w, requestPayload.Payload); err != nil {
+		_ = app.writeErrorJSON(w, err, status)
 	}
 }
 
-func (app *Config) forwardMailRequest(w http.ResponseWriter, mail MailPayload) {
+func (app *Config) forwardMailRequest(ctx context.Context, w http.ResponseWriter, mail MailPayload) {
 	jsonData, err := json.Marshal(mail)
 	if err != nil {
 		_ = app.writeErrorJSON(w, err)
 		return
 	}
 
-	request, err := http.NewRequest(http.MethodPost, app.MailServiceURL, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, app.MailServiceURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		_ = app.writeErrorJSON(w, err)
 		return
 	}
 
 	request.Header.Set("Content-Type", "application/json")
-	response, err := app.downstreamHTTPClient().Do(request)
+	setCallerHeader(ctx, request)
+	response, err := app.doHTTP(dependencyMail, request, noRetries)
 	if err != nil {
-		_ = app.writeErrorJSON(w, err, http.StatusBadGateway)
+		_ = app.writeErrorJSON(w, err, downstreamStatus(err))
 		return
 	}
 	defer response.Body.Close()
@@ -119,203 +175,285 @@ func (app *Config) forwardMailRequest(w http.ResponseWriter, mail MailPayload) {
 	_ = app.writeJSON(w, http.StatusOK, payload)
 }
 
-func (app *Config) forwardLogRequestHTTP(w http.ResponseWriter, logPayload LogPayload) {
-	jsonData, err := json.Marshal(logPayload)
+func (app *Config) forwardAuthRequest(ctx context.Context, w http.ResponseWriter, authPayload AuthPayload) {
+	// answering a challenge stays on HTTP; the AuthService has no call for it
+	if app.AuthGRPC != nil && authPayload.ChallengeToken == "" {
+		app.authenticateViaGRPC(ctx, w, authPayload)
+		return
+	}
+
+	jsonData, err := json.Marshal(authPayload)
 	if err != nil {
 		_ = app.writeErrorJSON(w, err)
 		return
 	}
 
-	request, err := http.NewRequest(http.MethodPost, app.LoggerServiceURL, bytes.NewBuffer(jsonData))
+	authURL := app.AuthServiceURL
+	if authPayload.ChallengeToken != "" {
+		authURL, err = app.authServiceEndpoint("/authenticate/second-factor")
+		if err != nil {
+			_ = app.writeErrorJSON(w, err)
+			return
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, authURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		_ = app.writeErrorJSON(w, err)
 		return
 	}
-
 	request.Header.Set("Content-Type", "application/json")
-	response, err := app.downstreamHTTPClient().Do(request)
+	setClientHeaders(ctx, request)
+
+	response, err := app.doHTTP(dependencyAuth, request, noRetries)
 	if err != nil {
-		_ = app.writeErrorJSON(w, err, http.StatusBadGateway)
+		_ = app.writeErrorJSON(w, err, downstreamStatus(err))
 		return
 	}
 	defer response.Body.Close()
 
-	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
-		_ = app.writeErrorJSON(w, fmt.Errorf("log service returned status %d", response.StatusCode), http.StatusBadGateway)
+	switch response.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		app.relayAuthRejection(w, response, "invalid credentials")
+		return
+	}
+	if response.StatusCode != http.StatusAccepted {
+		_ = app.writeErrorJSON(w, errors.New("error calling auth service"), http.StatusBadGateway)
+		return
+	}
+
+	reply, err := decodeAuthReply(response)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, http.StatusBadGateway)
+		return
+	}
+
+	// the password was right but the account needs a second factor; the
+	// client answers the challenge with another auth action
+	if reply.Code == secondFactorRequiredCode {
+		_ = app.writeJSON(w, http.StatusOK, reply)
+		return
+	}
+
+	result, err := reply.authResult()
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, http.StatusBadGateway)
 		return
 	}
 
 	var payload JsonResponse
 	payload.Error = false
-	payload.Message = "Logged"
+	payload.Message = "Authenticated!"
+	payload.Data = result
 
 	_ = app.writeJSON(w, http.StatusOK, payload)
 }
 
-func (app *Config) forwardAuthRequest(w http.ResponseWriter, authPayload AuthPayload) {
-	jsonData, err := json.Marshal(authPayload)
+func (app *Config) forwardRefreshRequest(ctx context.Context, w http.ResponseWriter, refreshPayload RefreshPayload) {
+	jsonData, err := json.Marshal(refreshPayload)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err)
+		return
+	}
+
+	refreshURL, err := app.authServiceEndpoint("/refresh")
 	if err != nil {
 		_ = app.writeErrorJSON(w, err)
 		return
 	}
 
-	request, err := http.NewRequest(http.MethodPost, app.AuthServiceURL, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, refreshURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		_ = app.writeErrorJSON(w, err)
 		return
 	}
 	request.Header.Set("Content-Type", "application/json")
+	setClientHeaders(ctx, request)
 
-	response, err := app.downstreamHTTPClient().Do(request)
+	response, err := app.doHTTP(dependencyAuth, request, noRetries)
 	if err != nil {
-		_ = app.writeErrorJSON(w, err, http.StatusBadGateway)
+		_ = app.writeErrorJSON(w, err, downstreamStatus(err))
 		return
 	}
 	defer response.Body.Close()
 
-	if response.StatusCode == http.StatusUnauthorized {
-		_ = app.writeErrorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+	// refused refreshes, such as a deactivated account's, keep their status
+	// and code
+	if response.StatusCode >= http.StatusBadRequest && response.StatusCode < http.StatusInternalServerError {
+		app.relayAuthRejection(w, response, "invalid refresh token")
 		return
 	}
-	if response.StatusCode != http.StatusAccepted {
+	if response.StatusCode != http.StatusOK {
 		_ = app.writeErrorJSON(w, errors.New("error calling auth service"), http.StatusBadGateway)
 		return
 	}
 
-	var jsonFromService JsonResponse
-
-	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+	result, err := decodeAuthResult(response)
 	if err != nil {
 		_ = app.writeErrorJSON(w, err, http.StatusBadGateway)
 		return
 	}
 
-	if jsonFromService.Error {
-		_ = app.writeErrorJSON(w, errors.New(jsonFromService.Message), http.StatusUnauthorized)
-		return
-	}
-
 	var payload JsonResponse
 	payload.Error = false
-	payload.Message = "Authenticated!"
-	payload.Data = jsonFromService.Data
+	payload.Message = "Token refreshed"
+	payload.Data = result
 
 	_ = app.writeJSON(w, http.StatusOK, payload)
 }
 
-func (app *Config) logViaRabbitMQ(w http.ResponseWriter, logPayload LogPayload) {
-	err := app.publishLogEvent(logPayload.Name, logPayload.Data)
-	if err != nil {
-		_ = app.writeErrorJSON(w, err)
-		return
-	}
+func (app *Config) forwardUserRequest(ctx context.Context, w http.ResponseWriter, userPayload UserPayload) {
+	userID, _ := userIDFromContext(ctx)
+	path := "/users/" + strconv.Itoa(userID)
 
-	var payload JsonResponse
-	payload.Error = false
-	payload.Message = "Logged via RabbitMQ"
-
-	_ = app.writeJSON(w, http.StatusOK, payload)
+	switch userPayload.Operation {
+	case "list":
+		query := url.Values{}
+		for name, value := range userPayload.Query {
+			query.Set(name, value)
+		}
+		app.relayToAuthService(ctx, w, http.MethodGet, (&url.URL{Path: "/users", RawQuery: query.Encode()}).String(), nil)
+	case "get":
+		app.relayToAuthService(ctx, w, http.MethodGet, path, nil)
+	case "update":
+		app.relayToAuthService(ctx, w, http.MethodPut, path, struct {
+			Email     string `json:"email,omitempty"`
+			FirstName string `json:"first_name,omitempty"`
+			LastName  string `json:"last_name,omitempty"`
+		}{userPayload.Email, userPayload.FirstName, userPayload.LastName})
+	case "deactivate":
+		app.relayToAuthService(ctx, w, http.MethodDelete, path, nil)
+	case "sessions":
+		app.relayToAuthService(ctx, w, http.MethodGet, "/sessions", nil)
+	case "revoke_session":
+		if userPayload.SessionID == "" {
+			_ = app.writeErrorJSON(w, errors.New("session_id is required"), http.StatusBadRequest)
+			return
+		}
+		app.relayToAuthService(ctx, w, http.MethodDelete, "/sessions/"+url.PathEscape(userPayload.SessionID), nil)
+	case "revoke_all_sessions":
+		app.relayToAuthService(ctx, w, http.MethodDelete, "/sessions", nil)
+	default:
+		_ = app.writeErrorJSON(w, errors.New("invalid user operation"), http.StatusBadRequest)
+	}
 }
 
-func (app *Config) publishLogEvent(name, msg string) error {
-	emitter, err := event.NewEmitter(app.Rabbit)
+// relayToAuthService calls an authentication-service route on behalf of the
+// caller and relays its JSON response. Client errors such as validation
+// failures or conflicts keep their status; server errors become 502.
+func (app *Config) relayToAuthService(ctx context.Context, w http.ResponseWriter, method, path string, body any) {
+	endpoint, err := app.authServiceEndpoint(path)
 	if err != nil {
-		return err
+		_ = app.writeErrorJSON(w, err)
+		return
 	}
 
-	payload := LogPayload{
-		Name: name,
-		Data: msg,
+	var requestBody io.Reader = http.NoBody
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			_ = app.writeErrorJSON(w, err)
+			return
+		}
+		requestBody = bytes.NewBuffer(jsonData)
 	}
 
-	jsonData, err := json.Marshal(payload)
+	request, err := http.NewRequestWithContext(ctx, method, endpoint, requestBody)
 	if err != nil {
-		return err
+		_ = app.writeErrorJSON(w, err)
+		return
 	}
+	request.Header.Set("Content-Type", "application/json")
+	setClientHeaders(ctx, request)
+	setBearerHeader(ctx, request)
 
-	err = emitter.Publish(string(jsonData), "log.INFO")
+	response, err := app.doHTTP(dependencyAuth, request, retryPolicyFor(method))
 	if err != nil {
-		return err
+		_ = app.writeErrorJSON(w, err, downstreamStatus(err))
+		return
 	}
-	return nil
-}
-
-type RPCPayload struct {
-	Name string
-	Data string
-}
+	defer response.Body.Close()
 
-func (app *Config) logViaRPC(w http.ResponseWriter, logPayload LogPayload) {
-	client, err := rpc.Dial("tcp", app.LoggerRPCAddr)
-	if err != nil {
-		_ = app.writeErrorJSON(w, err, http.StatusBadGateway)
+	if response.StatusCode >= http.StatusInternalServerError {
+		_ = app.writeErrorJSON(w, errors.New("error calling auth service"), http.StatusBadGateway)
 		return
 	}
-	defer client.Close()
 
-	var rpcPayload RPCPayload
-	rpcPayload.Name = logPayload.Name
-	rpcPayload.Data = logPayload.Data
+	var jsonFromService JsonResponse
 
-	var result string
-	err = client.Call("RPCServer.LogInfo", rpcPayload, &result)
+	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
 	if err != nil {
 		_ = app.writeErrorJSON(w, err, http.StatusBadGateway)
 		return
 	}
 
-	var payload JsonResponse
-	payload.Error = false
-	payload.Message = result
-
-	_ = app.writeJSON(w, http.StatusAccepted, payload)
+	_ = app.writeJSON(w, response.StatusCode, jsonFromService)
 }
 
-func (app *Config) logViaGRPC(w http.ResponseWriter, r *http.Request) {
-	var requestPayload RequestPayload
+// relayAuthRejection passes a refused login or refresh back to the caller with
+// its status, machine-readable code and any Retry-After hint intact. fallback
+// is the message when authentication-service sent none.
+func (app *Config) relayAuthRejection(w http.ResponseWriter, response *http.Response, fallback string) {
+	var jsonFromService JsonResponse
 
-	err := app.decodeJSON(w, r, &requestPayload)
-	if err != nil {
-		_ = app.writeErrorJSON(w, err, http.StatusBadRequest)
-		return
+	err := json.NewDecoder(response.Body).Decode(&jsonFromService)
+	if err != nil || jsonFromService.Message == "" {
+		jsonFromService = JsonResponse{Message: fallback}
+	}
+	jsonFromService.Error = true
+
+	if retryAfter := response.Header.Get("Retry-After"); retryAfter != "" {
+		w.Header().Set("Retry-After", retryAfter)
 	}
 
-	dialCtx, dialCancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer dialCancel()
+	_ = app.writeJSON(w, response.StatusCode, jsonFromService)
+}
+
+// authServiceReply is the JSON envelope returned by authentication-service
+// login and refresh calls.
+type authServiceReply struct {
+	Error   bool            `json:"error"`
+	Code    string          `json:"code,omitempty"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func decodeAuthReply(response *http.Response) (authServiceReply, error) {
+	var reply authServiceReply
 
-	conn, err := grpc.DialContext(
-		dialCtx,
-		app.LoggerGRPCAddr,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithBlock(),
-	)
+	err := json.NewDecoder(response.Body).Decode(&reply)
 	if err != nil {
-		_ = app.writeErrorJSON(w, err, http.StatusBadGateway)
-		return
+		return authServiceReply{}, err
 	}
 
-	defer conn.Close()
+	return reply, nil
+}
 
-	client := logs.NewLogServiceClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
+// authResult extracts the issued tokens from reply.
+func (reply authServiceReply) authResult() (AuthResult, error) {
+	if reply.Error {
+		return AuthResult{}, errors.New(reply.Message)
+	}
 
-	res, err := client.Write(ctx, &logs.LogRequest{
-		LogEntry: &logs.Log{
-			Name: requestPayload.Log.Name,
-			Data: requestPayload.Log.Data,
-		},
-	})
+	var result AuthResult
+	if len(reply.Data) > 0 {
+		if err := json.Unmarshal(reply.Data, &result); err != nil {
+			return AuthResult{}, err
+		}
+	}
+	if result.AccessToken == "" {
+		return AuthResult{}, errors.New("auth service did not issue an access token")
+	}
+
+	return result, nil
+}
 
+// decodeAuthResult extracts the issued tokens from an authentication-service response.
+func decodeAuthResult(response *http.Response) (AuthResult, error) {
+	reply, err := decodeAuthReply(response)
 	if err != nil {
-		_ = app.writeErrorJSON(w, err, http.StatusBadGateway)
-		return
+		return AuthResult{}, err
 	}
 
-	var payload JsonResponse
-	payload.Error = false
-	payload.Message = "Logged via GRPC"
-	payload.Data = res.GetResult()
-
-	_ = app.writeJSON(w, http.StatusAccepted, payload)
+	return reply.authResult()
 }
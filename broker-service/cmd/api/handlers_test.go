@@ -69,8 +69,12 @@ func TestForwardAuthRequestAccepted(t *testing.T) {
 		_ = json.NewEncoder(w).Encode(JsonResponse{
 			Error:   false,
 			Message: "ok",
-			Data: map[string]string{
-				"id": "123",
+			Data: map[string]any{
+				"user":          map[string]any{"id": 123},
+				"access_token":  "access",
+				"refresh_token": "refresh",
+				"token_type":    "Bearer",
+				"expires_in":    900,
 			},
 		})
 	}))
@@ -79,7 +83,7 @@ func TestForwardAuthRequestAccepted(t *testing.T) {
 	app := Config{AuthServiceURL: authServer.URL}
 	rr := httptest.NewRecorder()
 
-	app.forwardAuthRequest(rr, AuthPayload{Email: "me@example.com", Pass: "secret"})
+	app.forwardAuthRequest(context.Background(), rr, AuthPayload{Email: "me@example.com", Pass: "secret"})
 
 	if rr.Code != http.StatusOK {
 		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
@@ -92,66 +96,174 @@ func TestForwardAuthRequestAccepted(t *testing.T) {
 	if response.Message != "Authenticated!" {
 		t.Fatalf("expected authenticated message, got %q", response.Message)
 	}
+
+	result := decodeAuthResultData(t, rr)
+	if result.AccessToken != "access" || result.RefreshToken != "refresh" {
+		t.Fatalf("expected tokens to be passed through, got %+v", result)
+	}
 }
 
-func TestForwardAuthRequestUnauthorized(t *testing.T) {
+func TestForwardAuthRequestSecondFactor(t *testing.T) {
 	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusUnauthorized)
+		var body AuthPayload
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+
+		switch r.URL.Path {
+		case "/authenticate":
+			_ = json.NewEncoder(w).Encode(JsonResponse{
+				Code:    secondFactorRequiredCode,
+				Message: "A one-time code is required to finish logging in",
+				Data:    map[string]any{"challenge_token": "challenge", "expires_in": 300},
+			})
+		case "/authenticate/second-factor":
+			if body.ChallengeToken != "challenge" || body.Code != "123456" {
+				t.Fatalf("expected challenge and code to be forwarded, got %+v", body)
+			}
+			_ = json.NewEncoder(w).Encode(JsonResponse{
+				Message: "ok",
+				Data:    map[string]any{"access_token": "access", "refresh_token": "refresh"},
+			})
+		default:
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
 	}))
 	defer authServer.Close()
 
-	app := Config{AuthServiceURL: authServer.URL}
-	rr := httptest.NewRecorder()
+	app := Config{AuthServiceURL: authServer.URL + "/authenticate"}
 
-	app.forwardAuthRequest(rr, AuthPayload{Email: "me@example.com", Pass: "wrong"})
+	rr := httptest.NewRecorder()
+	app.forwardAuthRequest(context.Background(), rr, AuthPayload{Email: "me@example.com", Pass: "secret"})
 
-	if rr.Code != http.StatusUnauthorized {
-		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	var challenge struct {
+		Code string `json:"code"`
+		Data struct {
+			ChallengeToken string `json:"challenge_token"`
+		} `json:"data"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &challenge)
+	if challenge.Code != secondFactorRequiredCode || challenge.Data.ChallengeToken != "challenge" {
+		t.Fatalf("expected the challenge to be relayed, got %s", rr.Body.String())
 	}
 
-	response := decodeJSONResponse(t, rr)
-	if !response.Error {
-		t.Fatalf("expected error=true, got false")
+	rr = httptest.NewRecorder()
+	app.forwardAuthRequest(context.Background(), rr, AuthPayload{ChallengeToken: "challenge", Code: "123456"})
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if result := decodeAuthResultData(t, rr); result.AccessToken != "access" {
+		t.Fatalf("expected tokens after the second factor, got %+v", result)
 	}
 }
 
-func TestForwardMailRequestSuccess(t *testing.T) {
-	mailServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+func TestForwardAuthRequestBadGatewayWithoutTokens(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(JsonResponse{Error: false, Message: "ok"})
 	}))
-	defer mailServer.Close()
+	defer authServer.Close()
 
-	app := Config{MailServiceURL: mailServer.URL}
+	app := Config{AuthServiceURL: authServer.URL}
 	rr := httptest.NewRecorder()
 
-	app.forwardMailRequest(rr, MailPayload{From: "a@b.com", To: "c@d.com", Subject: "s", Message: "m"})
+	app.forwardAuthRequest(context.Background(), rr, AuthPayload{Email: "me@example.com", Pass: "secret"})
 
-	if rr.Code != http.StatusOK {
-		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+	if rr.Code != http.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", http.StatusBadGateway, rr.Code)
 	}
+}
 
-	response := decodeJSONResponse(t, rr)
-	if response.Error {
-		t.Fatalf("expected error=false, got true")
+func TestForwardRefreshRequest(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/refresh" {
+			t.Fatalf("expected /refresh path, got %s", r.URL.Path)
+		}
+		if r.Header.Get("X-Forwarded-For") != "203.0.113.7" || r.Header.Get("User-Agent") != "test-browser/1.0" {
+			t.Fatalf("expected the client's address and user agent, got %q and %q", r.Header.Get("X-Forwarded-For"), r.Header.Get("User-Agent"))
+		}
+
+		var body RefreshPayload
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if body.RefreshToken == "inactive" {
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(JsonResponse{Error: true, Code: "account_inactive", Message: "account is inactive"})
+			return
+		}
+		if body.RefreshToken != "good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(JsonResponse{
+			Error: false,
+			Data: map[string]any{
+				"access_token":  "new-access",
+				"refresh_token": "new-refresh",
+			},
+		})
+	}))
+	defer authServer.Close()
+
+	tests := []struct {
+		name           string
+		refreshToken   string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{name: "valid token", refreshToken: "good", expectedStatus: http.StatusOK},
+		{name: "rejected token", refreshToken: "bad", expectedStatus: http.StatusUnauthorized, expectedCode: ""},
+		{name: "inactive account", refreshToken: "inactive", expectedStatus: http.StatusForbidden, expectedCode: "account_inactive"},
 	}
-	if response.Message != "Mail sent" {
-		t.Fatalf("expected mail sent message, got %q", response.Message)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := Config{AuthServiceURL: authServer.URL + "/authenticate"}
+			rr := httptest.NewRecorder()
+			ctx := context.WithValue(context.Background(), clientIPContextKey, "203.0.113.7")
+			ctx = context.WithValue(ctx, userAgentContextKey, "test-browser/1.0")
+
+			app.forwardRefreshRequest(ctx, rr, RefreshPayload{RefreshToken: tt.refreshToken})
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			if tt.expectedStatus != http.StatusOK {
+				if response := decodeJSONResponse(t, rr); !response.Error || response.Code != tt.expectedCode {
+					t.Fatalf("expected an error with code %q, got %+v", tt.expectedCode, response)
+				}
+			}
+
+			if tt.expectedStatus == http.StatusOK {
+				result := decodeAuthResultData(t, rr)
+				if result.AccessToken != "new-access" {
+					t.Fatalf("expected refreshed access token, got %q", result.AccessToken)
+				}
+			}
+		})
 	}
 }
 
-func TestForwardMailRequestBadGatewayOnDownstreamFailure(t *testing.T) {
-	mailServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusInternalServerError)
+func TestForwardAuthRequestUnauthorized(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
 	}))
-	defer mailServer.Close()
+	defer authServer.Close()
 
-	app := Config{MailServiceURL: mailServer.URL}
+	app := Config{AuthServiceURL: authServer.URL}
 	rr := httptest.NewRecorder()
 
-	app.forwardMailRequest(rr, MailPayload{From: "a@b.com", To: "c@d.com", Subject: "s", Message: "m"})
+	app.forwardAuthRequest(context.Background(), rr, AuthPayload{Email: "me@example.com", Pass: "wrong"})
 
-	if rr.Code != http.StatusBadGateway {
-		t.Fatalf("expected status %d, got %d", http.StatusBadGateway, rr.Code)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
 	}
 
 	response := decodeJSONResponse(t, rr)
@@ -160,83 +272,188 @@ func TestForwardMailRequestBadGatewayOnDownstreamFailure(t *testing.T) {
 	}
 }
 
-func TestForwardLogRequestHTTPSuccess(t *testing.T) {
-	logServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusAccepted)
+func TestForwardAuthRequestRelaysLockout(t *testing.T) {
+	var forwardedFor, userAgent string
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor = r.Header.Get("X-Forwarded-For")
+		userAgent = r.Header.Get("User-Agent")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "900")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_ = json.NewEncoder(w).Encode(JsonResponse{Error: true, Code: "account_locked", Message: "too many failed login attempts"})
 	}))
-	defer logServer.Close()
+	defer authServer.Close()
 
-	app := Config{LoggerServiceURL: logServer.URL}
+	app := Config{AuthServiceURL: authServer.URL}
 	rr := httptest.NewRecorder()
+	ctx := context.WithValue(context.Background(), clientIPContextKey, "203.0.113.7")
+	ctx = context.WithValue(ctx, userAgentContextKey, "test-browser/1.0")
 
-	app.forwardLogRequestHTTP(rr, LogPayload{Name: "test", Data: "payload"})
+	app.forwardAuthRequest(ctx, rr, AuthPayload{Email: "me@example.com", Pass: "secret"})
 
-	if rr.Code != http.StatusOK {
-		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+	if forwardedFor != "203.0.113.7" {
+		t.Fatalf("expected X-Forwarded-For 203.0.113.7, got %q", forwardedFor)
+	}
+	if userAgent != "test-browser/1.0" {
+		t.Fatalf("expected User-Agent test-browser/1.0, got %q", userAgent)
+	}
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "900" {
+		t.Fatalf("expected Retry-After 900, got %q", rr.Header().Get("Retry-After"))
 	}
 
 	response := decodeJSONResponse(t, rr)
-	if response.Error {
-		t.Fatalf("expected error=false, got true")
-	}
-	if response.Message != "Logged" {
-		t.Fatalf("expected logged message, got %q", response.Message)
+	if response.Code != "account_locked" {
+		t.Fatalf("expected code account_locked, got %q", response.Code)
 	}
 }
 
-func TestForwardLogRequestHTTPBadGatewayOnDownstreamFailure(t *testing.T) {
-	logServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusInternalServerError)
+func TestRegisterActionRelaysAuthServiceStatus(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/users" {
+			t.Fatalf("expected POST /users, got %s %s", r.Method, r.URL.Path)
+		}
+
+		var body RegisterPayload
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		w.Header().Set("Content-Type", "application/json")
+		if body.Email == "taken@example.com" {
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(JsonResponse{Error: true, Message: "a user with this email already exists"})
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(JsonResponse{Error: false, Message: "Registered user " + body.Email})
 	}))
-	defer logServer.Close()
+	defer authServer.Close()
 
-	app := Config{LoggerServiceURL: logServer.URL}
-	rr := httptest.NewRecorder()
+	tests := []struct {
+		name           string
+		email          string
+		expectedStatus int
+	}{
+		{name: "new account", email: "new@example.com", expectedStatus: http.StatusCreated},
+		{name: "duplicate email", email: "taken@example.com", expectedStatus: http.StatusConflict},
+	}
 
-	app.forwardLogRequestHTTP(rr, LogPayload{Name: "test", Data: "payload"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := Config{AuthServiceURL: authServer.URL + "/authenticate"}
 
-	if rr.Code != http.StatusBadGateway {
-		t.Fatalf("expected status %d, got %d", http.StatusBadGateway, rr.Code)
+			body := `{"action":"register","register":{"email":"` + tt.email + `","password":"long-enough"}}`
+			req := httptest.NewRequest(http.MethodPost, "/handle", bytes.NewBufferString(body))
+			rr := httptest.NewRecorder()
+
+			app.handleSubmission(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+		})
 	}
+}
 
-	response := decodeJSONResponse(t, rr)
-	if !response.Error {
-		t.Fatalf("expected error=true, got false")
+func TestForwardUserRequest(t *testing.T) {
+	var seenMethod, seenPath, seenAuthorization string
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenMethod, seenPath, seenAuthorization = r.Method, r.URL.RequestURI(), r.Header.Get("Authorization")
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(JsonResponse{Error: false, Message: "ok"})
+	}))
+	defer authServer.Close()
+
+	tests := []struct {
+		name           string
+		operation      string
+		sessionID      string
+		query          map[string]string
+		expectedMethod string
+		expectedPath   string
+		expectedStatus int
+	}{
+		{name: "get", operation: "get", expectedMethod: http.MethodGet, expectedPath: "/users/42", expectedStatus: http.StatusOK},
+		{name: "update", operation: "update", expectedMethod: http.MethodPut, expectedPath: "/users/42", expectedStatus: http.StatusOK},
+		{name: "deactivate", operation: "deactivate", expectedMethod: http.MethodDelete, expectedPath: "/users/42", expectedStatus: http.StatusOK},
+		{name: "list", operation: "list", expectedMethod: http.MethodGet, expectedPath: "/users", expectedStatus: http.StatusOK},
+		{name: "list a page", operation: "list", query: map[string]string{"sort": "-email", "cursor": "a+b"}, expectedMethod: http.MethodGet, expectedPath: "/users?cursor=a%2Bb&sort=-email", expectedStatus: http.StatusOK},
+		{name: "sessions", operation: "sessions", expectedMethod: http.MethodGet, expectedPath: "/sessions", expectedStatus: http.StatusOK},
+		{name: "revoke session", operation: "revoke_session", sessionID: "abc123", expectedMethod: http.MethodDelete, expectedPath: "/sessions/abc123", expectedStatus: http.StatusOK},
+		{name: "revoke session without id", operation: "revoke_session", expectedStatus: http.StatusBadRequest},
+		{name: "revoke all sessions", operation: "revoke_all_sessions", expectedMethod: http.MethodDelete, expectedPath: "/sessions", expectedStatus: http.StatusOK},
+		{name: "unknown operation", operation: "explode", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seenMethod, seenPath, seenAuthorization = "", "", ""
+
+			app := Config{AuthServiceURL: authServer.URL + "/authenticate"}
+			rr := httptest.NewRecorder()
+			ctx := context.WithValue(context.Background(), userIDContextKey, 42)
+			ctx = context.WithValue(ctx, accessTokenContextKey, "good-token")
+			ctx = context.WithValue(ctx, identityContextKey, TokenIdentity{UserID: 42, Permissions: []string{"users:list"}})
+
+			app.forwardUserRequest(ctx, rr, UserPayload{Operation: tt.operation, FirstName: "New", SessionID: tt.sessionID, Query: tt.query})
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			if tt.expectedMethod == "" {
+				return
+			}
+			if seenMethod != tt.expectedMethod || seenPath != tt.expectedPath {
+				t.Fatalf("expected %s %s, got %s %s", tt.expectedMethod, tt.expectedPath, seenMethod, seenPath)
+			}
+			if seenAuthorization != "Bearer good-token" {
+				t.Fatalf("expected caller token to be forwarded, got %q", seenAuthorization)
+			}
+		})
 	}
 }
 
-func TestLogViaRPC(t *testing.T) {
-	address, cleanup := startTestRPCServer(t)
-	defer cleanup()
+func TestForwardMailRequestSuccess(t *testing.T) {
+	mailServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer mailServer.Close()
 
-	app := Config{LoggerRPCAddr: address}
+	app := Config{MailServiceURL: mailServer.URL}
 	rr := httptest.NewRecorder()
 
-	app.logViaRPC(rr, LogPayload{Name: "rpc-test", Data: "payload"})
+	app.forwardMailRequest(context.Background(), rr, MailPayload{From: "a@b.com", To: "c@d.com", Subject: "s", Message: "m"})
 
-	if rr.Code != http.StatusAccepted {
-		t.Fatalf("expected status %d, got %d", http.StatusAccepted, rr.Code)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
 	}
 
 	response := decodeJSONResponse(t, rr)
 	if response.Error {
 		t.Fatalf("expected error=false, got true")
 	}
-	if response.Message == "" {
-		t.Fatalf("expected a success message from RPC call")
+	if response.Message != "Mail sent" {
+		t.Fatalf("expected mail sent message, got %q", response.Message)
 	}
 }
 
-func TestLogViaGRPCRejectsInvalidJSON(t *testing.T) {
-	app := Config{}
+func TestForwardMailRequestBadGatewayOnDownstreamFailure(t *testing.T) {
+	mailServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer mailServer.Close()
 
-	req := httptest.NewRequest(http.MethodPost, "/log-grpc", bytes.NewBufferString("{"))
+	app := Config{MailServiceURL: mailServer.URL}
 	rr := httptest.NewRecorder()
 
-	app.logViaGRPC(rr, req)
+	app.forwardMailRequest(context.Background(), rr, MailPayload{From: "a@b.com", To: "c@d.com", Subject: "s", Message: "m"})
 
-	if rr.Code != http.StatusBadRequest {
-		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+	if rr.Code != http.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", http.StatusBadGateway, rr.Code)
 	}
 
 	response := decodeJSONResponse(t, rr)
@@ -245,50 +462,28 @@ func TestLogViaGRPCRejectsInvalidJSON(t *testing.T) {
 	}
 }
 
-func TestLogViaGRPC(t *testing.T) {
-	address, cleanup := startTestGRPCServer(t)
-	defer cleanup()
-
-	app := Config{LoggerGRPCAddr: address}
-
-	body, err := json.Marshal(RequestPayload{
-		Action: "log",
-		Log: LogPayload{
-			Name: "grpc-test",
-			Data: "payload",
-		},
-	})
-	if err != nil {
-		t.Fatalf("failed to marshal request body: %v", err)
-	}
-
-	req := httptest.NewRequest(http.MethodPost, "/log-grpc", bytes.NewBuffer(body))
-	rr := httptest.NewRecorder()
-
-	app.logViaGRPC(rr, req)
+func decodeJSONResponse(t *testing.T, rr *httptest.ResponseRecorder) JsonResponse {
+	t.Helper()
 
-	if rr.Code != http.StatusAccepted {
-		t.Fatalf("expected status %d, got %d", http.StatusAccepted, rr.Code)
+	var response JsonResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
 	}
 
-	response := decodeJSONResponse(t, rr)
-	if response.Error {
-		t.Fatalf("expected error=false, got true")
-	}
-	if response.Message != "Logged via GRPC" {
-		t.Fatalf("expected grpc success message, got %q", response.Message)
-	}
+	return response
 }
 
-func decodeJSONResponse(t *testing.T, rr *httptest.ResponseRecorder) JsonResponse {
+func decodeAuthResultData(t *testing.T, rr *httptest.ResponseRecorder) AuthResult {
 	t.Helper()
 
-	var response JsonResponse
+	var response struct {
+		Data AuthResult `json:"data"`
+	}
 	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
 		t.Fatalf("failed to decode JSON response: %v", err)
 	}
 
-	return response
+	return response.Data
 }
 
 type rpcTestServer struct{}
@@ -298,7 +493,7 @@ func (rpcTestServer) LogInfo(payload RPCPayload, result *string) error {
 	return nil
 }
 
-func startTestRPCServer(t *testing.T) (string, func()) {
+func startTestRPCServer(t testing.TB) (string, func()) {
 	t.Helper()
 
 	testServer := rpc.NewServer()
@@ -344,7 +539,7 @@ func (grpcTestLogServer) Write(ctx context.Context, req *logs.LogRequest) (*logs
 	return &logs.LogResponse{Result: "success"}, nil
 }
 
-func startTestGRPCServer(t *testing.T) (string, func()) {
+func startTestGRPCServer(t testing.TB) (string, func()) {
 	t.Helper()
 
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
@@ -366,3 +561,24 @@ func startTestGRPCServer(t *testing.T) (string, func()) {
 
 	return listener.Addr().String(), cleanup
 }
+
+func TestRelayToAuthServiceForwardsClientHeaders(t *testing.T) {
+	var forwardedFor, userAgent string
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor = r.Header.Get("X-Forwarded-For")
+		userAgent = r.Header.Get("User-Agent")
+		_ = json.NewEncoder(w).Encode(JsonResponse{Message: "Sessions"})
+	}))
+	defer authServer.Close()
+
+	app := Config{AuthServiceURL: authServer.URL + "/authenticate"}
+	rr := httptest.NewRecorder()
+	ctx := context.WithValue(context.Background(), clientIPContextKey, "203.0.113.7")
+	ctx = context.WithValue(ctx, userAgentContextKey, "test-browser/1.0")
+
+	app.relayToAuthService(ctx, rr, http.MethodGet, "/sessions", nil)
+
+	if rr.Code != http.StatusOK || forwardedFor != "203.0.113.7" || userAgent != "test-browser/1.0" {
+		t.Fatalf("expected the client's address and user agent to be forwarded, got %d with %q and %q", rr.Code, forwardedFor, userAgent)
+	}
+}
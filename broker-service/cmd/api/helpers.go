@@ -6,10 +6,13 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type JsonResponse struct {
 	Error   bool   `json:"error"`
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message"`
 	Data    any    `json:"data,omitempty"`
 }
@@ -66,5 +69,11 @@ func (app *Config) writeErrorJSON(w http.ResponseWriter, err error, status ...in
 	payload.Error = true
 	payload.Message = err.Error()
 
+	// tell clients refused by an open circuit when to try again
+	var unavailable *unavailableError
+	if errors.As(err, &unavailable) && unavailable.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(unavailable.RetryAfter.Round(time.Second).Seconds())))
+	}
+
 	return app.writeJSON(w, statusCode, payload)
 }
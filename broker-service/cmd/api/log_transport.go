@@ -0,0 +1,258 @@
+// Package main delivers log entries to logger-service over a configurable, ordered list of transports.
+package main
+
+import (
+	"broker/event"
+	"broker/logs"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// defaultLogTransport is used when LOG_TRANSPORT is not set.
+const defaultLogTransport = transportRPC
+
+// logGRPCTimeout bounds each log call to logger-service over gRPC.
+const logGRPCTimeout = 3 * time.Second
+
+var errRabbitMQUnavailable = errors.New("not connected to RabbitMQ")
+
+// logPublisher publishes an event to RabbitMQ with a routing key; it is
+// satisfied by *event.Emitter.
+type logPublisher interface {
+	Publish(ctx context.Context, event string, severity string) error
+}
+
+// logSender delivers entry to logger-service and returns its reply.
+type logSender func(app *Config, ctx context.Context, entry LogPayload) (string, error)
+
+// logSenders holds the sender for every transport the log action can use.
+var logSenders = map[string]logSender{
+	transportHTTP: (*Config).logViaHTTP,
+	transportRPC:  (*Config).logViaRPC,
+	transportGRPC: (*Config).logViaGRPC,
+	transportAMQP: (*Config).logViaRabbitMQ,
+}
+
+// logTransports lists the log transports in the order they are documented.
+var logTransports = []string{transportHTTP, transportRPC, transportGRPC, transportAMQP}
+
+// RPCPayload is the argument of logger-service's RPCServer.LogInfo.
+type RPCPayload struct {
+	Name   string
+	Data   string
+	UserID int
+}
+
+// logResult reports which transport delivered an entry.
+type logResult struct {
+	Transport string `json:"transport"`
+	Result    string `json:"result,omitempty"`
+}
+
+// parseLogTransports parses a comma-separated list of log transports, to
+// be tried in order, as in "grpc,amqp".
+func parseLogTransports(value string) ([]string, error) {
+	var transports []string
+	for transport := range strings.SplitSeq(value, ",") {
+		transport = strings.ToLower(strings.TrimSpace(transport))
+		if _, ok := logSenders[transport]; !ok {
+			return nil, fmt.Errorf("unknown log transport %q; use %s", transport, strings.Join(logTransports, ", "))
+		}
+		if slices.Contains(transports, transport) {
+			return nil, fmt.Errorf("log transport %q is listed twice", transport)
+		}
+		transports = append(transports, transport)
+	}
+
+	return transports, nil
+}
+
+// validateLogPayload checks a per-request transport override.
+func validateLogPayload(payload LogPayload) error {
+	if payload.Transport == "" {
+		return nil
+	}
+
+	_, err := parseLogTransports(payload.Transport)
+	return err
+}
+
+// writeLog delivers entry over the first transport that accepts it, trying
+// the entry's own transports, if any, and otherwise the configured ones. The
+// reply names the transport used; when every one fails it lists why.
+func (app *Config) writeLog(ctx context.Context, w http.ResponseWriter, entry LogPayload) {
+	transports := app.LogTransports
+	if entry.Transport != "" {
+		transports, _ = parseLogTransports(entry.Transport)
+	}
+	if len(transports) == 0 {
+		transports = []string{defaultLogTransport}
+	}
+
+	var failures []string
+	for i, transport := range transports {
+		// each transport left to try gets an even share of the budget
+		hopCtx, cancel := hopContext(ctx, len(transports)-i)
+		result, err := logSenders[transport](app, hopCtx, entry)
+		cancel()
+		if err != nil {
+			log.Printf("Logging via %s failed: %v", transport, err)
+			failures = append(failures, transport+": "+err.Error())
+			continue
+		}
+
+		payload := JsonResponse{
+			Error:   false,
+			Message: "Logged via " + transport,
+			Data:    logResult{Transport: transport, Result: result},
+		}
+
+		_ = app.writeJSON(w, http.StatusAccepted, payload)
+		return
+	}
+
+	_ = app.writeErrorJSON(w, fmt.Errorf("logger-service is unavailable (%s)", strings.Join(failures, "; ")), http.StatusBadGateway)
+}
+
+// handleLogGRPC serves /log-grpc, which predates per-request transports, as
+// a log action sent over gRPC.
+func (app *Config) handleLogGRPC(w http.ResponseWriter, r *http.Request) {
+	var requestPayload RequestPayload
+
+	err := app.decodeJSON(w, r, &requestPayload)
+	if err != nil {
+		_ = app.writeErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var entry LogPayload
+	if len(requestPayload.Payload) > 0 {
+		if err := json.Unmarshal(requestPayload.Payload, &entry); err != nil {
+			_ = app.writeErrorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	entry.Transport = transportGRPC
+
+	app.writeLog(r.Context(), w, entry)
+}
+
+func (app *Config) logViaHTTP(ctx context.Context, entry LogPayload) (string, error) {
+	jsonData, err := json.Marshal(LogPayload{Name: entry.Name, Data: entry.Data})
+	if err != nil {
+		return "", err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, app.LoggerServiceURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	setCallerHeader(ctx, request)
+	response, err := app.doHTTP(dependencyLoggerHTTP, request, noRetries)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		return "", fmt.Errorf("log service returned status %d", response.StatusCode)
+	}
+
+	return "", nil
+}
+
+func (app *Config) logViaRPC(ctx context.Context, entry LogPayload) (string, error) {
+	if app.LoggerRPC == nil {
+		return "", errLoggerNotConnected
+	}
+
+	var rpcPayload RPCPayload
+	rpcPayload.Name = entry.Name
+	rpcPayload.Data = entry.Data
+	rpcPayload.UserID, _ = userIDFromContext(ctx)
+
+	var result string
+	err := app.breaker(dependencyLoggerRPC).call(ctx, noRetries, func() error {
+		return app.LoggerRPC.Call(ctx, "RPCServer.LogInfo", rpcPayload, &result)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return result, nil
+}
+
+func (app *Config) logViaGRPC(ctx context.Context, entry LogPayload) (string, error) {
+	if app.LoggerGRPC == nil {
+		return "", errLoggerNotConnected
+	}
+
+	var res *logs.LogResponse
+	err := app.breaker(dependencyLoggerGRPC).call(ctx, noRetries, func() error {
+		// the first call also waits for the shared connection to be established
+		callCtx, cancel := context.WithTimeout(ctx, logGRPCTimeout)
+		defer cancel()
+
+		if userID, ok := userIDFromContext(ctx); ok {
+			callCtx = metadata.AppendToOutgoingContext(callCtx, strings.ToLower(userIDHeader), strconv.Itoa(userID))
+		}
+
+		var err error
+		res, err = app.LoggerGRPC.Write(callCtx, &logs.LogRequest{
+			LogEntry: &logs.Log{
+				Name: entry.Name,
+				Data: entry.Data,
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return res.GetResult(), nil
+}
+
+// logViaRabbitMQ publishes entry for listener-service, which forwards it to
+// logger-service; the reply only confirms that RabbitMQ took it.
+func (app *Config) logViaRabbitMQ(ctx context.Context, entry LogPayload) (string, error) {
+	publisher := app.LogPublisher
+	if publisher == nil {
+		if app.Rabbit == nil {
+			return "", errRabbitMQUnavailable
+		}
+
+		emitter, err := event.NewEmitter(app.Rabbit)
+		if err != nil {
+			return "", err
+		}
+		publisher = &emitter
+	}
+
+	jsonData, err := json.Marshal(LogPayload{Name: entry.Name, Data: entry.Data})
+	if err != nil {
+		return "", err
+	}
+
+	err = app.breaker(dependencyRabbitMQ).call(ctx, noRetries, func() error {
+		return publisher.Publish(ctx, string(jsonData), "log.INFO")
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return "", nil
+}
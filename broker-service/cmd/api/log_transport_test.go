@@ -0,0 +1,305 @@
+// Package main verifies log delivery over each transport and the fallback between them.
+package main
+
+import (
+	"broker/logs"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakePublisher records what the amqp transport publishes.
+type fakePublisher struct {
+	published []string
+	err       error
+}
+
+func (publisher *fakePublisher) Publish(ctx context.Context, event string, severity string) error {
+	if publisher.err != nil {
+		return publisher.err
+	}
+	publisher.published = append(publisher.published, severity+" "+event)
+
+	return nil
+}
+
+// newLogTestApp returns an app whose every log transport reaches an
+// in-process fake, and the fake publisher behind amqp.
+func newLogTestApp(t *testing.T) (*Config, *fakePublisher) {
+	t.Helper()
+
+	logServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entry map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil || entry["transport"] != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(logServer.Close)
+
+	rpcAddr, stopRPC := startTestRPCServer(t)
+	t.Cleanup(stopRPC)
+	grpcAddr, stopGRPC := startTestGRPCServer(t)
+	t.Cleanup(stopGRPC)
+
+	publisher := &fakePublisher{}
+	app := &Config{
+		LoggerServiceURL: logServer.URL,
+		LoggerRPCAddr:    rpcAddr,
+		LoggerGRPCAddr:   grpcAddr,
+		LogPublisher:     publisher,
+	}
+	connectTestLogger(t, app)
+
+	return app, publisher
+}
+
+// connectTestLogger gives app shared connections to its logger addresses,
+// closed when the test ends.
+func connectTestLogger(t testing.TB, app *Config) {
+	t.Helper()
+
+	conn, err := newGRPCClientConn(app.LoggerGRPCAddr)
+	if err != nil {
+		t.Fatalf("failed to create gRPC client: %v", err)
+	}
+	pool := newRPCPool(app.LoggerRPCAddr, 2)
+	t.Cleanup(func() {
+		_ = conn.Close()
+		_ = pool.Close()
+	})
+
+	app.LoggerRPC = pool
+	app.LoggerGRPC = logs.NewLogServiceClient(conn)
+}
+
+func decodeLogResult(t *testing.T, rr *httptest.ResponseRecorder) logResult {
+	t.Helper()
+
+	var response struct {
+		Data logResult `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+
+	return response.Data
+}
+
+func TestWriteLogOverEachTransport(t *testing.T) {
+	tests := []struct {
+		transport      string
+		expectedResult string
+	}{
+		{transport: transportHTTP},
+		{transport: transportRPC, expectedResult: "Processed payload via RPC: event"},
+		{transport: transportGRPC, expectedResult: "success"},
+		{transport: transportAMQP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.transport, func(t *testing.T) {
+			app, publisher := newLogTestApp(t)
+			app.LogTransports = []string{tt.transport}
+			rr := httptest.NewRecorder()
+
+			app.writeLog(context.Background(), rr, LogPayload{Name: "event", Data: "payload"})
+
+			if rr.Code != http.StatusAccepted {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rr.Code, rr.Body.String())
+			}
+			result := decodeLogResult(t, rr)
+			if result.Transport != tt.transport || result.Result != tt.expectedResult {
+				t.Fatalf("expected %s to deliver %q, got %+v", tt.transport, tt.expectedResult, result)
+			}
+			if message := decodeJSONResponse(t, rr).Message; message != "Logged via "+tt.transport {
+				t.Fatalf("expected the transport in the message, got %q", message)
+			}
+			if tt.transport == transportAMQP && (len(publisher.published) != 1 || publisher.published[0] != `log.INFO {"name":"event","data":"payload"}`) {
+				t.Fatalf("expected one entry on the log exchange, got %v", publisher.published)
+			}
+		})
+	}
+}
+
+func TestWriteLogFallsBack(t *testing.T) {
+	tests := []struct {
+		name              string
+		configured        []string
+		override          string
+		breakTransports   []string
+		expectedStatus    int
+		expectedTransport string
+	}{
+		{name: "first transport works", configured: []string{transportGRPC, transportAMQP}, expectedStatus: http.StatusAccepted, expectedTransport: transportGRPC},
+		{name: "grpc down falls back to the queue", configured: []string{transportGRPC, transportAMQP}, breakTransports: []string{transportGRPC}, expectedStatus: http.StatusAccepted, expectedTransport: transportAMQP},
+		{name: "every transport down", configured: []string{transportGRPC, transportAMQP}, breakTransports: []string{transportGRPC, transportAMQP}, expectedStatus: http.StatusBadGateway},
+		{name: "request overrides the configuration", configured: []string{transportGRPC}, override: "http", expectedStatus: http.StatusAccepted, expectedTransport: transportHTTP},
+		{name: "override has its own fallback", configured: []string{transportAMQP}, override: "rpc, http", breakTransports: []string{transportRPC}, expectedStatus: http.StatusAccepted, expectedTransport: transportHTTP},
+		{name: "default is rpc", expectedStatus: http.StatusAccepted, expectedTransport: transportRPC},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, publisher := newLogTestApp(t)
+			app.LogTransports = tt.configured
+			for _, broken := range tt.breakTransports {
+				switch broken {
+				case transportGRPC:
+					app.LoggerGRPCAddr = "127.0.0.1:1"
+				case transportRPC:
+					app.LoggerRPCAddr = "127.0.0.1:1"
+				case transportAMQP:
+					publisher.err = errors.New("channel closed")
+				}
+			}
+			connectTestLogger(t, app)
+			rr := httptest.NewRecorder()
+
+			app.writeLog(context.Background(), rr, LogPayload{Name: "event", Data: "payload", Transport: tt.override})
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectedStatus != http.StatusAccepted {
+				message := decodeJSONResponse(t, rr).Message
+				if !strings.Contains(message, "grpc: ") || !strings.Contains(message, "amqp: channel closed") {
+					t.Fatalf("expected every failure to be listed, got %q", message)
+				}
+				return
+			}
+			if result := decodeLogResult(t, rr); result.Transport != tt.expectedTransport {
+				t.Fatalf("expected delivery via %s, got %+v", tt.expectedTransport, result)
+			}
+		})
+	}
+}
+
+func TestWriteLogWithoutRabbitMQ(t *testing.T) {
+	app := Config{LogTransports: []string{transportAMQP}}
+	rr := httptest.NewRecorder()
+
+	app.writeLog(context.Background(), rr, LogPayload{Name: "event"})
+
+	if rr.Code != http.StatusBadGateway || !strings.Contains(decodeJSONResponse(t, rr).Message, errRabbitMQUnavailable.Error()) {
+		t.Fatalf("expected amqp to fail without RabbitMQ, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	app.LogTransports = []string{transportRPC, transportGRPC}
+	rr = httptest.NewRecorder()
+	app.writeLog(context.Background(), rr, LogPayload{Name: "event"})
+
+	if rr.Code != http.StatusBadGateway || strings.Count(decodeJSONResponse(t, rr).Message, errLoggerNotConnected.Error()) != 2 {
+		t.Fatalf("expected rpc and grpc to fail without clients, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestParseLogTransports(t *testing.T) {
+	tests := []struct {
+		value         string
+		expected      string
+		expectedError bool
+	}{
+		{value: "rpc", expected: "rpc"},
+		{value: "GRPC, amqp", expected: "grpc,amqp"},
+		{value: "http,rpc,grpc,amqp", expected: "http,rpc,grpc,amqp"},
+		{value: "", expectedError: true},
+		{value: "smtp", expectedError: true},
+		{value: "grpc,,amqp", expectedError: true},
+		{value: "grpc,grpc", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			transports, err := parseLogTransports(tt.value)
+			if tt.expectedError {
+				if err == nil {
+					t.Fatalf("expected %q to be rejected, got %v", tt.value, transports)
+				}
+				return
+			}
+			if err != nil || strings.Join(transports, ",") != tt.expected {
+				t.Fatalf("expected %s, got %v, %v", tt.expected, transports, err)
+			}
+		})
+	}
+}
+
+func TestLogActionTransports(t *testing.T) {
+	for _, transport := range actions["log"].Transports {
+		if _, ok := logSenders[transport]; !ok {
+			t.Fatalf("log action lists %s, which has no sender", transport)
+		}
+	}
+	if len(actions["log"].Transports) != len(logSenders) {
+		t.Fatalf("expected the log action to list every sender, got %v", actions["log"].Transports)
+	}
+
+	authServer := newTestAuthServer(t)
+	app, _ := newLogTestApp(t)
+	app.AuthServiceURL = authServer.URL + "/authenticate"
+
+	tests := []struct {
+		name              string
+		body              string
+		expectedStatus    int
+		expectedTransport string
+	}{
+		{name: "configured transport", body: `{"action":"log","log":{"name":"event"}}`, expectedStatus: http.StatusAccepted, expectedTransport: transportRPC},
+		{name: "override", body: `{"action":"log","log":{"name":"event","transport":"amqp"}}`, expectedStatus: http.StatusAccepted, expectedTransport: transportAMQP},
+		{name: "unknown override", body: `{"action":"log","log":{"name":"event","transport":"carrier-pigeon"}}`, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/handle", bytes.NewBufferString(tt.body))
+			req.Header.Set("Authorization", "Bearer good-token")
+			rr := httptest.NewRecorder()
+
+			app.routes().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectedTransport != "" && decodeLogResult(t, rr).Transport != tt.expectedTransport {
+				t.Fatalf("expected delivery via %s, got %s", tt.expectedTransport, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleLogGRPC(t *testing.T) {
+	app, _ := newLogTestApp(t)
+	app.LogTransports = []string{transportRPC}
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{name: "always uses grpc", body: `{"action":"log","log":{"name":"grpc-test","data":"payload"}}`, expectedStatus: http.StatusAccepted},
+		{name: "invalid JSON", body: "{", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/log-grpc", bytes.NewBufferString(tt.body))
+			rr := httptest.NewRecorder()
+
+			app.handleLogGRPC(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectedStatus == http.StatusAccepted && decodeLogResult(t, rr).Transport != transportGRPC {
+				t.Fatalf("expected delivery via grpc, got %s", rr.Body.String())
+			}
+		})
+	}
+}
@@ -2,10 +2,14 @@
 package main
 
 import (
+	"broker/auth"
+	"broker/event"
+	"broker/logs"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -22,6 +26,24 @@ type Config struct {
 	LoggerServiceURL string
 	LoggerRPCAddr    string
 	LoggerGRPCAddr   string
+	// LoggerRPC and LoggerGRPC are the shared connections to logger-service
+	// at LoggerRPCAddr and LoggerGRPCAddr; see connectLogger.
+	LoggerRPC  *rpcPool
+	LoggerGRPC logs.LogServiceClient
+	// LogTransports are tried in order for each log entry.
+	LogTransports []string
+	// LogPublisher publishes log entries sent over amqp; without one they
+	// are published on Rabbit.
+	LogPublisher logPublisher
+	// RequestTimeout is the budget for each request, shared by its
+	// downstream calls.
+	RequestTimeout time.Duration
+	// Breakers guard each downstream dependency; without them calls are
+	// only retried.
+	Breakers breakerRegistry
+	// AuthGRPC, when set, carries logins and token checks to
+	// authentication-service over gRPC instead of HTTP.
+	AuthGRPC auth.AuthServiceClient
 }
 
 func main() {
@@ -41,6 +63,50 @@ func main() {
 		LoggerGRPCAddr:   getenv("LOGGER_GRPC_ADDR", "logger-service:50001"),
 	}
 
+	app.RequestTimeout, err = time.ParseDuration(getenv("REQUEST_TIMEOUT", defaultRequestTimeout.String()))
+	if err != nil || app.RequestTimeout <= 0 {
+		log.Fatalf("REQUEST_TIMEOUT must be a positive duration such as 10s, got %q", os.Getenv("REQUEST_TIMEOUT"))
+	}
+
+	threshold, err := strconv.Atoi(getenv("BREAKER_THRESHOLD", strconv.Itoa(defaultBreakerThreshold)))
+	if err != nil || threshold < 1 {
+		log.Fatalf("BREAKER_THRESHOLD must be a positive number, got %q", os.Getenv("BREAKER_THRESHOLD"))
+	}
+	cooldown, err := time.ParseDuration(getenv("BREAKER_COOLDOWN", defaultBreakerCooldown.String()))
+	if err != nil || cooldown <= 0 {
+		log.Fatalf("BREAKER_COOLDOWN must be a positive duration such as 30s, got %q", os.Getenv("BREAKER_COOLDOWN"))
+	}
+	app.Breakers = newBreakerRegistry(threshold, cooldown)
+
+	poolSize, err := strconv.Atoi(getenv("LOGGER_RPC_POOL_SIZE", strconv.Itoa(defaultRPCPoolSize)))
+	if err != nil || poolSize < 1 {
+		log.Fatalf("LOGGER_RPC_POOL_SIZE must be a positive number, got %q", os.Getenv("LOGGER_RPC_POOL_SIZE"))
+	}
+	if err = app.connectLogger(poolSize); err != nil {
+		log.Fatal("Could not create the logger-service clients. Exiting...", err)
+	}
+
+	app.LogTransports, err = parseLogTransports(getenv("LOG_TRANSPORT", defaultLogTransport))
+	if err != nil {
+		log.Fatal("LOG_TRANSPORT is invalid. Exiting...", err)
+	}
+	if emitter, err := event.NewEmitter(rabbitmqConn); err != nil {
+		log.Println("Could not set up the RabbitMQ log exchange:", err)
+	} else {
+		app.LogPublisher = &emitter
+	}
+
+	switch transport := getenv("AUTH_TRANSPORT", authTransportHTTP); transport {
+	case authTransportHTTP:
+	case authTransportGRPC:
+		app.AuthGRPC, err = newAuthGRPCClient(getenv("AUTH_GRPC_ADDR", "authentication-service:50001"))
+		if err != nil {
+			log.Fatal("Could not create the auth gRPC client. Exiting...", err)
+		}
+	default:
+		log.Fatalf("AUTH_TRANSPORT must be %s or %s, got %q", authTransportHTTP, authTransportGRPC, transport)
+	}
+
 	log.Printf("Starting broker service on port %s\n", httpPort)
 
 	// define HTTP server
@@ -55,6 +121,21 @@ func main() {
 	}
 }
 
+// connectLogger creates the connections to logger-service that every log
+// entry sent over rpc or grpc shares: a pool of poolSize net/rpc
+// connections and one gRPC connection. Both connect on first use.
+func (app *Config) connectLogger(poolSize int) error {
+	conn, err := newGRPCClientConn(app.LoggerGRPCAddr)
+	if err != nil {
+		return err
+	}
+
+	app.LoggerRPC = newRPCPool(app.LoggerRPCAddr, poolSize)
+	app.LoggerGRPC = logs.NewLogServiceClient(conn)
+
+	return nil
+}
+
 func connectToRabbitMQ() (*amqp.Connection, error) {
 	var attempts int64
 	backoff := 1 * time.Second
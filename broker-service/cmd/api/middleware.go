@@ -0,0 +1,334 @@
+// Package main contains broker middleware that verifies caller identity.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type contextKey string
+
+const (
+	userIDContextKey      contextKey = "userID"
+	accessTokenContextKey contextKey = "accessToken"
+	clientIPContextKey    contextKey = "clientIP"
+	userAgentContextKey   contextKey = "userAgent"
+	identityContextKey    contextKey = "identity"
+	apiKeyContextKey      contextKey = "apiKey"
+)
+
+const (
+	// userIDHeader carries the verified caller to downstream HTTP services.
+	userIDHeader = "X-User-ID"
+	// apiKeyHeader identifies a service calling without a user.
+	apiKeyHeader = "X-API-Key"
+)
+
+var (
+	errAuthenticationRequired = errors.New("authentication required")
+	errPermissionDenied       = errors.New("permission denied")
+	errAPIKeyNotAllowed       = errors.New("api keys cannot use this action")
+)
+
+// TokenIdentity is the verified caller returned by authentication-service.
+type TokenIdentity struct {
+	UserID      int      `json:"user_id"`
+	Email       string   `json:"email"`
+	ExpiresAt   int64    `json:"expires_at"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// HasPermission reports whether the caller's token grants permission.
+func (identity TokenIdentity) HasPermission(permission string) bool {
+	return slices.Contains(identity.Permissions, permission)
+}
+
+// APIKeyIdentity is a verified service caller returned by authentication-service.
+type APIKeyIdentity struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// HasScope reports whether the API key grants scope.
+func (identity APIKeyIdentity) HasScope(scope string) bool {
+	return slices.Contains(identity.Scopes, scope)
+}
+
+// authenticateRequest verifies a bearer token or an API key when one is
+// supplied and stores the caller in the request context. Requests with neither
+// pass through anonymously; requests with invalid credentials are rejected.
+// The client address and user agent are always recorded so auth-service can
+// throttle by IP and label the sessions it starts.
+func (app *Config) authenticateRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPContextKey, remoteHost(r))
+		ctx = context.WithValue(ctx, userAgentContextKey, r.UserAgent())
+		r = r.WithContext(ctx)
+
+		header := r.Header.Get("Authorization")
+		key := strings.TrimSpace(r.Header.Get(apiKeyHeader))
+		if header != "" && key != "" {
+			_ = app.writeErrorJSON(w, errors.New("send either a bearer token or an api key, not both"), http.StatusBadRequest)
+			return
+		}
+
+		if key != "" {
+			identity, status, err := app.verifyAPIKey(ctx, key)
+			if err != nil {
+				_ = app.writeErrorJSON(w, err, status)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, apiKeyContextKey, identity)))
+			return
+		}
+
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scheme, token, found := strings.Cut(header, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+			_ = app.writeErrorJSON(w, errors.New("malformed authorization header"), http.StatusUnauthorized)
+			return
+		}
+
+		identity, status, err := app.verifyToken(ctx, strings.TrimSpace(token))
+		if err != nil {
+			_ = app.writeErrorJSON(w, err, status)
+			return
+		}
+
+		ctx = context.WithValue(ctx, userIDContextKey, identity.UserID)
+		ctx = context.WithValue(ctx, identityContextKey, identity)
+		ctx = context.WithValue(ctx, accessTokenContextKey, strings.TrimSpace(token))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireAuthentication rejects requests that authenticateRequest did not verify.
+func (app *Config) requireAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := userIDFromContext(r.Context()); !ok {
+			_ = app.writeErrorJSON(w, errAuthenticationRequired, http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requirePermission rejects callers whose token does not grant permission.
+func (app *Config) requirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if status, err := checkPermission(r.Context(), permission); err != nil {
+				_ = app.writeErrorJSON(w, err, status)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// verifyToken asks authentication-service whether token is a valid access token.
+func (app *Config) verifyToken(ctx context.Context, token string) (TokenIdentity, int, error) {
+	// the action still needs its share of the request budget
+	ctx, cancel := hopContext(ctx, credentialCheckHops)
+	defer cancel()
+
+	if app.AuthGRPC != nil {
+		return app.verifyTokenViaGRPC(ctx, token)
+	}
+
+	validateURL, err := app.authServiceEndpoint("/validate")
+	if err != nil {
+		return TokenIdentity{}, http.StatusInternalServerError, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, validateURL, nil)
+	if err != nil {
+		return TokenIdentity{}, http.StatusInternalServerError, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	response, err := app.doHTTP(dependencyAuth, request, idempotentRetries)
+	if err != nil {
+		return TokenIdentity{}, downstreamStatus(err), err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return TokenIdentity{}, http.StatusUnauthorized, errors.New("invalid or expired token")
+	}
+	if response.StatusCode != http.StatusOK {
+		return TokenIdentity{}, http.StatusBadGateway, errors.New("error calling auth service")
+	}
+
+	var jsonFromService struct {
+		Error   bool          `json:"error"`
+		Message string        `json:"message"`
+		Data    TokenIdentity `json:"data"`
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+	if err != nil {
+		return TokenIdentity{}, http.StatusBadGateway, err
+	}
+	if jsonFromService.Error || jsonFromService.Data.UserID == 0 {
+		return TokenIdentity{}, http.StatusUnauthorized, errors.New("invalid or expired token")
+	}
+
+	return jsonFromService.Data, http.StatusOK, nil
+}
+
+// verifyAPIKey asks authentication-service whether key is an active API key.
+func (app *Config) verifyAPIKey(ctx context.Context, key string) (APIKeyIdentity, int, error) {
+	ctx, cancel := hopContext(ctx, credentialCheckHops)
+	defer cancel()
+
+	validateURL, err := app.authServiceEndpoint("/api-keys/validate")
+	if err != nil {
+		return APIKeyIdentity{}, http.StatusInternalServerError, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, validateURL, nil)
+	if err != nil {
+		return APIKeyIdentity{}, http.StatusInternalServerError, err
+	}
+	request.Header.Set(apiKeyHeader, key)
+
+	response, err := app.doHTTP(dependencyAuth, request, idempotentRetries)
+	if err != nil {
+		return APIKeyIdentity{}, downstreamStatus(err), err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return APIKeyIdentity{}, http.StatusUnauthorized, errors.New("invalid or revoked api key")
+	}
+	if response.StatusCode != http.StatusOK {
+		return APIKeyIdentity{}, http.StatusBadGateway, errors.New("error calling auth service")
+	}
+
+	var jsonFromService struct {
+		Error   bool           `json:"error"`
+		Message string         `json:"message"`
+		Data    APIKeyIdentity `json:"data"`
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+	if err != nil {
+		return APIKeyIdentity{}, http.StatusBadGateway, err
+	}
+	if jsonFromService.Error || jsonFromService.Data.ID == 0 {
+		return APIKeyIdentity{}, http.StatusUnauthorized, errors.New("invalid or revoked api key")
+	}
+
+	return jsonFromService.Data, http.StatusOK, nil
+}
+
+// checkPermission reports whether the verified caller may use something that
+// needs permission: 401 when there is no caller, 403 when the token lacks it.
+// An empty permission is always allowed.
+func checkPermission(ctx context.Context, permission string) (int, error) {
+	if permission == "" {
+		return http.StatusOK, nil
+	}
+
+	identity, ok := ctx.Value(identityContextKey).(TokenIdentity)
+	if !ok {
+		return http.StatusUnauthorized, errAuthenticationRequired
+	}
+	if !identity.HasPermission(permission) {
+		return http.StatusForbidden, errPermissionDenied
+	}
+
+	return http.StatusOK, nil
+}
+
+// authorize reports whether the caller may use the action. API keys are
+// checked against their scopes and users against their permissions.
+func (act *action) authorize(ctx context.Context) (int, error) {
+	if apiKey, ok := apiKeyFromContext(ctx); ok {
+		return checkScope(apiKey, act.APIKeyScope)
+	}
+
+	if act.Protected {
+		if _, ok := userIDFromContext(ctx); !ok {
+			return http.StatusUnauthorized, errAuthenticationRequired
+		}
+	}
+
+	return checkPermission(ctx, act.Permission)
+}
+
+// checkScope reports whether an API key may call an action needing scope:
+// 403 when the action is not open to API keys or the key lacks the scope.
+func checkScope(identity APIKeyIdentity, scope string) (int, error) {
+	if scope == "" {
+		return http.StatusForbidden, errAPIKeyNotAllowed
+	}
+	if !identity.HasScope(scope) {
+		return http.StatusForbidden, errPermissionDenied
+	}
+
+	return http.StatusOK, nil
+}
+
+// apiKeyFromContext returns the verified API key stored by authenticateRequest.
+func apiKeyFromContext(ctx context.Context) (APIKeyIdentity, bool) {
+	identity, ok := ctx.Value(apiKeyContextKey).(APIKeyIdentity)
+	return identity, ok
+}
+
+// userIDFromContext returns the verified caller stored by authenticateRequest.
+func userIDFromContext(ctx context.Context) (int, bool) {
+	userID, ok := ctx.Value(userIDContextKey).(int)
+	return userID, ok
+}
+
+// setCallerHeader tags an outgoing request with the verified caller, if any.
+func setCallerHeader(ctx context.Context, request *http.Request) {
+	if userID, ok := userIDFromContext(ctx); ok {
+		request.Header.Set(userIDHeader, strconv.Itoa(userID))
+	}
+}
+
+// remoteHost returns the address of the peer that connected to the broker.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// setClientHeaders tells authentication-service which client a login attempt
+// came from, if known.
+func setClientHeaders(ctx context.Context, request *http.Request) {
+	if ip, ok := ctx.Value(clientIPContextKey).(string); ok && ip != "" {
+		request.Header.Set("X-Forwarded-For", ip)
+	}
+	if userAgent, ok := ctx.Value(userAgentContextKey).(string); ok && userAgent != "" {
+		request.Header.Set("User-Agent", userAgent)
+	}
+}
+
+// setBearerHeader forwards the caller's verified access token, if any.
+func setBearerHeader(ctx context.Context, request *http.Request) {
+	if token, ok := ctx.Value(accessTokenContextKey).(string); ok {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+}
@@ -0,0 +1,268 @@
+// Package main verifies broker token-verification middleware.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testIdentities are the bearer tokens newTestAuthServer accepts.
+var testIdentities = map[string]TokenIdentity{
+	"good-token":   {UserID: 42, Email: "me@example.com", Roles: []string{"user"}, Permissions: []string{"logs:write"}},
+	"mailer-token": {UserID: 43, Email: "mailer@example.com", Roles: []string{"mailer"}, Permissions: []string{"logs:write", "mail:send"}},
+	"admin-token":  {UserID: 1, Email: "admin@example.com", Roles: []string{"admin"}, Permissions: []string{"logs:write", "mail:send", "users:list"}},
+}
+
+// testAPIKeys are the API keys newTestAuthServer accepts.
+var testAPIKeys = map[string]APIKeyIdentity{
+	"log-key":  {ID: 7, Name: "log shipper", Scopes: []string{"log:write"}},
+	"mail-key": {ID: 8, Name: "newsletter", Scopes: []string{"mail:send"}},
+}
+
+// newTestAuthServer validates the bearer tokens in testIdentities and the API
+// keys in testAPIKeys; "good-token" is user 42 with the default user role. Any
+// other path answers 200.
+func newTestAuthServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.URL.Path == "/api-keys/validate" {
+			identity, ok := testAPIKeys[r.Header.Get(apiKeyHeader)]
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			_ = json.NewEncoder(w).Encode(JsonResponse{Error: false, Data: identity})
+			return
+		}
+
+		// other auth-service routes just acknowledge the relayed call
+		if r.URL.Path != "/validate" {
+			_ = json.NewEncoder(w).Encode(JsonResponse{Error: false, Message: r.Method + " " + r.URL.Path})
+			return
+		}
+
+		identity, ok := testIdentities[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(JsonResponse{
+			Error: false,
+			Data:  identity,
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestAuthenticateRequest(t *testing.T) {
+	authServer := newTestAuthServer(t)
+	app := Config{AuthServiceURL: authServer.URL + "/authenticate"}
+
+	tests := []struct {
+		name             string
+		authorization    string
+		apiKey           string
+		expectedStatus   int
+		expectedUserID   int
+		expectedAPIKeyID int
+	}{
+		{name: "anonymous request passes through", authorization: "", expectedStatus: http.StatusOK},
+		{name: "valid token", authorization: "Bearer good-token", expectedStatus: http.StatusOK, expectedUserID: 42},
+		{name: "rejected token", authorization: "Bearer bad-token", expectedStatus: http.StatusUnauthorized},
+		{name: "malformed header", authorization: "good-token", expectedStatus: http.StatusUnauthorized},
+		{name: "valid api key", apiKey: "log-key", expectedStatus: http.StatusOK, expectedAPIKeyID: 7},
+		{name: "rejected api key", apiKey: "bad-key", expectedStatus: http.StatusUnauthorized},
+		{name: "token and api key together", authorization: "Bearer good-token", apiKey: "log-key", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seenUserID int
+			var seenAPIKey APIKeyIdentity
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seenUserID, _ = userIDFromContext(r.Context())
+				seenAPIKey, _ = apiKeyFromContext(r.Context())
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/handle", http.NoBody)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.apiKey != "" {
+				req.Header.Set(apiKeyHeader, tt.apiKey)
+			}
+			rr := httptest.NewRecorder()
+
+			app.authenticateRequest(next).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			if seenUserID != tt.expectedUserID {
+				t.Fatalf("expected user ID %d in context, got %d", tt.expectedUserID, seenUserID)
+			}
+			if seenAPIKey.ID != tt.expectedAPIKeyID {
+				t.Fatalf("expected API key %d in context, got %d", tt.expectedAPIKeyID, seenAPIKey.ID)
+			}
+		})
+	}
+}
+
+func TestHandleSubmissionRejectsAnonymousProtectedActions(t *testing.T) {
+	app := Config{}
+
+	for _, action := range []string{"log", "mail", "user"} {
+		t.Run(action, func(t *testing.T) {
+			body := `{"action":"` + action + `"}`
+			req := httptest.NewRequest(http.MethodPost, "/handle", bytes.NewBufferString(body))
+			rr := httptest.NewRecorder()
+
+			app.handleSubmission(rr, req)
+
+			if rr.Code != http.StatusUnauthorized {
+				t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+			}
+
+			response := decodeJSONResponse(t, rr)
+			if response.Message != errAuthenticationRequired.Error() {
+				t.Fatalf("expected authentication required message, got %q", response.Message)
+			}
+		})
+	}
+}
+
+func TestHandleSubmissionEnforcesPermissions(t *testing.T) {
+	authServer := newTestAuthServer(t)
+	app := Config{AuthServiceURL: authServer.URL + "/authenticate"}
+
+	tests := []struct {
+		name      string
+		body      string
+		token     string
+		forbidden bool
+	}{
+		{name: "mail without mail:send", body: `{"action":"mail"}`, token: "good-token", forbidden: true},
+		{name: "mail as mailer", body: `{"action":"mail"}`, token: "mailer-token"},
+		{name: "list users without users:list", body: `{"action":"user","user":{"operation":"list"}}`, token: "good-token", forbidden: true},
+		{name: "list users as admin", body: `{"action":"user","user":{"operation":"list"}}`, token: "admin-token"},
+		{name: "own profile needs no extra permission", body: `{"action":"user","user":{"operation":"get"}}`, token: "good-token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/handle", bytes.NewBufferString(tt.body))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rr := httptest.NewRecorder()
+
+			app.routes().ServeHTTP(rr, req)
+
+			if tt.forbidden != (rr.Code == http.StatusForbidden) {
+				t.Fatalf("expected forbidden=%v, got status %d: %s", tt.forbidden, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleSubmissionEnforcesAPIKeyScopes(t *testing.T) {
+	authServer := newTestAuthServer(t)
+	app := Config{AuthServiceURL: authServer.URL + "/authenticate"}
+
+	tests := []struct {
+		name           string
+		body           string
+		apiKey         string
+		expectedStatus int
+		expectedError  error
+	}{
+		{name: "mail without mail:send", body: `{"action":"mail"}`, apiKey: "log-key", expectedStatus: http.StatusForbidden, expectedError: errPermissionDenied},
+		{name: "log without log:write", body: `{"action":"log"}`, apiKey: "mail-key", expectedStatus: http.StatusForbidden, expectedError: errPermissionDenied},
+		{name: "user action is not open to keys", body: `{"action":"user","user":{"operation":"get"}}`, apiKey: "log-key", expectedStatus: http.StatusForbidden, expectedError: errAPIKeyNotAllowed},
+		{name: "auth action is not open to keys", body: `{"action":"auth"}`, apiKey: "log-key", expectedStatus: http.StatusForbidden, expectedError: errAPIKeyNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/handle", bytes.NewBufferString(tt.body))
+			req.Header.Set(apiKeyHeader, tt.apiKey)
+			rr := httptest.NewRecorder()
+
+			app.routes().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if response := decodeJSONResponse(t, rr); response.Message != tt.expectedError.Error() {
+				t.Fatalf("expected %q, got %q", tt.expectedError, response.Message)
+			}
+		})
+	}
+}
+
+func TestForwardMailRequestWithAPIKey(t *testing.T) {
+	authServer := newTestAuthServer(t)
+	mailServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer mailServer.Close()
+
+	app := Config{AuthServiceURL: authServer.URL + "/authenticate", MailServiceURL: mailServer.URL}
+
+	body := `{"action":"mail","mail":{"from":"a@b.com","to":"c@d.com","subject":"s","message":"m"}}`
+	req := httptest.NewRequest(http.MethodPost, "/handle", bytes.NewBufferString(body))
+	req.Header.Set(apiKeyHeader, "mail-key")
+	rr := httptest.NewRecorder()
+
+	app.routes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+}
+
+func TestLogGRPCRouteRequiresAuthentication(t *testing.T) {
+	app := Config{}
+
+	req := httptest.NewRequest(http.MethodPost, "/log-grpc", bytes.NewBufferString(`{"action":"log"}`))
+	rr := httptest.NewRecorder()
+
+	app.routes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+func TestForwardMailRequestPropagatesCaller(t *testing.T) {
+	var callerHeader string
+	mailServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callerHeader = r.Header.Get(userIDHeader)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer mailServer.Close()
+
+	app := Config{MailServiceURL: mailServer.URL}
+	rr := httptest.NewRecorder()
+	ctx := context.WithValue(context.Background(), userIDContextKey, 42)
+
+	app.forwardMailRequest(ctx, rr, MailPayload{From: "a@b.com", To: "c@d.com", Subject: "s", Message: "m"})
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if callerHeader != "42" {
+		t.Fatalf("expected %s header 42, got %q", userIDHeader, callerHeader)
+	}
+}
@@ -16,7 +16,7 @@ func (app *Config) routes() http.Handler {
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-API-Key", "X-CSRF-Token"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
 		MaxAge:           300,
@@ -24,11 +24,19 @@ func (app *Config) routes() http.Handler {
 
 	mux.Use(middleware.Heartbeat("/ping"))
 
+	mux.Use(app.requestBudget)
+
+	mux.Use(app.authenticateRequest)
+
 	mux.Post("/", app.handleBroker)
 
 	mux.Post("/handle", app.handleSubmission)
 
-	mux.Post("/log-grpc", app.logViaGRPC)
+	mux.Get("/actions", app.handleListActions)
+
+	mux.Get("/status", app.handleStatus)
+
+	mux.With(app.requireAuthentication, app.requirePermission(actions["log"].Permission)).Post("/log-grpc", app.handleLogGRPC)
 
 	return mux
 }
@@ -15,6 +15,7 @@ func TestRoutesExist(t *testing.T) {
 
 	assertRouteExists(t, routes, "/")
 	assertRouteExists(t, routes, "/handle")
+	assertRouteExists(t, routes, "/actions")
 	assertRouteExists(t, routes, "/log-grpc")
 }
 
@@ -2,6 +2,7 @@
 package event
 
 import (
+	"context"
 	"log"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -21,7 +22,9 @@ func (e *Emitter) ensureExchange() error {
 	return declareLogsExchange(channel)
 }
 
-func (e *Emitter) Publish(event string, severity string) error {
+// Publish sends event to the logs_topic exchange with severity as its
+// routing key.
+func (e *Emitter) Publish(ctx context.Context, event string, severity string) error {
 	channel, err := e.connection.Channel()
 	if err != nil {
 		return err
@@ -29,7 +32,8 @@ func (e *Emitter) Publish(event string, severity string) error {
 	defer channel.Close()
 	log.Println("Pushing event:", event, "with severity:", severity)
 
-	err = channel.Publish(
+	err = channel.PublishWithContext(
+		ctx,
 		"logs_topic",
 		severity, // routing key
 		false,
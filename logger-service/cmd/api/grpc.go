@@ -9,6 +9,8 @@ import (
 	"net"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 type LogServer struct {
@@ -49,6 +51,8 @@ func (app *Config) listenGRPC() error {
 	grpcServer := grpc.NewServer()
 
 	logs.RegisterLogServiceServer(grpcServer, &LogServer{Models: app.Models})
+	// the broker's shared connection checks this before sending calls
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
 
 	log.Printf("gRPC server started on port %s", grpcPort)
 	if err := grpcServer.Serve(lis); err != nil {